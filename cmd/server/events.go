@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aebranton/rest-api/internal/config"
+	"github.com/aebranton/rest-api/internal/outbox"
+	"github.com/aebranton/rest-api/internal/webhook"
+)
+
+// eventSinks - builds the sinks the outbox relay publishes user events to from the configured list of:
+//
+//	webhook - queue deliveries to the webhook subscribers
+//	stdout  - write each event as a line of json to stdout
+//	file    - append each event as a line of json to the configured file
+//
+// A message broker can be added by implementing outbox.Broker and adding an outbox.BrokerSink here
+func eventSinks(cfg config.Events, webhooks *webhook.Service) (outbox.Sinks, error) {
+	var sinks outbox.Sinks
+	for _, name := range cfg.Sinks {
+		switch name {
+		case config.SinkWebhook:
+			sinks = append(sinks, webhooks)
+		case config.SinkStdout:
+			sinks = append(sinks, outbox.NewWriterSink(os.Stdout))
+		case config.SinkFile:
+			sink, err := outbox.NewFileSink(cfg.File)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		default:
+			// The config is validated before we get here, so this is a sink it knows but we don't
+			return nil, fmt.Errorf("unknown event sink %q", name)
+		}
+	}
+	return sinks, nil
+}
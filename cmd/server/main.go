@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,72 +11,168 @@ import (
 	"os/signal"
 	"time"
 
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/config"
 	"github.com/aebranton/rest-api/internal/database"
+	"github.com/aebranton/rest-api/internal/health"
+	"github.com/aebranton/rest-api/internal/idempotency"
+	"github.com/aebranton/rest-api/internal/metrics"
+	"github.com/aebranton/rest-api/internal/outbox"
+	"github.com/aebranton/rest-api/internal/tracing"
 	transHTTP "github.com/aebranton/rest-api/internal/transport/http"
 	"github.com/aebranton/rest-api/internal/user"
+	"github.com/aebranton/rest-api/internal/webhook"
 )
 
-// Server Constants (all in seconds)
-const IdleTimeout = 120
-const WriteTimeout = 1
-const ReadTimeout = 1
-const ShutdownGracePeriod = ReadTimeout * 3
+// RetentionInterval - how often deleted users are checked for being past DELETED_USER_RETENTION and purged
+const RetentionInterval = time.Hour
+
+// IdempotencyCleanupInterval - how often expired Idempotency-Keys are purged
+const IdempotencyCleanupInterval = time.Hour
 
 // App - will contain things like our database connection
 type App struct {
 }
 
-// Run - initializes application
-func (app *App) Run() error {
+// Run - initializes application with the given config, which must already be valid
+func (app *App) Run(cfg config.Config) error {
 
 	// Setup some basic logging
 	l := log.New(os.Stdout, "rest-api ", log.LstdFlags)
 	l.Println("App setup")
+	l.Printf("Config:\n%s", cfg)
+
+	// Every password is hashed at the configured cost from here on, and timed
+	metricsRegistry := metrics.New()
+	user.PasswordCost = cfg.Users.BcryptCost
+	user.PasswordHashed = metricsRegistry.ObservePasswordHash
+
+	// Requests are traced - along with the queries they make and the passwords they hash - and exported
+	// to wherever the config says
+	shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		return err
+	}
+	// Whichever way Run returns - after server.Shutdown has let the last requests finish, or early with an
+	// error - send whatever spans are still waiting to be exported
+	defer func() {
+		flushContext, cancelFlush := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownGracePeriod)
+		defer cancelFlush()
+		if err := shutdownTracing(flushContext); err != nil {
+			l.Println("Unable to export the last traces: ", err)
+		}
+	}()
 
 	// Create our database connection using our database package
-	db, err := database.NewDatabase()
+	db, err := database.NewDatabase(cfg.Database)
+	if err != nil {
+		return err
+	}
+
+	// Refuse to start against a database that hasn't been migrated up to what this build expects.
+	// Migrations are run separately with the migrate subcommand (ie `app migrate up`)
+	err = database.CheckMigrations(db)
 	if err != nil {
 		return err
 	}
+	tracing.RegisterCallbacks(db)
+
+	// Create a new user service that holds all our calls to manage users,
+	// on top of a store that keeps them in our database
+	userService := user.NewService(user.NewGormStore(db))
+
+	// Metrics on /metrics include the database connection pool and how many users there are
+	if err := metricsRegistry.RegisterDatabase(db.DB(), cfg.Database.Name); err != nil {
+		return err
+	}
+	if err := metricsRegistry.RegisterUserCounts(userService.CountUsers); err != nil {
+		return err
+	}
+
+	// Somebody has to be able to hand out roles, so if we're given an admin account make sure it exists
+	if cfg.Admin.Username != "" {
+		_, err = userService.EnsureAdmin(context.Background(), cfg.Admin.Username, cfg.Admin.Password.Reveal(), cfg.Admin.Email)
+		if err != nil {
+			return fmt.Errorf("unable to create admin user %s: %w", cfg.Admin.Username, err)
+		}
+	}
 
-	// Make sure we run our migrate function
-	// currently only migrating users model, as this is all we have
-	err = database.MigrateDB(db)
+	// Background workers run until we shut down
+	workersContext, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	// Deleted users are kept (so they can be restored) until they're purged - or until they've been deleted
+	// for the configured retention, if there is one
+	if cfg.Users.DeletedUserRetention > 0 {
+		go userService.RunRetention(workersContext, cfg.Users.DeletedUserRetention, RetentionInterval)
+	}
+
+	// Every user event is written to the outbox along with the change it describes, and the relay publishes
+	// them from there to the configured sinks - by default, on to any webhooks subscribed to them
+	webhookService := webhook.NewService(webhook.NewGormStore(db))
+	go webhookService.Run(workersContext)
+	sinks, err := eventSinks(cfg.Events, webhookService)
 	if err != nil {
 		return err
 	}
+	go outbox.NewRelay(userService.Store, sinks).Run(workersContext)
+	// The event stream gets every event too, whatever the sinks are. Only one instance relays at a time, so each
+	// instance tails the outbox for its own stream rather than being one of the relay's sinks
+	broadcaster := outbox.NewBroadcaster(outbox.DefaultReplaySize)
+	go outbox.NewTail(userService.Store, broadcaster).Run(workersContext)
+
+	// The auth service signs access tokens with a shared secret
+	authService := auth.NewService(auth.NewGormTokenStore(db), userService, []byte(cfg.Auth.JWTSecret.Reveal()),
+		cfg.Auth.AccessTokenTTL, cfg.Auth.RefreshTokenTTL)
 
-	// Create a new user service that holds all our calls to manage users in the database
-	// and supply our db pointer
-	userService := user.NewService(db)
+	// Responses to requests sent with an Idempotency-Key are kept for the configured TTL,
+	// so clients can safely retry them until then
+	idempotencyService := idempotency.NewService(idempotency.NewGormStore(db), cfg.Idempotency.KeyTTL)
+	idempotencyService.Lease = cfg.Idempotency.Lease
+	go idempotencyService.RunCleanup(workersContext, IdempotencyCleanupInterval)
 
 	// Creates our handler from our transport package.
 	// The handler will contain a Router (gorillamux router) and needs a pointer to
-	// our users service
-	handler := transHTTP.NewHandler(userService)
+	// our users and auth services
+	handler := transHTTP.NewHandler(userService, authService)
+	handler.Webhooks = webhookService
+	handler.Events = broadcaster
+	handler.Idempotency = idempotencyService
+	// Readiness checks the database is up and fully migrated - add a checker here for any new dependency
+	migrationsChecker, err := database.MigrationsChecker(db)
+	if err != nil {
+		return err
+	}
+	healthService := health.NewService(cfg.Health.CheckTimeout, database.PingChecker(db), migrationsChecker)
+	handler.Health = healthService
+	handler.Metrics = metricsRegistry
+	// Requiring If-Match makes clients prove they've seen the latest version of a user before changing it
+	handler.RequireIfMatch = cfg.HTTP.RequireIfMatch
 	// Setup the rotues!
 	handler.InitRoutes()
 
-	// Tweak some paramters to make sure our connections dont get hung up for nonsense
-	// We have very small data to read/write so timeouts are quite small
+	// Tweak some paramters to make sure our connections dont get hung up for nonsense.
+	// The write timeout is applied per request by WriteDeadline rather than by the server, so the event
+	// stream can keep its connection open (see transHTTP.WriteDeadline).
+	// Every request through the router is recorded in the metrics by Instrument
 	server := http.Server{
-		Addr:         ":8080",
-		Handler:      handler.Router,
-		IdleTimeout:  IdleTimeout * time.Second,
-		ReadTimeout:  ReadTimeout * time.Second,
-		WriteTimeout: WriteTimeout * time.Second,
+		Addr:        cfg.HTTP.Addr,
+		Handler:     transHTTP.WriteDeadline(transHTTP.Instrument(handler.Router, metricsRegistry), cfg.HTTP.WriteTimeout),
+		ConnContext: transHTTP.ConnContext,
+		IdleTimeout: cfg.HTTP.IdleTimeout,
+		ReadTimeout: cfg.HTTP.ReadTimeout,
 	}
 
-	// go func on this so we can do a graceful shutdown
+	// go func on this so we can do a graceful shutdown. Once Shutdown is called ListenAndServe returns
+	// ErrServerClosed straight away, while Shutdown waits for the requests in flight - so that isn't fatal
 	go func() {
-		err = server.ListenAndServe()
-		if err != nil {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			l.Fatal(err)
 		}
 	}()
 
 	// Prepare a chan for os signals, so we can catch when something ie Ctrl+C is done on the service
-	signalChannel := make(chan os.Signal)
+	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, os.Interrupt)
 	signal.Notify(signalChannel, os.Kill)
 
@@ -86,11 +184,22 @@ func (app *App) Run() error {
 	// Notify the console we have recieved the kill sig and will just wait for the connections to close
 	l.Println("Received kill signal - gracefully shutting down service via sig: ", sig)
 
-	// Allows our erver to shutdown gracefully. In this case, we have a timeout of our Read timeout * 3
+	// Fail readiness first, and keep serving for the shutdown delay, so load balancers stop sending us
+	// new requests before we stop accepting them
+	healthService.ShuttingDown()
+	if cfg.HTTP.ShutdownDelay > 0 {
+		l.Printf("Readiness failing - waiting %s before shutting down", cfg.HTTP.ShutdownDelay)
+		time.Sleep(cfg.HTTP.ShutdownDelay)
+	}
+
+	// Allows our erver to shutdown gracefully, within the configured grace period.
 	// Once called, no new connections will be allowed, and existing connections will be allowed to finish their work
-	// before we shutdown the service. Since its such a small read timeout, I did * 3 for some added buffer, though it shouldnt be necessary.
-	killContext, _ := context.WithTimeout(context.Background(), ShutdownGracePeriod*time.Second)
-	server.Shutdown(killContext)
+	// before we shutdown the service.
+	killContext, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(killContext); err != nil {
+		l.Println("Requests were still running at the end of the grace period: ", err)
+	}
 
 	return nil
 }
@@ -98,9 +207,51 @@ func (app *App) Run() error {
 func main() {
 	fmt.Println("Go REST API")
 
+	// Config comes from the defaults, a config file, the environment and flags - see config.Load.
+	// Whatever is left after the flags is a subcommand
+	cfg, args, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Println("Error loading config")
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		// `app migrate ...` manages the database schema instead of starting the api
+		case "migrate":
+			if err := runMigrate(cfg, args[1:]); err != nil {
+				fmt.Println("Error running migrations")
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		// `app config` prints the config the api would start with (secrets redacted), and any problems with it
+		case "config":
+			fmt.Print(cfg)
+			if err := cfg.Validate(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		default:
+			fmt.Printf("Unknown command %q - expected migrate or config (see -help)\n", args[0])
+			os.Exit(2)
+		}
+		return
+	}
+
+	// Refuse to start with a config we can't run with, listing everything wrong with it at once
+	if err := cfg.Validate(); err != nil {
+		fmt.Println("Error starting REST API")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	// Setup our app (separated into a struct for easier testing and such later on)
 	app := App{}
-	err := app.Run()
+	err = app.Run(cfg)
 
 	// Report any errors after run is complete
 	if err != nil {
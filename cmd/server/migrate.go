@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aebranton/rest-api/internal/config"
+	"github.com/aebranton/rest-api/internal/database"
+)
+
+// migrateUsage - printed when the migrate subcommand is called wrong
+const migrateUsage = `usage: app [flags] migrate <command>
+
+commands:
+  up            apply every pending migration
+  down          roll back the most recently applied migration
+  status        list every migration and whether it has been applied
+  to <version>  apply or roll back migrations until <version> is the latest applied (0 rolls back everything)`
+
+// runMigrate - the migrate subcommand. Connects to the database and applies, rolls back or
+// reports on our versioned migrations. Only the database config has to be valid
+func runMigrate(cfg config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	if err := cfg.ValidateDatabase(); err != nil {
+		return err
+	}
+
+	db, err := database.NewDatabase(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		return migrator.Up()
+
+	case "down":
+		return migrator.Down()
+
+	case "to":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid version %s: %w", args[1], err)
+		}
+		return migrator.To(uint(version))
+
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d  %-40s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	}
+
+	return errors.New(migrateUsage)
+}
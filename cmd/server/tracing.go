@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aebranton/rest-api/internal/config"
+	"github.com/aebranton/rest-api/internal/tracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// setupTracing - starts exporting traces to the configured exporter, one of:
+//
+//	none   - don't trace at all
+//	otlp   - send traces over http to an OTLP collector (ie the otel collector, jaeger or tempo)
+//	stdout - write each span to stdout as json
+//	file   - append each span to the configured file as a line of json
+//
+// Returns a function that sends any spans still waiting to be exported, for when we shut down
+func setupTracing(ctx context.Context, cfg config.Tracing) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case config.ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case config.ExporterOTLP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	case config.ExporterStdout:
+		exporter, err = tracing.NewWriterExporter(os.Stdout)
+	case config.ExporterFile:
+		exporter, err = tracing.NewFileExporter(cfg.File)
+	default:
+		// The config is validated before we get here, so this is an exporter it knows but we don't
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	provider := tracing.NewProvider(cfg.ServiceName, exporter)
+	tracing.Install(provider)
+	return provider.Shutdown, nil
+}
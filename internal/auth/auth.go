@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jinzhu/gorm"
+)
+
+// Errors returned by the auth service. The handler maps all of these to a 401 Unauthorized
+var (
+	ErrInvalidToken = errors.New("Token is invalid or has expired")
+	ErrTokenReused  = errors.New("Refresh token has already been used - all tokens in this session have been revoked")
+)
+
+// TokenType - the value put in the token_type field of a TokenPair, as described by RFC 6750
+const TokenType = "Bearer"
+
+// UserGetter - the small piece of the user service the auth service needs, so it can
+// make sure a user still exists before handing them a fresh set of tokens
+type UserGetter interface {
+	GetUser(ID uint) (user.User, error)
+}
+
+// Service - the auth service. Signs and parses access tokens and keeps track of
+// refresh tokens in a TokenStore so they can be rotated and revoked
+type Service struct {
+	Tokens     TokenStore
+	Users      UserGetter
+	Secret     []byte
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// Claims - the claims we put in our signed access tokens. The user's ID is stored in
+// the standard "sub" claim, the username is just along for the ride for convenience.
+// The role is baked in when the token is issued, but Authenticate swaps it for the users current role on every
+// request, so a role change (or the user being deleted) takes effect straight away
+type Claims struct {
+	Username string    `json:"username"`
+	Role     user.Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// UserID - parses the subject claim back into a user ID
+func (c *Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return uint(id), nil
+}
+
+// TokenPair - what gets handed back to the client when they log in or refresh
+type TokenPair struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+// RefreshToken - defines the refresh token model. We never store the token itself, only a sha256
+// of it, so a leaked table can't be used to mint new access tokens.
+// Every token issued from a single login shares a FamilyID - when a token is refreshed the old one is
+// marked as used and a new one is issued in the same family. If a used token ever comes back, someone
+// has a copy of it, so the whole family gets revoked.
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"unique_index"`
+	FamilyID  string `gorm:"index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// NewService - returns a new auth service
+func NewService(tokens TokenStore, users UserGetter, secret []byte, accessTTL, refreshTTL time.Duration) *Service {
+	return &Service{
+		Tokens:     tokens,
+		Users:      users,
+		Secret:     secret,
+		AccessTTL:  accessTTL,
+		RefreshTTL: refreshTTL,
+	}
+}
+
+// IssueTokens - issues a brand new access and refresh token for a user, starting a new token family.
+// This should only be called once the user has been authenticated.
+func (s *Service) IssueTokens(u user.User) (TokenPair, error) {
+	family, err := randomString(16)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return s.issue(u, family)
+}
+
+// RefreshTokens - exchanges a refresh token for a new token pair. The given refresh token is used up,
+// and can not be exchanged again.
+func (s *Service) RefreshTokens(raw string) (TokenPair, error) {
+	token, err := s.Tokens.GetByHash(hashToken(raw))
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+		return TokenPair{}, ErrInvalidToken
+	}
+
+	if token.UsedAt != nil {
+		if err := s.revokeFamily(token.FamilyID); err != nil {
+			return TokenPair{}, err
+		}
+		return TokenPair{}, ErrTokenReused
+	}
+
+	// Mark the token as used, making sure nobody else beat us to it between the read and the write
+	marked, err := s.Tokens.MarkUsed(token.ID, time.Now())
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if !marked {
+		if err := s.revokeFamily(token.FamilyID); err != nil {
+			return TokenPair{}, err
+		}
+		return TokenPair{}, ErrTokenReused
+	}
+
+	u, err := s.Users.GetUser(token.UserID)
+	if err != nil {
+		return TokenPair{}, ErrInvalidToken
+	}
+
+	return s.issue(u, token.FamilyID)
+}
+
+// RevokeToken - revokes the given refresh token along with every other token issued from the same login.
+// Access tokens that have already been issued stay valid until they expire, which is why they are short lived.
+func (s *Service) RevokeToken(raw string) error {
+	token, err := s.Tokens.GetByHash(hashToken(raw))
+	if err != nil {
+		return err
+	}
+	return s.revokeFamily(token.FamilyID)
+}
+
+// ParseAccessToken - validates the signature and expiry of an access token and returns its claims
+func (s *Service) ParseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", t.Header["alg"])
+		}
+		return s.Secret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Authenticate - parses an access token like ParseAccessToken, then brings its claims up to date with the user
+// it was issued to. The role is their current one rather than the one in the token, so a demoted admin loses their
+// rights straight away instead of when the token expires. Returns ErrInvalidToken if the user has been deleted since
+func (s *Service) Authenticate(tokenString string) (*Claims, error) {
+	claims, err := s.ParseAccessToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	ID, err := claims.UserID()
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.Users.GetUser(ID)
+	if user.KindOf(err) == user.KindNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	claims.Role = u.Role
+	return claims, nil
+}
+
+// issue - signs a new access token and stores a new refresh token in the given family
+func (s *Service) issue(u user.User, family string) (TokenPair, error) {
+	now := time.Now()
+
+	jti, err := randomString(16)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	claims := Claims{
+		Username: u.Username,
+		Role:     u.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(u.ID), 10),
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.AccessTTL)),
+		},
+	}
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.Secret)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	raw, err := randomString(32)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refresh := RefreshToken{
+		UserID:    u.ID,
+		TokenHash: hashToken(raw),
+		FamilyID:  family,
+		ExpiresAt: now.Add(s.RefreshTTL),
+	}
+	if err := s.Tokens.Create(&refresh); err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:      access,
+		TokenType:        TokenType,
+		ExpiresIn:        int64(s.AccessTTL.Seconds()),
+		RefreshToken:     raw,
+		RefreshExpiresIn: int64(s.RefreshTTL.Seconds()),
+	}, nil
+}
+
+// revokeFamily - revokes every refresh token that was issued from the same login
+func (s *Service) revokeFamily(family string) error {
+	return s.Tokens.RevokeFamily(family, time.Now())
+}
+
+// hashToken - refresh tokens are already long and random, so a plain sha256 is plenty here (no need for bcrypt)
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString - returns n random bytes encoded as url safe base64
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// Errors returned by Authorize. ErrUnauthenticated maps to a 401 (we don't know who you are),
+// ErrForbidden maps to a 403 (we know who you are, and you can't do that)
+var (
+	ErrUnauthenticated = errors.New("Authentication is required")
+	ErrForbidden       = errors.New("You do not have permission to perform this action")
+)
+
+// Action - something a caller is trying to do with a user record
+type Action string
+
+// The actions our policy knows about
+const (
+	ActionList       Action = "list"
+	ActionRead       Action = "read"
+	ActionUpdate     Action = "update"
+	ActionDelete     Action = "delete"
+	ActionAssignRole Action = "assign_role"
+
+	// Managing deleted users - listing them, restoring them and purging them for good
+	ActionListDeleted Action = "list_deleted"
+	ActionRestore     Action = "restore"
+	ActionPurge       Action = "purge"
+
+	// Reading a users audit log
+	ActionReadAudit Action = "read_audit"
+
+	// Reading a users revisions (or what it looked like at some point), and reverting it to one
+	ActionReadHistory Action = "read_history"
+	ActionRevert      Action = "revert"
+
+	// Subscribing to user events with webhooks, and looking after their deliveries
+	ActionManageWebhooks Action = "manage_webhooks"
+
+	// Importing users from a file, which can set roles and passwords directly
+	ActionImport Action = "import"
+
+	// Changing users in batches (see the bulk endpoint), which can create hundreds of users in one request
+	ActionBulk Action = "bulk"
+)
+
+// Authorize - decides whether the caller may perform an action on the target user.
+// claims is nil for anonymous callers. target is ignored for actions that don't have one (ie list).
+// Returns nil if the action is allowed, or ErrUnauthenticated/ErrForbidden if it is not.
+//
+//	admin   - can do anything, and is the only role that can see, restore or purge deleted users,
+//	          read the audit log, manage webhooks or import users
+//	support - can list and read anyone (including their revisions), update anyone who isn't an admin,
+//	          and change users in batches (each change still held to the rest of this policy)
+//	user    - can only read and update their own record
+func Authorize(claims *Claims, action Action, target user.User) error {
+	if claims == nil {
+		return ErrUnauthenticated
+	}
+
+	callerID, err := claims.UserID()
+	if err != nil {
+		return ErrUnauthenticated
+	}
+	isSelf := target.ID != 0 && target.ID == callerID
+
+	switch claims.Role {
+	case user.RoleAdmin:
+		return nil
+
+	case user.RoleSupport:
+		switch action {
+		case ActionList, ActionRead, ActionReadHistory, ActionBulk:
+			return nil
+		case ActionUpdate:
+			if isSelf || target.Role != user.RoleAdmin {
+				return nil
+			}
+		}
+
+	case user.RoleUser:
+		switch action {
+		case ActionRead, ActionUpdate:
+			if isSelf {
+				return nil
+			}
+		}
+	}
+
+	return ErrForbidden
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TokenStore - where the auth service keeps refresh tokens. GormTokenStore keeps them in postgres,
+// MemoryTokenStore keeps them in a map so the whole api can run in-process (ie in tests)
+type TokenStore interface {
+	Create(token *RefreshToken) error
+	// GetByHash - returns ErrInvalidToken if there is no token with the given hash
+	GetByHash(hash string) (RefreshToken, error)
+	// MarkUsed - marks an unused token as used. Returns false if the token had already been used
+	MarkUsed(ID uint, at time.Time) (bool, error)
+	RevokeFamily(family string, at time.Time) error
+}
+
+// GormTokenStore - a TokenStore that keeps refresh tokens in our database through gorm
+type GormTokenStore struct {
+	DB *gorm.DB
+}
+
+// NewGormTokenStore - returns a new gorm backed token store
+func NewGormTokenStore(db *gorm.DB) *GormTokenStore {
+	return &GormTokenStore{
+		DB: db,
+	}
+}
+
+// Create - inserts a new refresh token
+func (s *GormTokenStore) Create(token *RefreshToken) error {
+	return s.DB.Create(token).Error
+}
+
+// GetByHash - retreives a refresh token by the hash of its value
+func (s *GormTokenStore) GetByHash(hash string) (RefreshToken, error) {
+	var token RefreshToken
+	if result := s.DB.Where("token_hash = ?", hash).First(&token); result.Error != nil {
+		if gorm.IsRecordNotFoundError(result.Error) {
+			return RefreshToken{}, ErrInvalidToken
+		}
+		return RefreshToken{}, result.Error
+	}
+	return token, nil
+}
+
+// MarkUsed - marks the token as used, making sure nobody else beat us to it between the read and the write
+func (s *GormTokenStore) MarkUsed(ID uint, at time.Time) (bool, error) {
+	result := s.DB.Model(&RefreshToken{}).
+		Where("id = ? AND used_at IS NULL", ID).
+		Update("used_at", at)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// RevokeFamily - revokes every refresh token that was issued from the same login
+func (s *GormTokenStore) RevokeFamily(family string, at time.Time) error {
+	result := s.DB.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", at)
+	return result.Error
+}
+
+// MemoryTokenStore - a TokenStore that keeps refresh tokens in memory
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	nextID uint
+	tokens map[string]RefreshToken
+}
+
+// NewMemoryTokenStore - returns a new, empty in-memory token store
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		nextID: 1,
+		tokens: map[string]RefreshToken{},
+	}
+}
+
+// Create - stores a new refresh token
+func (s *MemoryTokenStore) Create(token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	token.ID = s.nextID
+	token.CreatedAt = now
+	token.UpdatedAt = now
+	s.tokens[token.TokenHash] = *token
+	s.nextID++
+	return nil
+}
+
+// GetByHash - retreives a refresh token by the hash of its value
+func (s *MemoryTokenStore) GetByHash(hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[hash]
+	if !ok {
+		return RefreshToken{}, ErrInvalidToken
+	}
+	return token, nil
+}
+
+// MarkUsed - marks the token as used, if it hasn't been already
+func (s *MemoryTokenStore) MarkUsed(ID uint, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.tokens {
+		if token.ID == ID {
+			if token.UsedAt != nil {
+				return false, nil
+			}
+			token.UsedAt = &at
+			s.tokens[hash] = token
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RevokeFamily - revokes every refresh token that was issued from the same login
+func (s *MemoryTokenStore) RevokeFamily(family string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.tokens {
+		if token.FamilyID == family && token.RevokedAt == nil {
+			token.RevokedAt = &at
+			s.tokens[hash] = token
+		}
+	}
+	return nil
+}
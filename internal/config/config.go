@@ -0,0 +1,390 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config - everything the api can be configured with. It is loaded once at startup by Load, from (in order of
+// precedence, lowest first) the defaults in Default, a YAML or TOML config file, environment variables and
+// command line flags, and then passed to whatever needs it. See settings for every key, variable and flag
+type Config struct {
+	HTTP        HTTP        `yaml:"http" toml:"http"`
+	Database    Database    `yaml:"database" toml:"database"`
+	Auth        Auth        `yaml:"auth" toml:"auth"`
+	Admin       Admin       `yaml:"admin" toml:"admin"`
+	Users       Users       `yaml:"users" toml:"users"`
+	Idempotency Idempotency `yaml:"idempotency" toml:"idempotency"`
+	Events      Events      `yaml:"events" toml:"events"`
+	Health      Health      `yaml:"health" toml:"health"`
+	Tracing     Tracing     `yaml:"tracing" toml:"tracing"`
+}
+
+// HTTP - how the server listens and serves requests. WriteTimeout is applied per request (see
+// transHTTP.WriteDeadline). When we're stopped, readiness fails straight away but requests are still served
+// for ShutdownDelay (so load balancers can stop sending them), then get ShutdownGracePeriod to finish
+type HTTP struct {
+	Addr                string        `yaml:"addr" toml:"addr"`
+	ReadTimeout         time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout        time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout         time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period" toml:"shutdown_grace_period"`
+	ShutdownDelay       time.Duration `yaml:"shutdown_delay" toml:"shutdown_delay"`
+	RequireIfMatch      bool          `yaml:"require_if_match" toml:"require_if_match"`
+}
+
+// Database - where our postgres database is. Connecting is retried ConnectRetries times, ConnectRetryDelay apart,
+// since docker only waits for the database to be running, not ready
+type Database struct {
+	Host              string        `yaml:"host" toml:"host"`
+	Port              int           `yaml:"port" toml:"port"`
+	Username          string        `yaml:"username" toml:"username"`
+	Password          Secret        `yaml:"password" toml:"password"`
+	Name              string        `yaml:"name" toml:"name"`
+	ConnectRetries    int           `yaml:"connect_retries" toml:"connect_retries"`
+	ConnectRetryDelay time.Duration `yaml:"connect_retry_delay" toml:"connect_retry_delay"`
+}
+
+// Auth - how tokens are issued. Access tokens are signed with JWTSecret
+type Auth struct {
+	JWTSecret       Secret        `yaml:"jwt_secret" toml:"jwt_secret"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl" toml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl" toml:"refresh_token_ttl"`
+}
+
+// Admin - the admin account made sure to exist on startup, if Username is set
+type Admin struct {
+	Username string `yaml:"username" toml:"username"`
+	Password Secret `yaml:"password" toml:"password"`
+	Email    string `yaml:"email" toml:"email"`
+}
+
+// Users - how users are kept. Deleted users are purged once they've been deleted for DeletedUserRetention,
+// or kept until they're purged by hand if it's 0
+type Users struct {
+	BcryptCost           int           `yaml:"bcrypt_cost" toml:"bcrypt_cost"`
+	DeletedUserRetention time.Duration `yaml:"deleted_user_retention" toml:"deleted_user_retention"`
+}
+
+// Idempotency - how long responses to requests sent with an Idempotency-Key are kept for, and how long a request
+// that never finished (ie we crashed) holds its key before a retry can take it over
+type Idempotency struct {
+	KeyTTL time.Duration `yaml:"key_ttl" toml:"key_ttl"`
+	Lease  time.Duration `yaml:"lease" toml:"lease"`
+}
+
+// Events - the sinks the outbox relay publishes user events to - any of webhook, stdout and file.
+// The file sink appends to File
+type Events struct {
+	Sinks List   `yaml:"sinks" toml:"sinks"`
+	File  string `yaml:"file" toml:"file"`
+}
+
+// Health - how readiness is checked. Each check (ie pinging the database) gets CheckTimeout
+type Health struct {
+	CheckTimeout time.Duration `yaml:"check_timeout" toml:"check_timeout"`
+}
+
+// Tracing - where traces of requests are exported to - none (the default), otlp, stdout or file.
+// The otlp exporter sends them over http to Endpoint (a collector, ie the otel collector or jaeger),
+// with tls unless Insecure. The file exporter appends them to File, for looking at locally
+type Tracing struct {
+	Exporter    string `yaml:"exporter" toml:"exporter"`
+	Endpoint    string `yaml:"endpoint" toml:"endpoint"`
+	Insecure    bool   `yaml:"insecure" toml:"insecure"`
+	File        string `yaml:"file" toml:"file"`
+	ServiceName string `yaml:"service_name" toml:"service_name"`
+}
+
+// The event sinks we know how to build
+const (
+	SinkWebhook = "webhook"
+	SinkStdout  = "stdout"
+	SinkFile    = "file"
+)
+
+// The trace exporters we know how to build
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Default - the config before any file, environment variable or flag is applied.
+// Everything but the JWT secret has a usable default
+func Default() Config {
+	return Config{
+		HTTP: HTTP{
+			Addr: ":8080",
+			// We have very small data to read/write so timeouts are quite small
+			ReadTimeout:         time.Second,
+			WriteTimeout:        time.Second,
+			IdleTimeout:         120 * time.Second,
+			ShutdownGracePeriod: 3 * time.Second,
+		},
+		Database: Database{
+			Host:              "localhost",
+			Port:              5432,
+			Username:          "postgres",
+			Name:              "postgres",
+			ConnectRetries:    3,
+			ConnectRetryDelay: 5 * time.Second,
+		},
+		Auth: Auth{
+			// Access tokens are kept short since they can't be revoked,
+			// refresh tokens can be revoked so they are allowed to live much longer
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 7 * 24 * time.Hour,
+		},
+		Users: Users{
+			BcryptCost: bcrypt.DefaultCost,
+		},
+		Idempotency: Idempotency{
+			KeyTTL: 24 * time.Hour,
+			Lease:  10 * time.Minute,
+		},
+		Events: Events{
+			Sinks: List{SinkWebhook},
+		},
+		Health: Health{
+			CheckTimeout: 2 * time.Second,
+		},
+		Tracing: Tracing{
+			Exporter:    ExporterNone,
+			Endpoint:    "localhost:4318",
+			ServiceName: "rest-api",
+		},
+	}
+}
+
+// String - the config as YAML (the same shape as a config file), with every secret redacted
+func (c Config) String() string {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("unable to print config: %s", err)
+	}
+	return string(out)
+}
+
+// Validate - checks everything the api needs to start, and returns a ValidationError listing every problem
+func (c Config) Validate() error {
+	var problems ValidationError
+	problems = append(problems, c.checkHTTP()...)
+	problems = append(problems, c.checkDatabase()...)
+	problems = append(problems, c.checkAuth()...)
+	problems = append(problems, c.checkAdmin()...)
+	problems = append(problems, c.checkUsers()...)
+	problems = append(problems, c.checkEvents()...)
+	problems = append(problems, c.checkTracing()...)
+	if c.Idempotency.KeyTTL <= 0 {
+		problems = append(problems, problem("idempotency.key_ttl", "must be more than 0"))
+	}
+	if longest := c.longestRequest(); c.Idempotency.Lease < longest {
+		problems = append(problems, problem("idempotency.lease",
+			fmt.Sprintf("must be at least as long as the longest request can run (%s - http.write_timeout, or the bulk routes %s)",
+				longest, user.BulkWriteTimeout)))
+	}
+	if c.Health.CheckTimeout <= 0 {
+		problems = append(problems, problem("health.check_timeout", "must be more than 0"))
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// longestRequest - the longest a request can run for - http.write_timeout, unless the bulk route (which gets longer
+// to write its response in) runs longer
+func (c Config) longestRequest() time.Duration {
+	if c.HTTP.WriteTimeout > user.BulkWriteTimeout {
+		return c.HTTP.WriteTimeout
+	}
+	return user.BulkWriteTimeout
+}
+
+// ValidateDatabase - checks just the database settings, for commands (ie migrate) that only need the database
+func (c Config) ValidateDatabase() error {
+	if problems := ValidationError(c.checkDatabase()); len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// checkHTTP - the problems with the http settings
+func (c Config) checkHTTP() []Problem {
+	var problems []Problem
+	if c.HTTP.Addr == "" {
+		problems = append(problems, problem("http.addr", "must be set"))
+	}
+	timeouts := []struct {
+		key     string
+		timeout time.Duration
+	}{
+		{"http.read_timeout", c.HTTP.ReadTimeout},
+		{"http.write_timeout", c.HTTP.WriteTimeout},
+		{"http.idle_timeout", c.HTTP.IdleTimeout},
+		{"http.shutdown_grace_period", c.HTTP.ShutdownGracePeriod},
+	}
+	for _, t := range timeouts {
+		if t.timeout <= 0 {
+			problems = append(problems, problem(t.key, "must be more than 0"))
+		}
+	}
+	if c.HTTP.ShutdownDelay < 0 {
+		problems = append(problems, problem("http.shutdown_delay", "can't be negative"))
+	}
+	return problems
+}
+
+// checkDatabase - the problems with the database settings
+func (c Config) checkDatabase() []Problem {
+	var problems []Problem
+	if c.Database.Host == "" {
+		problems = append(problems, problem("database.host", "must be set"))
+	}
+	if c.Database.Port < 1 || c.Database.Port > 65535 {
+		problems = append(problems, problem("database.port", "must be between 1 and 65535"))
+	}
+	if c.Database.Username == "" {
+		problems = append(problems, problem("database.username", "must be set"))
+	}
+	if c.Database.Name == "" {
+		problems = append(problems, problem("database.name", "must be set"))
+	}
+	if c.Database.ConnectRetries < 0 {
+		problems = append(problems, problem("database.connect_retries", "can't be negative"))
+	}
+	if c.Database.ConnectRetryDelay < 0 {
+		problems = append(problems, problem("database.connect_retry_delay", "can't be negative"))
+	}
+	return problems
+}
+
+// checkAuth - the problems with the auth settings
+func (c Config) checkAuth() []Problem {
+	var problems []Problem
+	// The auth service signs access tokens with a shared secret, so refuse to start without one
+	if c.Auth.JWTSecret == "" {
+		problems = append(problems, problem("auth.jwt_secret", "must be set"))
+	}
+	if c.Auth.AccessTokenTTL <= 0 {
+		problems = append(problems, problem("auth.access_token_ttl", "must be more than 0"))
+	}
+	if c.Auth.RefreshTokenTTL < c.Auth.AccessTokenTTL {
+		problems = append(problems, problem("auth.refresh_token_ttl", "must be at least auth.access_token_ttl"))
+	}
+	return problems
+}
+
+// checkAdmin - the problems with the admin account, if there is one
+func (c Config) checkAdmin() []Problem {
+	var problems []Problem
+	if c.Admin.Username == "" {
+		return nil
+	}
+	if c.Admin.Password == "" {
+		problems = append(problems, problem("admin.password", "must be set along with admin.username"))
+	}
+	if c.Admin.Email == "" {
+		problems = append(problems, problem("admin.email", "must be set along with admin.username"))
+	}
+	return problems
+}
+
+// checkUsers - the problems with the user settings
+func (c Config) checkUsers() []Problem {
+	var problems []Problem
+	if c.Users.BcryptCost < bcrypt.MinCost || c.Users.BcryptCost > bcrypt.MaxCost {
+		problems = append(problems, problem("users.bcrypt_cost",
+			fmt.Sprintf("must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)))
+	}
+	if c.Users.DeletedUserRetention < 0 {
+		problems = append(problems, problem("users.deleted_user_retention", "can't be negative (0 keeps deleted users)"))
+	}
+	return problems
+}
+
+// checkEvents - the problems with the event sinks
+func (c Config) checkEvents() []Problem {
+	var problems []Problem
+	if len(c.Events.Sinks) == 0 {
+		problems = append(problems, problem("events.sinks", "must have at least one sink"))
+	}
+	for _, sink := range c.Events.Sinks {
+		switch sink {
+		case SinkWebhook, SinkStdout:
+		case SinkFile:
+			if c.Events.File == "" {
+				problems = append(problems, problem("events.file", "must be set to use the file sink"))
+			}
+		default:
+			problems = append(problems, problem("events.sinks",
+				fmt.Sprintf("has unknown sink %q - expected any of %s, %s and %s", sink, SinkWebhook, SinkStdout, SinkFile)))
+		}
+	}
+	return problems
+}
+
+// checkTracing - the problems with the trace exporter
+func (c Config) checkTracing() []Problem {
+	var problems []Problem
+	switch c.Tracing.Exporter {
+	case ExporterNone, ExporterStdout:
+	case ExporterOTLP:
+		if c.Tracing.Endpoint == "" {
+			problems = append(problems, problem("tracing.endpoint", "must be set to use the otlp exporter"))
+		}
+	case ExporterFile:
+		if c.Tracing.File == "" {
+			problems = append(problems, problem("tracing.file", "must be set to use the file exporter"))
+		}
+	default:
+		problems = append(problems, problem("tracing.exporter",
+			fmt.Sprintf("has unknown exporter %q - expected one of %s, %s, %s and %s",
+				c.Tracing.Exporter, ExporterNone, ExporterOTLP, ExporterStdout, ExporterFile)))
+	}
+	if c.Tracing.ServiceName == "" {
+		problems = append(problems, problem("tracing.service_name", "must be set"))
+	}
+	return problems
+}
+
+// Problem - something wrong with one setting. Key is its key in a config file (ie auth.jwt_secret)
+type Problem struct {
+	Key     string
+	Message string
+}
+
+// problem - a problem with the setting at key
+func problem(key, message string) Problem {
+	return Problem{Key: key, Message: message}
+}
+
+// Error - the problem, with every way the setting can be set, ie
+// auth.jwt_secret must be set (set with JWT_SECRET or -auth-jwt-secret)
+func (p Problem) Error() string {
+	for _, s := range settings(&Config{}) {
+		if s.Key == p.Key {
+			return fmt.Sprintf("%s %s (set with %s or -%s)", p.Key, p.Message, s.Env, s.Flag())
+		}
+	}
+	return fmt.Sprintf("%s %s", p.Key, p.Message)
+}
+
+// ValidationError - every problem found with a config
+type ValidationError []Problem
+
+// Error - every problem, one per line
+func (v ValidationError) Error() string {
+	lines := make([]string, 0, len(v))
+	for _, p := range v {
+		lines = append(lines, "  "+p.Error())
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv - the environment variable naming the config file to load, if the -config flag isn't given
+const FileEnv = "CONFIG_FILE"
+
+// setting - one thing that can be configured. Key is its dotted path in a config file, Env the environment
+// variable it can be set with, and Value the field in a Config it sets
+type setting struct {
+	Key   string
+	Env   string
+	Usage string
+	Value flag.Value
+}
+
+// Flag - the command line flag the setting can be set with - its key with dashes, ie -auth-jwt-secret
+func (s setting) Flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.Key)
+}
+
+// settings - every setting, bound to the fields of c. The environment variables are the ones
+// the api has always read, so existing deployments keep working
+func settings(c *Config) []setting {
+	return []setting{
+		{"http.addr", "LISTEN_ADDR", "the address to listen on", (*stringValue)(&c.HTTP.Addr)},
+		{"http.read_timeout", "READ_TIMEOUT", "how long a client gets to send a request", (*durationValue)(&c.HTTP.ReadTimeout)},
+		{"http.write_timeout", "WRITE_TIMEOUT", "how long a request gets to write its response", (*durationValue)(&c.HTTP.WriteTimeout)},
+		{"http.idle_timeout", "IDLE_TIMEOUT", "how long an idle connection is kept open", (*durationValue)(&c.HTTP.IdleTimeout)},
+		{"http.shutdown_grace_period", "SHUTDOWN_GRACE_PERIOD", "how long requests get to finish when shutting down", (*durationValue)(&c.HTTP.ShutdownGracePeriod)},
+		{"http.shutdown_delay", "SHUTDOWN_DELAY", "how long to keep serving, failing readiness, before shutting down", (*durationValue)(&c.HTTP.ShutdownDelay)},
+		{"http.require_if_match", "REQUIRE_IF_MATCH", "require If-Match on requests that change a user", (*boolValue)(&c.HTTP.RequireIfMatch)},
+		{"database.host", "DB_HOST", "the database host", (*stringValue)(&c.Database.Host)},
+		{"database.port", "DB_PORT", "the database port", (*intValue)(&c.Database.Port)},
+		{"database.username", "DB_USERNAME", "the database user", (*stringValue)(&c.Database.Username)},
+		{"database.password", "DB_PASSWORD", "the database users password", &c.Database.Password},
+		{"database.name", "DB_TABLE", "the database name", (*stringValue)(&c.Database.Name)},
+		{"database.connect_retries", "DB_CONNECT_RETRIES", "how many times to retry connecting to the database", (*intValue)(&c.Database.ConnectRetries)},
+		{"database.connect_retry_delay", "DB_CONNECT_RETRY_DELAY", "how long to wait between database connection retries", (*durationValue)(&c.Database.ConnectRetryDelay)},
+		{"auth.jwt_secret", "JWT_SECRET", "the secret access tokens are signed with", &c.Auth.JWTSecret},
+		{"auth.access_token_ttl", "ACCESS_TOKEN_TTL", "how long access tokens last", (*durationValue)(&c.Auth.AccessTokenTTL)},
+		{"auth.refresh_token_ttl", "REFRESH_TOKEN_TTL", "how long refresh tokens last", (*durationValue)(&c.Auth.RefreshTokenTTL)},
+		{"admin.username", "ADMIN_USERNAME", "an admin account to make sure exists on startup", (*stringValue)(&c.Admin.Username)},
+		{"admin.password", "ADMIN_PASSWORD", "the admin accounts password", &c.Admin.Password},
+		{"admin.email", "ADMIN_EMAIL", "the admin accounts email", (*stringValue)(&c.Admin.Email)},
+		{"users.bcrypt_cost", "BCRYPT_COST", "the bcrypt cost passwords are hashed with", (*intValue)(&c.Users.BcryptCost)},
+		{"users.deleted_user_retention", "DELETED_USER_RETENTION", "purge deleted users after this long (0 keeps them)", (*durationValue)(&c.Users.DeletedUserRetention)},
+		{"idempotency.key_ttl", "IDEMPOTENCY_KEY_TTL", "how long Idempotency-Key responses are kept", (*durationValue)(&c.Idempotency.KeyTTL)},
+		{"idempotency.lease", "IDEMPOTENCY_LEASE", "how long a request that never finished holds its Idempotency-Key", (*durationValue)(&c.Idempotency.Lease)},
+		{"events.sinks", "EVENT_SINKS", "comma separated sinks to publish user events to (webhook, stdout, file)", &c.Events.Sinks},
+		{"events.file", "EVENT_FILE", "the file the file sink appends events to", (*stringValue)(&c.Events.File)},
+		{"health.check_timeout", "HEALTH_CHECK_TIMEOUT", "how long each readiness check gets", (*durationValue)(&c.Health.CheckTimeout)},
+		{"tracing.exporter", "TRACING_EXPORTER", "where to export traces to (none, otlp, stdout, file)", (*stringValue)(&c.Tracing.Exporter)},
+		{"tracing.endpoint", "TRACING_ENDPOINT", "the host:port of the collector the otlp exporter sends traces to", (*stringValue)(&c.Tracing.Endpoint)},
+		{"tracing.insecure", "TRACING_INSECURE", "send traces to the collector without tls", (*boolValue)(&c.Tracing.Insecure)},
+		{"tracing.file", "TRACING_FILE", "the file the file exporter appends traces to", (*stringValue)(&c.Tracing.File)},
+		{"tracing.service_name", "TRACING_SERVICE_NAME", "the service name traces are reported under", (*stringValue)(&c.Tracing.ServiceName)},
+	}
+}
+
+// Load - loads the config from, in order of precedence (lowest first):
+//
+//	the defaults (see Default)
+//	the YAML (.yaml, .yml) or TOML (.toml) file named by the -config flag or CONFIG_FILE
+//	environment variables, looked up with getenv (empty counts as unset)
+//	command line flags in args, ie -http-addr :9090
+//
+// Flags stop at the first argument that isn't one, and the rest are returned (ie a subcommand).
+// Returns flag.ErrHelp if args asks for help, after printing the usage. The config isn't validated -
+// call Validate (or ValidateDatabase) for whatever is about to use it
+func Load(args []string, getenv func(string) string) (Config, []string, error) {
+	// Flags win over everything, but the file is loaded first and can be named by one, so they're parsed
+	// twice - once into a throwaway config to find the file (and any bad flags), then for real
+	scratch := Default()
+	fs, path := newFlagSet(&scratch)
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			usage(fs)
+		}
+		return Config{}, nil, err
+	}
+	if *path == "" {
+		*path = getenv(FileEnv)
+	}
+
+	cfg := Default()
+	if *path != "" {
+		if err := loadFile(*path, &cfg); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	for _, s := range settings(&cfg) {
+		value := getenv(s.Env)
+		if value == "" {
+			continue
+		}
+		if err := s.Value.Set(value); err != nil {
+			return Config{}, nil, fmt.Errorf("invalid %s %q: %s", s.Env, value, err)
+		}
+	}
+
+	fs, _ = newFlagSet(&cfg)
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// newFlagSet - a flag set with a flag for every setting, bound to c, and the -config flag
+func newFlagSet(c *Config) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	for _, s := range settings(c) {
+		fs.Var(s.Value, s.Flag(), fmt.Sprintf("%s (%s)", s.Usage, s.Env))
+	}
+	path := fs.String("config", "", fmt.Sprintf("a YAML or TOML config file to load (%s)", FileEnv))
+	return fs, path
+}
+
+// usage - prints how to call the api, with every flag
+func usage(fs *flag.FlagSet) {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: app [flags] [migrate <command> | config]")
+	fmt.Fprintln(out, "\nflags:")
+	fs.SetOutput(out)
+	fs.PrintDefaults()
+}
+
+// loadFile - loads the config file at path over c. Keys we don't know are an error, so typos don't go unnoticed
+func loadFile(path string, c *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, 0, len(undecoded))
+			for _, key := range undecoded {
+				keys = append(keys, key.String())
+			}
+			sort.Strings(keys)
+			return fmt.Errorf("invalid config file %s: unknown keys %s", path, strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Secret - a setting that must never be shown, ie a password. It is redacted whenever it is printed or
+// marshalled - use Reveal to get the value
+type Secret string
+
+// Reveal - the secret itself
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// String - the secret redacted, or empty if it isn't set
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+// Set - sets the secret from a flag or environment variable
+func (s *Secret) Set(value string) error {
+	*s = Secret(value)
+	return nil
+}
+
+// MarshalYAML - the secret redacted
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// List - a list setting. It is a list in a config file, and a comma separated string in a flag or variable
+type List []string
+
+// String - the list, comma separated
+func (l List) String() string {
+	return strings.Join(l, ",")
+}
+
+// Set - sets the list from a comma separated string, replacing what it was
+func (l *List) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// The flag.Values for the plain settings - the flag package's own aren't exported
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("expected a whole number")
+	}
+	*v = intValue(i)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("expected true or false")
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New("expected a duration like 30s or 24h")
+	}
+	*v = durationValue(d)
+	return nil
+}
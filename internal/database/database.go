@@ -2,40 +2,34 @@ package database
 
 import (
 	"fmt"
-	"os"
 	"time"
 
+	"github.com/aebranton/rest-api/internal/config"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
 // NewDatabase - creates a new gorm DB connection to our postgres database
-func NewDatabase() (*gorm.DB, error) {
+func NewDatabase(cfg config.Database) (*gorm.DB, error) {
 	fmt.Println("Starting new database connection")
 
-	dbUser := os.Getenv("DB_USERNAME")
-	dbPass := os.Getenv("DB_PASSWORD")
-	dbHost := os.Getenv("DB_HOST")
-	dbTable := os.Getenv("DB_TABLE")
-	dbPort := os.Getenv("DB_PORT")
-
 	// Creates the connection string for postgres, and disables ssl for this demo code
-	conStr := fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbTable, dbPass)
+	conStr := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable",
+		cfg.Host, cfg.Port, cfg.Username, cfg.Name, cfg.Password.Reveal())
 
 	// opens a gorm DB
 	db, err := gorm.Open("postgres", conStr)
 
 	// Sometimes docker takes a while to get the db up and running - the dependency in docker only waits for the
 	// service to be running, not ready. So, allow some retries.
-	retries := 3
+	retries := cfg.ConnectRetries
 
 	for err != nil {
 		fmt.Printf("Failed to connect to database - retries remaining: %d\n", retries)
 		if retries > 0 {
 			retries--
-			time.Sleep(5 * time.Second)
-			fmt.Println(conStr)
+			time.Sleep(cfg.ConnectRetryDelay)
+			fmt.Printf("Connecting to %s@%s:%d/%s\n", cfg.Username, cfg.Host, cfg.Port, cfg.Name)
 			db, err = gorm.Open("postgres", conStr)
 			continue
 		} else {
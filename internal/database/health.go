@@ -0,0 +1,25 @@
+package database
+
+import (
+	"context"
+
+	"github.com/aebranton/rest-api/internal/health"
+	"github.com/jinzhu/gorm"
+)
+
+// PingChecker - a readiness check that the database is reachable
+func PingChecker(db *gorm.DB) health.Checker {
+	return health.CheckerFunc("database", func(ctx context.Context) error {
+		return db.DB().PingContext(ctx)
+	})
+}
+
+// MigrationsChecker - a readiness check that the database has every migration this build expects,
+// ie nobody has rolled one back since we started
+func MigrationsChecker(db *gorm.DB) (health.Checker, error) {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	return health.CheckerFunc("migrations", migrator.checkPending), nil
+}
@@ -1,14 +1,373 @@
 package database
 
 import (
-	"github.com/aebranton/rest-api/internal/user"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/jinzhu/gorm"
 )
 
-// MigrateDB - migrates our database, creating the user table and cols
-func MigrateDB(db *gorm.DB) error {
-	if result := db.AutoMigrate(&user.User{}); result.Error != nil {
-		return result.Error
+// migrationFiles - our migrations, embedded in the binary so the migrate subcommand works anywhere the app does.
+// Each migration is a pair of files, ie 0001_create_users.up.sql and 0001_create_users.down.sql.
+// A migration starting with a "-- migrate:no-transaction" line is run outside of a transaction (needed for
+// CREATE INDEX CONCURRENTLY) and must only contain a single statement
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationFileRegex - matches migration file names, capturing the version, name and direction
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// noTransactionMarker - the first line of a migration that must run outside a transaction
+const noTransactionMarker = "-- migrate:no-transaction"
+
+// migrationLockID - key for the postgres advisory lock held while migrating, so two instances
+// starting at once can't both try to apply the same migration
+const migrationLockID = 7311948241
+
+// Migration - a single versioned schema change, and how to undo it
+type Migration struct {
+	Version       uint
+	Name          string
+	Up            string
+	Down          string
+	NoTransaction bool
+}
+
+// MigrationStatus - a migration and whether it has been applied to the database
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator - applies and rolls back our migrations, keeping track of what has been applied
+// in the schema_migrations table
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// EmbeddedMigrations - every migration built into the binary, ordered by version
+func EmbeddedMigrations() ([]Migration, error) {
+	return LoadMigrations(migrationFiles)
+}
+
+// NewMigrator - returns a new migrator for our embedded migrations
+func NewMigrator(db *gorm.DB) (*Migrator, error) {
+	migrations, err := EmbeddedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		DB:         db.DB(),
+		Migrations: migrations,
+	}, nil
+}
+
+// LoadMigrations - reads every migration out of the migrations directory of fsys, ordered by version.
+// Every version must have both an up and a down file
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[uint]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s is not named like 0001_name.up.sql", entry.Name())
+		}
+		version, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := fs.ReadFile(fsys, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[uint(version)]
+		if !ok {
+			m = &Migration{Version: uint(version), Name: match[2]}
+			byVersion[m.Version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", m.Version, m.Name, match[2])
+		}
+
+		sqlText := string(contents)
+		if match[3] == "up" {
+			m.Up = sqlText
+		} else {
+			m.Down = sqlText
+		}
+		if strings.HasPrefix(sqlText, noTransactionMarker) {
+			m.NoTransaction = true
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Latest - the version of the newest migration we know about
+func (m *Migrator) Latest() uint {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Up - applies every migration that hasn't been applied yet
+func (m *Migrator) Up() error {
+	return m.To(m.Latest())
+}
+
+// Down - rolls back the most recently applied migration
+func (m *Migrator) Down() error {
+	return m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		if err := m.ensureTable(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.Migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[m.Migrations[i].Version]; ok {
+				return m.run(ctx, conn, m.Migrations[i], false)
+			}
+		}
+		fmt.Println("No migrations to roll back")
+		return nil
+	})
+}
+
+// To - applies or rolls back migrations until exactly the migrations up to and including version are applied.
+// Version 0 rolls back everything
+func (m *Migrator) To(version uint) error {
+	if version != 0 && !m.known(version) {
+		return fmt.Errorf("there is no migration with version %d", version)
+	}
+
+	return m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		if err := m.ensureTable(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		// Roll back anything newer than the target, newest first
+		for i := len(m.Migrations) - 1; i >= 0; i-- {
+			mig := m.Migrations[i]
+			if _, ok := applied[mig.Version]; ok && mig.Version > version {
+				if err := m.run(ctx, conn, mig, false); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Then apply anything up to the target that's missing, oldest first
+		for _, mig := range m.Migrations {
+			if _, ok := applied[mig.Version]; !ok && mig.Version <= version {
+				if err := m.run(ctx, conn, mig, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Status - every migration we know about, and when it was applied (nil if it hasn't been).
+// Only reads the database, so it's safe for readiness checks - a database that has never been migrated
+// has every migration pending
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	return m.StatusContext(context.Background())
+}
+
+// StatusContext - Status, giving up when ctx is done
+func (m *Migrator) StatusContext(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.Migrations))
+	for _, mig := range m.Migrations {
+		status := MigrationStatus{Migration: mig}
+		if at, ok := applied[mig.Version]; ok {
+			appliedAt := at
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Pending - every migration that hasn't been applied yet
+func (m *Migrator) Pending() ([]Migration, error) {
+	return m.PendingContext(context.Background())
+}
+
+// PendingContext - Pending, giving up when ctx is done
+func (m *Migrator) PendingContext(ctx context.Context) ([]Migration, error) {
+	statuses, err := m.StatusContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// CheckMigrations - returns an error if the database is missing any of our migrations, so we never
+// start serving requests against a schema older than the code expects
+func CheckMigrations(db *gorm.DB) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	return migrator.checkPending(context.Background())
+}
+
+// checkPending - returns an error naming the first pending migration, if there are any
+func (m *Migrator) checkPending(ctx context.Context) error {
+	pending, err := m.PendingContext(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is behind - %d migration(s) pending, starting with %d_%s. Run `migrate up` first",
+			len(pending), pending[0].Version, pending[0].Name)
 	}
 	return nil
 }
+
+// known - returns true if we have a migration with the given version
+func (m *Migrator) known(version uint) bool {
+	for _, mig := range m.Migrations {
+		if mig.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// withLock - runs fn on a single connection while holding the migration advisory lock
+func (m *Migrator) withLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	return fn(ctx, conn)
+}
+
+// ensureTable - makes sure the schema_migrations table exists, before migrating
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name varchar(255) NOT NULL,
+		applied_at timestamp with time zone NOT NULL DEFAULT now()
+	)`)
+	return err
+}
+
+// applied - returns the applied versions, and when they were applied. Only reads, so if the schema_migrations
+// table doesn't exist yet (nothing has been migrated) nothing has been applied
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[uint]time.Time, error) {
+	applied := map[uint]time.Time{}
+	var exists bool
+	if err := conn.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version uint
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// run - applies (up) or rolls back (!up) a single migration and records it in schema_migrations.
+// Both happen in one transaction, unless the migration asked not to be run in one
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, mig Migration, up bool) error {
+	direction, statement := "up", mig.Up
+	record, args := "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", []interface{}{mig.Version, mig.Name}
+	if !up {
+		direction, statement = "down", mig.Down
+		record, args = "DELETE FROM schema_migrations WHERE version = $1", []interface{}{mig.Version}
+	}
+	fmt.Printf("Migrating %s: %d_%s\n", direction, mig.Version, mig.Name)
+
+	if mig.NoTransaction {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("migration %d_%s %s failed: %w", mig.Version, mig.Name, direction, err)
+		}
+		_, err := conn.ExecContext(ctx, record, args...)
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, statement); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d_%s %s failed: %w", mig.Version, mig.Name, direction, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
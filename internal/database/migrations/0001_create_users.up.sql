@@ -0,0 +1,19 @@
+-- Matches the table gorm's AutoMigrate used to create, so databases created before versioned
+-- migrations existed can adopt this migration as-is
+CREATE TABLE IF NOT EXISTS users (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    username varchar(255) UNIQUE,
+    password varchar(255),
+    first_name varchar(255),
+    last_name varchar(255),
+    email varchar(255) UNIQUE,
+    telephone varchar(255),
+    role varchar(255) NOT NULL DEFAULT 'user'
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role varchar(255) NOT NULL DEFAULT 'user';
+
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
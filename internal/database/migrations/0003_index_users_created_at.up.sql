@@ -0,0 +1,3 @@
+-- migrate:no-transaction
+-- Built concurrently so it doesn't lock the users table on a live database
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_users_created_at ON users (created_at);
@@ -0,0 +1,5 @@
+ALTER TABLE users ADD CONSTRAINT users_username_key UNIQUE (username);
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+
+DROP INDEX IF EXISTS uix_users_username_lower;
+DROP INDEX IF EXISTS uix_users_email_lower;
@@ -0,0 +1,9 @@
+-- Usernames and emails are looked up (and kept unique) regardless of case, so the case sensitive
+-- unique constraints are swapped for unique indexes on lower(). These are also the indexes the
+-- lower(username) = lower($1) lookups use.
+-- This fails if two users already have usernames or emails that only differ by case - rename one of them first
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_username_lower ON users (lower(username));
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email_lower ON users (lower(email));
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_username_key;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
@@ -0,0 +1,3 @@
+-- Every update bumps a users version, so concurrent updates can be detected (and turned into ETags)
+-- instead of silently overwriting each other
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
@@ -0,0 +1,6 @@
+-- Fails if a deleted user shares a username or email with another user - purge one of them first
+DROP INDEX IF EXISTS uix_users_username_lower_live;
+DROP INDEX IF EXISTS uix_users_email_lower_live;
+
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_username_lower ON users (lower(username));
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email_lower ON users (lower(email));
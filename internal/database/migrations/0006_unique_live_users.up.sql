@@ -0,0 +1,7 @@
+-- Usernames and emails only need to be unique among users that haven't been deleted, so a deleted
+-- users username and email can be signed up with again (and restoring a user fails if they have been)
+DROP INDEX IF EXISTS uix_users_username_lower;
+DROP INDEX IF EXISTS uix_users_email_lower;
+
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_username_lower_live ON users (lower(username)) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email_lower_live ON users (lower(email)) WHERE deleted_at IS NULL;
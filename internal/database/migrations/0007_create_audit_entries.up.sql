@@ -0,0 +1,29 @@
+-- Every change made to a user through the service, for compliance reviews. Entries are written in the same
+-- transaction as the change and are never changed or removed, even when the user they describe is purged
+CREATE TABLE IF NOT EXISTS audit_entries (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    actor_id bigint,
+    action varchar(32) NOT NULL,
+    target_id bigint NOT NULL,
+    changes jsonb NOT NULL DEFAULT '[]',
+    request_id varchar(255) NOT NULL DEFAULT '',
+    ip varchar(64) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_entries_target_id ON audit_entries (target_id, id);
+
+-- Append-only - refuse to update, delete or truncate entries
+CREATE OR REPLACE FUNCTION audit_entries_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_entries is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_entries_no_changes ON audit_entries;
+CREATE TRIGGER audit_entries_no_changes BEFORE UPDATE OR DELETE ON audit_entries
+    FOR EACH ROW EXECUTE FUNCTION audit_entries_append_only();
+
+DROP TRIGGER IF EXISTS audit_entries_no_truncate ON audit_entries;
+CREATE TRIGGER audit_entries_no_truncate BEFORE TRUNCATE ON audit_entries
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_entries_append_only();
@@ -0,0 +1,22 @@
+-- A snapshot of a user every time it is created or changed, so we can see what it looked like at any point.
+-- number is the users version at the time. Revisions are never changed, only removed when their user is purged
+CREATE TABLE IF NOT EXISTS revisions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    user_id bigint NOT NULL,
+    number bigint NOT NULL,
+    snapshot jsonb NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uix_revisions_user_id_number ON revisions (user_id, number);
+CREATE INDEX IF NOT EXISTS idx_revisions_user_id_created_at ON revisions (user_id, created_at);
+
+CREATE OR REPLACE FUNCTION revisions_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'revisions can not be changed';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS revisions_no_changes ON revisions;
+CREATE TRIGGER revisions_no_changes BEFORE UPDATE ON revisions
+    FOR EACH ROW EXECUTE FUNCTION revisions_immutable();
@@ -0,0 +1,30 @@
+-- Webhook subscribers, and every event on its way to one of them. A delivery is due when next_attempt_at has
+-- passed, and next_attempt_at is cleared once it has been delivered (delivered_at) or run out of attempts (dead_at)
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    url text NOT NULL,
+    secret varchar(255) NOT NULL,
+    events text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    subscription_id integer NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    event_id varchar(64) NOT NULL,
+    event_type varchar(64) NOT NULL,
+    payload jsonb NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp with time zone,
+    last_status integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    delivered_at timestamp with time zone,
+    dead_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE next_attempt_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_dead ON webhook_deliveries (id) WHERE dead_at IS NOT NULL;
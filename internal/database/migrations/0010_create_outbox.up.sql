@@ -0,0 +1,18 @@
+-- User events, written in the same transaction as the change they describe and published from here by the
+-- outbox relay in id order. published_at is set once the relay has published a message
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    event_id varchar(64) NOT NULL,
+    event_type varchar(64) NOT NULL,
+    user_id bigint NOT NULL,
+    payload jsonb NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp with time zone,
+    last_error text NOT NULL DEFAULT '',
+    published_at timestamp with time zone
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uix_outbox_event_id ON outbox (event_id);
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox (id) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_published_at ON outbox (published_at) WHERE published_at IS NOT NULL;
@@ -0,0 +1,17 @@
+-- The first response to each request sent with an Idempotency-Key, so retries of it get the same response.
+-- Keys are scoped to the caller that sent them. completed_at is null while the first request is still running
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    expires_at timestamp with time zone NOT NULL,
+    caller varchar(255) NOT NULL,
+    key varchar(255) NOT NULL,
+    fingerprint varchar(64) NOT NULL,
+    status integer NOT NULL DEFAULT 0,
+    header jsonb NOT NULL DEFAULT '{}',
+    body bytea,
+    completed_at timestamp with time zone
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uix_idempotency_keys_caller_key ON idempotency_keys (caller, key);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
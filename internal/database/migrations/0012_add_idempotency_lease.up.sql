@@ -0,0 +1,3 @@
+-- A request holds its key until locked_until - after that a retry can take over a key whose request never finished
+-- (ie the api crashed). Keys reserved before this are released straight away
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS locked_until timestamp with time zone NOT NULL DEFAULT now();
@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+-- Users can be sorted (and cursor paged) by username. The unique indexes are on lower(username), and only cover
+-- live users, so they can't be used for that - built concurrently so it doesn't lock the users table
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_users_username ON users (username);
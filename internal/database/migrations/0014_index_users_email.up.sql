@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+-- Users can be sorted (and cursor paged) by email. Like username, the unique index on lower(email) can't be used for
+-- that - built concurrently so it doesn't lock the users table
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_users_email ON users (email);
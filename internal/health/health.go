@@ -0,0 +1,179 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTimeout - how long each check gets before it's reported as failing
+const DefaultTimeout = 2 * time.Second
+
+// The statuses a check, and a report, can have
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// ShutdownCheck - the name of the check that fails once we've started shutting down
+const ShutdownCheck = "shutdown"
+
+// ErrShuttingDown - the error the shutdown check fails with
+var ErrShuttingDown = errors.New("shutting down")
+
+// Checker - something we depend on that has to be working for us to serve requests, ie the database.
+// Check should give up (and return an error) when ctx is done. Add one to a Service for every new dependency
+type Checker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc - a Checker made from a name and a function, for checks too small for a type of their own
+func CheckerFunc(name string, check func(ctx context.Context) error) Checker {
+	return checkerFunc{name: name, check: check}
+}
+
+// checkerFunc - see CheckerFunc
+type checkerFunc struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Name - the checks name
+func (c checkerFunc) Name() string {
+	return c.name
+}
+
+// Check - runs the function
+func (c checkerFunc) Check(ctx context.Context) error {
+	return c.check(ctx)
+}
+
+// Result - how one check went. Latency is how long it took, in milliseconds
+type Result struct {
+	Name      string
+	Status    string
+	LatencyMS float64
+	Error     string `json:",omitempty"`
+}
+
+// Report - how every check went. Status is StatusOK only if every check is
+type Report struct {
+	Status string
+	Checks []Result
+}
+
+// OK - returns true if every check passed
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+// Service - checks whether we're ready to serve requests. Ready runs every Checker, and fails once
+// ShuttingDown has been called, so load balancers stop sending us requests while we finish the ones we have
+type Service struct {
+	// Timeout - how long each check gets
+	Timeout time.Duration
+
+	mu           sync.RWMutex
+	checkers     []Checker
+	shuttingDown int32
+}
+
+// NewService - creates a new health service running the given checkers, each with the given timeout
+func NewService(timeout time.Duration, checkers ...Checker) *Service {
+	return &Service{Timeout: timeout, checkers: checkers}
+}
+
+// Add - adds a checker to every readiness check from now on
+func (s *Service) Add(checker Checker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkers = append(s.checkers, checker)
+}
+
+// ShuttingDown - fails every readiness check from now on. Called at the start of a graceful shutdown
+func (s *Service) ShuttingDown() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// IsShuttingDown - returns true once ShuttingDown has been called
+func (s *Service) IsShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
+
+// Live - the liveness report. If we can answer at all we're alive, so there's nothing to check
+func (s *Service) Live() Report {
+	return Report{Status: StatusOK, Checks: []Result{}}
+}
+
+// Ready - the readiness report. Every checker runs at once, each with its own timeout, and the results
+// come back in the order the checkers were added, after the shutdown check
+func (s *Service) Ready(ctx context.Context) Report {
+	s.mu.RLock()
+	checkers := append([]Checker{}, s.checkers...)
+	s.mu.RUnlock()
+
+	results := make([]Result, len(checkers)+1)
+	results[0] = Result{Name: ShutdownCheck, Status: StatusOK}
+	if s.IsShuttingDown() {
+		results[0].Status = StatusFailing
+		results[0].Error = ErrShuttingDown.Error()
+	}
+
+	var wg sync.WaitGroup
+	for i, checker := range checkers {
+		wg.Add(1)
+		go func(i int, checker Checker) {
+			defer wg.Done()
+			results[i+1] = s.run(ctx, checker)
+		}(i, checker)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusFailing
+		}
+	}
+	return report
+}
+
+// run - runs a single checker within the timeout, and times it.
+// A checker that doesn't give up when its context is done is left running, but reported as timed out
+func (s *Service) run(ctx context.Context, checker Checker) Result {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- checker.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{
+		Name:      checker.Name(),
+		Status:    StatusOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusFailing
+		result.Error = err.Error()
+		if errors.Is(err, context.DeadlineExceeded) {
+			result.Error = "timed out after " + timeout.String()
+		}
+	}
+	return result
+}
@@ -0,0 +1,170 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// Errors returned by Begin. They're user.Errors, so the handler reports them like any other
+var (
+	ErrKeyReused  = &user.Error{Kind: user.KindValidation, Message: "Idempotency-Key has already been used for a different request"}
+	ErrInProgress = &user.Error{Kind: user.KindConflict, Message: "A request with this Idempotency-Key is still being processed - try again shortly"}
+)
+
+// DefaultTTL - how long a response is kept for replays unless the service is told otherwise
+const DefaultTTL = 24 * time.Hour
+
+// DefaultLease - how long a request gets to finish before its key can be taken over, unless the service is told
+// otherwise. It has to outlast the longest any request can run, which is user.BulkWriteTimeout for the bulk route
+// (or http.write_timeout, if that's longer) - config.Validate checks the configured lease does
+const DefaultLease = 10 * time.Minute
+
+// MaxKeyLength - the longest Idempotency-Key we accept
+const MaxKeyLength = 255
+
+// Headers - the response headers stored with a record, stored as json
+type Headers http.Header
+
+// Value - stores the headers as json
+func (h Headers) Value() (driver.Value, error) {
+	if h == nil {
+		h = Headers{}
+	}
+	raw, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+// Scan - reads the headers back from json
+func (h *Headers) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*h = Headers{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, h)
+	case string:
+		return json.Unmarshal([]byte(v), h)
+	}
+	return fmt.Errorf("can not scan %T into Headers", src)
+}
+
+// Record - the first request made with an Idempotency-Key, and the response it got. Keys are scoped to the Caller
+// (so two clients can't collide), and Fingerprint is a hash of the request, so reusing a key for a different request
+// can be told apart from a retry. CompletedAt is null while the first request is still being handled, which it is
+// assumed to be until LockedUntil - after that (ie we crashed part way through) the key can be taken over by a retry
+type Record struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	Caller      string
+	Key         string
+	Fingerprint string
+	LockedUntil time.Time
+	Status      int
+	Header      Headers `gorm:"type:jsonb"`
+	Body        []byte
+	CompletedAt *time.Time
+}
+
+// TableName - the table gorm keeps records in
+func (Record) TableName() string {
+	return "idempotency_keys"
+}
+
+// Service - the idempotency service. Remembers the response to the first request made with each key for TTL,
+// so retries of that request get the same response instead of making the change again.
+// A request that never finishes (ie we crashed while handling it) holds its key for Lease, then a retry takes it over
+type Service struct {
+	Store Store
+	TTL   time.Duration
+	Lease time.Duration
+}
+
+// NewService - returns a new idempotency service on top of the given store, keeping responses for ttl,
+// with the default lease
+func NewService(store Store, ttl time.Duration) *Service {
+	return &Service{
+		Store: store,
+		TTL:   ttl,
+		Lease: DefaultLease,
+	}
+}
+
+// Begin - starts a request with the given key. If this is the first time the caller has used the key, the request
+// should go ahead, and Begin returns the new record and true - pass it to Complete (or Abandon) once the request is done.
+// If the key was used for the same request before, Begin returns that record and false, and its response should be
+// replayed. Returns ErrKeyReused if the key was used for a different request, or ErrInProgress if the first request
+// with the key hasn't finished yet. A first request that hasn't finished within the lease is given up on, and the
+// key goes to whoever asks next, as if it was never used
+func (s *Service) Begin(caller, key, fingerprint string) (Record, bool, error) {
+	now := time.Now()
+	record := Record{
+		ExpiresAt:   now.Add(s.TTL),
+		Caller:      caller,
+		Key:         key,
+		Fingerprint: fingerprint,
+		LockedUntil: now.Add(s.Lease),
+	}
+	existing, created, err := s.Store.Reserve(&record, now)
+	if err != nil {
+		return Record{}, false, err
+	}
+	if created {
+		return record, true, nil
+	}
+
+	if existing.Fingerprint != fingerprint {
+		return Record{}, false, ErrKeyReused
+	}
+	if existing.CompletedAt == nil {
+		return Record{}, false, ErrInProgress
+	}
+	return existing, false, nil
+}
+
+// Complete - stores the response to a request started with Begin, for replays
+func (s *Service) Complete(record *Record, status int, header http.Header, body []byte) error {
+	now := time.Now()
+	record.Status = status
+	record.Header = Headers(header)
+	record.Body = body
+	record.CompletedAt = &now
+	return s.Store.Complete(record)
+}
+
+// Abandon - forgets a request started with Begin without storing its response (ie it failed on our end),
+// so it can be retried with the same key
+func (s *Service) Abandon(record Record) error {
+	return s.Store.Delete(record.ID)
+}
+
+// PurgeExpired - removes every record past its TTL, and returns how many were removed
+func (s *Service) PurgeExpired() (int64, error) {
+	return s.Store.DeleteExpired(time.Now())
+}
+
+// RunCleanup - purges expired records every interval until ctx is done
+func (s *Service) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.PurgeExpired(); err != nil {
+				fmt.Printf("Unable to purge expired idempotency keys: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package idempotency
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Store - where the idempotency service keeps records. GormStore keeps them in postgres,
+// MemoryStore keeps them in a map so the whole api can run in-process (ie in tests)
+type Store interface {
+	// Reserve - inserts the record unless the caller already has an unexpired one with the same key.
+	// Returns the record and true if it was inserted, or the existing record and false if not.
+	// Expired records, and records still in progress past their LockedUntil, are replaced, as if they were never there
+	Reserve(r *Record, now time.Time) (Record, bool, error)
+	// Complete - saves the response on a reserved record
+	Complete(r *Record) error
+	Delete(ID uint) error
+	// DeleteExpired - removes every record that expired by before, and returns how many were removed
+	DeleteExpired(before time.Time) (int64, error)
+}
+
+// GormStore - a Store that keeps records in our database through gorm
+type GormStore struct {
+	DB *gorm.DB
+}
+
+// NewGormStore - returns a new gorm backed idempotency store
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{
+		DB: db,
+	}
+}
+
+// Reserve - inserts the record, relying on the unique index on (caller, key) so that two requests racing
+// with the same key (or taking over the same abandoned one) can't both go ahead. Whoever loses the race gets the
+// winner's record back
+func (s *GormStore) Reserve(r *Record, now time.Time) (Record, bool, error) {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("caller = ? AND key = ? AND (expires_at <= ? OR (completed_at IS NULL AND locked_until <= ?))",
+			r.Caller, r.Key, now, now).Delete(&Record{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(r).Error
+	})
+	if err == nil {
+		return *r, true, nil
+	}
+
+	// The insert failed - most likely since the key is taken, in which case we hand back whoever has it
+	var existing Record
+	if result := s.DB.Where("caller = ? AND key = ?", r.Caller, r.Key).First(&existing); result.Error != nil {
+		return Record{}, false, err
+	}
+	return existing, false, nil
+}
+
+// Complete - saves the response. Save isn't used since it would insert the record again
+// if it had expired and been purged while the request was being handled
+func (s *GormStore) Complete(r *Record) error {
+	return s.DB.Model(r).Updates(map[string]interface{}{
+		"status":       r.Status,
+		"header":       r.Header,
+		"body":         r.Body,
+		"completed_at": r.CompletedAt,
+	}).Error
+}
+
+// Delete - removes a record by ID
+func (s *GormStore) Delete(ID uint) error {
+	return s.DB.Where("id = ?", ID).Delete(&Record{}).Error
+}
+
+// DeleteExpired - removes every record that expired by before
+func (s *GormStore) DeleteExpired(before time.Time) (int64, error) {
+	result := s.DB.Where("expires_at <= ?", before).Delete(&Record{})
+	return result.RowsAffected, result.Error
+}
+
+// MemoryStore - a Store that keeps records in memory
+type MemoryStore struct {
+	mu      sync.Mutex
+	nextID  uint
+	records map[string]Record
+}
+
+// NewMemoryStore - returns a new, empty in-memory idempotency store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nextID:  1,
+		records: map[string]Record{},
+	}
+}
+
+// memoryKey - the map key for a caller's Idempotency-Key
+func memoryKey(caller, key string) string {
+	return caller + "\x00" + key
+}
+
+// Reserve - stores the record unless the caller has an unexpired one with the same key, that is either
+// complete or still within its lease
+func (s *MemoryStore) Reserve(r *Record, now time.Time) (Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := memoryKey(r.Caller, r.Key)
+	if existing, ok := s.records[k]; ok && existing.ExpiresAt.After(now) &&
+		(existing.CompletedAt != nil || existing.LockedUntil.After(now)) {
+		return existing, false, nil
+	}
+	r.ID = s.nextID
+	r.CreatedAt = now
+	s.records[k] = *r
+	s.nextID++
+	return *r, true, nil
+}
+
+// Complete - saves the response, unless the record is gone
+func (s *MemoryStore) Complete(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := memoryKey(r.Caller, r.Key)
+	if existing, ok := s.records[k]; !ok || existing.ID != r.ID {
+		return nil
+	}
+	s.records[k] = *r
+	return nil
+}
+
+// Delete - removes a record by ID
+func (s *MemoryStore) Delete(ID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, r := range s.records {
+		if r.ID == ID {
+			delete(s.records, k)
+		}
+	}
+	return nil
+}
+
+// DeleteExpired - removes every record that expired by before
+func (s *MemoryStore) DeleteExpired(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed int64
+	for k, r := range s.records {
+		if !r.ExpiresAt.After(before) {
+			delete(s.records, k)
+			removed++
+		}
+	}
+	return removed, nil
+}
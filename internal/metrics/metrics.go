@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The results an authentication attempt can have
+const (
+	AuthSuccess = "success"
+	AuthFailure = "failure"
+)
+
+// The ways a caller can authenticate
+const (
+	AuthPassword = "password"
+	AuthRefresh  = "refresh"
+)
+
+// Metrics - every metric we expose on /metrics, in a registry of their own (so tests can make as many
+// as they like). Every method is safe to call on a nil *Metrics, and does nothing - so code that records
+// metrics doesn't have to check whether they're turned on
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	inFlight     prometheus.Gauge
+	passwordHash prometheus.Histogram
+	auth         *prometheus.CounterVec
+}
+
+// New - creates our metrics, along with the standard go runtime and process metrics
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests handled, by route template, method and status code.",
+		}, []string{"route", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "How long HTTP requests took to handle, by route template, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests being handled right now.",
+		}),
+		passwordHash: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "user_password_hash_duration_seconds",
+			Help: "How long hashing a password with bcrypt took.",
+			// bcrypt is slow on purpose - at the default cost it takes tens of milliseconds
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}),
+		auth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_attempts_total",
+			Help: "Attempts to log in (password) or refresh a token (refresh), by method and result.",
+		}, []string{"method", "result"}),
+	}
+	m.Registry.MustRegister(
+		m.requests, m.duration, m.inFlight, m.passwordHash, m.auth,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler - serves the metrics in the prometheus text format. A metric that can't be gathered (ie the user
+// counts, while the database is down) is left out and logged, rather than failing the whole scrape
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+		ErrorLog:      logger{},
+	})
+}
+
+// RegisterDatabase - exposes the connection pool stats of db (see sql.DBStats) as go_sql_* metrics,
+// labelled with the database name
+func (m *Metrics) RegisterDatabase(db *sql.DB, name string) error {
+	if m == nil {
+		return nil
+	}
+	return m.Registry.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterUserCounts - exposes how many users there are as the users gauge, labelled with their state
+// (active or deleted). count is called on every scrape
+func (m *Metrics) RegisterUserCounts(count func() (user.UserCounts, error)) error {
+	if m == nil {
+		return nil
+	}
+	return m.Registry.Register(&userCollector{
+		count: count,
+		desc:  prometheus.NewDesc("users", "Users, by state (active or soft-deleted).", []string{"state"}, nil),
+	})
+}
+
+// RequestStarted - counts a request as in flight until RequestFinished is called for it
+func (m *Metrics) RequestStarted() {
+	if m == nil {
+		return
+	}
+	m.inFlight.Inc()
+}
+
+// RequestFinished - records a handled request. route is the mux route template it matched (ie /api/user/{id}),
+// so every user is counted under the same route
+func (m *Metrics) RequestFinished(route, method string, status int, took time.Duration) {
+	if m == nil {
+		return
+	}
+	m.inFlight.Dec()
+	code := strconv.Itoa(status)
+	m.requests.WithLabelValues(route, method, code).Inc()
+	m.duration.WithLabelValues(route, method, code).Observe(took.Seconds())
+}
+
+// ObservePasswordHash - records how long hashing a password took. Meant for user.PasswordHashed
+func (m *Metrics) ObservePasswordHash(took time.Duration) {
+	if m == nil {
+		return
+	}
+	m.passwordHash.Observe(took.Seconds())
+}
+
+// ObserveAuth - records an authentication attempt with the given method (AuthPassword or AuthRefresh),
+// which failed if err isn't nil
+func (m *Metrics) ObserveAuth(method string, err error) {
+	if m == nil {
+		return
+	}
+	result := AuthSuccess
+	if err != nil {
+		result = AuthFailure
+	}
+	m.auth.WithLabelValues(method, result).Inc()
+}
+
+// userCollector - collects the users gauge by counting users on every scrape
+type userCollector struct {
+	count func() (user.UserCounts, error)
+	desc  *prometheus.Desc
+}
+
+// Describe - the users gauge
+func (c *userCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect - counts the users
+func (c *userCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.count()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(counts.Active), "active")
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(counts.Deleted), "deleted")
+}
+
+// logger - logs scrape errors, for promhttp
+type logger struct{}
+
+// Println - logs the error
+func (logger) Println(v ...interface{}) {
+	fmt.Println(append([]interface{}{"Metrics:"}, v...)...)
+}
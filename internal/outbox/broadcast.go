@@ -0,0 +1,105 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// DefaultReplaySize - how many of the latest events a Broadcaster keeps for listeners that reconnect
+const DefaultReplaySize = 1000
+
+// listenerBuffer - how many events a listener can fall behind by before it is dropped
+const listenerBuffer = 64
+
+// Broadcaster - a sink that hands every event to whoever is listening right now (ie event streams), and keeps
+// the latest ReplaySize events so a listener that reconnects can catch up on what it missed
+type Broadcaster struct {
+	mu         sync.Mutex
+	replaySize int
+	replay     []user.Event
+	listeners  map[*Listener]struct{}
+}
+
+// Listener - a single listener on a Broadcaster. Events arrive on C, which is closed if the listener falls
+// too far behind (it should reconnect and catch up from the replay buffer) or once it stops listening
+type Listener struct {
+	C      <-chan user.Event
+	ch     chan user.Event
+	filter func(user.Event) bool
+}
+
+// NewBroadcaster - returns a broadcaster that keeps the latest replaySize events
+func NewBroadcaster(replaySize int) *Broadcaster {
+	return &Broadcaster{
+		replaySize: replaySize,
+		listeners:  map[*Listener]struct{}{},
+	}
+}
+
+// Publish - hands the event to every listener that wants it, and keeps it for replays. Never fails -
+// a listener that can't keep up is dropped rather than holding everyone else up
+func (b *Broadcaster) Publish(ctx context.Context, event user.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.replay = append(b.replay, event)
+	if len(b.replay) > b.replaySize {
+		b.replay = append([]user.Event(nil), b.replay[len(b.replay)-b.replaySize:]...)
+	}
+
+	for l := range b.listeners {
+		if l.filter != nil && !l.filter(event) {
+			continue
+		}
+		select {
+		case l.ch <- event:
+		default:
+			delete(b.listeners, l)
+			close(l.ch)
+		}
+	}
+	return nil
+}
+
+// Listen - starts listening for events that pass filter (every event if filter is nil). Also returns the events
+// to replay first - those after lastEventID, or every kept event if lastEventID has already been dropped from the
+// replay buffer. There is nothing to replay if lastEventID is empty. Call Stop once done listening
+func (b *Broadcaster) Listen(lastEventID string, filter func(user.Event) bool) ([]user.Event, *Listener) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan user.Event, listenerBuffer)
+	l := &Listener{C: ch, ch: ch, filter: filter}
+	b.listeners[l] = struct{}{}
+
+	if lastEventID == "" {
+		return nil, l
+	}
+	start := 0
+	for i, event := range b.replay {
+		if event.ID == lastEventID {
+			start = i + 1
+			break
+		}
+	}
+	var replay []user.Event
+	for _, event := range b.replay[start:] {
+		if filter == nil || filter(event) {
+			replay = append(replay, event)
+		}
+	}
+	return replay, l
+}
+
+// Stop - stops the listener, closing its channel
+func (b *Broadcaster) Stop(l *Listener) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.listeners[l]; ok {
+		delete(b.listeners, l)
+		close(l.ch)
+	}
+}
@@ -0,0 +1,145 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// Relay defaults - how often the outbox is checked, how many messages are looked at a time, how failed
+// messages are retried, and how long published messages are kept
+const (
+	DefaultPollInterval = time.Second
+	DefaultBatchSize    = 500
+	DefaultBaseBackoff  = time.Second
+	DefaultMaxBackoff   = 5 * time.Minute
+	DefaultRetention    = 24 * time.Hour
+)
+
+// Relay - publishes the messages in the user stores outbox to a Sink, oldest first, and marks them published.
+//
+// Each users events are published in the order they happened - if one fails it is retried after BaseBackoff
+// (doubling each time, up to MaxBackoff), and that users later events wait for it. Other users events carry on.
+// Messages are never given up on, since skipping one would put the users events out of order.
+// Only one relay publishes at a time (see user.Store.LockOutbox), so running one per instance is fine for sinks
+// any instance can publish to (ie webhooks or a broker). A sink every instance needs its own copy of the events
+// for (ie the Broadcaster behind the event stream) mustn't be one of them - feed it with a Tail instead.
+// A message is only marked published after the sink takes it, so a crash in between publishes it again -
+// events are delivered at least once, and their IDs let consumers ignore repeats.
+// Published messages are removed once they're older than Retention
+type Relay struct {
+	Store        user.Store
+	Sink         Sink
+	PollInterval time.Duration
+	BatchSize    int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	Retention    time.Duration
+}
+
+// NewRelay - returns a new relay from the stores outbox to the sink, with the default settings
+func NewRelay(store user.Store, sink Sink) *Relay {
+	return &Relay{
+		Store:        store,
+		Sink:         sink,
+		PollInterval: DefaultPollInterval,
+		BatchSize:    DefaultBatchSize,
+		BaseBackoff:  DefaultBaseBackoff,
+		MaxBackoff:   DefaultMaxBackoff,
+		Retention:    DefaultRetention,
+	}
+}
+
+// RelayPending - publishes every pending message that is due, and returns how many were published.
+// Does nothing if another relay is busy publishing. Run calls this every PollInterval, but it can be
+// called directly (ie in tests)
+func (r *Relay) RelayPending(ctx context.Context) (int, error) {
+	published := 0
+	err := r.Store.Transaction(func(tx user.Store) error {
+		locked, err := tx.LockOutbox()
+		if err != nil || !locked {
+			return err
+		}
+
+		messages, err := tx.PendingOutbox(r.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		blocked := map[uint]bool{}
+		for _, message := range messages {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if blocked[message.UserID] {
+				continue
+			}
+			if message.NextAttemptAt != nil && message.NextAttemptAt.After(now) {
+				blocked[message.UserID] = true
+				continue
+			}
+
+			message.Attempts++
+			if err := r.publish(ctx, message); err != nil {
+				fmt.Printf("Unable to publish %s event %s (attempt %d): %s\n", message.EventType, message.EventID, message.Attempts, err)
+				blocked[message.UserID] = true
+				next := now.Add(r.backoff(message.Attempts))
+				message.NextAttemptAt = &next
+				message.LastError = err.Error()
+			} else {
+				published++
+				message.PublishedAt = &now
+				message.NextAttemptAt = nil
+				message.LastError = ""
+			}
+			if err := tx.UpdateOutbox(&message); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.PruneOutbox(now.Add(-r.Retention))
+		return err
+	})
+	return published, err
+}
+
+// Run - relays the outbox every PollInterval until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.RelayPending(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("Unable to relay the outbox: %s\n", err)
+			}
+		}
+	}
+}
+
+// publish - publishes a single message to the sink
+func (r *Relay) publish(ctx context.Context, message user.OutboxMessage) error {
+	event, err := message.Event()
+	if err != nil {
+		return err
+	}
+	return r.Sink.Publish(ctx, event)
+}
+
+// backoff - how long to wait before trying a message again, after it has failed the given number of attempts
+func (r *Relay) backoff(attempts int) time.Duration {
+	wait := r.BaseBackoff
+	for i := 1; i < attempts && wait < r.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > r.MaxBackoff {
+		wait = r.MaxBackoff
+	}
+	return wait
+}
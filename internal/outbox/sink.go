@@ -0,0 +1,106 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// Sink - somewhere the relay publishes events to. Publish must only return nil once the event is safely
+// on its way - an error makes the relay try the event again later, along with every later event for the same user.
+// Events can be published more than once (ie if we crash right after publishing one), so sinks and whatever
+// is behind them should ignore an event ID they've already seen
+type Sink interface {
+	Publish(ctx context.Context, event user.Event) error
+}
+
+// Sinks - publishes every event to each sink in turn, stopping at the first one that fails.
+// The event is retried on all of them, so the sinks before the failure see it again
+type Sinks []Sink
+
+// Publish - publishes the event to every sink
+func (s Sinks) Publish(ctx context.Context, event user.Event) error {
+	for _, sink := range s {
+		if err := sink.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriterSink - writes every event as a line of json (NDJSON) to W, ie stdout or a file
+type WriterSink struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+// NewWriterSink - returns a sink that writes events to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{
+		W: w,
+	}
+}
+
+// NewFileSink - returns a sink that appends events to the file at path, creating it if it doesn't exist
+func NewFileSink(path string) (*WriterSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open event file %s: %w", path, err)
+	}
+	return NewWriterSink(f), nil
+}
+
+// Publish - writes the event as a single line of json
+func (s *WriterSink) Publish(ctx context.Context, event user.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.W.Write(line); err != nil {
+		return err
+	}
+	if f, ok := s.W.(*os.File); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Broker - a message broker (ie Kafka, NATS or RabbitMQ) that BrokerSink publishes to. Implement it around
+// whichever client library you use. Publish must return once the broker has the message.
+// key is the users ID - brokers that partition by key keep each users events in order
+type Broker interface {
+	Publish(ctx context.Context, topic string, key string, payload []byte) error
+}
+
+// BrokerSink - publishes every event as json to a topic on a message broker
+type BrokerSink struct {
+	Broker Broker
+	Topic  string
+}
+
+// NewBrokerSink - returns a sink that publishes events to the given topic
+func NewBrokerSink(broker Broker, topic string) *BrokerSink {
+	return &BrokerSink{
+		Broker: broker,
+		Topic:  topic,
+	}
+}
+
+// Publish - publishes the event to the topic, keyed by the users ID
+func (s *BrokerSink) Publish(ctx context.Context, event user.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.Broker.Publish(ctx, s.Topic, strconv.FormatUint(uint64(event.UserID), 10), payload)
+}
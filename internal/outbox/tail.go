@@ -0,0 +1,108 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// DefaultTailLookback - how far back a Tail looks for messages it hasn't seen yet. It has to be longer than a
+// relay takes to publish a batch, since a batch is only seen once the relay's transaction commits
+const DefaultTailLookback = time.Minute
+
+// Tail - hands every message some relay publishes to a Sink of this instance's own - the Broadcaster behind
+// the event stream. Only one instance's relay publishes at a time (see Relay), so a sink every instance needs
+// (rather than one any instance can publish to) can't be one of the relay's sinks - each instance runs a Tail
+// for it instead.
+//
+// A Tail reads published messages in the order they were published, and remembers the ones it has handed on
+// for Lookback, so a batch that was committed late is still picked up without handing anything on twice.
+// Events published before the Tail started (less Lookback) are never handed on
+type Tail struct {
+	Store        user.Store
+	Sink         Sink
+	PollInterval time.Duration
+	BatchSize    int
+	Lookback     time.Duration
+
+	latest time.Time
+	seen   map[uint]time.Time
+}
+
+// NewTail - returns a new tail from the stores outbox to the sink, with the default settings,
+// starting from now
+func NewTail(store user.Store, sink Sink) *Tail {
+	return &Tail{
+		Store:        store,
+		Sink:         sink,
+		PollInterval: DefaultPollInterval,
+		BatchSize:    DefaultBatchSize,
+		Lookback:     DefaultTailLookback,
+		latest:       time.Now(),
+		seen:         map[uint]time.Time{},
+	}
+}
+
+// Poll - hands on every message published since the last poll, and returns how many were handed on.
+// A message the sink fails to take is tried again on the next poll. Run calls this every PollInterval,
+// but it can be called directly (ie in tests). It isn't safe to call from more than one goroutine at once
+func (t *Tail) Poll(ctx context.Context) (int, error) {
+	from := t.latest.Add(-t.Lookback)
+	handed := 0
+	publishedAt, afterID := from, uint(0)
+	for {
+		messages, err := t.Store.PublishedOutbox(publishedAt, afterID, t.BatchSize)
+		if err != nil {
+			return handed, err
+		}
+		for _, message := range messages {
+			publishedAt, afterID = *message.PublishedAt, message.ID
+			if _, ok := t.seen[message.ID]; ok {
+				continue
+			}
+			event, err := message.Event()
+			if err != nil {
+				return handed, err
+			}
+			if err := t.Sink.Publish(ctx, event); err != nil {
+				return handed, err
+			}
+			t.seen[message.ID] = *message.PublishedAt
+			if message.PublishedAt.After(t.latest) {
+				t.latest = *message.PublishedAt
+			}
+			handed++
+		}
+		if len(messages) < t.BatchSize {
+			break
+		}
+	}
+
+	// Anything published before the next poll looks from can't come up again
+	from = t.latest.Add(-t.Lookback)
+	for ID, at := range t.seen {
+		if at.Before(from) {
+			delete(t.seen, ID)
+		}
+	}
+	return handed, nil
+}
+
+// Run - polls the outbox every PollInterval until ctx is done
+func (t *Tail) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := t.Poll(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("Unable to tail the outbox: %s\n", err)
+			}
+		}
+	}
+}
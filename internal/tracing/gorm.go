@@ -0,0 +1,80 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The keys the context and span of a query are kept under in gorm
+const (
+	contextKey = "tracing:context"
+	spanKey    = "tracing:span"
+)
+
+// WithContext - db, with every query made through it traced as a child of the span on ctx.
+// gorm has no context of its own, so this is how a store says which request its queries are for
+func WithContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	return db.Set(contextKey, ctx)
+}
+
+// RegisterCallbacks - traces every query made through db (and anything made from it) with a span named
+// after what it does (ie gorm.query), holding the sql and the table. Queries made through db without a
+// context (see WithContext) aren't traced, so background workers polling the database don't fill up the traces
+func RegisterCallbacks(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:create").Register("tracing:before_create", before("gorm.create"))
+	callbacks.Create().After("gorm:create").Register("tracing:after_create", after)
+	callbacks.Query().Before("gorm:query").Register("tracing:before_query", before("gorm.query"))
+	callbacks.Query().After("gorm:query").Register("tracing:after_query", after)
+	callbacks.Update().Before("gorm:update").Register("tracing:before_update", before("gorm.update"))
+	callbacks.Update().After("gorm:update").Register("tracing:after_update", after)
+	callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", before("gorm.delete"))
+	callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", after)
+	callbacks.RowQuery().Before("gorm:row_query").Register("tracing:before_row_query", before("gorm.row_query"))
+	callbacks.RowQuery().After("gorm:row_query").Register("tracing:after_row_query", after)
+}
+
+// before - starts the span for a query called name, if it has a context
+func before(name string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		value, ok := scope.Get(contextKey)
+		if !ok {
+			return
+		}
+		ctx, ok := value.(context.Context)
+		if !ok {
+			return
+		}
+		_, span := Start(ctx, name,
+			semconv.DBSystemKey.String(scope.Dialect().GetName()),
+			semconv.DBSQLTableKey.String(scope.TableName()),
+		)
+		scope.InstanceSet(spanKey, span)
+	}
+}
+
+// after - ends the span for a query, with the sql it ran, how many rows it touched and any error.
+// Not finding a record isn't an error here - callers ask for records that might not exist all the time
+func after(scope *gorm.Scope) {
+	value, ok := scope.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(
+		semconv.DBStatementKey.String(scope.SQL),
+		attribute.Int64("db.rows_affected", scope.DB().RowsAffected),
+	)
+	err := scope.DB().Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = nil
+	}
+	End(span, err)
+}
@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName - the name our spans are recorded under
+const TracerName = "github.com/aebranton/rest-api"
+
+// NewProvider - a tracer provider that batches spans up and sends them to exporter, reported as coming from
+// serviceName. Requests that arrive as part of a trace are sampled if the caller sampled them, and every other
+// request is sampled. Call Shutdown on it when we're done, to send whatever spans are still waiting
+func NewProvider(serviceName string, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+}
+
+// Install - makes provider the one every span is recorded with, and has traces carried between services
+// in the W3C traceparent header. Until it's called spans aren't recorded at all, so tracing costs nothing
+func Install(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// NewWriterExporter - an exporter that writes every span to w as json, ie to stdout while trying things out locally
+func NewWriterExporter(w io.Writer) (sdktrace.SpanExporter, error) {
+	return stdouttrace.New(stdouttrace.WithWriter(w), stdouttrace.WithPrettyPrint())
+}
+
+// NewFileExporter - an exporter that appends every span to the file at path as a line of json,
+// creating it if it doesn't exist
+func NewFileExporter(path string) (sdktrace.SpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open trace file %s: %w", path, err)
+	}
+	return stdouttrace.New(stdouttrace.WithWriter(f))
+}
+
+// Start - starts a span called name as a child of the span on ctx, which has to be ended when whatever it
+// times is done. We only ever add to traces a request started - if there's no span on ctx (ie in a background
+// worker, or a test) nothing is recorded, and the span returned does nothing
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End - ends span, recording err on it if there was one
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
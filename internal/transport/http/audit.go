@@ -0,0 +1,69 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/gorilla/mux"
+)
+
+// ActorContext - the request context with the caller recorded on it as the user.Actor, so any change the user
+// service makes for this request is audited with who asked for it, the request ID and the callers IP.
+// Must be called after the auth middleware, or the change is recorded as anonymous
+func ActorContext(r *http.Request) context.Context {
+	actor := user.Actor{
+		RequestID: RequestIDFromContext(r.Context()),
+		IP:        clientIP(r),
+	}
+	if claims, ok := ClaimsFromContext(r.Context()); ok {
+		if id, err := claims.UserID(); err == nil {
+			actor.UserID = id
+		}
+	}
+	return user.WithActor(r.Context(), actor)
+}
+
+// clientIP - the IP address the request came from. X-Forwarded-For is ignored, since anyone can send it
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// GetAuditLog - gets a page of the audit log for the user with the given ID, oldest change first
+// (ie ../user/1/audit?limit=20). Only admins can read the audit log, and it can be read even after the
+// user has been purged. Writes the page as json, along with Link and X-Total-Count headers and a 200 status code,
+// or a Problem - 400 for a bad ID or paging options, or 403 if the caller isn't an admin
+func (h *Handler) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, val, err := h.GetUintFromVars(vars, "id")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionReadAudit, user.User{}) {
+		return
+	}
+
+	opts, err := ParseHistoryOptions(r.URL.Query())
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid paging options: %s", err))
+		return
+	}
+
+	page, err := h.users(r).GetAuditLog(id, opts)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	WriteAuditPageHeaders(w, r, opts, page)
+	page.ToJSON(w)
+}
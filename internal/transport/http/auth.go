@@ -0,0 +1,179 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/metrics"
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// contextKey - unexported type for our request context keys so they can't collide with anyone else's
+type contextKey string
+
+// claimsKey - context key the RequireAuth middleware stores the callers token claims under
+const claimsKey contextKey = "claims"
+
+// RefreshRequest - body for the refresh and logout endpoints
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// ClaimsFromContext - returns the access token claims stored on the request context by RequireAuth.
+// ok is false if the request never went through the middleware
+func ClaimsFromContext(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*auth.Claims)
+	return claims, ok
+}
+
+// RequireAuth - middleware for the mux router that rejects any request without a valid
+// "Authorization: Bearer <access token>" header with a 401. The tokens claims are put on the
+// request context for the handlers further down the chain.
+func (h *Handler) RequireAuth(next http.Handler) http.Handler {
+	return h.authenticate(next, true)
+}
+
+// OptionalAuth - middleware for routes anyone can call, but that behave differently for logged in callers
+// (ie creating a user). Requests without an Authorization header are let through anonymously, but a bad token
+// is still rejected with a 401 rather than silently ignored.
+func (h *Handler) OptionalAuth(next http.Handler) http.Handler {
+	return h.authenticate(next, false)
+}
+
+// authenticate - does the work for RequireAuth and OptionalAuth
+func (h *Handler) authenticate(next http.Handler, required bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" && !required {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		parts := strings.SplitN(header, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], auth.TokenType) || parts[1] == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			h.WriteProblem(w, r, http.StatusUnauthorized, "Missing bearer token in Authorization header")
+			return
+		}
+
+		claims, err := h.Auth.Authenticate(parts[1])
+		if errors.Is(err, auth.ErrInvalidToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			h.WriteProblem(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			h.WriteError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Authorize - checks the callers claims against our policy for the given action and target user.
+// Writes a 401 or 403 and returns false if the caller isn't allowed, so handlers can just return.
+func (h *Handler) Authorize(w http.ResponseWriter, r *http.Request, action auth.Action, target user.User) bool {
+	claims, _ := ClaimsFromContext(r.Context())
+	err := auth.Authorize(claims, action, target)
+	if err == nil {
+		return true
+	}
+	h.WriteError(w, r, err)
+	return false
+}
+
+// IssueToken - takes a JSON body with a Username and Password, and if they are correct
+// writes a new access and refresh token pair as json and a 200 status code
+// or a 401 Problem if the credentials don't match
+func (h *Handler) IssueToken(w http.ResponseWriter, r *http.Request) {
+	var credentials user.UserAuth
+	err := json.NewDecoder(r.Body).Decode(&credentials)
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, "Failed to decode user Auth from requests JSON. Please make sure to provide a Username and Password field.")
+		return
+	}
+
+	u, err := h.users(r).AuthenticateUser(credentials)
+	if err != nil {
+		h.Metrics.ObserveAuth(metrics.AuthPassword, err)
+		h.WriteError(w, r, err)
+		return
+	}
+
+	tokens, err := h.Auth.IssueTokens(u)
+	h.Metrics.ObserveAuth(metrics.AuthPassword, err)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.writeTokens(w, tokens)
+}
+
+// RefreshToken - exchanges a refresh token for a new token pair. Refresh tokens can only be used once,
+// so the client must hold on to the new refresh token that comes back.
+// Writes the new token pair as json and a 200 status code
+// or a 401 Problem if the refresh token is invalid, expired, revoked or has been used already
+func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RefreshToken == "" {
+		h.WriteProblem(w, r, http.StatusBadRequest, "Failed to decode refresh_token from requests JSON")
+		return
+	}
+
+	tokens, err := h.Auth.RefreshTokens(req.RefreshToken)
+	h.Metrics.ObserveAuth(metrics.AuthRefresh, err)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrTokenReused) {
+			h.WriteProblem(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.writeTokens(w, tokens)
+}
+
+// Logout - revokes the given refresh token, and every other refresh token from the same login.
+// Writes a success Response message and a 200 status code
+// or a 401 Problem if the refresh token isn't one we know about
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RefreshToken == "" {
+		h.WriteProblem(w, r, http.StatusBadRequest, "Failed to decode refresh_token from requests JSON")
+		return
+	}
+
+	err = h.Auth.RevokeToken(req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			h.WriteProblem(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.WriteResponseMessage(w, http.StatusOK, "Successfully logged out")
+}
+
+// writeTokens - writes a token pair as json with a 200 status code. Tokens must never be cached.
+func (h *Handler) writeTokens(w http.ResponseWriter, tokens auth.TokenPair) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(tokens)
+	if err != nil {
+		panic(err)
+	}
+}
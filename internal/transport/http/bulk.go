@@ -0,0 +1,192 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// MaxBulkOperations - the most operations a single batch can have
+const MaxBulkOperations = 500
+
+// MaxBulkSize - the largest batch body we'll read, in bytes
+const MaxBulkSize = 1 << 20
+
+// BulkRequest - the JSON body accepted by BulkUsers. Mode is atomic (the default) or best_effort, see user.BulkMode
+type BulkRequest struct {
+	Mode       user.BulkMode
+	Operations []BulkOperationRequest
+}
+
+// BulkOperationRequest - one operation in a BulkRequest. Op is create, update or delete. User is the body
+// CreateUser takes for create, or the body UpdateUser takes for update. ID picks the user to update or delete,
+// and Version (the users Version) makes the change only if nobody else has changed the user since -
+// leave it out to change the user whatever its version, unless REQUIRE_IF_MATCH is set
+type BulkOperationRequest struct {
+	Op      user.BulkOp
+	ID      uint
+	Version uint
+	User    json.RawMessage
+}
+
+// BulkResult - how one operation in a batch went. Index is its position in the requests Operations, and Status
+// is the status it would have had as a request of its own. On success User is the created, updated or deleted user.
+// On failure Code is the kind of problem (ie validation - the end of its problem type) and Error is the problem itself
+type BulkResult struct {
+	Index  int
+	Op     user.BulkOp
+	Status int
+	Code   string             `json:",omitempty"`
+	User   *user.UserResponse `json:",omitempty"`
+	Error  *Problem           `json:",omitempty"`
+}
+
+// BulkResponse - the results of a batch, one per operation in the same order
+type BulkResponse struct {
+	Mode      user.BulkMode
+	Succeeded int
+	Failed    int
+	Results   []BulkResult
+}
+
+// BulkUsers - creates, updates and deletes users in one batch (.../user/bulk), with a BulkRequest body.
+// Every operation goes through the same checks as its own request would - the same policy, validation and
+// password hashing as CreateUser, UpdateUser and DeleteUser - and a batch can only change each user once.
+// In atomic mode nothing is changed unless every operation succeeds, and the operations that didn't fail are
+// reported as failed dependencies (424). In best_effort mode every operation that can be made is.
+// Writes a BulkResponse with a 200 status code if every operation succeeded, or 207 if any failed.
+// Only admins and support can send batches, since creating a user hashes its password and a batch can create
+// hundreds of them. Writes a Problem instead if the caller can't (403), or if the batch itself is bad - 400 if it
+// can't be decoded (or is bigger than MaxBulkSize), is empty, has more than MaxBulkOperations operations, has an
+// unknown mode, or changes the same user twice
+func (h *Handler) BulkUsers(w http.ResponseWriter, r *http.Request) {
+	if !h.Authorize(w, r, auth.ActionBulk, user.User{}) {
+		return
+	}
+
+	var req BulkRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBulkSize)).Decode(&req); err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Failed to decode the batch from requests JSON (it can be at most %d bytes)", MaxBulkSize))
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = user.BulkAtomic
+	}
+	if !req.Mode.IsValid() {
+		h.WriteProblem(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Mode must be %s or %s", user.BulkAtomic, user.BulkBestEffort))
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > MaxBulkOperations {
+		h.WriteProblem(w, r, http.StatusBadRequest,
+			fmt.Sprintf("A batch must have between 1 and %d operations", MaxBulkOperations))
+		return
+	}
+	changed := map[uint]int{}
+	for i, op := range req.Operations {
+		if op.Op != user.BulkUpdate && op.Op != user.BulkDelete {
+			continue
+		}
+		if first, ok := changed[op.ID]; ok {
+			h.WriteProblem(w, r, http.StatusBadRequest,
+				fmt.Sprintf("Operations %d and %d both change user %d - a batch can only change each user once", first, i, op.ID))
+			return
+		}
+		changed[op.ID] = i
+	}
+
+	extendWriteDeadline(r, user.BulkWriteTimeout)
+
+	ops := make([]user.BulkOperation, len(req.Operations))
+	for i, op := range req.Operations {
+		ops[i] = h.checkBulkOperation(r, op)
+	}
+	results := h.users(r).Bulk(ActorContext(r), ops, req.Mode)
+
+	resp := BulkResponse{Mode: req.Mode, Results: make([]BulkResult, 0, len(results))}
+	for i, result := range results {
+		item := BulkResult{Index: i, Op: req.Operations[i].Op, Status: http.StatusOK}
+		if result.Err != nil {
+			problem := ErrorProblem(r, result.Err)
+			item.Status = problem.Status
+			item.Code = strings.TrimPrefix(problem.Type, "/problems/")
+			item.Error = &problem
+			resp.Failed++
+		} else {
+			u := result.User.ToResponse()
+			item.User = &u
+			resp.Succeeded++
+		}
+		resp.Results = append(resp.Results, item)
+	}
+
+	status := http.StatusOK
+	if resp.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	writeJSON(w, status, resp)
+}
+
+// checkBulkOperation - turns an operation from a batch into one for the user service, running the checks its own
+// request would go through first. If any of them fail, the operation is returned with the error as its Err.
+// New users passwords aren't hashed here - the user service hashes each one just before it's created
+func (h *Handler) checkBulkOperation(r *http.Request, req BulkOperationRequest) user.BulkOperation {
+	op := user.BulkOperation{Op: req.Op, ID: req.ID, Version: req.Version}
+	switch req.Op {
+	case user.BulkCreate:
+		var create user.CreateUserRequest
+		if op.Err = decodeBulkUser(req.User, &create); op.Err != nil {
+			return op
+		}
+		op.User = create.ToUser()
+		op.Err = validateNewUser(r, op.User)
+
+	case user.BulkUpdate, user.BulkDelete:
+		target, err := h.users(r).GetUser(req.ID)
+		if err != nil {
+			op.Err = err
+			return op
+		}
+		action := auth.ActionDelete
+		if req.Op == user.BulkUpdate {
+			action = auth.ActionUpdate
+		}
+		claims, _ := ClaimsFromContext(r.Context())
+		if op.Err = auth.Authorize(claims, action, target); op.Err != nil {
+			return op
+		}
+		if h.RequireIfMatch && req.Version == user.AnyVersion {
+			op.Err = user.ValidationErrors{
+				{Field: "Version", Code: user.CodeRequired, Message: "Version is required to change a user"},
+			}
+			return op
+		}
+
+		if req.Op == user.BulkUpdate {
+			var update user.UpdateUserRequest
+			if op.Err = decodeBulkUser(req.User, &update); op.Err != nil {
+				return op
+			}
+			op.User = update.ToUser()
+			op.Err = checkRoleChange(r, target, op.User)
+		}
+	}
+	// The user service fails any other Op
+	return op
+}
+
+// decodeBulkUser - decodes the User of an operation in a batch into v
+func decodeBulkUser(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return &user.Error{Kind: user.KindBadRequest, Message: "User is required"}
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &user.Error{Kind: user.KindBadRequest, Message: "Failed to decode user from the operations JSON"}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// connKey - context key ConnContext stores the connection under
+type connKey struct{}
+
+// ConnContext - for http.Server's ConnContext, so handlers can reach the connection their request came in on
+// to set its write deadline (see WriteDeadline)
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// WriteDeadline - gives every request timeout to write its response in, like http.Server's WriteTimeout does.
+// The server's WriteTimeout can't be used since it would cut off event streams, which push the deadline
+// out every time they write (see extendWriteDeadline). Needs the server to use ConnContext, and does nothing otherwise
+func WriteDeadline(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extendWriteDeadline(r, timeout)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// extendWriteDeadline - gives the request until d from now to finish its next write
+func extendWriteDeadline(r *http.Request, d time.Duration) {
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(d))
+	}
+}
+
+// extendReadDeadline - gives the request until d from now to finish its next read, so handlers that read
+// their body a bit at a time (ie imports) aren't cut off by the server's ReadTimeout
+func extendReadDeadline(r *http.Request, d time.Duration) {
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		conn.SetReadDeadline(time.Now().Add(d))
+	}
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// ETag - the strong entity tag for a user. It changes every time the user does, since every update bumps the version
+func ETag(u user.User) string {
+	return fmt.Sprintf(`"%d-%d"`, u.ID, u.Version)
+}
+
+// WriteUser - writes a user as json along with its ETag. For reads, if the client sent an If-None-Match
+// that matches the user, a 304 Not Modified is written instead since it already has this version
+func (h *Handler) WriteUser(w http.ResponseWriter, r *http.Request, u user.User) {
+	etag := ETag(u)
+	w.Header().Set("ETag", etag)
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if header := r.Header.Get("If-None-Match"); header != "" && etagMatches(header, etag, false) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	u.ToJSON(w)
+}
+
+// CheckIfMatch - checks the If-Match header on a request that changes target, and returns the version the change
+// has to be made against - AnyVersion if the client didn't send an If-Match (and it isn't required).
+// Writes a 428 Problem if If-Match is required but missing, or a 412 Problem if it doesn't match the user,
+// and returns false so handlers can just return
+func (h *Handler) CheckIfMatch(w http.ResponseWriter, r *http.Request, target user.User) (uint, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if h.RequireIfMatch {
+			h.WriteProblem(w, r, http.StatusPreconditionRequired,
+				"An If-Match header with the users current ETag is required to change a user")
+			return user.AnyVersion, false
+		}
+		return user.AnyVersion, true
+	}
+
+	if !etagMatches(header, ETag(target), true) {
+		w.Header().Set("ETag", ETag(target))
+		h.WriteProblem(w, r, http.StatusPreconditionFailed, "The user has been changed since it was read - fetch it again and retry")
+		return user.AnyVersion, false
+	}
+	return target.Version, true
+}
+
+// etagMatches - returns true if any of the comma separated entity tags in header (or "*") matches etag.
+// Strong comparison (for If-Match) never matches a weak W/ tag, weak comparison (for If-None-Match) ignores the W/
+func etagMatches(header, etag string, strong bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// DefaultHeartbeat - how often an event stream sends a comment when there are no events, so proxies
+// (and the write deadline) don't close an idle stream
+const DefaultHeartbeat = 15 * time.Second
+
+// StreamEvents - streams user events as Server-Sent Events (.../user/events), for live dashboards.
+// Each event is sent with its ID, its type (ie user.created) as the event name, and the event as json data.
+// Only callers allowed to list users can stream their events. Filter to certain users with user_id
+// (ie ?user_id=1&user_id=2, or ?user_id=1,2). Reconnecting with a Last-Event-ID header replays the events
+// missed since then, if they're still in the replay buffer - otherwise everything in the buffer is replayed.
+// A comment is sent every Heartbeat when nothing else is. Writes a Problem before the stream starts - 400 for a bad
+// user_id, or 403 if the caller can't list users
+func (h *Handler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	if !h.Authorize(w, r, auth.ActionList, user.User{}) {
+		return
+	}
+
+	filter, err := parseUserIDFilter(r.URL.Query()["user_id"])
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.WriteError(w, r, fmt.Errorf("%T does not support streaming", w))
+		return
+	}
+
+	replay, listener := h.Events.Listen(r.Header.Get("Last-Event-ID"), filter)
+	defer h.Events.Stop(listener)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Every write gets until a couple of heartbeats from now, so a client that stops reading is
+	// eventually cut off, but a quiet stream isn't
+	deadline := 2 * h.Heartbeat
+	extendWriteDeadline(r, deadline)
+	for _, event := range replay {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-listener.C:
+			// The listener fell too far behind and was dropped - the client reconnects with Last-Event-ID
+			if !ok {
+				return
+			}
+			extendWriteDeadline(r, deadline)
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-heartbeat.C:
+			extendWriteDeadline(r, deadline)
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent - writes a single event in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, event user.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// parseUserIDFilter - builds a filter for events about the given user IDs, from user_id query values that are each
+// an ID or a comma separated list of them. Returns a nil filter (every event) if no IDs are given
+func parseUserIDFilter(values []string) (func(user.Event) bool, error) {
+	ids := map[uint]bool{}
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("user_id must be a user ID: %s", v)
+			}
+			ids[uint(id)] = true
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return func(event user.Event) bool {
+		return ids[event.UserID]
+	}, nil
+}
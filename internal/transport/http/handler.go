@@ -2,52 +2,151 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"strconv"
-
+	"strings"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/health"
+	"github.com/aebranton/rest-api/internal/idempotency"
+	"github.com/aebranton/rest-api/internal/metrics"
+	"github.com/aebranton/rest-api/internal/outbox"
 	"github.com/aebranton/rest-api/internal/user"
+	"github.com/aebranton/rest-api/internal/webhook"
 	"github.com/gorilla/mux"
 )
 
-// Handler stores a pointer to our router and user service
+// MaxPatchSize - the largest PATCH body we'll read, in bytes
+const MaxPatchSize = 1 << 20
+
+// Handler stores a pointer to our router, user service and auth service.
+// The user service is an interface so the handler can be run against any implementation (ie in tests).
+// Webhooks and Events are optional - the webhook routes and the event stream are only added if they are set.
+// Idempotency is optional too - without it Idempotency-Key headers are ignored
 type Handler struct {
-	Router  *mux.Router
-	Service *user.Service
+	Router      *mux.Router
+	Service     user.UserService
+	Auth        *auth.Service
+	Webhooks    *webhook.Service
+	Events      *outbox.Broadcaster
+	Idempotency *idempotency.Service
+	Health      *health.Service
+	Metrics     *metrics.Metrics
+
+	// Heartbeat - how often the event stream sends a comment when there are no events
+	Heartbeat time.Duration
+
+	// RequireIfMatch - when true, requests that change a user must send an If-Match header with
+	// the users current ETag. Otherwise If-Match is optional, but still checked when it is sent
+	RequireIfMatch bool
 }
 
 // Response - simple struct for displaying results in json on a page if the request
-// has no object to return (ie Delete requests)
+// has no object to return (ie Delete requests). Errors are written as a Problem instead
 type Response struct {
 	Message string
-	Error   string
 }
 
 // NewHandler - creates a new Handler
-func NewHandler(service *user.Service) *Handler {
+func NewHandler(service user.UserService, authService *auth.Service) *Handler {
 	return &Handler{
-		Service: service,
+		Service:   service,
+		Auth:      authService,
+		Heartbeat: DefaultHeartbeat,
+		Health:    health.NewService(health.DefaultTimeout),
 	}
 }
 
+// users - the user service, working for r - so the queries it makes are traced as part of the request
+func (h *Handler) users(r *http.Request) user.UserService {
+	return h.Service.WithContext(r.Context())
+}
+
 // InitRoutes - sets up the routes on our handler
 func (h *Handler) InitRoutes() {
 	fmt.Println("Building Routes")
 	h.Router = mux.NewRouter()
 
-	// Add user routes
-	h.Router.HandleFunc("/api/user/{id}", h.GetUser).Methods("GET")
-	h.Router.HandleFunc("/api/user", h.GetUserByUsername).Queries("username", "{username}").Methods("GET")
-	h.Router.HandleFunc("/api/user", h.GetAllUsers).Methods("GET")
-	h.Router.HandleFunc("/api/user", h.CreateUser).Methods("POST")
-	h.Router.HandleFunc("/api/user/{id}", h.DeleteUser).Methods("DELETE")
-	h.Router.HandleFunc("/api/user/{id}", h.UpdateUser).Methods("PUT")
+	// Every request gets an ID, which is sent back in the X-Request-ID header and in any Problem written.
+	// Requests mux can't route never reach the router's middleware, so its not found and method not allowed
+	// handlers get it too
+	h.Router.Use(RequestID)
+	// Every routed request is traced, carrying on the trace of whoever sent it if there is a traceparent header
+	h.Router.Use(Trace)
+	h.Router.NotFoundHandler = RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.WriteProblem(w, r, http.StatusNotFound, fmt.Sprintf("There is no route for %s", r.URL.Path))
+	}))
+	h.Router.MethodNotAllowedHandler = RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.WriteProblem(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+	}))
+
+	// Creating a user (signing up) is the only user route that doesn't need a token - though an admin
+	// can send one along to create users with other roles.
+	// It has to be registered before the protected subrouter below, otherwise the subrouter's
+	// path prefix would match first and the request would never make it here.
+	// Idempotent goes inside the auth middleware everywhere, since keys belong to the caller
+	h.Router.Handle("/api/user", h.OptionalAuth(h.Idempotent(http.HandlerFunc(h.CreateUser)))).Methods("POST")
+
+	// The event stream needs a token like the other user routes, but has to be registered before them too,
+	// otherwise /{id} would match it
+	if h.Events != nil {
+		h.Router.Handle("/api/user/events", h.RequireAuth(http.HandlerFunc(h.StreamEvents))).Methods("GET")
+	}
+
+	// Add user routes - everything on this subrouter requires a valid access token.
+	// Idempotent buffers the whole request and response, so it only wraps the routes that change users and
+	// answer with a single response - not the import, which streams in files far bigger than it keeps
+	users := h.Router.PathPrefix("/api/user").Subrouter()
+	users.Use(h.RequireAuth)
+	users.HandleFunc("/deleted", h.GetDeletedUsers).Methods("GET")
+	users.Handle("/bulk", h.Idempotent(http.HandlerFunc(h.BulkUsers))).Methods("POST")
+	users.HandleFunc("/export", h.ExportUsers).Methods("GET")
+	users.HandleFunc("/import", h.ImportUsers).Methods("POST")
+	users.HandleFunc("/{id}", h.GetUser).Methods("GET")
+	users.HandleFunc("", h.GetUserByUsername).Queries("username", "{username}").Methods("GET")
+	users.HandleFunc("", h.GetUserByEmail).Queries("email", "{email}").Methods("GET")
+	users.HandleFunc("", h.GetAllUsers).Methods("GET")
+	users.Handle("/{id}", h.Idempotent(http.HandlerFunc(h.DeleteUser))).Methods("DELETE")
+	users.Handle("/{id}", h.Idempotent(http.HandlerFunc(h.UpdateUser))).Methods("PUT")
+	users.Handle("/{id}", h.Idempotent(http.HandlerFunc(h.PatchUser))).Methods("PATCH")
+	users.Handle("/{id}/restore", h.Idempotent(http.HandlerFunc(h.RestoreUser))).Methods("POST")
+	users.Handle("/{id}/purge", h.Idempotent(http.HandlerFunc(h.PurgeUser))).Methods("DELETE")
+	users.HandleFunc("/{id}/audit", h.GetAuditLog).Methods("GET")
+	users.HandleFunc("/{id}/revisions", h.GetRevisions).Methods("GET")
+	users.Handle("/{id}/revisions/{number}/revert", h.Idempotent(http.HandlerFunc(h.RevertUser))).Methods("POST")
+
+	// Webhook routes - subscribing to user events, and looking after deliveries that didn't make it
+	if h.Webhooks != nil {
+		webhooks := h.Router.PathPrefix("/api/webhooks").Subrouter()
+		webhooks.Use(h.RequireAuth, h.Idempotent)
+		webhooks.HandleFunc("", h.CreateWebhook).Methods("POST")
+		webhooks.HandleFunc("", h.GetWebhooks).Methods("GET")
+		webhooks.HandleFunc("/dead-letters", h.GetDeadLetters).Methods("GET")
+		webhooks.HandleFunc("/deliveries/{id}/redeliver", h.RedeliverWebhook).Methods("POST")
+		webhooks.HandleFunc("/{id}", h.DeleteWebhook).Methods("DELETE")
+	}
 
-	// I realize this is kind of strange, and also having a body in get is never something id usually do
-	// But since we are only making the rest api, i wanted to supply an endpoint to confirm auth works (basic though it is)
-	h.Router.HandleFunc("/api/auth/user", h.AuthenticateUser).Methods("GET")
+	// Auth routes - log in with a username and password to get a token pair, refresh it, or log out
+	h.Router.HandleFunc("/api/auth/token", h.IssueToken).Methods("POST")
+	h.Router.HandleFunc("/api/auth/refresh", h.RefreshToken).Methods("POST")
+	h.Router.HandleFunc("/api/auth/logout", h.Logout).Methods("POST")
+
+	// Health checks - /healthz is whether we're alive, and /readyz whether we can serve requests.
+	// Neither needs a token, so probes and load balancers can call them
+	h.Router.HandleFunc("/healthz", h.Liveness).Methods("GET")
+	h.Router.HandleFunc("/readyz", h.Readiness).Methods("GET")
+	// Prometheus metrics, for scraping - see Instrument for how requests are recorded
+	if h.Metrics != nil {
+		h.Router.Handle("/metrics", h.Metrics.Handler()).Methods("GET")
+	}
 
-	// Adding a simple status check to make sure its online
+	// Adding a simple status check to make sure its online. It only shows that we're answering -
+	// use /readyz to check that we can actually serve requests
 	h.Router.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
@@ -59,24 +158,14 @@ func (h *Handler) InitRoutes() {
 	})
 }
 
-// WriteResponseMessage - helper for writing a response message to a page.
-// Can be given any status code, and any message.
-// Internally it will set the response pages header to the status code given, and then select
-// wether the supplied message should go into the Message field, or the Error field, based on the code.
+// WriteResponseMessage - helper for writing a successful response message to a page.
+// Can be given any status code, and any message. Errors are written with WriteProblem or WriteError instead.
 // Panics if anything goes wrong encoding the message to json.
 func (h *Handler) WriteResponseMessage(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(status)
 
-	var response Response
-	if status == http.StatusOK {
-		response.Message = msg
-	} else if status == http.StatusBadRequest {
-		response.Error = msg
-	} else {
-		response.Message = msg
-	}
-
+	response := Response{Message: msg}
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
 		panic(err)
@@ -97,156 +186,418 @@ func (h *Handler) GetUintFromVars(vars map[string]string, key string) (uint, str
 	return uint(i), k, nil
 }
 
-// GetUser - gets a user given the ID from a query (.../user/1)
-// Writes either the selected user as json and a 200 status code
-// or a 400 status code, and an error message written within a Response object
+// GetUser - gets a user given the ID from a query (.../user/1), or what it looked like at some point in time
+// with an as_of query (.../user/1?as_of=2021-04-01T00:00:00Z, see GetUserAsOf).
+// Writes either the selected user as json with its ETag and a 200 status code, a 304 status code if it matches
+// the If-None-Match header, or a Problem - 400 for a bad ID,
+// 403 if the caller isn't allowed to see this user, or 404 if there is no such user
 func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, val, err := h.GetUintFromVars(vars, "id")
 
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
 		return
 	}
 
-	user, err := h.Service.GetUser(id)
+	if r.URL.Query().Get("as_of") != "" {
+		h.GetUserAsOf(w, r, id)
+		return
+	}
+
+	user, err := h.users(r).GetUser(id)
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("Error getting user with ID: %d", id))
+		h.WriteError(w, r, err)
 		return
 	}
 
-	user.ToJSON(w)
+	if !h.Authorize(w, r, auth.ActionRead, user) {
+		return
+	}
+
+	h.WriteUser(w, r, user)
 }
 
 // GetUserByUsername - gets a user given the username from a query (.../user?username=test)
-// Writes either the selected user as json and a 200 status code
-// or a 400 status code, and an error message written within a Response object
+// Writes either the selected user as json with its ETag and a 200 status code, a 304 status code if it matches
+// the If-None-Match header, or a Problem - 403 if the caller
+// isn't allowed to see this user, or 404 if there is no such user
 func (h *Handler) GetUserByUsername(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username, ok := vars["username"]
 	if !ok {
-		h.WriteResponseMessage(w, http.StatusBadRequest, "Invalid, or no username given")
+		h.WriteProblem(w, r, http.StatusBadRequest, "Invalid, or no username given")
 		return
 	}
 
-	user, err := h.Service.GetUserByUsername(username)
+	user, err := h.users(r).GetUserByUsername(username)
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("Error getting user with username: %s", username))
+		h.WriteError(w, r, err)
 		return
 	}
 
-	user.ToJSON(w)
-}
+	if !h.Authorize(w, r, auth.ActionRead, user) {
+		return
+	}
 
-// AuthenticateUser - Once more for the notes - this is a GET request with a BODY containing username and password json.
-// I knopw this isn't the RESTful way, and is not something I'd do in production, but since we are only building the rest api,
-// and not using 0auth or jwt or anything, i wanted to give some sort of super-basic user validation
-func (h *Handler) AuthenticateUser(w http.ResponseWriter, r *http.Request) {
-	var auth user.UserAuth
-	err := json.NewDecoder(r.Body).Decode(&auth)
+	h.WriteUser(w, r, user)
+}
 
-	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, "Failed to decode user Auth from requests JSON. Please make sure to provide a Username and Password field.")
+// GetUserByEmail - gets a user given the email from a query (.../user?email=test@example.com)
+// Writes either the selected user as json with its ETag and a 200 status code, a 304 status code if it matches
+// the If-None-Match header, or a Problem - 403 if the caller
+// isn't allowed to see this user, or 404 if there is no such user
+func (h *Handler) GetUserByEmail(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	email, ok := vars["email"]
+	if !ok {
+		h.WriteProblem(w, r, http.StatusBadRequest, "Invalid, or no email given")
 		return
 	}
 
-	user, err := h.Service.AuthenticateUser(auth)
+	user, err := h.users(r).GetUserByEmail(email)
 	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
 
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("%s", err))
+	if !h.Authorize(w, r, auth.ActionRead, user) {
 		return
 	}
 
-	user.ToJSON(w)
+	h.WriteUser(w, r, user)
 }
 
-// GetAllUsers - gets all users from the database.
-// Not currently paginated or using limits for the purposes of this demo.
-// Production solutions would allow something such as (../user?limit=20&offset=40)
-// Writes either the selected user as json and a 200 status code
-// or a 400 status code, and an error message written within a Response object
+// GetAllUsers - gets a page of users from the database.
+// Supports limit/offset or cursor paging, sorting and filtering through the query string - see ParseListOptions
+// ie (../user?limit=20&offset=40) or (../user?sort=-created_at&name_contains=smith&cursor=...)
+// Only admin and support users can list users.
+// Writes the page of users as json, along with Link and X-Total-Count headers and a 200 status code,
+// or a Problem - 400 if the query string can't be parsed, 403 if the caller isn't allowed to list users,
+// or 422 if the list options don't make sense
 func (h *Handler) GetAllUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := h.Service.GetAllUsers()
+	if !h.Authorize(w, r, auth.ActionList, user.User{}) {
+		return
+	}
 
+	opts, err := ParseListOptions(r.URL.Query())
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, "Unable to retreive users")
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid list options: %s", err))
 		return
 	}
 
-	users.ToJSON(w)
+	page, err := h.users(r).ListUsers(opts)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	WritePageHeaders(w, r, opts, page)
+	page.ToJSON(w)
 }
 
 // CreateUser - adds a user to the database with the given information in the body as JSON
-// Writes the created user as json and a 200 status code
-// or a 400 status code, and an error message written within a Response object
+// Only an admin can give the new user a Role other than "user".
+// Writes the created user as json and a 200 status code, or a Problem - 400 if the body can't be decoded,
+// 409 if the username or email is taken, or 422 listing every invalid field
 func (h *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
-	var newUser user.User
-	err := json.NewDecoder(r.Body).Decode(&newUser)
+	var req user.CreateUserRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
 
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, "Failed to decode user from requests JSON")
+		h.WriteProblem(w, r, http.StatusBadRequest, "Failed to decode user from requests JSON")
+		return
+	}
+	newUser := req.ToUser()
+	if err := checkNewUser(r, &newUser); err != nil {
+		h.WriteError(w, r, err)
 		return
 	}
 
-	pwd, err := user.HashPassword(newUser.Password)
+	created, err := h.users(r).CreateUser(ActorContext(r), newUser)
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, "Unable to create user - password failed to hash.")
+		h.WriteError(w, r, err)
 		return
 	}
 
-	newUser.Password = pwd
-	user, err := h.Service.CreateUser(newUser)
+	h.WriteUser(w, r, created)
+}
+
+// checkNewUser - runs validateNewUser, then hashes the new users password ready for it to be created
+func checkNewUser(r *http.Request, newUser *user.User) error {
+	if err := validateNewUser(r, *newUser); err != nil {
+		return err
+	}
+
+	pwd, err := user.HashPasswordContext(r.Context(), newUser.Password)
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("Unable to create new user: %s", err))
-		return
+		return err
+	}
+	newUser.Password = pwd
+	return nil
+}
+
+// validateNewUser - the checks every new user goes through before it is created, whether on its own or in a batch.
+// Anybody can sign up as a regular user, but only an admin can create a user with any other role.
+// It's run before the password is hashed, so the password rules see what was actually sent
+func validateNewUser(r *http.Request, newUser user.User) error {
+	if newUser.Role != "" && newUser.Role != user.RoleUser {
+		claims, _ := ClaimsFromContext(r.Context())
+		if err := auth.Authorize(claims, auth.ActionAssignRole, newUser); err != nil {
+			return err
+		}
 	}
 
-	user.ToJSON(w)
+	if valid, errs := newUser.IsValid(); !valid {
+		return errs
+	}
+	return nil
 }
 
 // UpdateUser - updates a user in the database with the given id, and updates the supplied fields/data
-// in the request body as JSON
-// Writes the updated user as json and a 200 status code
-// or a 400 status code, and an error message written within a Response object
+// in the request body as JSON. Regular users can only update themselves, and only admins can change roles.
+// If-Match is checked against the users ETag (see CheckIfMatch), so an update can't overwrite changes it didn't see.
+// Writes the updated user as json with its new ETag and a 200 status code, or a Problem - 400 if the body can't
+// be decoded, 403 if the caller isn't allowed to make this change, 404 if there is no such user, 409 if the new
+// username or email is taken, 412 if If-Match doesn't match, 422 listing every field that would be invalid after
+// the update, or 428 if If-Match is required and missing
 func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, val, err := h.GetUintFromVars(vars, "id")
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		return
+	}
+
+	var req user.UpdateUserRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, "Failed to decode user from requests JSON")
+		return
+	}
+	updatedUser := req.ToUser()
+
+	target, err := h.users(r).GetUser(id)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionUpdate, target) {
+		return
+	}
+	version, ok := h.CheckIfMatch(w, r, target)
+	if !ok {
+		return
+	}
+	if err := checkRoleChange(r, target, updatedUser); err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	updated, err := h.users(r).UpdateUser(ActorContext(r), id, updatedUser, version)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.WriteUser(w, r, updated)
+}
+
+// checkRoleChange - if an update changes the targets role, checks the new role is one we know
+// and that the caller is allowed to hand it out
+func checkRoleChange(r *http.Request, target user.User, changes user.User) error {
+	if changes.Role == "" || changes.Role == target.Role {
+		return nil
+	}
+	if !changes.Role.IsValid() {
+		return user.ValidationErrors{
+			{Field: "Role", Code: user.CodeInvalidValue, Message: "Role is not one of admin, support or user"},
+		}
+	}
+	claims, _ := ClaimsFromContext(r.Context())
+	return auth.Authorize(claims, auth.ActionAssignRole, target)
+}
+
+// PatchUser - patches a user in the database with the given id. The body is either a JSON Merge Patch
+// (Content-Type: application/merge-patch+json) or a JSON Patch (Content-Type: application/json-patch+json),
+// applied to the user as GET returns it - see user.ApplyPatch. The patched user is validated before it is saved,
+// and is only saved if nobody else changed the user while the patch was being applied.
+// Same rules as UpdateUser for who can change what, and If-Match is checked the same way.
+// Writes the patched user as json with its new ETag and a 200 status code, or a Problem - 400 if the patch can't
+// be parsed, 409 if a JSON Patch test fails or the new username or email is taken, 415 for any other content type,
+// 422 if the patch doesn't apply or leaves the user invalid, or the same problems as UpdateUser
+func (h *Handler) PatchUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, val, err := h.GetUintFromVars(vars, "id")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	patchType := user.PatchType(mediaType)
+	if err != nil || (patchType != user.MergePatch && patchType != user.JSONPatch) {
+		w.Header().Set("Accept-Patch", strings.Join([]string{string(user.MergePatch), string(user.JSONPatch)}, ", "))
+		h.WriteProblem(w, r, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("PATCH needs a Content-Type of %s or %s", user.MergePatch, user.JSONPatch))
+		return
+	}
+
+	patch, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxPatchSize))
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, "Failed to read the patch from the request body")
 		return
 	}
 
-	var updatedUser user.User
-	err = json.NewDecoder(r.Body).Decode(&updatedUser)
+	target, err := h.users(r).GetUser(id)
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, "Failed to decode user from requests JSON")
+		h.WriteError(w, r, err)
 		return
 	}
 
-	user, err := h.Service.UpdateUser(id, updatedUser)
+	if !h.Authorize(w, r, auth.ActionUpdate, target) {
+		return
+	}
+	if _, ok := h.CheckIfMatch(w, r, target); !ok {
+		return
+	}
+
+	changes, err := user.ApplyPatch(target, patchType, patch)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+	if changes.Role != target.Role {
+		if !h.Authorize(w, r, auth.ActionAssignRole, target) {
+			return
+		}
+	}
+
+	// The patch was applied to the user at target.Version, so it can only be saved on top of that version
+	updated, err := h.users(r).UpdateUser(ActorContext(r), id, changes, target.Version)
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("Unable to update user with ID: %d", id))
+		h.WriteError(w, r, err)
 		return
 	}
 
-	user.ToJSON(w)
+	h.WriteUser(w, r, updated)
 }
 
-// DeleteUser - Deletes a user from the database with the given ID
-// Writes a success Response message and a 200 status code
-// or a 400 status code, and an error message written within a Response object
+// DeleteUser - Deletes a user from the database with the given ID. Only admins can delete users.
+// If-Match is checked against the users ETag, like UpdateUser.
+// Writes a success Response message and a 200 status code, or a Problem - 400 for a bad ID,
+// 403 if the caller isn't an admin, 404 if there is no such user, 412 if If-Match doesn't match,
+// or 428 if If-Match is required and missing
 func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, val, err := h.GetUintFromVars(vars, "id")
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
 		return
 	}
 
-	err = h.Service.DeleteUser(id)
+	target, err := h.users(r).GetUser(id)
 	if err != nil {
-		h.WriteResponseMessage(w, http.StatusBadRequest, fmt.Sprintf("Unbale to delete user with ID: %d", id))
+		h.WriteError(w, r, err)
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionDelete, target) {
+		return
+	}
+	version, ok := h.CheckIfMatch(w, r, target)
+	if !ok {
+		return
+	}
+
+	err = h.users(r).DeleteUser(ActorContext(r), id, version)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
 	}
 
 	h.WriteResponseMessage(w, http.StatusOK, fmt.Sprintf("Success deleting comment: %d", id))
 }
+
+// GetDeletedUsers - gets a page of soft-deleted users, with the same paging, sorting and filtering as GetAllUsers
+// (ie ../user/deleted?limit=20&sort=-created_at). Only admins can see deleted users.
+// Writes the page of users as json, along with Link and X-Total-Count headers and a 200 status code,
+// or a Problem - 400 if the query string can't be parsed, or 403 if the caller isn't an admin
+func (h *Handler) GetDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	if !h.Authorize(w, r, auth.ActionListDeleted, user.User{}) {
+		return
+	}
+
+	opts, err := ParseListOptions(r.URL.Query())
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid list options: %s", err))
+		return
+	}
+	opts.Deleted = true
+
+	page, err := h.users(r).ListUsers(opts)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	WritePageHeaders(w, r, opts, page)
+	page.ToJSON(w)
+}
+
+// RestoreUser - undeletes a soft-deleted user with the given ID. Only admins can restore users.
+// Writes the restored user as json with its ETag and a 200 status code, or a Problem - 400 for a bad ID,
+// 403 if the caller isn't an admin, 404 if there is no deleted user with that ID, or 409 if somebody
+// has signed up with the users username or email since it was deleted
+func (h *Handler) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, val, err := h.GetUintFromVars(vars, "id")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionRestore, user.User{}) {
+		return
+	}
+
+	restored, err := h.users(r).RestoreUser(ActorContext(r), id)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.WriteUser(w, r, restored)
+}
+
+// PurgeUser - permanently removes a soft-deleted user with the given ID. Only admins can purge users,
+// and a user has to be deleted (DELETE ../user/{id}) before it can be purged.
+// Writes a success Response message and a 200 status code, or a Problem - 400 for a bad ID,
+// 403 if the caller isn't an admin, 404 if there is no such user, or 409 if the user hasn't been deleted
+func (h *Handler) PurgeUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, val, err := h.GetUintFromVars(vars, "id")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionPurge, user.User{}) {
+		return
+	}
+
+	err = h.users(r).PurgeUser(ActorContext(r), id)
+	if errors.Is(err, user.ErrNotFound) {
+		if _, liveErr := h.users(r).GetUser(id); liveErr == nil {
+			h.WriteProblem(w, r, http.StatusConflict, fmt.Sprintf("User %d has to be deleted before it can be purged", id))
+			return
+		}
+	}
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.WriteResponseMessage(w, http.StatusOK, fmt.Sprintf("Success purging user: %d", id))
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"net/http"
+	"time"
+)
+
+// Liveness - reports that the process is alive (/healthz), for restarting it if it isn't.
+// Always writes a health.Report with a 200 status code - nothing we depend on is checked, since restarting
+// us won't fix the database
+func (h *Handler) Liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, h.Health.Live())
+}
+
+// Readiness - reports whether we can serve requests (/readyz), for deciding whether to send us any.
+// Runs every check in the health service - by default the database, its migrations and whether we're
+// shutting down - and writes a health.Report with each checks status, latency and error.
+// Writes a 200 status code if every check passed, or 503 if any failed
+func (h *Handler) Readiness(w http.ResponseWriter, r *http.Request) {
+	// Checks can take up to their timeout, which can be longer than the write timeout
+	extendWriteDeadline(r, h.Health.Timeout+time.Second)
+
+	report := h.Health.Ready(r.Context())
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
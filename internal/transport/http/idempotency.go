@@ -0,0 +1,167 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aebranton/rest-api/internal/idempotency"
+)
+
+// IdempotencyKeyHeader - the header clients send a key in, to make retrying a request safe
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader - set on responses that were replayed for a retried request, rather than made for it
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// MaxIdempotentBodySize - the largest body we'll read for a request sent with an Idempotency-Key, in bytes
+const MaxIdempotentBodySize = 1 << 20
+
+// anonymousCaller - who keys sent without a token belong to (ie when signing up)
+const anonymousCaller = "anonymous"
+
+// Idempotent - middleware that makes POST, PUT, PATCH and DELETE requests sent with an Idempotency-Key header
+// safe to retry. The first response to each key is stored (see idempotency.Service), and a retry with the same key
+// gets that response back with an Idempotent-Replayed header, instead of making the change again.
+// Keys belong to whoever sent them, so this has to run after the auth middleware. Reusing a key for a different
+// request is a 422, and retrying while the first request is still running is a 409.
+// Server errors aren't stored, so the retry runs for real, and neither is a response we couldn't store - either way
+// the key is released straight away. If we crash part way through, the key is released once its lease runs out.
+// Does nothing if the handler has no Idempotency service
+func (h *Handler) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if h.Idempotency == nil || key == "" || !changesState(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > idempotency.MaxKeyLength {
+			h.WriteProblem(w, r, http.StatusBadRequest,
+				fmt.Sprintf("%s can be at most %d characters", IdempotencyKeyHeader, idempotency.MaxKeyLength))
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxIdempotentBodySize+1))
+		if err != nil {
+			h.WriteProblem(w, r, http.StatusBadRequest, "Unable to read the request body")
+			return
+		}
+		if len(body) > MaxIdempotentBodySize {
+			h.WriteProblem(w, r, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Requests sent with an %s can be at most %d bytes", IdempotencyKeyHeader, MaxIdempotentBodySize))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		record, fresh, err := h.Idempotency.Begin(idempotencyCaller(r), key, requestFingerprint(r, body))
+		if err != nil {
+			h.WriteError(w, r, err)
+			return
+		}
+		if !fresh {
+			replayResponse(w, record)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			// The handler panicked - forget the key so the request can be retried
+			if !completed {
+				if err := h.Idempotency.Abandon(record); err != nil {
+					fmt.Printf("Unable to release idempotency key %q: %s\n", key, err)
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+		completed = true
+
+		if rec.status < http.StatusInternalServerError {
+			err = h.Idempotency.Complete(&record, rec.status, rec.header, rec.body.Bytes())
+			if err == nil {
+				return
+			}
+			fmt.Printf("Unable to store the response for idempotency key %q: %s\n", key, err)
+		}
+		if err := h.Idempotency.Abandon(record); err != nil {
+			fmt.Printf("Unable to release idempotency key %q: %s\n", key, err)
+		}
+	})
+}
+
+// changesState - returns true for the methods Idempotency-Key is honoured on
+func changesState(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// idempotencyCaller - who the request's Idempotency-Key belongs to - the user in its token, or anonymous without one
+func idempotencyCaller(r *http.Request) string {
+	if claims, ok := ClaimsFromContext(r.Context()); ok {
+		if id, err := claims.UserID(); err == nil {
+			return fmt.Sprintf("user:%d", id)
+		}
+	}
+	return anonymousCaller
+}
+
+// requestFingerprint - a hash of everything about the request that decides what it does, so a retry can be told
+// apart from a different request that reused the key
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	for _, part := range []string{r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"), r.Header.Get("If-Match")} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// replayResponse - writes a stored response back out. The request ID header is left as this request's own
+func replayResponse(w http.ResponseWriter, record idempotency.Record) {
+	for name, values := range record.Header {
+		if name == http.CanonicalHeaderKey(RequestIDHeader) {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// responseRecorder - passes a response through to the client, keeping a copy of it to store
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+// WriteHeader - records the status, and the headers as they were when it was written
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+	rec.header = rec.ResponseWriter.Header().Clone()
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write - records the body as it's written
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/metrics"
+	"github.com/gorilla/mux"
+)
+
+// UnmatchedRoute - the route requests that don't match any route are counted under, so a scan
+// of random paths can't make a new series per path
+const UnmatchedRoute = "unmatched"
+
+// Instrument - records every request through router in m - in flight while it's handled, then counted and timed
+// by the route template it matched (ie /api/user/{id}), its method and its status code.
+// It wraps the router rather than being one of its middlewares, so requests mux can't route are counted too
+func Instrument(router *mux.Router, m *metrics.Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := UnmatchedRoute
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		m.RequestStarted()
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			m.RequestFinished(route, r.Method, sw.status, time.Since(start))
+		}()
+		router.ServeHTTP(sw, r)
+	})
+}
+
+// statusWriter - passes a response straight through to the client, noting its status code
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader - notes the status code, and writes it
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status = status
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write - writes the body. Like http.ResponseWriter, the status is 200 if it hasn't been written yet
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush - flushes the response, for event streams and exports
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,135 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// ParseListOptions - reads paging, sorting and filtering options for the user list from the query string:
+//
+//	limit, offset, cursor, sort (ie sort=-created_at),
+//	username_contains, email_contains, name_contains,
+//	created_after, created_before (RFC 3339 timestamps)
+//
+// The options are validated, so any error returned here is the callers fault
+func ParseListOptions(query url.Values) (user.ListOptions, error) {
+	var opts user.ListOptions
+	var err error
+
+	if v := query.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("limit must be a number: %s", v)
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if opts.Offset, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("offset must be a number: %s", v)
+		}
+	}
+	if v := query.Get("created_after"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return opts, fmt.Errorf("created_after must be an RFC 3339 timestamp: %s", v)
+		}
+		opts.CreatedAfter = &t
+	}
+	if v := query.Get("created_before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return opts, fmt.Errorf("created_before must be an RFC 3339 timestamp: %s", v)
+		}
+		opts.CreatedBefore = &t
+	}
+
+	opts.Cursor = query.Get("cursor")
+	opts.Sort = query.Get("sort")
+	opts.UsernameContains = query.Get("username_contains")
+	opts.EmailContains = query.Get("email_contains")
+	opts.NameContains = query.Get("name_contains")
+
+	return opts, opts.Validate()
+}
+
+// ParseHistoryOptions - reads paging options for a users audit log or revisions from the query string - limit, and either offset or cursor.
+// The options are validated, so any error returned here is the callers fault
+func ParseHistoryOptions(query url.Values) (user.HistoryOptions, error) {
+	var opts user.HistoryOptions
+	var err error
+
+	if v := query.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("limit must be a number: %s", v)
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if opts.Offset, err = strconv.Atoi(v); err != nil {
+			return opts, fmt.Errorf("offset must be a number: %s", v)
+		}
+	}
+	opts.Cursor = query.Get("cursor")
+
+	return opts, opts.Validate()
+}
+
+// WritePageHeaders - sets the X-Total-Count header and an RFC 8288 Link header with first, prev and next
+// links for a page of users. Links keep every other query parameter (filters, sort, limit) from the request.
+// Offset paging gets offset based links, everything else gets cursor links
+func WritePageHeaders(w http.ResponseWriter, r *http.Request, opts user.ListOptions, page user.Page) {
+	writePageHeaders(w, r, opts.Offset, page.Limit, page.Total, page.NextCursor)
+}
+
+// WriteAuditPageHeaders - sets the same X-Total-Count and Link headers as WritePageHeaders, for a page of an audit log
+func WriteAuditPageHeaders(w http.ResponseWriter, r *http.Request, opts user.HistoryOptions, page user.AuditPage) {
+	writePageHeaders(w, r, opts.Offset, page.Limit, page.Total, page.NextCursor)
+}
+
+// WriteRevisionPageHeaders - sets the same X-Total-Count and Link headers as WritePageHeaders, for a page of revisions
+func WriteRevisionPageHeaders(w http.ResponseWriter, r *http.Request, opts user.HistoryOptions, page user.RevisionPage) {
+	writePageHeaders(w, r, opts.Offset, page.Limit, page.Total, page.NextCursor)
+}
+
+// writePageHeaders - sets the X-Total-Count and Link headers for any page of results
+func writePageHeaders(w http.ResponseWriter, r *http.Request, offset, limit int, total int64, nextCursor string) {
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+	links := []string{pageLink(r, "first", map[string]string{"limit": strconv.Itoa(limit)})}
+
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, pageLink(r, "prev", map[string]string{"offset": strconv.Itoa(prev), "limit": strconv.Itoa(limit)}))
+	}
+
+	if nextCursor != "" {
+		if offset > 0 {
+			next := offset + limit
+			links = append(links, pageLink(r, "next", map[string]string{"offset": strconv.Itoa(next), "limit": strconv.Itoa(limit)}))
+		} else {
+			links = append(links, pageLink(r, "next", map[string]string{"cursor": nextCursor, "limit": strconv.Itoa(limit)}))
+		}
+	}
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// pageLink - builds a single Link header entry pointing at the current request with its paging parameters
+// swapped out for the given ones
+func pageLink(r *http.Request, rel string, params map[string]string) string {
+	query := r.URL.Query()
+	query.Del("offset")
+	query.Del("cursor")
+	for k, v := range params {
+		query.Set(k, v)
+	}
+
+	link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, link.String(), rel)
+}
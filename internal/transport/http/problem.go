@@ -0,0 +1,136 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// ProblemContentType - the content type of every error response
+const ProblemContentType = "application/problem+json"
+
+// Problem - an RFC 7807 problem details document. Every error response is one of these.
+// Type is a URI reference naming the kind of problem (see problemTypes), Title is the same for every
+// problem of that type, and Detail explains this occurrence. Instance is the path the request was made to,
+// and RequestID matches the X-Request-ID header so a problem can be found in the logs.
+// Errors lists every field that failed validation, for validation problems
+type Problem struct {
+	Type      string                `json:"type"`
+	Title     string                `json:"title"`
+	Status    int                   `json:"status"`
+	Detail    string                `json:"detail,omitempty"`
+	Instance  string                `json:"instance,omitempty"`
+	RequestID string                `json:"request_id,omitempty"`
+	Errors    user.ValidationErrors `json:"errors,omitempty"`
+}
+
+// problemType - the type URI and title for problems with a given status
+type problemType struct {
+	Type  string
+	Title string
+}
+
+// problemTypes - the type and title we use for each status we write problems with
+var problemTypes = map[int]problemType{
+	http.StatusBadRequest:            {"/problems/bad-request", "Bad request"},
+	http.StatusUnauthorized:          {"/problems/unauthorized", "Authentication required"},
+	http.StatusForbidden:             {"/problems/forbidden", "Forbidden"},
+	http.StatusNotFound:              {"/problems/not-found", "Not found"},
+	http.StatusMethodNotAllowed:      {"/problems/method-not-allowed", "Method not allowed"},
+	http.StatusConflict:              {"/problems/conflict", "Conflict"},
+	http.StatusPreconditionFailed:    {"/problems/precondition-failed", "Precondition failed"},
+	http.StatusRequestEntityTooLarge: {"/problems/payload-too-large", "Payload too large"},
+	http.StatusUnsupportedMediaType:  {"/problems/unsupported-media-type", "Unsupported media type"},
+	http.StatusPreconditionRequired:  {"/problems/precondition-required", "Precondition required"},
+	http.StatusUnprocessableEntity:   {"/problems/validation", "Validation failed"},
+	http.StatusFailedDependency:      {"/problems/failed-dependency", "Failed dependency"},
+	http.StatusInternalServerError:   {"/problems/internal", "Internal server error"},
+}
+
+// kindStatuses - the status each kind of user service error is reported with
+var kindStatuses = map[user.Kind]int{
+	user.KindBadRequest:   http.StatusBadRequest,
+	user.KindNotFound:     http.StatusNotFound,
+	user.KindConflict:     http.StatusConflict,
+	user.KindValidation:   http.StatusUnprocessableEntity,
+	user.KindUnauthorized: http.StatusUnauthorized,
+	user.KindPrecondition: http.StatusPreconditionFailed,
+	user.KindAborted:      http.StatusFailedDependency,
+	user.KindInternal:     http.StatusInternalServerError,
+}
+
+// NewProblem - builds the problem document for the given status and request
+func NewProblem(r *http.Request, status int, detail string) Problem {
+	pt, ok := problemTypes[status]
+	if !ok {
+		pt = problemType{"about:blank", http.StatusText(status)}
+	}
+	return Problem{
+		Type:      pt.Type,
+		Title:     pt.Title,
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+}
+
+// WriteProblem - writes a problem document with the given status and detail.
+// Panics if anything goes wrong encoding the problem to json.
+func (h *Handler) WriteProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblem(w, NewProblem(r, status, detail))
+}
+
+// WriteError - writes the problem document for an error from the user service, with the status picked from
+// the errors Kind (see user.KindOf). Validation errors list every failed field.
+// Internal errors are logged along with the request ID, and their details are never sent to the client
+func (h *Handler) WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := ErrorProblem(r, err)
+	if problem.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	}
+	writeProblem(w, problem)
+}
+
+// ErrorProblem - builds the problem document for an error, as WriteError writes it. The errors from auth.Authorize
+// are a 401 or 403, and anything else is picked from its Kind
+func ErrorProblem(r *http.Request, err error) Problem {
+	status, ok := kindStatuses[user.KindOf(err)]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		status = http.StatusUnauthorized
+	case errors.Is(err, auth.ErrForbidden):
+		status = http.StatusForbidden
+	}
+
+	problem := NewProblem(r, status, err.Error())
+	switch status {
+	case http.StatusUnprocessableEntity:
+		var errs user.ValidationErrors
+		if errors.As(err, &errs) {
+			problem.Errors = errs
+			problem.Detail = "One or more fields are invalid"
+		}
+	case http.StatusInternalServerError:
+		fmt.Printf("Request %s to %s %s failed: %s\n", problem.RequestID, r.Method, r.URL.Path, err)
+		problem.Detail = "Something went wrong on our end - please quote the request_id if you report this"
+	}
+	return problem
+}
+
+// writeProblem - writes a problem document, with its status
+func writeProblem(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(problem.Status)
+	err := json.NewEncoder(w).Encode(problem)
+	if err != nil {
+		panic(err)
+	}
+}
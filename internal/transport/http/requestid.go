@@ -0,0 +1,64 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader - the header request IDs are read from and written back on
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey - context key the RequestID middleware stores the request ID under
+const requestIDKey contextKey = "request_id"
+
+// maxRequestIDLength - the longest request ID we'll accept from a client before making our own
+const maxRequestIDLength = 128
+
+// RequestID - middleware that gives every request an ID, so a response (and any problem it reports) can be
+// matched up with our logs. A client (or proxy in front of us) can send its own X-Request-ID to use,
+// otherwise a random one is made. Either way it is put on the request context and sent back in the
+// X-Request-ID response header
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFromContext - returns the request ID stored on the request context by RequestID,
+// or an empty string if the request never went through the middleware
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// validRequestID - returns true if a request ID sent by a client is safe to use and echo back -
+// not empty, not too long, and only printable ascii
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID - makes a random 128 bit request ID, hex encoded
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
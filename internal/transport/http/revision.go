@@ -0,0 +1,110 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/gorilla/mux"
+)
+
+// GetUserAsOf - gets the user with the given ID as it was at the as_of time (an RFC 3339 timestamp), from its revisions.
+// Only admins and support can see old revisions of a user. Writes the user as it was as json with the ETag it had
+// then and a 200 status code, or a Problem - 400 for a bad timestamp, 403 if the caller isn't allowed to see
+// revisions, or 404 if the user didn't exist yet (or had been deleted) at that time
+func (h *Handler) GetUserAsOf(w http.ResponseWriter, r *http.Request, id uint) {
+	value := r.URL.Query().Get("as_of")
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("as_of must be an RFC 3339 timestamp: %s", value))
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionReadHistory, user.User{}) {
+		return
+	}
+
+	old, err := h.users(r).GetUserAsOf(id, at)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.WriteUser(w, r, old)
+}
+
+// GetRevisions - gets a page of the revisions of the user with the given ID, oldest first (ie ../user/1/revisions?limit=20).
+// Each revision has the users Number (its version at the time) and a Snapshot of the user.
+// Only admins and support can see revisions. Writes the page as json, along with Link and X-Total-Count headers and
+// a 200 status code, or a Problem - 400 for a bad ID or paging options, or 403 if the caller isn't allowed to see revisions
+func (h *Handler) GetRevisions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, val, err := h.GetUintFromVars(vars, "id")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionReadHistory, user.User{}) {
+		return
+	}
+
+	opts, err := ParseHistoryOptions(r.URL.Query())
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid paging options: %s", err))
+		return
+	}
+
+	page, err := h.users(r).ListRevisions(id, opts)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	WriteRevisionPageHeaders(w, r, opts, page)
+	page.ToJSON(w)
+}
+
+// RevertUser - changes the user with the given ID back to how it was at a revision (.../user/1/revisions/3/revert).
+// Only admins can revert users. The revert is validated like any other update, and honours If-Match.
+// Writes the reverted user as json with its new ETag and a 200 status code, or a Problem - 400 for a bad ID or
+// revision number, 403 if the caller isn't an admin, 404 if there is no such user or revision,
+// 409 if the old username or email has been taken since, 412/428 for If-Match problems,
+// or 422 if the old revision isn't valid anymore
+func (h *Handler) RevertUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, val, err := h.GetUintFromVars(vars, "id")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid user ID given: %s", val))
+		return
+	}
+	number, val, err := h.GetUintFromVars(vars, "number")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid revision number given: %s", val))
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionRevert, user.User{}) {
+		return
+	}
+
+	target, err := h.users(r).GetUser(id)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+	version, ok := h.CheckIfMatch(w, r, target)
+	if !ok {
+		return
+	}
+
+	reverted, err := h.users(r).RevertUser(ActorContext(r), id, number, version)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.WriteUser(w, r, reverted)
+}
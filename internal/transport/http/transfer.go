@@ -0,0 +1,616 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// The formats users can be exported and imported in
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Content types for each format
+const (
+	CSVContentType    = "text/csv"
+	NDJSONContentType = "application/x-ndjson"
+)
+
+// ExportWriteTimeout - how long an export waits for the client to read the next chunk of users before giving up
+const ExportWriteTimeout = 30 * time.Second
+
+// ImportRowTimeout - how long an import waits for (and then spends on) each row before giving up
+const ImportRowTimeout = time.Minute
+
+// MaxImportLineSize - the longest line we'll read from an NDJSON import, in bytes
+const MaxImportLineSize = 1 << 16
+
+// exportFlushRows - how many users an export writes between flushes
+const exportFlushRows = 500
+
+// exportColumn - a column an export can have, and how to get it from a user
+type exportColumn struct {
+	Name  string
+	Value func(u user.UserResponse) interface{}
+}
+
+// exportColumns - every column an export can have, in the order they're written by default.
+// These are the same names (and values) a user has in json
+var exportColumns = []exportColumn{
+	{"ID", func(u user.UserResponse) interface{} { return u.ID }},
+	{"CreatedAt", func(u user.UserResponse) interface{} { return u.CreatedAt }},
+	{"UpdatedAt", func(u user.UserResponse) interface{} { return u.UpdatedAt }},
+	{"Username", func(u user.UserResponse) interface{} { return u.Username }},
+	{"FirstName", func(u user.UserResponse) interface{} { return u.FirstName }},
+	{"LastName", func(u user.UserResponse) interface{} { return u.LastName }},
+	{"Email", func(u user.UserResponse) interface{} { return u.Email }},
+	{"Telephone", func(u user.UserResponse) interface{} { return u.Telephone }},
+	{"Role", func(u user.UserResponse) interface{} { return u.Role }},
+	{"Version", func(u user.UserResponse) interface{} { return u.Version }},
+}
+
+// importColumns - the columns an import sets on each user
+var importColumns = []string{"Username", "Password", "FirstName", "LastName", "Email", "Telephone", "Role"}
+
+// ignoredImportColumns - columns an export has that an import can't set, and just skips,
+// so an export can be imported again as it is
+var ignoredImportColumns = []string{"ID", "CreatedAt", "UpdatedAt", "Version", "DeletedAt"}
+
+// ExportUsers - streams every user as CSV or NDJSON (.../user/export?format=csv), for spreadsheets and migrations.
+// Takes the same filters and sort as GetAllUsers, but isn't paged - users are streamed out of the database as
+// they're written, so any number of them can be exported. Pick the columns with columns (ie columns=ID,Email),
+// otherwise every column is written. CSV starts with a header row of the column names.
+// Only callers allowed to list users can export them. Writes a Problem before the export starts - 400 for a bad
+// format, columns or filters, or any paging options, or 403 if the caller can't list users
+func (h *Handler) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	if !h.Authorize(w, r, auth.ActionList, user.User{}) {
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = FormatCSV
+	}
+	if format != FormatCSV && format != FormatNDJSON {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("format must be %s or %s", FormatCSV, FormatNDJSON))
+		return
+	}
+	for _, paging := range []string{"limit", "offset", "cursor"} {
+		if query.Get(paging) != "" {
+			h.WriteProblem(w, r, http.StatusBadRequest, "Exports aren't paged - leave out limit, offset and cursor")
+			return
+		}
+	}
+	columns, err := parseExportColumns(query.Get("columns"))
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts, err := ParseListOptions(query)
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid list options: %s", err))
+		return
+	}
+
+	var out exportWriter
+	if format == FormatCSV {
+		out = &csvExportWriter{w: csv.NewWriter(w), columns: columns}
+	} else {
+		out = &ndjsonExportWriter{w: w, columns: columns}
+	}
+	flusher, _ := w.(http.Flusher)
+
+	// Nothing is written until the first user is, so a problem fetching them can still be reported as one
+	rows := 0
+	start := func() error {
+		w.Header().Set("Content-Type", out.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+		w.WriteHeader(http.StatusOK)
+		extendWriteDeadline(r, ExportWriteTimeout)
+		return out.Start()
+	}
+	err = h.users(r).ExportUsers(opts, func(u user.User) error {
+		if rows == 0 {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := out.Write(u.ToResponse()); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			extendWriteDeadline(r, ExportWriteTimeout)
+		}
+		return nil
+	})
+	if err != nil && rows == 0 {
+		h.WriteError(w, r, err)
+		return
+	}
+	if err != nil {
+		// Too late for a problem - cut the response off, so the client can tell the export is incomplete
+		fmt.Printf("Export %s failed after %d users: %s\n", RequestIDFromContext(r.Context()), rows, err)
+		panic(http.ErrAbortHandler)
+	}
+	if rows == 0 {
+		if err := start(); err != nil {
+			return
+		}
+	}
+	out.Flush()
+}
+
+// parseExportColumns - the columns to export, from a comma separated list of column names (ignoring case).
+// Every column if the list is empty
+func parseExportColumns(value string) ([]exportColumn, error) {
+	if value == "" {
+		return exportColumns, nil
+	}
+	var columns []exportColumn
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, column := range exportColumns {
+			if strings.EqualFold(column.Name, name) {
+				columns = append(columns, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			names := make([]string, 0, len(exportColumns))
+			for _, column := range exportColumns {
+				names = append(names, column.Name)
+			}
+			return nil, fmt.Errorf("Unknown column %q - columns can be any of %s", name, strings.Join(names, ", "))
+		}
+	}
+	return columns, nil
+}
+
+// exportWriter - writes exported users in one of the formats
+type exportWriter interface {
+	ContentType() string
+	// Start - writes anything that comes before the first user, ie a header row
+	Start() error
+	Write(u user.UserResponse) error
+	// Flush - writes out anything buffered
+	Flush() error
+}
+
+// csvFormulaPrefixes - what a cell a spreadsheet would run as a formula starts with
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// escapeCSVCell - stops a spreadsheet running the cell as a formula (ie a FirstName of =HYPERLINK(...)),
+// by putting a ' in front of it if it starts like one. unescapeCSVCell takes it back off
+func escapeCSVCell(cell string) string {
+	if cell != "" && strings.ContainsRune(csvFormulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// unescapeCSVCell - a cell as it was before escapeCSVCell, so an export can be imported back in as it is
+func unescapeCSVCell(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// csvExportWriter - writes users as CSV rows, after a header row of the column names.
+// Times are written in RFC 3339, and cells that would be run as formulas are escaped (see escapeCSVCell)
+type csvExportWriter struct {
+	w       *csv.Writer
+	columns []exportColumn
+}
+
+// ContentType - the content type of a CSV export
+func (c *csvExportWriter) ContentType() string {
+	return CSVContentType + "; charset=utf-8"
+}
+
+// Start - writes the header row
+func (c *csvExportWriter) Start() error {
+	names := make([]string, 0, len(c.columns))
+	for _, column := range c.columns {
+		names = append(names, column.Name)
+	}
+	return c.w.Write(names)
+}
+
+// Write - writes a users row
+func (c *csvExportWriter) Write(u user.UserResponse) error {
+	record := make([]string, 0, len(c.columns))
+	for _, column := range c.columns {
+		switch v := column.Value(u).(type) {
+		case time.Time:
+			record = append(record, v.UTC().Format(time.RFC3339Nano))
+		default:
+			record = append(record, escapeCSVCell(fmt.Sprint(v)))
+		}
+	}
+	return c.w.Write(record)
+}
+
+// Flush - writes out the buffered rows
+func (c *csvExportWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ndjsonExportWriter - writes users as one json object per line, with only the selected columns, in order
+type ndjsonExportWriter struct {
+	w       io.Writer
+	columns []exportColumn
+}
+
+// ContentType - the content type of an NDJSON export
+func (n *ndjsonExportWriter) ContentType() string {
+	return NDJSONContentType
+}
+
+// Start - NDJSON has nothing before the first user
+func (n *ndjsonExportWriter) Start() error {
+	return nil
+}
+
+// Write - writes a users line. The object is built by hand so the columns keep their order
+func (n *ndjsonExportWriter) Write(u user.UserResponse) error {
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for i, column := range n.columns {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+		name, _ := json.Marshal(column.Name)
+		value, err := json.Marshal(column.Value(u))
+		if err != nil {
+			return err
+		}
+		line.Write(name)
+		line.WriteByte(':')
+		line.Write(value)
+	}
+	line.WriteString("}\n")
+	_, err := n.w.Write(line.Bytes())
+	return err
+}
+
+// Flush - lines are written straight through, so there is nothing to flush
+func (n *ndjsonExportWriter) Flush() error {
+	return nil
+}
+
+// ImportResponse - the report for an import, with a result for every row
+type ImportResponse struct {
+	DryRun    bool
+	Created   int
+	Updated   int
+	Unchanged int
+	Failed    int
+	Rows      []ImportRowResult
+}
+
+// ImportRowResult - how importing one row went. Row is where it is in the file - for CSV the rows are counted
+// from 1 not counting the header, and for NDJSON it's the line number (blank lines included).
+// Action is what importing it did (or would have done, for a dry run), and ID is the user it was matched to or
+// created as. Status is the status it would have had as a request of its own, and on failure Code is the kind of
+// problem (ie validation) and Error is the problem itself, listing every invalid field
+type ImportRowResult struct {
+	Row      int
+	Status   int
+	Action   user.ImportAction `json:",omitempty"`
+	ID       uint              `json:",omitempty"`
+	Username string            `json:",omitempty"`
+	Code     string            `json:",omitempty"`
+	Error    *Problem          `json:",omitempty"`
+}
+
+// ImportUsers - creates or updates users from a CSV or NDJSON file in the body (.../user/import?format=csv),
+// for migrating customers in. Only admins can import. The format comes from format, or the Content-Type.
+// CSV needs a header row naming its columns - any of Username, Password, FirstName, LastName, Email, Telephone
+// and Role, ignoring case. NDJSON lines are objects with the same fields. The read-only columns an export has
+// are skipped, so an export can be imported again as it is.
+// Each row updates the user with the same username or email, or creates a new one - see user.Service.ImportUser.
+// Rows are imported one at a time, so a row that fails doesn't stop the rest. With dry_run=true every row is
+// checked and reported, but nothing is changed. With hashed_passwords=true passwords must be bcrypt hashes,
+// and are stored as they are.
+// Writes an ImportResponse with a 200 status code if every row was imported, or 207 if any failed. Writes a Problem
+// instead if the import can't be read at all - 400 for a bad option, CSV header or read, 403 if the caller isn't
+// an admin, or 415 if the format is unknown
+func (h *Handler) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	if !h.Authorize(w, r, auth.ActionImport, user.User{}) {
+		return
+	}
+
+	query := r.URL.Query()
+	var opts user.ImportOptions
+	var err error
+	if v := query.Get("dry_run"); v != "" {
+		if opts.DryRun, err = strconv.ParseBool(v); err != nil {
+			h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("dry_run must be true or false: %s", v))
+			return
+		}
+	}
+	if v := query.Get("hashed_passwords"); v != "" {
+		if opts.HashedPasswords, err = strconv.ParseBool(v); err != nil {
+			h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("hashed_passwords must be true or false: %s", v))
+			return
+		}
+	}
+
+	extendReadDeadline(r, ImportRowTimeout)
+	var in importReader
+	switch importFormat(r) {
+	case FormatCSV:
+		in, err = newCSVImportReader(r.Body)
+		if err != nil {
+			h.WriteProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	case FormatNDJSON:
+		in = newNDJSONImportReader(r.Body)
+	default:
+		h.WriteProblem(w, r, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("Imports must be %s (%s) or %s (%s)", FormatCSV, CSVContentType, FormatNDJSON, NDJSONContentType))
+		return
+	}
+
+	resp := ImportResponse{DryRun: opts.DryRun, Rows: []ImportRowResult{}}
+	for {
+		extendReadDeadline(r, ImportRowTimeout)
+		u, err := in.Next()
+		if err == io.EOF {
+			break
+		}
+		var rowErr *importRowError
+		if err != nil && !errors.As(err, &rowErr) {
+			h.WriteProblem(w, r, http.StatusBadRequest,
+				fmt.Sprintf("Failed to read row %d of the import - the rows before it were imported", in.Row()))
+			return
+		}
+
+		result := ImportRowResult{Row: in.Row(), Status: http.StatusOK, Username: u.Username}
+		if err == nil {
+			var imported user.User
+			result.Action, imported, err = h.users(r).ImportUser(ActorContext(r), u, opts)
+			result.ID = imported.ID
+		}
+		if err != nil {
+			problem := ErrorProblem(r, err)
+			result.Action = ""
+			result.Status = problem.Status
+			result.Code = strings.TrimPrefix(problem.Type, "/problems/")
+			result.Error = &problem
+			resp.Failed++
+		}
+		switch result.Action {
+		case user.ImportCreated:
+			resp.Created++
+		case user.ImportUpdated:
+			resp.Updated++
+		case user.ImportUnchanged:
+			resp.Unchanged++
+		}
+		resp.Rows = append(resp.Rows, result)
+	}
+
+	status := http.StatusOK
+	if resp.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	extendWriteDeadline(r, ExportWriteTimeout)
+	writeJSON(w, status, resp)
+}
+
+// importFormat - the format of an import, from the format query parameter or else the Content-Type.
+// Empty if it's neither of ours
+func importFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if format == FormatCSV || format == FormatNDJSON {
+			return format
+		}
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case CSVContentType:
+		return FormatCSV
+	case NDJSONContentType, "application/ndjson":
+		return FormatNDJSON
+	}
+	return ""
+}
+
+// importReader - reads the users in an import a row at a time
+type importReader interface {
+	// Next - the next row's user. Returns io.EOF after the last row, or an importRowError
+	// if just this row is bad and the rest can still be read
+	Next() (user.User, error)
+	// Row - where the row Next last read is in the file, see ImportRowResult
+	Row() int
+}
+
+// importRowError - a row of an import that couldn't be parsed. It's reported as a bad request for that row
+type importRowError struct {
+	Message string
+}
+
+// Error - the message
+func (e *importRowError) Error() string {
+	return e.Message
+}
+
+// Unwrap - a bad row is a bad request
+func (e *importRowError) Unwrap() error {
+	return &user.Error{Kind: user.KindBadRequest, Message: e.Message}
+}
+
+// csvImportReader - reads users from CSV, using the header row to find each column
+type csvImportReader struct {
+	r *csv.Reader
+	// fields - the import column each CSV column sets, or "" for columns that are skipped
+	fields []string
+	row    int
+}
+
+// newCSVImportReader - reads the header row, and returns a reader for the rows after it.
+// Errors if the header is missing, or names a column we don't know
+func newCSVImportReader(body io.Reader) (*csvImportReader, error) {
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.New("Failed to read the CSV header row")
+	}
+
+	c := &csvImportReader{r: r, fields: make([]string, len(header))}
+	var unknown []string
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if matched := matchColumn(importColumns, name); matched != "" {
+			c.fields[i] = matched
+		} else if matchColumn(ignoredImportColumns, name) == "" {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("Unknown CSV columns %s - columns can be any of %s",
+			strings.Join(unknown, ", "), strings.Join(importColumns, ", "))
+	}
+	return c, nil
+}
+
+// matchColumn - the column in columns with the given name, ignoring case. Empty if there isn't one
+func matchColumn(columns []string, name string) string {
+	for _, column := range columns {
+		if strings.EqualFold(column, name) {
+			return column
+		}
+	}
+	return ""
+}
+
+// Next - reads the next row
+func (c *csvImportReader) Next() (user.User, error) {
+	record, err := c.r.Read()
+	if err == io.EOF {
+		return user.User{}, io.EOF
+	}
+	c.row++
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return user.User{}, &importRowError{Message: fmt.Sprintf("Failed to parse the CSV row: %s", parseErr.Err)}
+	}
+	if err != nil {
+		return user.User{}, err
+	}
+	if len(record) != len(c.fields) {
+		return user.User{}, &importRowError{
+			Message: fmt.Sprintf("Row has %d columns, but the header has %d", len(record), len(c.fields)),
+		}
+	}
+
+	var req user.CreateUserRequest
+	for i, value := range record {
+		value = unescapeCSVCell(value)
+		switch c.fields[i] {
+		case "Username":
+			req.Username = value
+		case "Password":
+			req.Password = value
+		case "FirstName":
+			req.FirstName = value
+		case "LastName":
+			req.LastName = value
+		case "Email":
+			req.Email = value
+		case "Telephone":
+			req.Telephone = value
+		case "Role":
+			req.Role = user.Role(value)
+		}
+	}
+	return req.ToUser(), nil
+}
+
+// Row - the rows read so far, not counting the header
+func (c *csvImportReader) Row() int {
+	return c.row
+}
+
+// ndjsonRecord - a line of an NDJSON import. The read-only fields an export has are allowed, but ignored
+type ndjsonRecord struct {
+	user.CreateUserRequest
+	ID        json.RawMessage
+	CreatedAt json.RawMessage
+	UpdatedAt json.RawMessage
+	Version   json.RawMessage
+	DeletedAt json.RawMessage
+}
+
+// ndjsonImportReader - reads users from NDJSON, one object per line. Blank lines are skipped
+type ndjsonImportReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// newNDJSONImportReader - returns a reader for the lines of body
+func newNDJSONImportReader(body io.Reader) *ndjsonImportReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 4096), MaxImportLineSize)
+	return &ndjsonImportReader{scanner: scanner}
+}
+
+// Next - reads the next line. Fields we don't know make the line bad, so typos don't go unnoticed
+func (n *ndjsonImportReader) Next() (user.User, error) {
+	for n.scanner.Scan() {
+		n.line++
+		line := bytes.TrimSpace(n.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record ndjsonRecord
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			return user.User{}, &importRowError{Message: fmt.Sprintf("Failed to decode the line: %s", err)}
+		}
+		return record.ToUser(), nil
+	}
+	if err := n.scanner.Err(); err != nil {
+		// The line that couldn't be read is the one after the last line scanned
+		n.line++
+		return user.User{}, err
+	}
+	return user.User{}, io.EOF
+}
+
+// Row - the line number of the line last read
+func (n *ndjsonImportReader) Row() int {
+	return n.line
+}
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/aebranton/rest-api/internal/webhook"
+	"github.com/gorilla/mux"
+)
+
+// CreateWebhook - subscribes a URL to user events, from a JSON body with the URL, the Events wanted
+// (every event if left out) and optionally the Secret to sign deliveries with (one is generated if left out).
+// Only admins can manage webhooks. Writes the new subscription as json, including its Secret (the only time
+// it is shown), and a 200 status code, or a Problem - 400 if the body can't be decoded, 403 if the caller
+// isn't an admin, or 422 if the subscription isn't valid
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !h.Authorize(w, r, auth.ActionManageWebhooks, user.User{}) {
+		return
+	}
+
+	var req webhook.SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, "Failed to decode webhook from requests JSON")
+		return
+	}
+
+	sub, err := h.Webhooks.Subscribe(req)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		webhook.SubscriptionResponse
+		Secret string
+	}{sub.ToResponse(), sub.Secret})
+}
+
+// GetWebhooks - lists every webhook subscription, oldest first, without their secrets.
+// Only admins can manage webhooks. Writes the subscriptions as json and a 200 status code,
+// or a 403 Problem if the caller isn't an admin
+func (h *Handler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !h.Authorize(w, r, auth.ActionManageWebhooks, user.User{}) {
+		return
+	}
+
+	subs, err := h.Webhooks.ListSubscriptions()
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	responses := make([]webhook.SubscriptionResponse, len(subs))
+	for i := range subs {
+		responses[i] = subs[i].ToResponse()
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+// DeleteWebhook - unsubscribes a webhook by ID (.../webhooks/1), dropping any deliveries still on their way to it.
+// Only admins can manage webhooks. Writes a success message and a 200 status code, or a Problem - 400 for a bad ID,
+// 403 if the caller isn't an admin, or 404 if there is no such webhook
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, val, err := h.GetUintFromVars(vars, "id")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid webhook ID given: %s", val))
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionManageWebhooks, user.User{}) {
+		return
+	}
+
+	if err := h.Webhooks.Unsubscribe(id); err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	h.WriteResponseMessage(w, http.StatusOK, fmt.Sprintf("Success deleting webhook: %d", id))
+}
+
+// GetDeadLetters - lists every webhook delivery that ran out of attempts, oldest first, along with how its
+// last attempt went. Only admins can manage webhooks. Writes the deliveries as json and a 200 status code,
+// or a 403 Problem if the caller isn't an admin
+func (h *Handler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !h.Authorize(w, r, auth.ActionManageWebhooks, user.User{}) {
+		return
+	}
+
+	dead, err := h.Webhooks.ListDeadLetters()
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	responses := make([]webhook.DeliveryResponse, len(dead))
+	for i := range dead {
+		responses[i] = dead[i].ToResponse()
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+// RedeliverWebhook - sends a webhook delivery again with a fresh set of attempts (.../webhooks/deliveries/1/redeliver),
+// ie once a dead-lettered subscriber has been fixed. Only admins can manage webhooks. Writes the delivery (now pending)
+// as json and a 202 status code, or a Problem - 400 for a bad ID, 403 if the caller isn't an admin,
+// or 404 if there is no such delivery
+func (h *Handler) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, val, err := h.GetUintFromVars(vars, "id")
+	if err != nil {
+		h.WriteProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid delivery ID given: %s", val))
+		return
+	}
+
+	if !h.Authorize(w, r, auth.ActionManageWebhooks, user.User{}) {
+		return
+	}
+
+	d, err := h.Webhooks.Redeliver(id)
+	if err != nil {
+		h.WriteError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, d.ToResponse())
+}
+
+// writeJSON - writes v as json with the given status.
+// Panics if anything goes wrong encoding it to json.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
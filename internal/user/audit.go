@@ -0,0 +1,199 @@
+package user
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// AuditAction - the kind of change an audit entry records
+type AuditAction string
+
+// The changes we audit
+const (
+	AuditCreate  AuditAction = "create"
+	AuditUpdate  AuditAction = "update"
+	AuditDelete  AuditAction = "delete"
+	AuditRestore AuditAction = "restore"
+	AuditPurge   AuditAction = "purge"
+	AuditRevert  AuditAction = "revert"
+)
+
+// Redacted - what the audit log shows in place of a password (hash), so it only records that it changed
+const Redacted = "[REDACTED]"
+
+// Actor - who is making a change, and where from. Put on the context passed to the services methods
+// that change users with WithActor, and recorded with every change in the audit log.
+// UserID is 0 for anonymous callers (signing up) and for changes the api makes itself (ie EnsureAdmin)
+type Actor struct {
+	UserID    uint
+	RequestID string
+	IP        string
+}
+
+// actorKey - context key WithActor stores the actor under
+type actorKey struct{}
+
+// WithActor - returns a copy of ctx carrying the actor, for the audit log
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext - returns the actor stored on ctx by WithActor, or an empty Actor if there isn't one
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// FieldChange - a single field changed by an audited action. Before is null for a new user,
+// After is null for a purged one, and passwords are only ever shown as Redacted
+type FieldChange struct {
+	Field  string
+	Before interface{}
+	After  interface{}
+}
+
+// FieldChanges - every field changed by an audited action, stored as json
+type FieldChanges []FieldChange
+
+// Value - stores the changes as json
+func (c FieldChanges) Value() (driver.Value, error) {
+	if c == nil {
+		c = FieldChanges{}
+	}
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+// Scan - reads the changes back from json
+func (c *FieldChanges) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*c = FieldChanges{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	}
+	return fmt.Errorf("can not scan %T into FieldChanges", src)
+}
+
+// AuditEntry - a record of one change made to a user - who made it (ActorID is null if nobody was logged in),
+// what they did to which user, which fields changed, and the request it came from.
+// Entries are append-only, and outlive the user they describe
+type AuditEntry struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	ActorID   *uint
+	Action    AuditAction
+	TargetID  uint
+	Changes   FieldChanges `gorm:"type:jsonb"`
+	RequestID string
+	IP        string
+}
+
+// AuditPage - a single page of a users audit log. NextCursor is empty when there are no more entries
+type AuditPage struct {
+	Entries    []AuditEntry
+	Total      int64
+	Limit      int
+	Offset     int
+	NextCursor string
+}
+
+// auditPage - trims the extra entry a store fetched off the end of entries, and builds the AuditPage with the cursor for the next one
+func (o *HistoryOptions) auditPage(entries []AuditEntry, total int64) AuditPage {
+	page := AuditPage{
+		Total:  total,
+		Limit:  o.Limit,
+		Offset: o.Offset,
+	}
+	if len(entries) > o.Limit {
+		entries = entries[:o.Limit]
+		page.NextCursor = o.nextCursor(entries[len(entries)-1].ID)
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	page.Entries = entries
+	return page
+}
+
+// auditedFields - the user fields the audit log tracks, in the order their changes are listed
+var auditedFields = []string{"Username", "Password", "FirstName", "LastName", "Email", "Telephone", "Role", "Version", "DeletedAt"}
+
+// auditValues - the audited fields of a user, keyed by field name. A nil user (one that doesn't exist) has none
+func auditValues(u *User) map[string]interface{} {
+	if u == nil {
+		return map[string]interface{}{}
+	}
+	values := map[string]interface{}{
+		"Username":  u.Username,
+		"Password":  u.Password,
+		"FirstName": u.FirstName,
+		"LastName":  u.LastName,
+		"Email":     u.Email,
+		"Telephone": u.Telephone,
+		"Role":      string(u.Role),
+		"Version":   u.Version,
+	}
+	if u.DeletedAt != nil {
+		values["DeletedAt"] = u.DeletedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return values
+}
+
+// diffUsers - every audited field that differs between before and after. before is nil for a new user
+// and after is nil for a purged one. Passwords are compared, but only ever recorded as Redacted
+func diffUsers(before, after *User) FieldChanges {
+	beforeValues, afterValues := auditValues(before), auditValues(after)
+	changes := FieldChanges{}
+	for _, field := range auditedFields {
+		b, a := beforeValues[field], afterValues[field]
+		if b == a {
+			continue
+		}
+		if field == "Password" {
+			if b != nil {
+				b = Redacted
+			}
+			if a != nil {
+				a = Redacted
+			}
+		}
+		changes = append(changes, FieldChange{Field: field, Before: b, After: a})
+	}
+	return changes
+}
+
+// audit - records a change to a user in the audit log through tx, so it is only kept if the change is.
+// The actor comes from ctx
+func audit(ctx context.Context, tx Store, action AuditAction, targetID uint, before, after *User) error {
+	actor := ActorFromContext(ctx)
+	entry := AuditEntry{
+		Action:    action,
+		TargetID:  targetID,
+		Changes:   diffUsers(before, after),
+		RequestID: actor.RequestID,
+		IP:        actor.IP,
+	}
+	if actor.UserID != 0 {
+		entry.ActorID = &actor.UserID
+	}
+	return tx.AddAudit(&entry)
+}
+
+// ToJSON - writes an AuditPage as json to the given responseWriter with a header status of Ok
+func (p *AuditPage) ToJSON(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
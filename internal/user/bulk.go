@@ -0,0 +1,192 @@
+package user
+
+import (
+	"context"
+	"time"
+)
+
+// BulkWriteTimeout - how long a batch gets to write its response in, since hashing every new password takes a while.
+// It's the longest any request runs for, so anything that waits on requests (ie idempotency leases) has to outlast it
+const BulkWriteTimeout = 5 * time.Minute
+
+// BulkOp - what a bulk operation does to its user
+type BulkOp string
+
+// The operations a batch can be made of
+const (
+	BulkCreate BulkOp = "create"
+	BulkUpdate BulkOp = "update"
+	BulkDelete BulkOp = "delete"
+)
+
+// BulkMode - how a batch of operations is applied
+type BulkMode string
+
+// The ways a batch can be applied. BulkAtomic runs the whole batch in one transaction, so if any operation fails
+// nothing is changed. BulkBestEffort runs every operation in its own transaction, so the ones that can be made are
+const (
+	BulkAtomic     BulkMode = "atomic"
+	BulkBestEffort BulkMode = "best_effort"
+)
+
+// IsValid - returns true if the mode is one we know how to apply
+func (m BulkMode) IsValid() bool {
+	return m == BulkAtomic || m == BulkBestEffort
+}
+
+// ErrAborted - the error for operations that weren't made (or were rolled back) since another operation
+// in the same atomic batch failed
+var ErrAborted = &Error{Kind: KindAborted, Message: "Not changed, since another operation in the batch failed"}
+
+// BulkOperation - one change in a batch. User is the new user for BulkCreate, already validated but with its password
+// not hashed yet (Bulk hashes it), or the changes to make for BulkUpdate (like UpdateUser). ID and Version pick the user
+// for BulkUpdate and BulkDelete, with the same rules as UpdateUser and DeleteUser.
+// Err fails the operation before it is run - ie if the caller already found it isn't allowed
+type BulkOperation struct {
+	Op      BulkOp
+	ID      uint
+	Version uint
+	User    User
+	Err     error
+
+	// target - the user an update is made to, as read by prepareBulk
+	target User
+}
+
+// BulkResult - how one operation in a batch went. User is the user it created, updated or deleted,
+// or Err is why it failed
+type BulkResult struct {
+	User User
+	Err  error
+}
+
+// Bulk - makes a batch of creates, updates and deletes, each audited, revised and evented exactly like making
+// them one at a time, and returns a result for each operation in the same order.
+// Each operation is checked (and its password hashed) outside of any transaction, as CreateUser and UpdateUser do,
+// but only once it's about to be made - so a batch that fails doesn't pay for hashing passwords it never needed.
+// In BulkAtomic mode every operation is made in one transaction - if any of them fails it is the only result
+// with its own error, and every other result is ErrAborted. The batch stops at the first operation that fails,
+// so if several would have only the first is reported. In BulkBestEffort mode every operation is made in its own
+// transaction, and fails on its own
+func (s *Service) Bulk(ctx context.Context, ops []BulkOperation, mode BulkMode) []BulkResult {
+	results := make([]BulkResult, len(ops))
+
+	if mode == BulkBestEffort {
+		for i := range ops {
+			if err := s.prepareBulk(ctx, &ops[i]); err != nil {
+				results[i].Err = err
+				continue
+			}
+			op := ops[i]
+			err := s.Store.Transaction(func(tx Store) error {
+				var err error
+				results[i].User, err = applyBulk(ctx, tx, op)
+				return err
+			})
+			if err != nil {
+				results[i] = BulkResult{Err: err}
+			}
+		}
+		return results
+	}
+
+	// Operations the caller already failed cost nothing to report, so they're all reported before anything
+	// is prepared. Otherwise the batch is prepared in order, until an operation fails
+	failed := false
+	for i := range ops {
+		if ops[i].Err != nil {
+			results[i].Err = ops[i].Err
+			failed = true
+		}
+	}
+	for i := 0; i < len(ops) && !failed; i++ {
+		if err := s.prepareBulk(ctx, &ops[i]); err != nil {
+			results[i].Err = err
+			failed = true
+		}
+	}
+
+	if !failed {
+		err := s.Store.Transaction(func(tx Store) error {
+			for i, op := range ops {
+				user, err := applyBulk(ctx, tx, op)
+				if err != nil {
+					results[i].Err = err
+					return err
+				}
+				results[i].User = user
+			}
+			return nil
+		})
+		if err == nil {
+			return results
+		}
+		// Nothing was changed. If no operation failed, the transaction itself did (ie the commit)
+		if !failedAny(results) {
+			for i := range results {
+				results[i] = BulkResult{Err: err}
+			}
+			return results
+		}
+	}
+
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = BulkResult{Err: ErrAborted}
+		}
+	}
+	return results
+}
+
+// failedAny - returns true if any of the results is an error
+func failedAny(results []BulkResult) bool {
+	for _, result := range results {
+		if result.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareBulk - does everything for an operation that can be done before its transaction starts
+func (s *Service) prepareBulk(ctx context.Context, op *BulkOperation) error {
+	if op.Err != nil {
+		return op.Err
+	}
+	switch op.Op {
+	case BulkCreate:
+		hashed, err := HashPasswordContext(ctx, op.User.Password)
+		if err != nil {
+			return internalError(err)
+		}
+		op.User.Password = hashed
+		return nil
+	case BulkDelete:
+		return nil
+	case BulkUpdate:
+		target, changes, err := s.prepareUpdate(op.ID, op.User, op.Version)
+		if err != nil {
+			return err
+		}
+		op.target = target
+		op.User = changes
+		return nil
+	}
+	return &Error{Kind: KindBadRequest, Message: "Op must be one of create, update or delete"}
+}
+
+// applyBulk - makes a prepared operation through tx, and returns the user it was made to
+func applyBulk(ctx context.Context, tx Store, op BulkOperation) (User, error) {
+	switch op.Op {
+	case BulkCreate:
+		user := op.User
+		err := create(ctx, tx, &user)
+		return user, err
+	case BulkUpdate:
+		user := op.target
+		err := update(ctx, tx, AuditUpdate, &user, op.User)
+		return user, err
+	default:
+		return remove(ctx, tx, op.ID, op.Version)
+	}
+}
@@ -0,0 +1,114 @@
+package user
+
+import "time"
+
+// UserResponse - the public representation of a user, and the only thing we ever write back to a client.
+// The User model itself is never marshalled, so nothing we add to it later (ie the password hash)
+// can leak into a response by accident
+type UserResponse struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Username  string
+	FirstName string
+	LastName  string
+	Email     string
+	Telephone string
+	Role      Role
+	Version   uint
+	DeletedAt *time.Time `json:",omitempty"`
+}
+
+// UserPage - the public representation of a page of users from ListUsers
+type UserPage struct {
+	Users      []UserResponse
+	Total      int64
+	Limit      int
+	Offset     int
+	NextCursor string
+}
+
+// CreateUserRequest - the JSON body accepted when creating a user
+type CreateUserRequest struct {
+	Username  string
+	Password  string
+	FirstName string
+	LastName  string
+	Email     string
+	Telephone string
+	Role      Role
+}
+
+// UpdateUserRequest - the JSON body accepted when updating a user. Any field left empty is left unchanged
+type UpdateUserRequest struct {
+	Username  string
+	Password  string
+	FirstName string
+	LastName  string
+	Email     string
+	Telephone string
+	Role      Role
+}
+
+// ToResponse - converts a User into its public representation
+func (u *User) ToResponse() UserResponse {
+	return UserResponse{
+		ID:        u.ID,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+		Username:  u.Username,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Email:     u.Email,
+		Telephone: u.Telephone,
+		Role:      u.Role,
+		Version:   u.Version,
+		DeletedAt: u.DeletedAt,
+	}
+}
+
+// ToResponse - converts a slice of Users into their public representation
+func (u Users) ToResponse() []UserResponse {
+	responses := make([]UserResponse, 0, len(u))
+	for i := range u {
+		responses = append(responses, u[i].ToResponse())
+	}
+	return responses
+}
+
+// ToResponse - converts a Page into its public representation
+func (p *Page) ToResponse() UserPage {
+	return UserPage{
+		Users:      p.Users.ToResponse(),
+		Total:      p.Total,
+		Limit:      p.Limit,
+		Offset:     p.Offset,
+		NextCursor: p.NextCursor,
+	}
+}
+
+// ToUser - converts a create request into a User model. The password is still plain text at this point
+func (r CreateUserRequest) ToUser() User {
+	return User{
+		Username:  r.Username,
+		Password:  r.Password,
+		FirstName: r.FirstName,
+		LastName:  r.LastName,
+		Email:     r.Email,
+		Telephone: r.Telephone,
+		Role:      r.Role,
+	}
+}
+
+// ToUser - converts an update request into a partial User model. The password is still plain text at this point
+func (r UpdateUserRequest) ToUser() User {
+	return User{
+		Username:  r.Username,
+		Password:  r.Password,
+		FirstName: r.FirstName,
+		LastName:  r.LastName,
+		Email:     r.Email,
+		Telephone: r.Telephone,
+		Role:      r.Role,
+	}
+}
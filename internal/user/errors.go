@@ -0,0 +1,70 @@
+package user
+
+import "errors"
+
+// Kind - what sort of failure an error from the user service is. The transport layer decides how
+// to report an error (ie which HTTP status to use) from its Kind alone, see KindOf
+type Kind string
+
+// The kinds of error the user service returns
+const (
+	KindBadRequest   Kind = "bad-request"
+	KindNotFound     Kind = "not-found"
+	KindConflict     Kind = "conflict"
+	KindValidation   Kind = "validation"
+	KindUnauthorized Kind = "unauthorized"
+	KindPrecondition Kind = "precondition"
+	KindAborted      Kind = "aborted"
+	KindInternal     Kind = "internal"
+)
+
+// Error - an error from the user service, along with its Kind. Err is the underlying cause, if there is one
+// (ie the database error behind a KindInternal error), and is never meant to be shown to clients
+type Error struct {
+	Kind    Kind
+	Message string
+	Err     error
+}
+
+// Error - the message, followed by the underlying cause if there is one
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap - returns the underlying cause, so errors.Is and errors.As can see through an Error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors the user service returns. Compare against them with errors.Is
+var (
+	ErrNotFound           = &Error{Kind: KindNotFound, Message: "User not found"}
+	ErrDuplicate          = &Error{Kind: KindConflict, Message: "A user with that username or email already exists"}
+	ErrInvalidCredentials = &Error{Kind: KindUnauthorized, Message: "Invalid username or password"}
+	ErrVersionMismatch    = &Error{Kind: KindPrecondition, Message: "User has been changed since that version was read"}
+)
+
+// internalError - wraps an unexpected error (ie the database being down) as a KindInternal error
+func internalError(err error) error {
+	return &Error{Kind: KindInternal, Message: "Internal error", Err: err}
+}
+
+// KindOf - returns the Kind of err. ValidationErrors are KindValidation, and anything that isn't one of our
+// errors is KindInternal, since we didn't expect it. Returns an empty Kind for a nil error
+func KindOf(err error) Kind {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	var v ValidationErrors
+	if errors.As(err, &v) {
+		return KindValidation
+	}
+	return KindInternal
+}
@@ -0,0 +1,47 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// EventType - what happened to a user, named the way subscribers see it
+type EventType string
+
+// The events the user service publishes
+const (
+	EventUserCreated       EventType = "user.created"
+	EventUserUpdated       EventType = "user.updated"
+	EventUserDeleted       EventType = "user.deleted"
+	EventUserAuthenticated EventType = "user.authenticated"
+)
+
+// EventTypes - every event type, in the order they're documented
+var EventTypes = []EventType{EventUserCreated, EventUserUpdated, EventUserDeleted, EventUserAuthenticated}
+
+// Event - something that happened to a user, along with the user as it was right after.
+// ID is unique to the event, so receivers can tell a repeat delivery from a new event.
+// The service writes events to the outbox (see OutboxMessage), and the outbox relay publishes them
+type Event struct {
+	ID         string
+	Type       EventType
+	UserID     uint
+	OccurredAt time.Time
+	User       UserResponse
+}
+
+// NewEvent - builds an event of the given type for the user, with a new random ID
+func NewEvent(eventType EventType, u User) Event {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return Event{
+		ID:         hex.EncodeToString(b),
+		Type:       eventType,
+		UserID:     u.ID,
+		OccurredAt: time.Now().UTC(),
+		User:       u.ToResponse(),
+	}
+}
@@ -0,0 +1,253 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paging limits for ListUsers
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+// ErrInvalidCursor - returned when a cursor can't be decoded, or was issued for a different sort order
+var ErrInvalidCursor = &Error{Kind: KindValidation, Message: "Cursor is invalid or does not match the requested sort"}
+
+// sortColumns - the columns users can be sorted by, keyed by the name used in the query string.
+// Only indexed columns are allowed so sorting (and cursor paging) never needs a full table scan
+var sortColumns = map[string]string{
+	"id":         "id",
+	"username":   "username",
+	"email":      "email",
+	"created_at": "created_at",
+}
+
+// ListOptions - paging, sorting and filtering for ListUsers.
+// Either Offset or Cursor can be used to page through results, not both.
+// Sort is one of the keys in sortColumns, prefixed with a "-" for descending order (ie "-created_at")
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Cursor string
+	Sort   string
+
+	UsernameContains string
+	EmailContains    string
+	NameContains     string
+	CreatedAfter     *time.Time
+	CreatedBefore    *time.Time
+
+	// Deleted lists soft-deleted users instead of live ones
+	Deleted bool
+}
+
+// Page - a single page of users from ListUsers. NextCursor is empty when there are no more results
+type Page struct {
+	Users      Users
+	Total      int64
+	Limit      int
+	Offset     int
+	NextCursor string
+}
+
+// historyCursorSort - stands in for the sort in history cursors, so they can't be mixed up with user list cursors
+const historyCursorSort = "history"
+
+// HistoryOptions - paging for a users history (its audit log or revisions), which is always oldest first.
+// Either Offset or Cursor can be used to page through entries, not both
+type HistoryOptions struct {
+	Limit  int
+	Offset int
+	Cursor string
+}
+
+// cursor - what we pack into the opaque cursor string. It remembers the sort it was made for, and the
+// sort value and ID of the last user on the page, so the next page can carry on right after it
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    uint   `json:"i"`
+}
+
+// Validate - fills in defaults and checks the options make sense. Returns a KindValidation error describing the first problem found
+func (o *ListOptions) Validate() error {
+	if o.Limit == 0 {
+		o.Limit = DefaultListLimit
+	}
+	if o.Limit < 1 || o.Limit > MaxListLimit {
+		return invalidOptions(fmt.Sprintf("limit must be between 1 and %d", MaxListLimit))
+	}
+	if o.Offset < 0 {
+		return invalidOptions("offset can not be negative")
+	}
+	if o.Offset > 0 && o.Cursor != "" {
+		return invalidOptions("offset and cursor can not be used together")
+	}
+	if o.Sort == "" {
+		o.Sort = "id"
+	}
+	if _, ok := sortColumns[strings.TrimPrefix(o.Sort, "-")]; !ok {
+		return invalidOptions(fmt.Sprintf("can not sort by %s - must be one of id, username, email, created_at", o.Sort))
+	}
+	if o.CreatedAfter != nil && o.CreatedBefore != nil && !o.CreatedAfter.Before(*o.CreatedBefore) {
+		return invalidOptions("created_after must be before created_before")
+	}
+	if o.Cursor != "" {
+		if _, err := o.decodeCursor(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidOptions - a KindValidation error for list options that don't make sense
+func invalidOptions(msg string) error {
+	return &Error{Kind: KindValidation, Message: msg}
+}
+
+// column - the database column and direction for the requested sort
+func (o *ListOptions) column() (string, string) {
+	if strings.HasPrefix(o.Sort, "-") {
+		return sortColumns[o.Sort[1:]], "DESC"
+	}
+	return sortColumns[o.Sort], "ASC"
+}
+
+// orderBy - the ORDER BY clause for the requested sort. The ID breaks ties, so users with the same sort value
+// (ie created in the same instant) still have a stable order
+func (o *ListOptions) orderBy() string {
+	column, direction := o.column()
+	if column == "id" {
+		return fmt.Sprintf("id %s", direction)
+	}
+	return fmt.Sprintf("%s %s, id %s", column, direction, direction)
+}
+
+// decodeCursor - unpacks the cursor string, making sure it was made for the same sort
+func (o *ListOptions) decodeCursor() (cursor, error) {
+	var c cursor
+	raw, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	if c.Sort != o.Sort {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// cursorValue - converts the cursors string value back into something the database can compare against the sort column
+func (o *ListOptions) cursorValue(c cursor) (interface{}, error) {
+	column, _ := o.column()
+	switch column {
+	case "id":
+		id, err := strconv.ParseUint(c.Value, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return uint(id), nil
+	case "created_at":
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return t, nil
+	}
+	return c.Value, nil
+}
+
+// encodeCursor - builds the cursor pointing just past the given user
+func (o *ListOptions) encodeCursor(u User) string {
+	c := cursor{Sort: o.Sort, ID: u.ID}
+	column, _ := o.column()
+	switch column {
+	case "id":
+		c.Value = strconv.FormatUint(uint64(u.ID), 10)
+	case "username":
+		c.Value = u.Username
+	case "email":
+		c.Value = u.Email
+	case "created_at":
+		c.Value = u.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// page - trims the extra user List fetched off the end of users, and builds the Page with the cursor for the next one
+func (o *ListOptions) page(users Users, total int64) Page {
+	page := Page{
+		Total:  total,
+		Limit:  o.Limit,
+		Offset: o.Offset,
+	}
+	if len(users) > o.Limit {
+		users = users[:o.Limit]
+		page.NextCursor = o.encodeCursor(users[len(users)-1])
+	}
+	if users == nil {
+		users = Users{}
+	}
+	page.Users = users
+	return page
+}
+
+// Validate - fills in defaults and checks the options make sense, with the same limits as ListOptions.
+// Returns a KindValidation error describing the first problem found
+func (o *HistoryOptions) Validate() error {
+	if o.Limit == 0 {
+		o.Limit = DefaultListLimit
+	}
+	if o.Limit < 1 || o.Limit > MaxListLimit {
+		return invalidOptions(fmt.Sprintf("limit must be between 1 and %d", MaxListLimit))
+	}
+	if o.Offset < 0 {
+		return invalidOptions("offset can not be negative")
+	}
+	if o.Offset > 0 && o.Cursor != "" {
+		return invalidOptions("offset and cursor can not be used together")
+	}
+	if o.Cursor != "" {
+		if _, err := o.after(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// after - the ID of the last record on the previous page, from the cursor. 0 if there is no cursor
+func (o *HistoryOptions) after() (uint, error) {
+	if o.Cursor == "" {
+		return 0, nil
+	}
+	var c cursor
+	raw, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(raw, &c); err != nil || c.Sort != historyCursorSort {
+		return 0, ErrInvalidCursor
+	}
+	return c.ID, nil
+}
+
+// nextCursor - builds the cursor pointing just past the record with the given ID
+func (o *HistoryOptions) nextCursor(lastID uint) string {
+	raw, _ := json.Marshal(cursor{Sort: historyCursorSort, ID: lastID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// likeContains - escapes LIKE wildcards in user input and wraps it for a case-insensitive "contains" match
+func likeContains(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return "%" + strings.ToLower(s) + "%"
+}
@@ -0,0 +1,53 @@
+package user
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OutboxMessage - an event waiting to be published. Events are written to the outbox in the same transaction
+// as the change they describe, so an event is stored if and only if its change is - nothing is lost if we crash
+// before publishing it, and nothing is published for a change that was rolled back. The outbox relay then
+// publishes messages in ID order, and marks them published.
+// Changes to a user lock its row, so a users messages get their IDs in the order the changes were made
+type OutboxMessage struct {
+	ID            uint `gorm:"primary_key"`
+	CreatedAt     time.Time
+	EventID       string
+	EventType     EventType
+	UserID        uint
+	Payload       string `gorm:"type:jsonb"`
+	Attempts      int
+	NextAttemptAt *time.Time
+	LastError     string
+	PublishedAt   *time.Time
+}
+
+// TableName - the table gorm keeps the outbox in
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+// Event - the event the message carries
+func (m *OutboxMessage) Event() (Event, error) {
+	var event Event
+	if err := json.Unmarshal([]byte(m.Payload), &event); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+// emit - writes an event of the given type about the user to the outbox through tx, so it is only kept if the change is
+func emit(tx Store, eventType EventType, u User) error {
+	event := NewEvent(eventType, u)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return internalError(err)
+	}
+	return tx.AddOutbox(&OutboxMessage{
+		EventID:   event.ID,
+		EventType: event.Type,
+		UserID:    event.UserID,
+		Payload:   string(payload),
+	})
+}
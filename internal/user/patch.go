@@ -0,0 +1,153 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+// PatchType - the patch formats ApplyPatch understands, named by their media types
+type PatchType string
+
+// The patch formats we accept - JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+const (
+	MergePatch PatchType = "application/merge-patch+json"
+	JSONPatch  PatchType = "application/json-patch+json"
+)
+
+// Errors returned by ApplyPatch when the patch itself is the problem, rather than the user it produces
+var (
+	ErrInvalidPatch = &Error{Kind: KindBadRequest, Message: "Patch is not a valid patch document"}
+	ErrPatchTest    = &Error{Kind: KindConflict, Message: "A test operation in the patch failed"}
+)
+
+// readOnlyFields - fields a patch can see (and test) but not change
+var readOnlyFields = []string{"ID", "CreatedAt", "UpdatedAt", "Version", "DeletedAt"}
+
+// writableFields - fields a patch can change. Password isn't in the document being patched since it's
+// never shown, but it can be added to set a new one
+var writableFields = []string{"Username", "Password", "FirstName", "LastName", "Email", "Telephone", "Role"}
+
+// ApplyPatch - applies a patch to the users public representation (see UserResponse) and returns the changes
+// to pass on to UpdateUser. Unlike an UpdateUserRequest, a patch can tell a field that was left alone from one
+// that was set to null or removed - those are cleared, and so fail validation like they would on a new user.
+// The patched user is validated before anything is returned, and read-only or unknown fields can't be changed.
+// A new Password comes back as plain text, ready for UpdateUser to hash, or empty if it wasn't changed.
+//
+// Returns ErrInvalidPatch if the patch can't be parsed, ErrPatchTest if a JSON Patch test operation fails,
+// a KindValidation error if the patch doesn't apply (ie it replaces a path that doesn't exist),
+// or ValidationErrors if it produces an invalid user
+func ApplyPatch(u User, patchType PatchType, patch []byte) (User, error) {
+	original, err := json.Marshal(u.ToResponse())
+	if err != nil {
+		return User{}, internalError(err)
+	}
+
+	patched, err := applyPatch(original, patchType, patch)
+	if err != nil {
+		return User{}, err
+	}
+
+	var before, after map[string]json.RawMessage
+	if err := json.Unmarshal(original, &before); err != nil {
+		return User{}, internalError(err)
+	}
+	if err := json.Unmarshal(patched, &after); err != nil {
+		return User{}, &Error{Kind: KindValidation, Message: "Patch must leave the user as a JSON object"}
+	}
+
+	var errs ValidationErrors
+	for _, field := range readOnlyFields {
+		if !bytes.Equal(before[field], after[field]) {
+			errs = append(errs, FieldError{Field: field, Code: CodeReadOnly, Message: fmt.Sprintf("%s can not be changed", field)})
+		}
+		delete(after, field)
+	}
+
+	values := map[string]string{}
+	for _, field := range writableFields {
+		raw, ok := after[field]
+		delete(after, field)
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			errs = append(errs, FieldError{Field: field, Code: CodeInvalidFormat, Message: fmt.Sprintf("%s must be a string", field)})
+			continue
+		}
+		values[field] = value
+	}
+
+	unknown := make([]string, 0, len(after))
+	for field := range after {
+		unknown = append(unknown, field)
+	}
+	sort.Strings(unknown)
+	for _, field := range unknown {
+		errs = append(errs, FieldError{Field: field, Code: CodeUnknownField, Message: fmt.Sprintf("%s is not a field of a user", field)})
+	}
+	if len(errs) > 0 {
+		return User{}, errs
+	}
+
+	changes := User{
+		Username:  values["Username"],
+		Password:  values["Password"],
+		FirstName: values["FirstName"],
+		LastName:  values["LastName"],
+		Email:     values["Email"],
+		Telephone: values["Telephone"],
+		Role:      Role(values["Role"]),
+	}
+
+	// Validate the user exactly as the patch left it - the stored password hash stands in if the
+	// patch didn't set a new one, and an empty Role is an error here since the patch cleared it
+	result := changes
+	if result.Password == "" {
+		result.Password = u.Password
+	}
+	valid, errs := result.IsValid()
+	if result.Role == "" {
+		errs = append(errs, FieldError{Field: "Role", Code: CodeRequired, Message: "Role is required"})
+		valid = false
+	}
+	if !valid {
+		return User{}, errs
+	}
+	return changes, nil
+}
+
+// applyPatch - applies a patch of the given type to a JSON document
+func applyPatch(doc []byte, patchType PatchType, patch []byte) ([]byte, error) {
+	switch patchType {
+	case MergePatch:
+		if !json.Valid(patch) {
+			return nil, ErrInvalidPatch
+		}
+		patched, err := jsonpatch.MergePatch(doc, patch)
+		if err != nil {
+			return nil, ErrInvalidPatch
+		}
+		return patched, nil
+
+	case JSONPatch:
+		ops, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, ErrInvalidPatch
+		}
+		patched, err := ops.Apply(doc)
+		if errors.Is(err, jsonpatch.ErrTestFailed) {
+			return nil, ErrPatchTest
+		}
+		if err != nil {
+			return nil, &Error{Kind: KindValidation, Message: fmt.Sprintf("Patch could not be applied: %s", err)}
+		}
+		return patched, nil
+	}
+	return nil, &Error{Kind: KindBadRequest, Message: fmt.Sprintf("Unsupported patch type %s", patchType)}
+}
@@ -0,0 +1,52 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// PurgeExpired - permanently removes every user that was soft-deleted more than retention ago,
+// and returns how many were removed. Each purge is audited, with the Actor on ctx (if any)
+func (s *Service) PurgeExpired(ctx context.Context, retention time.Duration) (int64, error) {
+	var purged Users
+	err := s.Store.Transaction(func(tx Store) error {
+		var err error
+		if purged, err = tx.PurgeDeletedBefore(time.Now().Add(-retention)); err != nil {
+			return err
+		}
+		for i := range purged {
+			if err := audit(ctx, tx, AuditPurge, purged[i].ID, &purged[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(purged)), nil
+}
+
+// RunRetention - purges users that have been deleted for longer than retention, once straight away and then
+// every interval, until ctx is cancelled. Meant to be run in its own goroutine. A failed purge is logged and
+// tried again next interval, since the users will still be there
+func (s *Service) RunRetention(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.PurgeExpired(ctx, retention)
+		if err != nil {
+			fmt.Printf("Failed to purge users deleted more than %s ago: %s\n", retention, err)
+		} else if purged > 0 {
+			fmt.Printf("Purged %d user(s) deleted more than %s ago\n", purged, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package user
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrRevisionNotFound - returned when a user has no revision with the requested number
+var ErrRevisionNotFound = &Error{Kind: KindNotFound, Message: "Revision not found"}
+
+// Snapshot - a users public representation, frozen in a revision and stored as json.
+// Like every response, it never includes the password
+type Snapshot UserResponse
+
+// Value - stores the snapshot as json
+func (s Snapshot) Value() (driver.Value, error) {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+// Scan - reads the snapshot back from json
+func (s *Snapshot) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return fmt.Errorf("can not scan %T into Snapshot", src)
+}
+
+// Revision - an immutable snapshot of a user, taken every time it is created, updated, deleted or restored.
+// Number is the users Version at the time, so a users revisions count up from 1 (for users created
+// after revisions were added) and revision N is what the user looked like at version N
+type Revision struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UserID    uint
+	Number    uint
+	Snapshot  Snapshot `gorm:"type:jsonb"`
+}
+
+// RevisionPage - a single page of a users revisions. NextCursor is empty when there are no more revisions
+type RevisionPage struct {
+	Revisions  []Revision
+	Total      int64
+	Limit      int
+	Offset     int
+	NextCursor string
+}
+
+// User - the user as it was at this revision. Revisions don't keep passwords, so the Password is always empty
+func (r Revision) User() User {
+	s := r.Snapshot
+	u := User{
+		Username:  s.Username,
+		FirstName: s.FirstName,
+		LastName:  s.LastName,
+		Email:     s.Email,
+		Telephone: s.Telephone,
+		Role:      s.Role,
+		Version:   s.Version,
+	}
+	u.ID, u.CreatedAt, u.UpdatedAt, u.DeletedAt = s.ID, s.CreatedAt, s.UpdatedAt, s.DeletedAt
+	return u
+}
+
+// ToJSON - writes a RevisionPage as json to the given responseWriter with a header status of Ok
+func (p *RevisionPage) ToJSON(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
+
+// revisionPage - trims the extra revision a store fetched off the end of revisions, and builds the RevisionPage
+// with the cursor for the next one
+func (o *HistoryOptions) revisionPage(revisions []Revision, total int64) RevisionPage {
+	page := RevisionPage{
+		Total:  total,
+		Limit:  o.Limit,
+		Offset: o.Offset,
+	}
+	if len(revisions) > o.Limit {
+		revisions = revisions[:o.Limit]
+		page.NextCursor = o.nextCursor(revisions[len(revisions)-1].ID)
+	}
+	if revisions == nil {
+		revisions = []Revision{}
+	}
+	page.Revisions = revisions
+	return page
+}
+
+// revise - records a revision of the user as it is now through tx, so it is only kept if the change is
+func revise(tx Store, u User) error {
+	revision := Revision{
+		UserID:   u.ID,
+		Number:   u.Version,
+		Snapshot: Snapshot(u.ToResponse()),
+	}
+	return tx.AddRevision(&revision)
+}
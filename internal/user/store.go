@@ -0,0 +1,83 @@
+package user
+
+import (
+	"context"
+	"time"
+)
+
+// Store - the storage the user service sits on top of. GormStore keeps users in postgres,
+// MemoryStore keeps them in a map so the whole api can run in-process (ie in tests).
+//
+// Both stores soft-delete: deleted users are hidden from every method except the *Deleted ones, Restore and
+// Purge, and their usernames and emails are free to be used again. Usernames and emails are unique among
+// live users regardless of case. Create runs the User's BeforeCreate hook, so invalid users are never stored.
+// Stores return ErrNotFound and ErrDuplicate rather than their own errors, so the service doesn't have to
+// care where users are kept.
+//
+// Stores also keep the append-only audit log and every users revisions. The service records every change it
+// makes with AddAudit (and AddRevision) inside a Transaction along with the change itself, so neither is ever
+// kept without the other
+type Store interface {
+	GetByID(ID uint) (User, error)
+	// GetByUsername and GetByEmail - exact matches, ignoring case
+	GetByUsername(username string) (User, error)
+	GetByEmail(email string) (User, error)
+	Create(user *User) error
+	// Update - applies every non-zero field of changes to the stored user, bumps its version and updates
+	// user to match. Returns ErrVersionMismatch if the stored user is no longer at user.Version
+	Update(user *User, changes User) error
+	// Delete - soft deletes a user and bumps its version. Unless version is AnyVersion, returns ErrVersionMismatch
+	// if the stored user is no longer at that version
+	Delete(ID uint, version uint) error
+	All() (Users, error)
+	// List - returns a page of users (or of deleted users, if opts.Deleted is set). opts must already be validated
+	List(opts ListOptions) (Page, error)
+	// Each - calls fn with every user List would return across all of its pages, in the same order, without
+	// holding them all in memory at once. Paging options are ignored. Stops at (and returns) the first error from fn
+	Each(opts ListOptions, fn func(User) error) error
+
+	// GetDeletedByID - retreives a soft-deleted user by ID
+	GetDeletedByID(ID uint) (User, error)
+	// Restore - undeletes a soft-deleted user and bumps its version. Returns ErrDuplicate if a live user
+	// has taken its username or email in the meantime
+	Restore(ID uint) error
+	// Purge - permanently removes a soft-deleted user, along with its revisions
+	Purge(ID uint) error
+	// PurgeDeletedBefore - permanently removes every user deleted before the given time (and their revisions), and returns them
+	PurgeDeletedBefore(before time.Time) (Users, error)
+
+	// Transaction - runs fn with a Store where every change made through it is kept if fn returns nil,
+	// or none are if it returns an error (which Transaction then returns)
+	Transaction(fn func(tx Store) error) error
+	// WithContext - the store, with every query made through it traced as part of the request on ctx
+	WithContext(ctx context.Context) Store
+	// AddAudit - appends an entry to the audit log, giving it an ID and timestamp
+	AddAudit(entry *AuditEntry) error
+	// ListAudit - returns a page of the audit log for a single user, oldest first. opts must already be validated
+	ListAudit(targetID uint, opts HistoryOptions) (AuditPage, error)
+
+	// AddRevision - stores a revision of a user, giving it an ID and timestamp
+	AddRevision(revision *Revision) error
+	// GetRevision - retreives a users revision by number. Returns ErrNotFound if there isn't one
+	GetRevision(userID uint, number uint) (Revision, error)
+	// GetRevisionAt - retreives the latest revision of a user made at or before the given time.
+	// Returns ErrNotFound if there isn't one
+	GetRevisionAt(userID uint, at time.Time) (Revision, error)
+	// ListRevisions - returns a page of a users revisions, oldest first. opts must already be validated
+	ListRevisions(userID uint, opts HistoryOptions) (RevisionPage, error)
+
+	// AddOutbox - writes a message to the outbox, giving it an ID and timestamp
+	AddOutbox(message *OutboxMessage) error
+	// LockOutbox - called in a Transaction by the outbox relay, so only one relay publishes at a time (which keeps
+	// events in order). Returns false if another relay holds the lock. The lock is released with the transaction
+	LockOutbox() (bool, error)
+	// PendingOutbox - returns up to limit unpublished messages, oldest first
+	PendingOutbox(limit int) ([]OutboxMessage, error)
+	// UpdateOutbox - saves how publishing a message went
+	UpdateOutbox(message *OutboxMessage) error
+	// PublishedOutbox - returns up to limit published messages, in the order they were published (then by ID),
+	// starting after the message published at publishedAt with ID afterID
+	PublishedOutbox(publishedAt time.Time, afterID uint, limit int) ([]OutboxMessage, error)
+	// PruneOutbox - removes messages published before the given time, and returns how many were removed
+	PruneOutbox(before time.Time) (int64, error)
+}
@@ -0,0 +1,462 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/tracing"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// uniqueViolation - the postgres error code for a unique constraint violation
+const uniqueViolation = "23505"
+
+// outboxLockID - key for the postgres advisory lock held by the outbox relay, so two instances
+// can't publish (and so reorder) the same events at once
+const outboxLockID = 7311948242
+
+// GormStore - a Store that keeps users in our database through gorm
+type GormStore struct {
+	DB *gorm.DB
+}
+
+// NewGormStore - returns a new gorm backed user store
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{
+		DB: db,
+	}
+}
+
+// GetByID - retreives a user by ID from the database
+func (s *GormStore) GetByID(ID uint) (User, error) {
+	var user User
+	if result := s.DB.First(&user, ID); result.Error != nil {
+		return User{}, translateError(result.Error)
+	}
+	return user, nil
+}
+
+// GetByUsername - retreives a user by username from the database, ignoring case.
+// Uses the unique index on lower(username)
+func (s *GormStore) GetByUsername(username string) (User, error) {
+	var user User
+	if result := s.DB.Where("lower(username) = lower(?)", username).First(&user); result.Error != nil {
+		return User{}, translateError(result.Error)
+	}
+	return user, nil
+}
+
+// GetByEmail - retreives a user by email from the database, ignoring case.
+// Uses the unique index on lower(email)
+func (s *GormStore) GetByEmail(email string) (User, error) {
+	var user User
+	if result := s.DB.Where("lower(email) = lower(?)", email).First(&user); result.Error != nil {
+		return User{}, translateError(result.Error)
+	}
+	return user, nil
+}
+
+// Create - inserts a new user. Gorm runs the BeforeCreate hook for us
+func (s *GormStore) Create(user *User) error {
+	if result := s.DB.Create(user); result.Error != nil {
+		return translateError(result.Error)
+	}
+	return nil
+}
+
+// Update - updates the non-zero fields of changes on the given user, and bumps its version.
+// The update only matches the row if it is still at the version user was read at
+func (s *GormStore) Update(user *User, changes User) error {
+	changes.Version = user.Version + 1
+	result := s.DB.Model(user).Where("version = ?", user.Version).Updates(changes)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return s.missingOrChanged(user.ID)
+	}
+	return nil
+}
+
+// Delete - soft deletes a user by ID and bumps its version, if it is still at the given version (or at any version
+// for AnyVersion). Deleting is a change like any other, so the deleted user gets a version (and revision) of its own
+func (s *GormStore) Delete(ID uint, version uint) error {
+	query := s.DB.Model(&User{}).Where("id = ?", ID)
+	if version != AnyVersion {
+		query = query.Where("version = ?", version)
+	}
+	result := query.Updates(map[string]interface{}{"deleted_at": time.Now(), "version": gorm.Expr("version + 1")})
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return s.missingOrChanged(ID)
+	}
+	return nil
+}
+
+// missingOrChanged - works out why a conditional update or delete didn't match any rows -
+// either the user is gone, or it is at a different version now
+func (s *GormStore) missingOrChanged(ID uint) error {
+	if _, err := s.GetByID(ID); err != nil {
+		return err
+	}
+	return ErrVersionMismatch
+}
+
+// All - returns every user from the database
+func (s *GormStore) All() (Users, error) {
+	var users Users
+	if result := s.DB.Order("id").Find(&users); result.Error != nil {
+		return Users{}, translateError(result.Error)
+	}
+	return users, nil
+}
+
+// List - returns a page of users matching the filters in opts. Deleted users are only listed (on their own) if opts.Deleted is set
+func (s *GormStore) List(opts ListOptions) (Page, error) {
+	query := s.filtered(opts)
+
+	// Count before paging is applied, so the total covers every page
+	var total int64
+	if result := query.Count(&total); result.Error != nil {
+		return Page{}, translateError(result.Error)
+	}
+
+	// The ID breaks ties, so users with the same sort value (ie created in the same instant) still have
+	// a stable order and the cursor knows exactly where it left off
+	column, direction := opts.column()
+	if opts.Cursor != "" {
+		c, err := opts.decodeCursor()
+		if err != nil {
+			return Page{}, err
+		}
+		value, err := opts.cursorValue(c)
+		if err != nil {
+			return Page{}, err
+		}
+		op := ">"
+		if direction == "DESC" {
+			op = "<"
+		}
+		if column == "id" {
+			query = query.Where(fmt.Sprintf("id %s ?", op), c.ID)
+		} else {
+			query = query.Where(fmt.Sprintf("%s %s ? OR (%s = ? AND id %s ?)", column, op, column, op), value, value, c.ID)
+		}
+	} else if opts.Offset > 0 {
+		query = query.Offset(opts.Offset)
+	}
+	query = query.Order(opts.orderBy())
+
+	// Grab one extra user so we know if there is another page after this one
+	var users Users
+	if result := query.Limit(opts.Limit + 1).Find(&users); result.Error != nil {
+		return Page{}, translateError(result.Error)
+	}
+
+	return opts.page(users, total), nil
+}
+
+// Each - streams the matching users out of the database a row at a time, rather than loading them all
+func (s *GormStore) Each(opts ListOptions, fn func(User) error) error {
+	rows, err := s.filtered(opts).Order(opts.orderBy()).Rows()
+	if err != nil {
+		return translateError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err := s.DB.ScanRows(rows, &user); err != nil {
+			return translateError(err)
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return translateError(err)
+	}
+	return nil
+}
+
+// filtered - the query for the users matching opts' filters, before any sorting or paging
+func (s *GormStore) filtered(opts ListOptions) *gorm.DB {
+	query := s.DB.Model(&User{})
+	if opts.Deleted {
+		query = s.DB.Unscoped().Model(&User{}).Where("deleted_at IS NOT NULL")
+	}
+	if opts.UsernameContains != "" {
+		query = query.Where("LOWER(username) LIKE ? ESCAPE '\\'", likeContains(opts.UsernameContains))
+	}
+	if opts.EmailContains != "" {
+		query = query.Where("LOWER(email) LIKE ? ESCAPE '\\'", likeContains(opts.EmailContains))
+	}
+	if opts.NameContains != "" {
+		query = query.Where("LOWER(first_name || ' ' || last_name) LIKE ? ESCAPE '\\'", likeContains(opts.NameContains))
+	}
+	if opts.CreatedAfter != nil {
+		query = query.Where("created_at >= ?", *opts.CreatedAfter)
+	}
+	if opts.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *opts.CreatedBefore)
+	}
+	return query
+}
+
+// GetDeletedByID - retreives a soft-deleted user by ID from the database
+func (s *GormStore) GetDeletedByID(ID uint) (User, error) {
+	var user User
+	if result := s.DB.Unscoped().Where("deleted_at IS NOT NULL").First(&user, ID); result.Error != nil {
+		return User{}, translateError(result.Error)
+	}
+	return user, nil
+}
+
+// Restore - clears DeletedAt on a soft-deleted user and bumps its version. The partial unique indexes
+// only cover live users, so this is where a taken username or email is caught
+func (s *GormStore) Restore(ID uint) error {
+	result := s.DB.Unscoped().Model(&User{}).Where("id = ? AND deleted_at IS NOT NULL", ID).
+		Updates(map[string]interface{}{"deleted_at": nil, "version": gorm.Expr("version + 1")})
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Purge - permanently deletes a soft-deleted user and its revisions from the database.
+// Run it in a Transaction, so the revisions aren't lost if the user can't be
+func (s *GormStore) Purge(ID uint) error {
+	result := s.DB.Unscoped().Where("deleted_at IS NOT NULL").Delete(&User{}, ID)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	if result := s.DB.Where("user_id = ?", ID).Delete(&Revision{}); result.Error != nil {
+		return translateError(result.Error)
+	}
+	return nil
+}
+
+// PurgeDeletedBefore - permanently deletes every user soft-deleted before the given time, along with their revisions.
+// The users are picked and deleted in a single statement, so a user restored while it runs is never purged, and
+// only the users that were actually deleted are returned (and have their revisions removed). Run it in a
+// Transaction, so the revisions aren't lost if the users can't be
+func (s *GormStore) PurgeDeletedBefore(before time.Time) (Users, error) {
+	var users Users
+	result := s.DB.Raw("DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < ? RETURNING *", before).Scan(&users)
+	if result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+	if len(users) == 0 {
+		return users, nil
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	ids := make([]uint, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	if result := s.DB.Where("user_id IN (?)", ids).Delete(&Revision{}); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+	return users, nil
+}
+
+// Transaction - runs fn inside a database transaction, committing it if fn succeeds and rolling it back if not
+func (s *GormStore) Transaction(fn func(tx Store) error) error {
+	var fnErr error
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		fnErr = fn(NewGormStore(tx))
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return translateError(err)
+	}
+	return nil
+}
+
+// WithContext - the store, with every query made through it (and any transaction started from it) traced
+// as a child of the span on ctx - see tracing.RegisterCallbacks
+func (s *GormStore) WithContext(ctx context.Context) Store {
+	return NewGormStore(tracing.WithContext(s.DB, ctx))
+}
+
+// AddAudit - inserts an audit entry. The database refuses to change or remove them afterwards
+func (s *GormStore) AddAudit(entry *AuditEntry) error {
+	if result := s.DB.Create(entry); result.Error != nil {
+		return translateError(result.Error)
+	}
+	return nil
+}
+
+// ListAudit - returns a page of a users audit log, oldest first, using the index on (target_id, id)
+func (s *GormStore) ListAudit(targetID uint, opts HistoryOptions) (AuditPage, error) {
+	query := s.DB.Model(&AuditEntry{}).Where("target_id = ?", targetID)
+
+	var total int64
+	if result := query.Count(&total); result.Error != nil {
+		return AuditPage{}, translateError(result.Error)
+	}
+
+	after, err := opts.after()
+	if err != nil {
+		return AuditPage{}, err
+	}
+	if after != 0 {
+		query = query.Where("id > ?", after)
+	}
+
+	// Fetch one extra entry so we know whether there is another page
+	var entries []AuditEntry
+	result := query.Order("id ASC").Offset(opts.Offset).Limit(opts.Limit + 1).Find(&entries)
+	if result.Error != nil {
+		return AuditPage{}, translateError(result.Error)
+	}
+	return opts.auditPage(entries, total), nil
+}
+
+// AddRevision - inserts a revision. The database refuses to change them afterwards
+func (s *GormStore) AddRevision(revision *Revision) error {
+	if result := s.DB.Create(revision); result.Error != nil {
+		return translateError(result.Error)
+	}
+	return nil
+}
+
+// GetRevision - retreives a users revision by number, using the unique index on (user_id, number)
+func (s *GormStore) GetRevision(userID uint, number uint) (Revision, error) {
+	var revision Revision
+	if result := s.DB.Where("user_id = ? AND number = ?", userID, number).First(&revision); result.Error != nil {
+		return Revision{}, translateError(result.Error)
+	}
+	return revision, nil
+}
+
+// GetRevisionAt - retreives the latest revision of a user made at or before the given time,
+// using the index on (user_id, created_at)
+func (s *GormStore) GetRevisionAt(userID uint, at time.Time) (Revision, error) {
+	var revision Revision
+	result := s.DB.Where("user_id = ? AND created_at <= ?", userID, at).Order("created_at DESC, id DESC").First(&revision)
+	if result.Error != nil {
+		return Revision{}, translateError(result.Error)
+	}
+	return revision, nil
+}
+
+// ListRevisions - returns a page of a users revisions, oldest first
+func (s *GormStore) ListRevisions(userID uint, opts HistoryOptions) (RevisionPage, error) {
+	query := s.DB.Model(&Revision{}).Where("user_id = ?", userID)
+
+	var total int64
+	if result := query.Count(&total); result.Error != nil {
+		return RevisionPage{}, translateError(result.Error)
+	}
+
+	after, err := opts.after()
+	if err != nil {
+		return RevisionPage{}, err
+	}
+	if after != 0 {
+		query = query.Where("id > ?", after)
+	}
+
+	// Fetch one extra revision so we know whether there is another page
+	var revisions []Revision
+	result := query.Order("id ASC").Offset(opts.Offset).Limit(opts.Limit + 1).Find(&revisions)
+	if result.Error != nil {
+		return RevisionPage{}, translateError(result.Error)
+	}
+	return opts.revisionPage(revisions, total), nil
+}
+
+// AddOutbox - inserts a message into the outbox
+func (s *GormStore) AddOutbox(message *OutboxMessage) error {
+	if result := s.DB.Create(message); result.Error != nil {
+		return translateError(result.Error)
+	}
+	return nil
+}
+
+// LockOutbox - takes the outbox relays advisory lock for the rest of the transaction, without waiting for it
+func (s *GormStore) LockOutbox() (bool, error) {
+	var locked bool
+	if err := s.DB.Raw("SELECT pg_try_advisory_xact_lock(?)", outboxLockID).Row().Scan(&locked); err != nil {
+		return false, translateError(err)
+	}
+	return locked, nil
+}
+
+// PendingOutbox - returns the oldest unpublished messages, using the partial index on unpublished IDs
+func (s *GormStore) PendingOutbox(limit int) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	result := s.DB.Where("published_at IS NULL").Order("id").Limit(limit).Find(&messages)
+	if result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+	return messages, nil
+}
+
+// PublishedOutbox - returns published messages in the order they were published, using the index on published_at
+func (s *GormStore) PublishedOutbox(publishedAt time.Time, afterID uint, limit int) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	result := s.DB.Where("published_at > ? OR (published_at = ? AND id > ?)", publishedAt, publishedAt, afterID).
+		Order("published_at, id").Limit(limit).Find(&messages)
+	if result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+	return messages, nil
+}
+
+// UpdateOutbox - saves how publishing a message went
+func (s *GormStore) UpdateOutbox(message *OutboxMessage) error {
+	result := s.DB.Model(message).Updates(map[string]interface{}{
+		"attempts":        message.Attempts,
+		"next_attempt_at": message.NextAttemptAt,
+		"last_error":      message.LastError,
+		"published_at":    message.PublishedAt,
+	})
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	return nil
+}
+
+// PruneOutbox - removes messages published before the given time
+func (s *GormStore) PruneOutbox(before time.Time) (int64, error) {
+	result := s.DB.Where("published_at < ?", before).Delete(&OutboxMessage{})
+	if result.Error != nil {
+		return 0, translateError(result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// translateError - turns the gorm/postgres errors callers care about into our own.
+// Anything else is unexpected, and becomes a KindInternal error
+func translateError(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrNotFound
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrDuplicate
+	}
+	var validation ValidationErrors
+	if errors.As(err, &validation) {
+		return validation
+	}
+	return internalError(err)
+}
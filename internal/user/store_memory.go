@@ -0,0 +1,643 @@
+package user
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore - a Store that keeps users in memory. It behaves like GormStore does against postgres -
+// IDs count up from 1, the BeforeCreate hook runs, usernames and emails are unique among live users
+// and lists are filtered, sorted and paged the same way - so the whole api can be
+// run in-process without a database
+type MemoryStore struct {
+	mu             sync.RWMutex
+	nextID         uint
+	nextRevisionID uint
+	nextOutboxID   uint
+	users          map[uint]User
+	audit          []AuditEntry
+	revisions      []Revision
+	outbox         []OutboxMessage
+}
+
+// NewMemoryStore - returns a new, empty in-memory user store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nextID:         1,
+		nextRevisionID: 1,
+		nextOutboxID:   1,
+		users:          map[uint]User{},
+	}
+}
+
+// GetByID - retreives a user by ID
+func (s *MemoryStore) GetByID(ID uint) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[ID]
+	if !ok || user.DeletedAt != nil {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+// GetByUsername - retreives a user by username, ignoring case
+func (s *MemoryStore) GetByUsername(username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.DeletedAt == nil && strings.EqualFold(user.Username, username) {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+// GetByEmail - retreives a user by email, ignoring case
+func (s *MemoryStore) GetByEmail(email string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.DeletedAt == nil && strings.EqualFold(user.Email, email) {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+// Create - stores a new user, giving it an ID and timestamps
+func (s *MemoryStore) Create(user *User) error {
+	if err := user.BeforeCreate(nil); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.taken(0, user.Username, user.Email) {
+		return ErrDuplicate
+	}
+
+	now := time.Now()
+	user.ID = s.nextID
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.DeletedAt = nil
+	s.users[user.ID] = *user
+	s.nextID++
+	return nil
+}
+
+// Update - applies the non-zero fields of changes to the stored user, the same way gorm's Updates does,
+// as long as it is still at the version user was read at
+func (s *MemoryStore) Update(user *User, changes User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[user.ID]
+	if !ok || stored.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if stored.Version != user.Version {
+		return ErrVersionMismatch
+	}
+
+	stored = stored.WithChanges(changes)
+	stored.Version++
+
+	if s.taken(stored.ID, stored.Username, stored.Email) {
+		return ErrDuplicate
+	}
+
+	stored.UpdatedAt = time.Now()
+	s.users[stored.ID] = stored
+	*user = stored
+	return nil
+}
+
+// Delete - soft deletes a user by ID and bumps its version, if it is still at the given version (or at any version
+// for AnyVersion)
+func (s *MemoryStore) Delete(ID uint, version uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[ID]
+	if !ok || user.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if version != AnyVersion && user.Version != version {
+		return ErrVersionMismatch
+	}
+
+	now := time.Now()
+	user.DeletedAt = &now
+	user.Version++
+	user.UpdatedAt = now
+	s.users[ID] = user
+	return nil
+}
+
+// All - returns every user, ordered by ID
+func (s *MemoryStore) All() (Users, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := s.live()
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// List - returns a page of users matching the filters in opts
+func (s *MemoryStore) List(opts ListOptions) (Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := s.live()
+	if opts.Deleted {
+		users = s.deleted()
+	}
+
+	var matched Users
+	for _, user := range users {
+		if opts.matches(user) {
+			matched = append(matched, user)
+		}
+	}
+	total := int64(len(matched))
+
+	sort.Slice(matched, func(i, j int) bool { return opts.less(matched[i], matched[j]) })
+
+	if opts.Cursor != "" {
+		c, err := opts.decodeCursor()
+		if err != nil {
+			return Page{}, err
+		}
+		// The cursor stands in for the last user on the previous page - skip everything up to and including it
+		var last User
+		last.ID = c.ID
+		column, _ := opts.column()
+		switch column {
+		case "username":
+			last.Username = c.Value
+		case "email":
+			last.Email = c.Value
+		case "created_at":
+			t, err := time.Parse(time.RFC3339Nano, c.Value)
+			if err != nil {
+				return Page{}, ErrInvalidCursor
+			}
+			last.CreatedAt = t
+		}
+		start := sort.Search(len(matched), func(i int) bool { return opts.less(last, matched[i]) })
+		matched = matched[start:]
+	} else if opts.Offset > 0 {
+		if opts.Offset >= len(matched) {
+			matched = nil
+		} else {
+			matched = matched[opts.Offset:]
+		}
+	}
+
+	if len(matched) > opts.Limit+1 {
+		matched = matched[:opts.Limit+1]
+	}
+	return opts.page(matched, total), nil
+}
+
+// Each - calls fn with every matching user in order. The users are copied out first,
+// so fn is free to use the store
+func (s *MemoryStore) Each(opts ListOptions, fn func(User) error) error {
+	s.mu.RLock()
+	users := s.live()
+	if opts.Deleted {
+		users = s.deleted()
+	}
+	s.mu.RUnlock()
+
+	var matched Users
+	for _, user := range users {
+		if opts.matches(user) {
+			matched = append(matched, user)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return opts.less(matched[i], matched[j]) })
+
+	for _, user := range matched {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDeletedByID - retreives a soft-deleted user by ID
+func (s *MemoryStore) GetDeletedByID(ID uint) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[ID]
+	if !ok || user.DeletedAt == nil {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+// Restore - undeletes a soft-deleted user and bumps its version, as long as nobody has taken its username or email
+func (s *MemoryStore) Restore(ID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[ID]
+	if !ok || user.DeletedAt == nil {
+		return ErrNotFound
+	}
+	if s.taken(ID, user.Username, user.Email) {
+		return ErrDuplicate
+	}
+
+	user.DeletedAt = nil
+	user.Version++
+	user.UpdatedAt = time.Now()
+	s.users[ID] = user
+	return nil
+}
+
+// Purge - permanently removes a soft-deleted user and its revisions
+func (s *MemoryStore) Purge(ID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[ID]
+	if !ok || user.DeletedAt == nil {
+		return ErrNotFound
+	}
+	delete(s.users, ID)
+	s.removeRevisions(map[uint]bool{ID: true})
+	return nil
+}
+
+// PurgeDeletedBefore - permanently removes every user soft-deleted before the given time
+func (s *MemoryStore) PurgeDeletedBefore(before time.Time) (Users, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged Users
+	IDs := map[uint]bool{}
+	for ID, user := range s.users {
+		if user.DeletedAt != nil && user.DeletedAt.Before(before) {
+			delete(s.users, ID)
+			purged = append(purged, user)
+			IDs[ID] = true
+		}
+	}
+	s.removeRevisions(IDs)
+	sort.Slice(purged, func(i, j int) bool { return purged[i].ID < purged[j].ID })
+	return purged, nil
+}
+
+// Transaction - runs fn against a copy of the store, and only keeps the copy's changes if fn succeeds,
+// like a database transaction would. Every other call waits until fn is done
+func (s *MemoryStore) Transaction(fn func(tx Store) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &MemoryStore{
+		nextID:         s.nextID,
+		nextRevisionID: s.nextRevisionID,
+		nextOutboxID:   s.nextOutboxID,
+		users:          make(map[uint]User, len(s.users)),
+		audit:          append([]AuditEntry(nil), s.audit...),
+		revisions:      append([]Revision(nil), s.revisions...),
+		outbox:         append([]OutboxMessage(nil), s.outbox...),
+	}
+	for ID, user := range s.users {
+		tx.users[ID] = user
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.nextID, s.nextRevisionID, s.nextOutboxID = tx.nextID, tx.nextRevisionID, tx.nextOutboxID
+	s.users, s.audit, s.revisions, s.outbox = tx.users, tx.audit, tx.revisions, tx.outbox
+	return nil
+}
+
+// AddAudit - appends an audit entry, giving it the next ID
+func (s *MemoryStore) AddAudit(entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = uint(len(s.audit) + 1)
+	entry.CreatedAt = time.Now()
+	s.audit = append(s.audit, *entry)
+	return nil
+}
+
+// ListAudit - returns a page of a users audit log, oldest first
+func (s *MemoryStore) ListAudit(targetID uint, opts HistoryOptions) (AuditPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	after, err := opts.after()
+	if err != nil {
+		return AuditPage{}, err
+	}
+
+	var total int64
+	var matched []AuditEntry
+	for _, entry := range s.audit {
+		if entry.TargetID != targetID {
+			continue
+		}
+		total++
+		if entry.ID > after {
+			matched = append(matched, entry)
+		}
+	}
+
+	if opts.Offset >= len(matched) {
+		matched = nil
+	} else {
+		matched = matched[opts.Offset:]
+	}
+	if len(matched) > opts.Limit+1 {
+		matched = matched[:opts.Limit+1]
+	}
+	return opts.auditPage(matched, total), nil
+}
+
+// AddRevision - stores a revision, giving it the next ID
+func (s *MemoryStore) AddRevision(revision *Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revision.ID = s.nextRevisionID
+	s.nextRevisionID++
+	revision.CreatedAt = time.Now()
+	s.revisions = append(s.revisions, *revision)
+	return nil
+}
+
+// GetRevision - retreives a users revision by number
+func (s *MemoryStore) GetRevision(userID uint, number uint) (Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, revision := range s.revisions {
+		if revision.UserID == userID && revision.Number == number {
+			return revision, nil
+		}
+	}
+	return Revision{}, ErrNotFound
+}
+
+// GetRevisionAt - retreives the latest revision of a user made at or before the given time
+func (s *MemoryStore) GetRevisionAt(userID uint, at time.Time) (Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := len(s.revisions) - 1; i >= 0; i-- {
+		revision := s.revisions[i]
+		if revision.UserID == userID && !revision.CreatedAt.After(at) {
+			return revision, nil
+		}
+	}
+	return Revision{}, ErrNotFound
+}
+
+// ListRevisions - returns a page of a users revisions, oldest first
+func (s *MemoryStore) ListRevisions(userID uint, opts HistoryOptions) (RevisionPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	after, err := opts.after()
+	if err != nil {
+		return RevisionPage{}, err
+	}
+
+	var total int64
+	var matched []Revision
+	for _, revision := range s.revisions {
+		if revision.UserID != userID {
+			continue
+		}
+		total++
+		if revision.ID > after {
+			matched = append(matched, revision)
+		}
+	}
+
+	if opts.Offset >= len(matched) {
+		matched = nil
+	} else {
+		matched = matched[opts.Offset:]
+	}
+	if len(matched) > opts.Limit+1 {
+		matched = matched[:opts.Limit+1]
+	}
+	return opts.revisionPage(matched, total), nil
+}
+
+// removeRevisions - removes every revision of the given users. Callers must hold the lock
+func (s *MemoryStore) removeRevisions(IDs map[uint]bool) {
+	kept := s.revisions[:0:0]
+	for _, revision := range s.revisions {
+		if !IDs[revision.UserID] {
+			kept = append(kept, revision)
+		}
+	}
+	s.revisions = kept
+}
+
+// live - every user that hasn't been deleted. Callers must hold the lock
+func (s *MemoryStore) live() Users {
+	users := make(Users, 0, len(s.users))
+	for _, user := range s.users {
+		if user.DeletedAt == nil {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// deleted - every user that has been soft-deleted. Callers must hold the lock
+func (s *MemoryStore) deleted() Users {
+	users := make(Users, 0)
+	for _, user := range s.users {
+		if user.DeletedAt != nil {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// taken - returns true if any other live user already has the username or email, ignoring case,
+// like the partial unique indexes do in postgres. Callers must hold the lock
+func (s *MemoryStore) taken(ID uint, username, email string) bool {
+	for _, user := range s.users {
+		if user.ID != ID && user.DeletedAt == nil && (strings.EqualFold(user.Username, username) || strings.EqualFold(user.Email, email)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches - returns true if the user passes every filter in the options
+func (o *ListOptions) matches(u User) bool {
+	if o.UsernameContains != "" && !containsFold(u.Username, o.UsernameContains) {
+		return false
+	}
+	if o.EmailContains != "" && !containsFold(u.Email, o.EmailContains) {
+		return false
+	}
+	if o.NameContains != "" && !containsFold(u.FirstName+" "+u.LastName, o.NameContains) {
+		return false
+	}
+	if o.CreatedAfter != nil && u.CreatedAt.Before(*o.CreatedAfter) {
+		return false
+	}
+	if o.CreatedBefore != nil && !u.CreatedAt.Before(*o.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// less - orders users by the sort column, with the ID breaking ties, the same way GormStore.List does
+func (o *ListOptions) less(a, b User) bool {
+	column, direction := o.column()
+
+	cmp := 0
+	switch column {
+	case "username":
+		cmp = strings.Compare(a.Username, b.Username)
+	case "email":
+		cmp = strings.Compare(a.Email, b.Email)
+	case "created_at":
+		if a.CreatedAt.Before(b.CreatedAt) {
+			cmp = -1
+		} else if a.CreatedAt.After(b.CreatedAt) {
+			cmp = 1
+		}
+	}
+	if cmp == 0 {
+		if a.ID < b.ID {
+			cmp = -1
+		} else if a.ID > b.ID {
+			cmp = 1
+		}
+	}
+
+	if direction == "DESC" {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// containsFold - case insensitive strings.Contains
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// AddOutbox - appends a message to the outbox, giving it the next ID
+func (s *MemoryStore) AddOutbox(message *OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message.ID = s.nextOutboxID
+	s.nextOutboxID++
+	message.CreatedAt = time.Now()
+	s.outbox = append(s.outbox, *message)
+	return nil
+}
+
+// WithContext - the store itself, since there are no queries to trace
+func (s *MemoryStore) WithContext(ctx context.Context) Store {
+	return s
+}
+
+// LockOutbox - always succeeds, since a Transaction already has the whole store to itself
+func (s *MemoryStore) LockOutbox() (bool, error) {
+	return true, nil
+}
+
+// PendingOutbox - returns the oldest unpublished messages
+func (s *MemoryStore) PendingOutbox(limit int) ([]OutboxMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []OutboxMessage
+	for _, message := range s.outbox {
+		if message.PublishedAt == nil {
+			messages = append(messages, message)
+		}
+		if len(messages) == limit {
+			break
+		}
+	}
+	return messages, nil
+}
+
+// PublishedOutbox - returns published messages in the order they were published
+func (s *MemoryStore) PublishedOutbox(publishedAt time.Time, afterID uint, limit int) ([]OutboxMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []OutboxMessage
+	for _, message := range s.outbox {
+		if message.PublishedAt == nil {
+			continue
+		}
+		at := *message.PublishedAt
+		if at.After(publishedAt) || (at.Equal(publishedAt) && message.ID > afterID) {
+			messages = append(messages, message)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		if !messages[i].PublishedAt.Equal(*messages[j].PublishedAt) {
+			return messages[i].PublishedAt.Before(*messages[j].PublishedAt)
+		}
+		return messages[i].ID < messages[j].ID
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// UpdateOutbox - saves how publishing a message went
+func (s *MemoryStore) UpdateOutbox(message *OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.outbox {
+		if s.outbox[i].ID == message.ID {
+			s.outbox[i] = *message
+			return nil
+		}
+	}
+	return nil
+}
+
+// PruneOutbox - removes messages published before the given time
+func (s *MemoryStore) PruneOutbox(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned int64
+	kept := s.outbox[:0]
+	for _, message := range s.outbox {
+		if message.PublishedAt != nil && message.PublishedAt.Before(before) {
+			pruned++
+			continue
+		}
+		kept = append(kept, message)
+	}
+	s.outbox = kept
+	return pruned, nil
+}
@@ -0,0 +1,149 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ImportAction - what importing a user did
+type ImportAction string
+
+// The things importing a user can do. A dry run reports what it would have done
+const (
+	ImportCreated   ImportAction = "created"
+	ImportUpdated   ImportAction = "updated"
+	ImportUnchanged ImportAction = "unchanged"
+)
+
+// ImportOptions - how users are imported. DryRun checks every user and reports what importing it would do,
+// without changing anything. HashedPasswords takes passwords as bcrypt hashes (ie exported from another system)
+// and stores them as they are, instead of hashing them
+type ImportOptions struct {
+	DryRun          bool
+	HashedPasswords bool
+}
+
+// ExportUsers - calls fn with every user matching the filters and sort in opts, one at a time, so any number of
+// users can be exported without holding them all in memory. opts is validated like ListUsers, but paging is ignored
+func (s *Service) ExportUsers(opts ListOptions, fn func(User) error) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	return s.Store.Each(opts, fn)
+}
+
+// ImportUser - creates or updates a user from an import. It updates the live user with the same username or email
+// if there is one (only the non-empty fields, like UpdateUser), or creates a new user otherwise (like CreateUser).
+// Either way the user is validated with IsValid first, and a plain text password is hashed. Nothing is changed if
+// the user already matches, which makes importing the same file twice safe.
+// Returns a KindConflict error if the username and email belong to two different users
+func (s *Service) ImportUser(ctx context.Context, u User, opts ImportOptions) (ImportAction, User, error) {
+	existing, found, err := s.findImported(u)
+	if err != nil {
+		return "", User{}, err
+	}
+
+	if !found {
+		if valid, errs := u.IsValid(); !valid {
+			return "", User{}, errs
+		}
+		if err := importPassword(ctx, &u, opts); err != nil {
+			return "", User{}, err
+		}
+		if opts.DryRun {
+			return ImportCreated, u, nil
+		}
+		created, err := s.CreateUser(ctx, u)
+		return ImportCreated, created, err
+	}
+
+	merged := existing.WithChanges(u)
+	if valid, errs := merged.IsValid(); !valid {
+		return "", User{}, errs
+	}
+	if importMatches(ctx, existing, u, opts) {
+		return ImportUnchanged, existing, nil
+	}
+	if u.Password != "" {
+		if err := importPassword(ctx, &u, opts); err != nil {
+			return "", User{}, err
+		}
+	}
+	if opts.DryRun {
+		return ImportUpdated, existing.WithChanges(u), nil
+	}
+
+	err = s.Store.Transaction(func(tx Store) error {
+		return update(ctx, tx, AuditUpdate, &existing, u)
+	})
+	if err != nil {
+		return "", User{}, err
+	}
+	return ImportUpdated, existing, nil
+}
+
+// findImported - finds the live user an imported user is matched to, by username or email
+func (s *Service) findImported(u User) (User, bool, error) {
+	var byUsername, byEmail User
+	var err error
+	if u.Username != "" {
+		if byUsername, err = s.GetUserByUsername(u.Username); err != nil && !errors.Is(err, ErrNotFound) {
+			return User{}, false, err
+		}
+	}
+	if u.Email != "" {
+		if byEmail, err = s.GetUserByEmail(u.Email); err != nil && !errors.Is(err, ErrNotFound) {
+			return User{}, false, err
+		}
+	}
+
+	switch {
+	case byUsername.ID != 0 && byEmail.ID != 0 && byUsername.ID != byEmail.ID:
+		return User{}, false, &Error{
+			Kind:    KindConflict,
+			Message: fmt.Sprintf("Username belongs to user %d, but email belongs to user %d", byUsername.ID, byEmail.ID),
+		}
+	case byUsername.ID != 0:
+		return byUsername, true, nil
+	case byEmail.ID != 0:
+		return byEmail, true, nil
+	}
+	return User{}, false, nil
+}
+
+// importPassword - hashes an imported users password, or checks it is already a bcrypt hash
+// if we were told passwords are hashed
+func importPassword(ctx context.Context, u *User, opts ImportOptions) error {
+	if opts.HashedPasswords {
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return ValidationErrors{{Field: "Password", Code: CodeInvalidFormat, Message: "Password is not a bcrypt hash"}}
+		}
+		return nil
+	}
+	hashed, err := HashPasswordContext(ctx, u.Password)
+	if err != nil {
+		return internalError(err)
+	}
+	u.Password = hashed
+	return nil
+}
+
+// importMatches - returns true if updating existing with changes wouldn't change anything
+func importMatches(ctx context.Context, existing, changes User, opts ImportOptions) bool {
+	merged := existing.WithChanges(changes)
+	if merged.Username != existing.Username || merged.FirstName != existing.FirstName ||
+		merged.LastName != existing.LastName || merged.Email != existing.Email ||
+		merged.Telephone != existing.Telephone || merged.Role != existing.Role {
+		return false
+	}
+	if changes.Password == "" {
+		return true
+	}
+	if opts.HashedPasswords {
+		return changes.Password == existing.Password
+	}
+	return ComparePasswordContext(ctx, changes.Password, existing.Password)
+}
@@ -1,25 +1,25 @@
 package user
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
-	"regexp"
+	"time"
 
+	"github.com/aebranton/rest-api/internal/tracing"
 	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Email regex for validation
-var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
-
-// Phone number regex for validation (not acutally cleaning them, probabably would in production)
-var phoneRegex = regexp.MustCompile(`^(?:(?:\(?(?:00|\+)([1-4]\d\d|[1-9]\d?)\)?)?[\-\.\ \\\/]?)?((?:\(?\d{1,}\)?[\-\.\ \\\/]?){0,})(?:[\-\.\ \\\/]?(?:#|ext\.?|extension|x)[\-\.\ \\\/]?(\d+))?$`)
-
-// Service - the user service. Holds a DB connection pointer and has
+// Service - the user service. Holds the Store users are kept in and has
 // methods attached for working with user objects
 type Service struct {
-	DB *gorm.DB
+	Store Store
+
+	// ctx - the request the service is working for, when it was made by WithContext
+	ctx context.Context
 }
 
 // UserAuth - Type to allow post requests with username and password to authenticate a user.
@@ -30,88 +30,156 @@ type UserAuth struct {
 	Password string
 }
 
-// User - defines the user model/structure
+// Role - the role a user has, which decides what they are allowed to do through the api
+type Role string
+
+// The roles a user can have. Admins can do anything, support can look at and fix up
+// other users (but not admins), and everybody else can only look at and update themselves
+const (
+	RoleAdmin   Role = "admin"
+	RoleSupport Role = "support"
+	RoleUser    Role = "user"
+)
+
+// IsValid - returns true if the role is one we know about
+func (r Role) IsValid() bool {
+	switch r {
+	case RoleAdmin, RoleSupport, RoleUser:
+		return true
+	}
+	return false
+}
+
+// User - defines the user model/structure. This is our persistence model and is never written to a
+// response directly - see UserResponse. The password hash is also tagged so it can never be marshalled.
+// Version starts at 1 and goes up by one every time the user is updated, so a client can tell whether
+// the user it read is still the latest (optimistic concurrency)
 type User struct {
 	gorm.Model
 	Username  string `gorm:"unique"`
-	Password  string
+	Password  string `json:"-"`
 	FirstName string
 	LastName  string
 	Email     string `gorm:"unique"`
 	Telephone string
+	Role      Role `gorm:"not null;default:'user'"`
+	Version   uint `gorm:"not null;default:1"`
 }
 
-// IsValid - this is called within a BeforeCreate hook on the gorm User model.
-// This will check to make sure fields are entered, sized correctly, are valid data, etc.
-func (u *User) IsValid() (bool, string) {
-	if len(u.FirstName) < 2 || len(u.FirstName) > 255 {
-		return false, "Length of FirstName is not between 2-255 characters"
+// AnyVersion - pass as the version to UpdateUser or DeleteUser to skip checking the user hasn't changed
+const AnyVersion uint = 0
+
+// BeforeCreate - User hook before it is created to check if it is valid. This runs the User struct's IsValid method
+// If any of the tests fail, the ValidationErrors listing every failure are returned
+// Users without a role given are regular users, and every new user starts at version 1.
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	if u.Role == "" {
+		u.Role = RoleUser
 	}
-	if len(u.LastName) < 2 || len(u.LastName) > 255 {
-		return false, "Length of LastName is not between 2-255 characters"
+	u.Version = 1
+	valid, errs := u.IsValid()
+	if !valid {
+		return errs
 	}
-	if len(u.Password) < 8 || len(u.Password) > 255 {
-		return false, "Length of Password is not between 8-255 characters"
+	return nil
+}
+
+// WithChanges - returns a copy of the user with every non-zero field of changes applied,
+// the same way an update applies them. Used to see what a user will look like after a partial update
+func (u User) WithChanges(changes User) User {
+	if changes.Username != "" {
+		u.Username = changes.Username
 	}
-	if len(u.Email) < 5 || len(u.Email) > 255 {
-		return false, "Length of the email is not between 5-255 characters"
+	if changes.Password != "" {
+		u.Password = changes.Password
 	}
-	if !emailRegex.MatchString(u.Email) {
-		return false, "Email is not a valid address"
+	if changes.FirstName != "" {
+		u.FirstName = changes.FirstName
 	}
-	if len(u.Telephone) < 5 || len(u.Telephone) > 50 {
-		return false, "Length of the telephone number is not between 5-50 characters"
+	if changes.LastName != "" {
+		u.LastName = changes.LastName
 	}
-	if !phoneRegex.MatchString(u.Telephone) {
-		return false, "Telephone number is not a valid number"
+	if changes.Email != "" {
+		u.Email = changes.Email
 	}
-	return true, ""
-}
-
-// BeforeCreate - User hook before it is created to check if it is valid. This runs the User struct's IsValid method
-// If any of the tests fail, an error is returned that will be shown on the page with a 400 Bad Request status
-func (u *User) BeforeCreate(tx *gorm.DB) error {
-	valid, errorMsg := u.IsValid()
-	if !valid {
-		err := errors.New(errorMsg)
-		return err
+	if changes.Telephone != "" {
+		u.Telephone = changes.Telephone
 	}
-	return nil
+	if changes.Role != "" {
+		u.Role = changes.Role
+	}
+	return u
 }
 
 // Users - Custom slice of User objects with some attached methods
 // that are necessary to match a User object, ie ToJSON
 type Users []User
 
-// ToJSON - converts a Users object (slice of User) to JSON and writes to the given
+// ToJSON - converts a Users object (slice of User) to their public JSON representation and writes to the given
 // responseWriter with a header status of Ok
 func (u *Users) ToJSON(w http.ResponseWriter) error {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	encoder := json.NewEncoder(w)
-	return encoder.Encode(u)
+	return encoder.Encode(u.ToResponse())
 }
 
-// ToJSON - converts a User to JSON and writes to the given
+// ToJSON - converts a User to its public JSON representation and writes to the given
 // responseWriter with a header status of Ok
 func (u *User) ToJSON(w http.ResponseWriter) error {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	encoder := json.NewEncoder(w)
-	return encoder.Encode(u)
+	return encoder.Encode(u.ToResponse())
+}
+
+// ToJSON - converts a Page to its public JSON representation and writes to the given
+// responseWriter with a header status of Ok
+func (p *Page) ToJSON(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p.ToResponse())
 }
 
+// PasswordCost - the bcrypt cost HashPassword uses. Set once at startup from the config, before any
+// password is hashed. Passwords hashed at another cost still compare fine
+var PasswordCost = bcrypt.DefaultCost
+
+// PasswordHashed - called with how long each HashPassword took, ie to record it as a metric.
+// Set once at startup, like PasswordCost
+var PasswordHashed = func(d time.Duration) {}
+
 // HashPassword - given a string password, ex: "testpassword", converts it to a hash
 // for storage in the database.
 func HashPassword(pwd string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+	return HashPasswordContext(context.Background(), pwd)
+}
+
+// HashPasswordContext - HashPassword, traced as part of the request on ctx. bcrypt is slow on purpose,
+// so it's worth seeing how much of a request it takes
+func HashPasswordContext(ctx context.Context, pwd string) (string, error) {
+	_, span := tracing.Start(ctx, "user.HashPassword", attribute.Int("bcrypt.cost", PasswordCost))
+	start := time.Now()
+	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), PasswordCost)
+	PasswordHashed(time.Since(start))
+	tracing.End(span, err)
 	return string(hash), err
 }
 
 // ComparePassword - Given a password and a pre-hashed string, see if the given
 // password matches the hash supplied. Return nil if they match, error if not.
 func ComparePassword(pwd, hash string) bool {
+	return ComparePasswordContext(context.Background(), pwd, hash)
+}
+
+// ComparePasswordContext - ComparePassword, traced as part of the request on ctx.
+// A password that doesn't match isn't an error, so it's only noted on the span
+func ComparePasswordContext(ctx context.Context, pwd, hash string) bool {
+	_, span := tracing.Start(ctx, "user.ComparePassword")
+	defer span.End()
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd))
+	span.SetAttributes(attribute.Bool("user.password_matched", err == nil))
 	return err == nil
 }
 
@@ -119,93 +187,383 @@ func ComparePassword(pwd, hash string) bool {
 type UserService interface {
 	GetUser(ID uint) (User, error)
 	GetUserByUsername(username string) (User, error)
-	CreateUser(user User) (User, error)
-	UpdateUser(ID uint, updatedUser User) (User, error)
-	DeleteUser(ID uint) error
-	GetAllUsers() ([]User, error)
+	GetUserByEmail(email string) (User, error)
+	AuthenticateUser(u UserAuth) (User, error)
+	CreateUser(ctx context.Context, user User) (User, error)
+	UpdateUser(ctx context.Context, ID uint, updatedUser User, version uint) (User, error)
+	DeleteUser(ctx context.Context, ID uint, version uint) error
+	GetAllUsers() (Users, error)
+	ListUsers(opts ListOptions) (Page, error)
+	GetDeletedUser(ID uint) (User, error)
+	RestoreUser(ctx context.Context, ID uint) (User, error)
+	PurgeUser(ctx context.Context, ID uint) error
+	GetAuditLog(ID uint, opts HistoryOptions) (AuditPage, error)
+	GetUserAsOf(ID uint, at time.Time) (User, error)
+	ListRevisions(ID uint, opts HistoryOptions) (RevisionPage, error)
+	RevertUser(ctx context.Context, ID uint, number uint, version uint) (User, error)
+	Bulk(ctx context.Context, ops []BulkOperation, mode BulkMode) []BulkResult
+	ExportUsers(opts ListOptions, fn func(User) error) error
+	ImportUser(ctx context.Context, u User, opts ImportOptions) (ImportAction, User, error)
+	WithContext(ctx context.Context) UserService
 }
 
-// NewService - returns a new user service
-func NewService(db *gorm.DB) *Service {
+// NewService - returns a new user service on top of the given store
+func NewService(store Store) *Service {
 	return &Service{
-		DB: db,
+		Store: store,
 	}
 }
 
-// GetUser - retreives a user by ID from the database
-func (s *Service) GetUser(ID uint) (User, error) {
-	var user User
-	if result := s.DB.First(&user, ID); result.Error != nil {
-		return User{}, result.Error
+// WithContext - the service, working for the request on ctx. Every query it makes and every password it hashes
+// is traced as part of the request - handlers call it once per request, rather than using the service as is
+func (s *Service) WithContext(ctx context.Context) UserService {
+	return &Service{
+		Store: s.Store.WithContext(ctx),
+		ctx:   ctx,
 	}
-	return user, nil
 }
 
-// GetUserByUsername - retreives users by username from the database
-func (s *Service) GetUserByUsername(username string) (User, error) {
-	var user User
-	if result := s.DB.Find(&user).Where("username = ?", username); result.Error != nil {
-		return User{}, result.Error
+// requestContext - the request the service is working for, or an empty context if it isn't working for one
+func (s *Service) requestContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
 	}
-	return user, nil
+	return s.ctx
+}
+
+// GetUser - retreives a user by ID from the store
+func (s *Service) GetUser(ID uint) (User, error) {
+	return s.Store.GetByID(ID)
+}
+
+// GetUserByUsername - retreives a user by username from the store. The match is exact, but ignores case
+func (s *Service) GetUserByUsername(username string) (User, error) {
+	return s.Store.GetByUsername(username)
 }
 
-// AuthenticateUser - authenticates a user by username and password
+// GetUserByEmail - retreives a user by email from the store. The match is exact, but ignores case
+func (s *Service) GetUserByEmail(email string) (User, error) {
+	return s.Store.GetByEmail(email)
+}
+
+// AuthenticateUser - authenticates a user by username and password, writing a user.authenticated event to the outbox.
+// Returns ErrInvalidCredentials whether the username or the password is wrong, so callers can't tell which
 func (s *Service) AuthenticateUser(u UserAuth) (User, error) {
 	user, err := s.GetUserByUsername(u.Username)
+	if errors.Is(err, ErrNotFound) {
+		return User{}, ErrInvalidCredentials
+	}
 	if err != nil {
 		return User{}, err
 	}
-	if ComparePassword(u.Password, user.Password) {
+	if ComparePasswordContext(s.requestContext(), u.Password, user.Password) {
+		if err := emit(s.Store, EventUserAuthenticated, user); err != nil {
+			return User{}, err
+		}
 		return user, nil
 	}
-	return User{}, errors.New("Password authentication failed")
+	return User{}, ErrInvalidCredentials
 }
 
-// CreateUser - creates a user in the database. Users do have a BeforeCreate hook to validate
+// CreateUser - creates a user in the store. Users do have a BeforeCreate hook to validate
 // and make sure the data coming in is sufficient, ie the email is valid, phone is valid, username is unique, etc.
-// Errors will be returned if anything is invalid
-func (s *Service) CreateUser(user User) (User, error) {
-	if result := s.DB.Save(&user); result.Error != nil {
-		return User{}, result.Error
+// Errors will be returned if anything is invalid.
+// Like every change the service makes, it is recorded in the audit log along with the Actor on ctx,
+// and its event is written to the outbox in the same transaction
+func (s *Service) CreateUser(ctx context.Context, user User) (User, error) {
+	err := s.Store.Transaction(func(tx Store) error {
+		return create(ctx, tx, &user)
+	})
+	if err != nil {
+		return User{}, err
 	}
 	return user, nil
 }
 
-// UpdateUser - updates a user in the database by ID.
-func (s *Service) UpdateUser(ID uint, updatedUser User) (User, error) {
-	user, err := s.GetUser(ID)
+// create - creates the user through tx, along with its audit entry, first revision and event
+func create(ctx context.Context, tx Store, user *User) error {
+	if err := tx.Create(user); err != nil {
+		return err
+	}
+	if err := audit(ctx, tx, AuditCreate, user.ID, nil, user); err != nil {
+		return err
+	}
+	if err := revise(tx, *user); err != nil {
+		return err
+	}
+	return emit(tx, EventUserCreated, *user)
+}
+
+// EnsureAdmin - makes sure an admin account exists with the given username, so there is always someone
+// who can hand out roles. If a user with that username already exists they are promoted to admin,
+// otherwise a new admin account is created with placeholder names that can be updated later.
+func (s *Service) EnsureAdmin(ctx context.Context, username, password, email string) (User, error) {
+	user, err := s.GetUserByUsername(username)
+	if err == nil {
+		if user.Role == RoleAdmin {
+			return user, nil
+		}
+		return s.UpdateUser(ctx, user.ID, User{Role: RoleAdmin}, user.Version)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return User{}, err
+	}
+
+	// The password is hashed before it gets to IsValid, so check its length here
+	if len(password) < 8 || len(password) > 255 {
+		return User{}, ValidationErrors{{Field: "Password", Code: CodeInvalidLength, Message: "Length of Password is not between 8-255 characters"}}
+	}
+	hashed, err := HashPasswordContext(ctx, password)
+	if err != nil {
+		return User{}, internalError(err)
+	}
+	return s.CreateUser(ctx, User{
+		Username:  username,
+		Password:  hashed,
+		FirstName: "Admin",
+		LastName:  "Admin",
+		Email:     email,
+		Telephone: "0000000000",
+		Role:      RoleAdmin,
+	})
+}
+
+// UpdateUser - updates a user in the store by ID. Only the non-empty fields of updatedUser are changed.
+// The user as it would be after the update is validated with the same rules as a new user, and
+// ValidationErrors are returned (with nothing stored) if the update would leave the user invalid.
+// A new password is validated as the plain text given, before it is hashed.
+// Unless version is AnyVersion, ErrVersionMismatch is returned if the user is no longer at that version,
+// so an update based on an old read can't overwrite someone elses changes.
+// Every successful update stores a new Revision of the user
+func (s *Service) UpdateUser(ctx context.Context, ID uint, updatedUser User, version uint) (User, error) {
+	return s.update(ctx, AuditUpdate, ID, updatedUser, version)
+}
+
+// update - updates a user like UpdateUser does, recording the change in the audit log as action
+func (s *Service) update(ctx context.Context, action AuditAction, ID uint, updatedUser User, version uint) (User, error) {
+	user, changes, err := s.prepareUpdate(ID, updatedUser, version)
 	if err != nil {
 		return User{}, err
 	}
 
+	err = s.Store.Transaction(func(tx Store) error {
+		return update(ctx, tx, action, &user, changes)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// prepareUpdate - reads the user with the given ID and checks the update against it, without changing anything.
+// Returns the user and the changes to make to it, with any new password hashed. Done outside of any transaction,
+// since hashing is slow. The store only applies the changes if the user is still at the version read here
+func (s *Service) prepareUpdate(ID uint, updatedUser User, version uint) (User, User, error) {
+	user, err := s.GetUser(ID)
+	if err != nil {
+		return User{}, User{}, err
+	}
+	if version != AnyVersion && user.Version != version {
+		return User{}, User{}, ErrVersionMismatch
+	}
+
+	merged := user.WithChanges(updatedUser)
+	if valid, errs := merged.IsValid(); !valid {
+		return User{}, User{}, errs
+	}
+
 	if updatedUser.Password != "" {
-		hashed, err := HashPassword(updatedUser.Password)
+		hashed, err := HashPasswordContext(s.requestContext(), updatedUser.Password)
 		if err != nil {
-			return User{}, err
+			return User{}, User{}, internalError(err)
 		}
 		updatedUser.Password = hashed
 	}
+	return user, updatedUser, nil
+}
 
-	if result := s.DB.Model(&user).Updates(updatedUser); result.Error != nil {
-		return User{}, result.Error
+// update - applies changes to the user through tx, recording the change in the audit log as action,
+// along with a new revision and its event
+func update(ctx context.Context, tx Store, action AuditAction, user *User, changes User) error {
+	before := *user
+	if err := tx.Update(user, changes); err != nil {
+		return err
 	}
-	return user, nil
+	if err := audit(ctx, tx, action, user.ID, &before, user); err != nil {
+		return err
+	}
+	if err := revise(tx, *user); err != nil {
+		return err
+	}
+	return emit(tx, EventUserUpdated, *user)
 }
 
-// DeleteUser - Deletes a user object from the database
-func (s *Service) DeleteUser(ID uint) error {
-	if result := s.DB.Delete(&User{}, ID); result.Error != nil {
-		return result.Error
+// DeleteUser - Deletes a user object from the store.
+// Unless version is AnyVersion, ErrVersionMismatch is returned if the user is no longer at that version
+func (s *Service) DeleteUser(ctx context.Context, ID uint, version uint) error {
+	return s.Store.Transaction(func(tx Store) error {
+		_, err := remove(ctx, tx, ID, version)
+		return err
+	})
+}
+
+// remove - soft deletes the user through tx, along with its audit entry, revision and event, and returns it as deleted
+func remove(ctx context.Context, tx Store, ID uint, version uint) (User, error) {
+	before, err := tx.GetByID(ID)
+	if err != nil {
+		return User{}, err
 	}
-	return nil
+	if err := tx.Delete(ID, version); err != nil {
+		return User{}, err
+	}
+	after, err := tx.GetDeletedByID(ID)
+	if err != nil {
+		return User{}, err
+	}
+	if err := audit(ctx, tx, AuditDelete, ID, &before, &after); err != nil {
+		return User{}, err
+	}
+	if err := revise(tx, after); err != nil {
+		return User{}, err
+	}
+	return after, emit(tx, EventUserDeleted, after)
 }
 
-// GetAllUsers - returns all users from the database as a Users object
+// GetAllUsers - returns all users from the store as a Users object
 func (s *Service) GetAllUsers() (Users, error) {
-	var users Users
-	if result := s.DB.Find(&users); result.Error != nil {
-		return []User{}, result.Error
+	return s.Store.All()
+}
+
+// ListUsers - returns a single page of users matching the given filters, in the given order,
+// along with the total number of users matching the filters
+func (s *Service) ListUsers(opts ListOptions) (Page, error) {
+	if err := opts.Validate(); err != nil {
+		return Page{}, err
+	}
+	return s.Store.List(opts)
+}
+
+// UserCounts - how many users there are, live and soft-deleted
+type UserCounts struct {
+	Active  int64
+	Deleted int64
+}
+
+// CountUsers - counts the live and soft-deleted users
+func (s *Service) CountUsers() (UserCounts, error) {
+	active, err := s.ListUsers(ListOptions{Limit: 1})
+	if err != nil {
+		return UserCounts{}, err
+	}
+	deleted, err := s.ListUsers(ListOptions{Limit: 1, Deleted: true})
+	if err != nil {
+		return UserCounts{}, err
+	}
+	return UserCounts{Active: active.Total, Deleted: deleted.Total}, nil
+}
+
+// GetDeletedUser - retreives a soft-deleted user by ID from the store
+func (s *Service) GetDeletedUser(ID uint) (User, error) {
+	return s.Store.GetDeletedByID(ID)
+}
+
+// RestoreUser - undeletes a soft-deleted user and returns it. Returns ErrDuplicate if somebody else
+// has signed up with its username or email since it was deleted
+func (s *Service) RestoreUser(ctx context.Context, ID uint) (User, error) {
+	var restored User
+	err := s.Store.Transaction(func(tx Store) error {
+		before, err := tx.GetDeletedByID(ID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Restore(ID); err != nil {
+			return err
+		}
+		if restored, err = tx.GetByID(ID); err != nil {
+			return err
+		}
+		if err := audit(ctx, tx, AuditRestore, ID, &before, &restored); err != nil {
+			return err
+		}
+		if err := revise(tx, restored); err != nil {
+			return err
+		}
+		return emit(tx, EventUserUpdated, restored)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return restored, nil
+}
+
+// PurgeUser - permanently removes a soft-deleted user. Live users have to be deleted first.
+// The users audit log is kept, with a last entry for the purge
+func (s *Service) PurgeUser(ctx context.Context, ID uint) error {
+	return s.Store.Transaction(func(tx Store) error {
+		before, err := tx.GetDeletedByID(ID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Purge(ID); err != nil {
+			return err
+		}
+		return audit(ctx, tx, AuditPurge, ID, &before, nil)
+	})
+}
+
+// GetAuditLog - returns a page of the audit log for the user with the given ID, oldest change first.
+// The log is kept even after the user is purged, so this never returns ErrNotFound
+func (s *Service) GetAuditLog(ID uint, opts HistoryOptions) (AuditPage, error) {
+	if err := opts.Validate(); err != nil {
+		return AuditPage{}, err
+	}
+	return s.Store.ListAudit(ID, opts)
+}
+
+// GetUserAsOf - returns the user with the given ID as it was at the given time, from its revisions.
+// Returns ErrNotFound if the user had no revisions yet at that time (ie it didn't exist), or had been deleted by then
+func (s *Service) GetUserAsOf(ID uint, at time.Time) (User, error) {
+	revision, err := s.Store.GetRevisionAt(ID, at)
+	if err != nil {
+		return User{}, err
+	}
+	old := revision.User()
+	if old.DeletedAt != nil {
+		return User{}, ErrNotFound
+	}
+	return old, nil
+}
+
+// ListRevisions - returns a page of the revisions of the user with the given ID, oldest first.
+// A purged users revisions are removed along with it
+func (s *Service) ListRevisions(ID uint, opts HistoryOptions) (RevisionPage, error) {
+	if err := opts.Validate(); err != nil {
+		return RevisionPage{}, err
+	}
+	return s.Store.ListRevisions(ID, opts)
+}
+
+// RevertUser - changes the user with the given ID back to how it was at revision number. The revert is an
+// update like any other - it is validated (ie the old username might have been taken since), checked against
+// version, audited and makes a new revision. Passwords aren't kept in revisions, so the password is left alone.
+// Returns ErrRevisionNotFound if the user has no such revision
+func (s *Service) RevertUser(ctx context.Context, ID uint, number uint, version uint) (User, error) {
+	revision, err := s.Store.GetRevision(ID, number)
+	if errors.Is(err, ErrNotFound) {
+		return User{}, ErrRevisionNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	old := revision.User()
+	changes := User{
+		Username:  old.Username,
+		FirstName: old.FirstName,
+		LastName:  old.LastName,
+		Email:     old.Email,
+		Telephone: old.Telephone,
+		Role:      old.Role,
 	}
-	return users, nil
+	return s.update(ctx, AuditRevert, ID, changes, version)
 }
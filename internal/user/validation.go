@@ -0,0 +1,82 @@
+package user
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Email regex for validation
+var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+// Phone number regex for validation (not acutally cleaning them, probabably would in production)
+var phoneRegex = regexp.MustCompile(`^(?:(?:\(?(?:00|\+)([1-4]\d\d|[1-9]\d?)\)?)?[\-\.\ \\\/]?)?((?:\(?\d{1,}\)?[\-\.\ \\\/]?){0,})(?:[\-\.\ \\\/]?(?:#|ext\.?|extension|x)[\-\.\ \\\/]?(\d+))?$`)
+
+// Validation rule codes - these are what clients should match on, the messages are just for people
+const (
+	CodeRequired      = "required"
+	CodeInvalidLength = "invalid_length"
+	CodeInvalidFormat = "invalid_format"
+	CodeInvalidValue  = "invalid_value"
+	CodeReadOnly      = "read_only"
+	CodeUnknownField  = "unknown_field"
+)
+
+// FieldError - a single validation failure. Field is the name of the field as it appears in
+// request bodies, Code is one of the Code constants above
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+// ValidationErrors - every validation failure for a user, so a client can show them all at once
+type ValidationErrors []FieldError
+
+// Error - lists every failure as "Field: code", ie "Email: invalid_format, Telephone: required"
+func (v ValidationErrors) Error() string {
+	parts := make([]string, 0, len(v))
+	for _, e := range v {
+		parts = append(parts, fmt.Sprintf("%s: %s", e.Field, e.Code))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// IsValid - this is called within a BeforeCreate hook on the gorm User model.
+// This will check to make sure fields are entered, sized correctly, are valid data, etc.
+// Every rule is checked, and every failure is returned - not just the first one.
+// An empty Role is allowed, since BeforeCreate fills it in
+func (u *User) IsValid() (bool, ValidationErrors) {
+	var errs ValidationErrors
+
+	errs = checkLength(errs, "FirstName", u.FirstName, 2, 255, "Length of FirstName is not between 2-255 characters")
+	errs = checkLength(errs, "LastName", u.LastName, 2, 255, "Length of LastName is not between 2-255 characters")
+	errs = checkLength(errs, "Password", u.Password, 8, 255, "Length of Password is not between 8-255 characters")
+
+	errs = checkLength(errs, "Email", u.Email, 5, 255, "Length of the email is not between 5-255 characters")
+	if len(u.Email) > 0 && !emailRegex.MatchString(u.Email) {
+		errs = append(errs, FieldError{Field: "Email", Code: CodeInvalidFormat, Message: "Email is not a valid address"})
+	}
+
+	errs = checkLength(errs, "Telephone", u.Telephone, 5, 50, "Length of the telephone number is not between 5-50 characters")
+	if len(u.Telephone) > 0 && !phoneRegex.MatchString(u.Telephone) {
+		errs = append(errs, FieldError{Field: "Telephone", Code: CodeInvalidFormat, Message: "Telephone number is not a valid number"})
+	}
+
+	if u.Role != "" && !u.Role.IsValid() {
+		errs = append(errs, FieldError{Field: "Role", Code: CodeInvalidValue, Message: "Role is not one of admin, support or user"})
+	}
+
+	return len(errs) == 0, errs
+}
+
+// checkLength - adds a required error if value is empty, or an invalid_length error if it isn't between min and max
+func checkLength(errs ValidationErrors, field, value string, min, max int, msg string) ValidationErrors {
+	if len(value) == 0 {
+		return append(errs, FieldError{Field: field, Code: CodeRequired, Message: fmt.Sprintf("%s is required", field)})
+	}
+	if len(value) < min || len(value) > max {
+		return append(errs, FieldError{Field: field, Code: CodeInvalidLength, Message: msg})
+	}
+	return errs
+}
@@ -0,0 +1,285 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// Delivery defaults - how deliveries are retried unless the service is told otherwise.
+// With these, an event is tried 8 times over roughly 21 minutes before it is dead-lettered
+const (
+	DefaultMaxAttempts  = 8
+	DefaultBaseBackoff  = 10 * time.Second
+	DefaultMaxBackoff   = time.Hour
+	DefaultTimeout      = 10 * time.Second
+	DefaultLease        = time.Minute
+	DefaultPollInterval = 5 * time.Second
+)
+
+// Service - the webhook service. Keeps track of subscribers, turns the user services events into deliveries
+// for them (it is an outbox.Sink), and sends those deliveries with retries.
+//
+// A failed delivery (anything but a 2xx, or no answer) is tried again after BaseBackoff, doubling every attempt
+// up to MaxBackoff, and is dead-lettered once it has been tried MaxAttempts times. Lease is how long a
+// delivery being sent is hidden from other senders - deliveries are claimed one at a time, just before they're
+// sent, so it only has to be longer than the Clients timeout. If a sender does outlast its lease (and someone
+// else claims the delivery) whatever it found out is thrown away, rather than overwriting the new senders attempt
+type Service struct {
+	Store        Store
+	Client       *http.Client
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	Lease        time.Duration
+	PollInterval time.Duration
+
+	// wake - nudges Run to send new deliveries now, rather than at its next poll
+	wake chan struct{}
+}
+
+// NewService - returns a new webhook service on top of the given store, with the default retry settings
+func NewService(store Store) *Service {
+	return &Service{
+		Store:        store,
+		Client:       &http.Client{Timeout: DefaultTimeout},
+		MaxAttempts:  DefaultMaxAttempts,
+		BaseBackoff:  DefaultBaseBackoff,
+		MaxBackoff:   DefaultMaxBackoff,
+		Lease:        DefaultLease,
+		PollInterval: DefaultPollInterval,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Subscribe - registers a new subscriber. The returned subscription includes its secret, which is never shown again.
+// Returns ValidationErrors if the request isn't valid (see SubscriptionRequest.Validate)
+func (s *Service) Subscribe(req SubscriptionRequest) (Subscription, error) {
+	if err := req.Validate(); err != nil {
+		return Subscription{}, err
+	}
+
+	types := make([]string, len(req.Events))
+	for i, t := range req.Events {
+		types[i] = string(t)
+	}
+	sub := Subscription{
+		URL:    req.URL,
+		Secret: req.Secret,
+		Events: strings.Join(types, ","),
+	}
+	if err := s.Store.CreateSubscription(&sub); err != nil {
+		return Subscription{}, err
+	}
+	return sub, nil
+}
+
+// ListSubscriptions - every subscriber, oldest first
+func (s *Service) ListSubscriptions() ([]Subscription, error) {
+	return s.Store.ListSubscriptions()
+}
+
+// Unsubscribe - removes a subscriber, along with any deliveries still on their way to it
+func (s *Service) Unsubscribe(ID uint) error {
+	return s.Store.DeleteSubscription(ID)
+}
+
+// ListDeadLetters - every delivery that ran out of attempts, oldest first
+func (s *Service) ListDeadLetters() ([]Delivery, error) {
+	return s.Store.ListDeadLetters()
+}
+
+// Redeliver - sends a delivery again, with a fresh set of attempts. Usually used on dead letters once whatever
+// was wrong with the subscriber has been fixed, but it works on any delivery
+func (s *Service) Redeliver(ID uint) (Delivery, error) {
+	d, err := s.Store.GetDelivery(ID)
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	now := time.Now()
+	d.Attempts = 0
+	d.NextAttemptAt = &now
+	d.DeliveredAt = nil
+	d.DeadAt = nil
+	if err := s.Store.UpdateDelivery(&d); err != nil {
+		return Delivery{}, err
+	}
+	s.nudge()
+	return d, nil
+}
+
+// Publish - queues a delivery of the event for every subscriber that wants it. The webhook service is a sink for
+// the outbox relay, so if this fails the event is published again later, and subscribers that were already
+// queued get it twice - which they can spot by its X-Webhook-ID
+func (s *Service) Publish(ctx context.Context, event user.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	subs, err := s.Store.ListSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	queued := false
+	for _, sub := range subs {
+		if !sub.Wants(event.Type) {
+			continue
+		}
+		now := time.Now()
+		d := Delivery{
+			SubscriptionID: sub.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Payload:        string(payload),
+			NextAttemptAt:  &now,
+		}
+		if err := s.Store.CreateDelivery(&d); err != nil {
+			return err
+		}
+		queued = true
+	}
+	if queued {
+		s.nudge()
+	}
+	return nil
+}
+
+// DeliverDue - sends every delivery that was due when it was called, and returns how many were sent (whether they
+// worked or not). Each delivery is claimed just before it is sent, so its lease is only spent on sending it.
+// Run calls this whenever there might be something to send, but it can be called directly (ie in tests)
+func (s *Service) DeliverDue(ctx context.Context) (int, error) {
+	start := time.Now()
+	sent := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+		due, err := s.Store.ClaimDue(start, time.Now().Add(s.Lease), 1)
+		if err != nil {
+			return sent, err
+		}
+		if len(due) == 0 {
+			return sent, nil
+		}
+
+		d := due[0]
+		claimedUntil := *d.NextAttemptAt
+		s.attempt(ctx, &d)
+		finished, err := s.Store.FinishDelivery(&d, claimedUntil)
+		if err != nil {
+			return sent, err
+		}
+		if !finished {
+			fmt.Printf("Webhook delivery %d changed hands while it was being sent (ie it outlasted its lease), so this attempt wasn't saved\n", d.ID)
+		}
+		sent++
+	}
+}
+
+// Run - sends deliveries as they're queued (and retries them as they come due) until ctx is done
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.DeliverDue(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("Unable to send webhook deliveries: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// nudge - wakes Run up, if it isn't already about to wake up
+func (s *Service) nudge() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// attempt - sends the delivery to its subscriber once, and records how it went on d
+func (s *Service) attempt(ctx context.Context, d *Delivery) {
+	now := time.Now()
+	d.Attempts++
+
+	status, err := s.send(ctx, d)
+	d.LastStatus = status
+	if err == nil {
+		d.LastError = ""
+		d.DeliveredAt = &now
+		d.NextAttemptAt = nil
+		return
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts >= s.MaxAttempts {
+		d.DeadAt = &now
+		d.NextAttemptAt = nil
+		return
+	}
+	next := now.Add(s.backoff(d.Attempts))
+	d.NextAttemptAt = &next
+}
+
+// send - POSTs the delivery to its subscriber, signed with their secret. Returns the status code they answered
+// with, and an error unless it was a 2xx
+func (s *Service) send(ctx context.Context, d *Delivery) (int, error) {
+	sub, err := s.Store.GetSubscription(d.SubscriptionID)
+	if err != nil {
+		return 0, err
+	}
+
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, d.EventID)
+	req.Header.Set(HeaderEvent, string(d.EventType))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, timestamp, body))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber answered with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff - how long to wait before trying a delivery again, after it has failed the given number of attempts
+func (s *Service) backoff(attempts int) time.Duration {
+	wait := s.BaseBackoff
+	for i := 1; i < attempts && wait < s.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > s.MaxBackoff {
+		wait = s.MaxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,350 @@
+package webhook
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Store - where the webhook service keeps subscriptions and deliveries. GormStore keeps them in postgres,
+// MemoryStore keeps them in maps so the whole api can run in-process (ie in tests)
+type Store interface {
+	CreateSubscription(s *Subscription) error
+	// GetSubscription - returns ErrSubscriptionNotFound if there is no subscription with the given ID
+	GetSubscription(ID uint) (Subscription, error)
+	ListSubscriptions() ([]Subscription, error)
+	// DeleteSubscription - removes a subscription along with its deliveries.
+	// Returns ErrSubscriptionNotFound if there is no subscription with the given ID
+	DeleteSubscription(ID uint) error
+
+	CreateDelivery(d *Delivery) error
+	// GetDelivery - returns ErrDeliveryNotFound if there is no delivery with the given ID
+	GetDelivery(ID uint) (Delivery, error)
+	UpdateDelivery(d *Delivery) error
+	// FinishDelivery - saves how an attempt at a delivery claimed with ClaimDue went, but only if it is still claimed
+	// until claimedUntil. Returns false (and saves nothing) if it isn't - the lease ran out and someone else
+	// claimed it, it was redelivered, or it has been deleted
+	FinishDelivery(d *Delivery, claimedUntil time.Time) (bool, error)
+	// ClaimDue - returns up to limit deliveries that were due by dueBy, pushing their NextAttemptAt out to until
+	// so nobody else (ie another instance of the api) picks them up while they're being sent.
+	// If the sender dies before updating a delivery it just becomes due again once the lease runs out
+	ClaimDue(dueBy, until time.Time, limit int) ([]Delivery, error)
+	// ListDeadLetters - every delivery that ran out of attempts, oldest first
+	ListDeadLetters() ([]Delivery, error)
+}
+
+// GormStore - a Store that keeps subscriptions and deliveries in our database through gorm
+type GormStore struct {
+	DB *gorm.DB
+}
+
+// NewGormStore - returns a new gorm backed webhook store
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{
+		DB: db,
+	}
+}
+
+// CreateSubscription - inserts a new subscription
+func (s *GormStore) CreateSubscription(sub *Subscription) error {
+	return s.DB.Create(sub).Error
+}
+
+// GetSubscription - retreives a subscription by ID
+func (s *GormStore) GetSubscription(ID uint) (Subscription, error) {
+	var sub Subscription
+	if result := s.DB.First(&sub, ID); result.Error != nil {
+		if gorm.IsRecordNotFoundError(result.Error) {
+			return Subscription{}, ErrSubscriptionNotFound
+		}
+		return Subscription{}, result.Error
+	}
+	return sub, nil
+}
+
+// ListSubscriptions - every subscription, oldest first
+func (s *GormStore) ListSubscriptions() ([]Subscription, error) {
+	subs := []Subscription{}
+	if err := s.DB.Order("id").Find(&subs).Error; err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// DeleteSubscription - removes a subscription and its deliveries. The foreign key cascades too,
+// but deleting them here means we don't depend on it
+func (s *GormStore) DeleteSubscription(ID uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("subscription_id = ?", ID).Delete(&Delivery{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id = ?", ID).Delete(&Subscription{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrSubscriptionNotFound
+		}
+		return nil
+	})
+}
+
+// CreateDelivery - inserts a new delivery
+func (s *GormStore) CreateDelivery(d *Delivery) error {
+	return s.DB.Create(d).Error
+}
+
+// GetDelivery - retreives a delivery by ID
+func (s *GormStore) GetDelivery(ID uint) (Delivery, error) {
+	var d Delivery
+	if result := s.DB.First(&d, ID); result.Error != nil {
+		if gorm.IsRecordNotFoundError(result.Error) {
+			return Delivery{}, ErrDeliveryNotFound
+		}
+		return Delivery{}, result.Error
+	}
+	return d, nil
+}
+
+// UpdateDelivery - saves the fields that change on a delivery (ie when it is redelivered). Save isn't used since it
+// would insert the delivery again if its subscription (and so the delivery) had been deleted in the meantime
+func (s *GormStore) UpdateDelivery(d *Delivery) error {
+	return s.DB.Model(d).Updates(map[string]interface{}{
+		"attempts":        d.Attempts,
+		"next_attempt_at": d.NextAttemptAt,
+		"last_status":     d.LastStatus,
+		"last_error":      d.LastError,
+		"delivered_at":    d.DeliveredAt,
+		"dead_at":         d.DeadAt,
+	}).Error
+}
+
+// FinishDelivery - saves how the attempt went, if the delivery's NextAttemptAt is still the lease we claimed it with
+func (s *GormStore) FinishDelivery(d *Delivery, claimedUntil time.Time) (bool, error) {
+	result := s.DB.Model(&Delivery{}).Where("id = ? AND next_attempt_at = ?", d.ID, claimedUntil).
+		Updates(map[string]interface{}{
+			"attempts":        d.Attempts,
+			"next_attempt_at": d.NextAttemptAt,
+			"last_status":     d.LastStatus,
+			"last_error":      d.LastError,
+			"delivered_at":    d.DeliveredAt,
+			"dead_at":         d.DeadAt,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ClaimDue - claims each due delivery by moving its NextAttemptAt, but only if it is still what we read.
+// If someone else claimed it between the read and the write they'll have moved it, and we skip it.
+// The lease is cut to the microsecond, since that's all postgres keeps, so FinishDelivery can match it exactly
+func (s *GormStore) ClaimDue(dueBy, until time.Time, limit int) ([]Delivery, error) {
+	var due []Delivery
+	err := s.DB.Where("next_attempt_at <= ?", dueBy).
+		Order("next_attempt_at, id").
+		Limit(limit).
+		Find(&due).Error
+	if err != nil {
+		return nil, err
+	}
+
+	until = until.Truncate(time.Microsecond)
+	claimed := []Delivery{}
+	for _, d := range due {
+		result := s.DB.Model(&Delivery{}).
+			Where("id = ? AND next_attempt_at = ?", d.ID, d.NextAttemptAt).
+			Update("next_attempt_at", until)
+		if result.Error != nil {
+			return claimed, result.Error
+		}
+		if result.RowsAffected == 1 {
+			d.NextAttemptAt = &until
+			claimed = append(claimed, d)
+		}
+	}
+	return claimed, nil
+}
+
+// ListDeadLetters - every delivery that ran out of attempts, oldest first
+func (s *GormStore) ListDeadLetters() ([]Delivery, error) {
+	dead := []Delivery{}
+	if err := s.DB.Where("dead_at IS NOT NULL").Order("id").Find(&dead).Error; err != nil {
+		return nil, err
+	}
+	return dead, nil
+}
+
+// MemoryStore - a Store that keeps subscriptions and deliveries in memory
+type MemoryStore struct {
+	mu                 sync.Mutex
+	nextSubscriptionID uint
+	nextDeliveryID     uint
+	subscriptions      map[uint]Subscription
+	deliveries         map[uint]Delivery
+}
+
+// NewMemoryStore - returns a new, empty in-memory webhook store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nextSubscriptionID: 1,
+		nextDeliveryID:     1,
+		subscriptions:      map[uint]Subscription{},
+		deliveries:         map[uint]Delivery{},
+	}
+}
+
+// CreateSubscription - stores a new subscription
+func (s *MemoryStore) CreateSubscription(sub *Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sub.ID = s.nextSubscriptionID
+	sub.CreatedAt = now
+	sub.UpdatedAt = now
+	s.subscriptions[sub.ID] = *sub
+	s.nextSubscriptionID++
+	return nil
+}
+
+// GetSubscription - retreives a subscription by ID
+func (s *MemoryStore) GetSubscription(ID uint) (Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[ID]
+	if !ok {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// ListSubscriptions - every subscription, oldest first
+func (s *MemoryStore) ListSubscriptions() ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := make([]Subscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+// DeleteSubscription - removes a subscription and its deliveries
+func (s *MemoryStore) DeleteSubscription(ID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscriptions[ID]; !ok {
+		return ErrSubscriptionNotFound
+	}
+	delete(s.subscriptions, ID)
+	for id, d := range s.deliveries {
+		if d.SubscriptionID == ID {
+			delete(s.deliveries, id)
+		}
+	}
+	return nil
+}
+
+// CreateDelivery - stores a new delivery
+func (s *MemoryStore) CreateDelivery(d *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	d.ID = s.nextDeliveryID
+	d.CreatedAt = now
+	d.UpdatedAt = now
+	s.deliveries[d.ID] = *d
+	s.nextDeliveryID++
+	return nil
+}
+
+// GetDelivery - retreives a delivery by ID
+func (s *MemoryStore) GetDelivery(ID uint) (Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.deliveries[ID]
+	if !ok {
+		return Delivery{}, ErrDeliveryNotFound
+	}
+	return d, nil
+}
+
+// UpdateDelivery - saves every field of the delivery. Deliveries whose subscription has been deleted
+// are gone, and stay gone
+func (s *MemoryStore) UpdateDelivery(d *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.deliveries[d.ID]; !ok {
+		return nil
+	}
+	d.UpdatedAt = time.Now()
+	s.deliveries[d.ID] = *d
+	return nil
+}
+
+// FinishDelivery - saves every field of the delivery, if it is still claimed until claimedUntil
+func (s *MemoryStore) FinishDelivery(d *Delivery, claimedUntil time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.deliveries[d.ID]
+	if !ok || current.NextAttemptAt == nil || !current.NextAttemptAt.Equal(claimedUntil) {
+		return false, nil
+	}
+	d.UpdatedAt = time.Now()
+	s.deliveries[d.ID] = *d
+	return true, nil
+}
+
+// ClaimDue - claims the deliveries due by dueBy, oldest due first
+func (s *MemoryStore) ClaimDue(dueBy, until time.Time, limit int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []Delivery{}
+	for _, d := range s.deliveries {
+		if d.NextAttemptAt != nil && !d.NextAttemptAt.After(dueBy) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(*due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for i := range due {
+		due[i].NextAttemptAt = &until
+		s.deliveries[due[i].ID] = due[i]
+	}
+	return due, nil
+}
+
+// ListDeadLetters - every delivery that ran out of attempts, oldest first
+func (s *MemoryStore) ListDeadLetters() ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dead := []Delivery{}
+	for _, d := range s.deliveries {
+		if d.DeadAt != nil {
+			dead = append(dead, d)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].ID < dead[j].ID })
+	return dead, nil
+}
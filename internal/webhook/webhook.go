@@ -0,0 +1,251 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+)
+
+// Errors returned by the webhook service. They're user.Errors, so the handler reports them like any other
+var (
+	ErrSubscriptionNotFound = &user.Error{Kind: user.KindNotFound, Message: "Webhook subscription not found"}
+	ErrDeliveryNotFound     = &user.Error{Kind: user.KindNotFound, Message: "Webhook delivery not found"}
+)
+
+// MinSecretLength - the shortest secret a subscriber can choose to sign their deliveries with
+const MinSecretLength = 16
+
+// Headers sent with every delivery. The signature is "sha256=" followed by the hex HMAC-SHA256 of the timestamp,
+// a ".", and the body, keyed with the subscriptions secret (see Sign). X-Webhook-ID is the events ID, and is the
+// same for every attempt at delivering it, so receivers can ignore an event they've already seen
+const (
+	HeaderID        = "X-Webhook-ID"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Subscription - somewhere to send user events to. Events is a comma separated list of the event types the
+// subscriber wants. The Secret is only ever shown when the subscription is created
+type Subscription struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	URL       string
+	Secret    string
+	Events    string
+}
+
+// TableName - the table gorm keeps subscriptions in
+func (Subscription) TableName() string {
+	return "webhook_subscriptions"
+}
+
+// SubscriptionRequest - the body of a request to subscribe to events. Secret can be left out to have one
+// generated, and leaving out Events subscribes to every event type
+type SubscriptionRequest struct {
+	URL    string
+	Secret string
+	Events []user.EventType
+}
+
+// SubscriptionResponse - a subscription as it is shown once it has been created, without its Secret
+type SubscriptionResponse struct {
+	ID        uint
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	URL       string
+	Events    []user.EventType
+}
+
+// EventTypes - the event types the subscriber wants, split back out of Events
+func (s *Subscription) EventTypes() []user.EventType {
+	types := []user.EventType{}
+	for _, t := range strings.Split(s.Events, ",") {
+		if t != "" {
+			types = append(types, user.EventType(t))
+		}
+	}
+	return types
+}
+
+// Wants - whether the subscriber wants events of the given type
+func (s *Subscription) Wants(eventType user.EventType) bool {
+	for _, t := range s.EventTypes() {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// ToResponse - the subscription as it is shown to callers, without its secret
+func (s *Subscription) ToResponse() SubscriptionResponse {
+	return SubscriptionResponse{
+		ID:        s.ID,
+		CreatedAt: s.CreatedAt,
+		UpdatedAt: s.UpdatedAt,
+		URL:       s.URL,
+		Events:    s.EventTypes(),
+	}
+}
+
+// Delivery statuses - a delivery is pending until it is delivered, or dead once it has run out of attempts
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Delivery - a single event on its way to a single subscriber, and how getting it there is going.
+// NextAttemptAt is when it is next due to be sent, and is null once it has been delivered or is dead.
+// LastStatus is the status code the subscriber last answered with (0 if they couldn't be reached),
+// and LastError says what went wrong
+type Delivery struct {
+	ID             uint `gorm:"primary_key"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	SubscriptionID uint
+	EventID        string
+	EventType      user.EventType
+	Payload        string `gorm:"type:jsonb"`
+	Attempts       int
+	NextAttemptAt  *time.Time
+	LastStatus     int
+	LastError      string
+	DeliveredAt    *time.Time
+	DeadAt         *time.Time
+}
+
+// TableName - the table gorm keeps deliveries in
+func (Delivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// DeliveryResponse - a delivery as it is shown to callers, with its payload as json rather than a string
+type DeliveryResponse struct {
+	ID             uint
+	CreatedAt      time.Time
+	SubscriptionID uint
+	EventID        string
+	EventType      user.EventType
+	Payload        json.RawMessage
+	Status         string
+	Attempts       int
+	NextAttemptAt  *time.Time
+	LastStatus     int
+	LastError      string
+	DeliveredAt    *time.Time
+	DeadAt         *time.Time
+}
+
+// Status - whether the delivery is pending, delivered or dead
+func (d *Delivery) Status() string {
+	switch {
+	case d.DeliveredAt != nil:
+		return StatusDelivered
+	case d.DeadAt != nil:
+		return StatusDead
+	}
+	return StatusPending
+}
+
+// ToResponse - the delivery as it is shown to callers
+func (d *Delivery) ToResponse() DeliveryResponse {
+	return DeliveryResponse{
+		ID:             d.ID,
+		CreatedAt:      d.CreatedAt,
+		SubscriptionID: d.SubscriptionID,
+		EventID:        d.EventID,
+		EventType:      d.EventType,
+		Payload:        json.RawMessage(d.Payload),
+		Status:         d.Status(),
+		Attempts:       d.Attempts,
+		NextAttemptAt:  d.NextAttemptAt,
+		LastStatus:     d.LastStatus,
+		LastError:      d.LastError,
+		DeliveredAt:    d.DeliveredAt,
+		DeadAt:         d.DeadAt,
+	}
+}
+
+// Sign - the signature sent in the X-Webhook-Signature header of a delivery with the given timestamp and body.
+// Receivers check a delivery came from us by computing the same thing with their secret
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify - whether signature is the right signature for the timestamp and body, compared in constant time
+func Verify(secret, timestamp, signature string, body []byte) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Validate - checks the request is a subscription we can deliver to, filling in a generated Secret
+// and every event type if they were left out. Returns ValidationErrors listing everything that is wrong
+func (r *SubscriptionRequest) Validate() error {
+	var errs user.ValidationErrors
+
+	u, err := url.Parse(r.URL)
+	switch {
+	case r.URL == "":
+		errs = append(errs, user.FieldError{Field: "URL", Code: user.CodeRequired, Message: "URL is required"})
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		errs = append(errs, user.FieldError{Field: "URL", Code: user.CodeInvalidFormat, Message: "URL must be an absolute http or https URL"})
+	}
+
+	if r.Secret == "" {
+		secret, err := randomSecret()
+		if err != nil {
+			return &user.Error{Kind: user.KindInternal, Message: "Internal error", Err: err}
+		}
+		r.Secret = secret
+	} else if len(r.Secret) < MinSecretLength || len(r.Secret) > 255 {
+		errs = append(errs, user.FieldError{Field: "Secret", Code: user.CodeInvalidLength,
+			Message: fmt.Sprintf("Length of Secret is not between %d-255 characters", MinSecretLength)})
+	}
+
+	if len(r.Events) == 0 {
+		r.Events = user.EventTypes
+	}
+	for _, t := range r.Events {
+		if !knownEventType(t) {
+			errs = append(errs, user.FieldError{Field: "Events", Code: user.CodeInvalidValue, Message: fmt.Sprintf("%s is not an event type", t)})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// knownEventType - whether the user service publishes events of the given type
+func knownEventType(eventType user.EventType) bool {
+	for _, t := range user.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// randomSecret - a new random secret for a subscriber that didn't choose their own
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,790 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/auth"
+	"github.com/aebranton/rest-api/internal/idempotency"
+	"github.com/aebranton/rest-api/internal/outbox"
+	transHTTP "github.com/aebranton/rest-api/internal/transport/http"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/aebranton/rest-api/internal/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests run the whole api in-process on top of the in-memory stores, so unlike the e2e tests
+// they don't need docker or a database, and each test gets a fresh api to itself
+
+// testAPI - an in-process api and the services behind it.
+// Nothing runs in the background - tests relay the outbox and send webhook deliveries with deliver
+type testAPI struct {
+	t           *testing.T
+	server      http.Handler
+	users       *user.Service
+	authSvc     *auth.Service
+	webhooks    *webhook.Service
+	events      *outbox.Broadcaster
+	relay       *outbox.Relay
+	tail        *outbox.Tail
+	idempotency *idempotency.Service
+	handler     *transHTTP.Handler
+}
+
+// newTestAPI - builds a fresh api on top of empty in-memory stores, with an admin account (user 1)
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	users := user.NewService(user.NewMemoryStore())
+	_, err := users.EnsureAdmin(context.Background(), "admin", "adminpassword", "admin@example.com")
+	require.NoError(t, err)
+
+	webhooks := webhook.NewService(webhook.NewMemoryStore())
+	events := outbox.NewBroadcaster(outbox.DefaultReplaySize)
+	relay := outbox.NewRelay(users.Store, webhooks)
+	tail := outbox.NewTail(users.Store, events)
+
+	authSvc := auth.NewService(auth.NewMemoryTokenStore(), users, []byte("test-secret"), time.Minute, time.Hour)
+	handler := transHTTP.NewHandler(users, authSvc)
+	handler.Webhooks = webhooks
+	handler.Events = events
+	handler.Idempotency = idempotency.NewService(idempotency.NewMemoryStore(), idempotency.DefaultTTL)
+	handler.InitRoutes()
+
+	return &testAPI{t: t, server: handler.Router, users: users, authSvc: authSvc, webhooks: webhooks,
+		events: events, relay: relay, tail: tail, idempotency: handler.Idempotency, handler: handler}
+}
+
+// do - sends a request to the api and returns the recorded response. body can be a string or anything json encodable
+func (a *testAPI) do(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	a.t.Helper()
+	return a.doWithHeaders(method, path, token, body, nil)
+}
+
+// doWithHeaders - like do, but sets the given headers on the request too
+func (a *testAPI) doWithHeaders(method, path, token string, body interface{}, headers map[string]string) *httptest.ResponseRecorder {
+	a.t.Helper()
+	var raw []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		raw = []byte(b)
+	default:
+		var err error
+		raw, err = json.Marshal(b)
+		require.NoError(a.t, err)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	a.server.ServeHTTP(rec, req)
+	return rec
+}
+
+// createUser - signs up a regular user, with their username as their password
+func (a *testAPI) createUser(username string) user.UserResponse {
+	a.t.Helper()
+	rec := a.do("POST", "/api/user", "", map[string]string{
+		"Username":  username,
+		"Password":  username + "password",
+		"FirstName": "Testy",
+		"LastName":  "McTest",
+		"Email":     username + "@example.com",
+		"Telephone": "5555555555",
+	})
+	require.Equal(a.t, 200, rec.Code, rec.Body.String())
+
+	var created user.UserResponse
+	require.NoError(a.t, json.Unmarshal(rec.Body.Bytes(), &created))
+	return created
+}
+
+// login - logs in and returns an access token
+func (a *testAPI) login(username, password string) string {
+	a.t.Helper()
+	rec := a.do("POST", "/api/auth/token", "", map[string]string{"Username": username, "Password": password})
+	require.Equal(a.t, 200, rec.Code, rec.Body.String())
+
+	var tokens auth.TokenPair
+	require.NoError(a.t, json.Unmarshal(rec.Body.Bytes(), &tokens))
+	return tokens.AccessToken
+}
+
+// TestInProcessUserLifecycle - create, log in, read, update and delete a user
+func TestInProcessUserLifecycle(t *testing.T) {
+	api := newTestAPI(t)
+	created := api.createUser("testyguy")
+	assert.Equal(t, uint(2), created.ID)
+	assert.Equal(t, user.RoleUser, created.Role)
+
+	token := api.login("testyguy", "testyguypassword")
+	admin := api.login("admin", "adminpassword")
+
+	rec := api.do("GET", "/api/user/2", token, nil)
+	assert.Equal(t, 200, rec.Code)
+
+	rec = api.do("GET", "/api/user?username=testyguy", token, nil)
+	assert.Equal(t, 200, rec.Code)
+
+	rec = api.do("PUT", "/api/user/2", token, `{"Telephone": "6666666666"}`)
+	assert.Equal(t, 200, rec.Code)
+	var updated user.UserResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &updated))
+	assert.Equal(t, "6666666666", updated.Telephone)
+
+	rec = api.do("DELETE", "/api/user/2", admin, nil)
+	assert.Equal(t, 200, rec.Code)
+
+	rec = api.do("GET", "/api/user/2", admin, nil)
+	assert.Equal(t, 404, rec.Code)
+}
+
+// TestInProcessPolicy - regular users can only see themselves
+func TestInProcessPolicy(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	token := api.login("testyguy", "testyguypassword")
+
+	assert.Equal(t, 401, api.do("GET", "/api/user", "", nil).Code)
+	assert.Equal(t, 403, api.do("GET", "/api/user", token, nil).Code)
+	assert.Equal(t, 403, api.do("GET", "/api/user/1", token, nil).Code)
+	assert.Equal(t, 403, api.do("DELETE", "/api/user/2", token, nil).Code)
+	assert.Equal(t, 403, api.do("PUT", "/api/user/2", token, `{"Role": "admin"}`).Code)
+}
+
+// TestInProcessStaleRole - access tokens are held to the users current role, not the one they were issued with,
+// and stop working once the user is deleted
+func TestInProcessStaleRole(t *testing.T) {
+	api := newTestAPI(t)
+	boss := api.createUser("bossguy")
+	api.createUser("testyguy")
+	_, err := api.users.UpdateUser(context.Background(), boss.ID, user.User{Role: user.RoleAdmin}, user.AnyVersion)
+	require.NoError(t, err)
+	token := api.login("bossguy", "bossguypassword")
+	require.Equal(t, 200, api.do("GET", "/api/user", token, nil).Code)
+
+	// Demoted while the token is still good - admin rights go straight away
+	admin := api.login("admin", "adminpassword")
+	rec := api.do("PUT", "/api/user/2", admin, map[string]string{"Role": "user"})
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, 403, api.do("GET", "/api/user", token, nil).Code)
+	assert.Equal(t, 403, api.do("DELETE", "/api/user/3", token, nil).Code)
+	assert.Equal(t, 200, api.do("GET", "/api/user/2", token, nil).Code)
+
+	// Deleted - the token doesn't work at all
+	require.Equal(t, 200, api.do("DELETE", "/api/user/2", admin, nil).Code)
+	assert.Equal(t, 401, api.do("GET", "/api/user/2", token, nil).Code)
+}
+
+// TestInProcessUniqueness - usernames are unique among live users, and are freed up once the user is deleted
+func TestInProcessUniqueness(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+
+	_, err := api.users.CreateUser(context.Background(), user.User{
+		Username: "testyguy", Password: "password", FirstName: "Other", LastName: "Guy",
+		Email: "other@example.com", Telephone: "5555555555",
+	})
+	assert.ErrorIs(t, err, user.ErrDuplicate)
+
+	require.NoError(t, api.users.DeleteUser(context.Background(), 2, user.AnyVersion))
+	_, err = api.users.GetUser(2)
+	assert.ErrorIs(t, err, user.ErrNotFound)
+
+	rec := api.do("POST", "/api/user", "", map[string]string{
+		"Username": "testyguy", "Password": "password", "FirstName": "Other", "LastName": "Guy",
+		"Email": "testyguy@example.com", "Telephone": "5555555555",
+	})
+	assert.Equal(t, 200, rec.Code, rec.Body.String())
+
+	// With the username taken again, the old user can't come back
+	_, err = api.users.RestoreUser(context.Background(), 2)
+	assert.ErrorIs(t, err, user.ErrDuplicate)
+}
+
+// TestInProcessSoftDeleteLifecycle - admins can list deleted users, restore them and purge them for good
+func TestInProcessSoftDeleteLifecycle(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	api.createUser("otherguy")
+	admin := api.login("admin", "adminpassword")
+	token := api.login("testyguy", "testyguypassword")
+
+	assert.Equal(t, 409, api.do("DELETE", "/api/user/2/purge", admin, nil).Code, "live users have to be deleted first")
+	require.Equal(t, 200, api.do("DELETE", "/api/user/2", admin, nil).Code)
+	require.Equal(t, 200, api.do("DELETE", "/api/user/3", admin, nil).Code)
+
+	rec := api.do("GET", "/api/user/deleted?sort=id", admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, "2", rec.Header().Get("X-Total-Count"))
+	var page user.Page
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Users, 2)
+	assert.Equal(t, "testyguy", page.Users[0].Username)
+	assert.NotNil(t, page.Users[0].DeletedAt)
+	assertNoHash(t, rec.Body.String())
+
+	// Live users aren't listed as deleted, and deleted users aren't listed as live
+	rec = api.do("GET", "/api/user", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("X-Total-Count"))
+
+	// Only admins can see or manage deleted users
+	assert.Equal(t, 401, api.do("GET", "/api/user/deleted", "", nil).Code)
+	other := api.createUser("thirdguy")
+	otherToken := api.login("thirdguy", "thirdguypassword")
+	assert.Equal(t, 403, api.do("GET", "/api/user/deleted", otherToken, nil).Code)
+	assert.Equal(t, 403, api.do("POST", "/api/user/2/restore", otherToken, nil).Code)
+	assert.Equal(t, 403, api.do("DELETE", "/api/user/2/purge", otherToken, nil).Code)
+	assert.Equal(t, 400, api.do("POST", "/api/user/abc/restore", admin, nil).Code)
+	assert.Equal(t, 404, api.do("POST", fmt.Sprintf("/api/user/%d/restore", other.ID), admin, nil).Code, "only deleted users can be restored")
+
+	// A restored user is back as it was, with a new version (deleting it made one too), and can log in again
+	rec = api.do("POST", "/api/user/2/restore", admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, `"2-3"`, rec.Header().Get("ETag"))
+	var restored user.UserResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &restored))
+	assert.Equal(t, "testyguy", restored.Username)
+	assert.Nil(t, restored.DeletedAt)
+	assert.Equal(t, 200, api.do("GET", "/api/user/2", token, nil).Code)
+	api.login("testyguy", "testyguypassword")
+
+	// A purged user is gone for good
+	rec = api.do("DELETE", "/api/user/3/purge", admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, 404, api.do("POST", "/api/user/3/restore", admin, nil).Code)
+	assert.Equal(t, 404, api.do("DELETE", "/api/user/3/purge", admin, nil).Code)
+
+	// The retention job only purges users deleted longer ago than the retention period
+	require.NoError(t, api.users.DeleteUser(context.Background(), 2, user.AnyVersion))
+	purged, err := api.users.PurgeExpired(context.Background(), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), purged)
+	purged, err = api.users.PurgeExpired(context.Background(), -time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+	_, err = api.users.GetDeletedUser(2)
+	assert.ErrorIs(t, err, user.ErrNotFound)
+}
+
+// TestInProcessListPaging - following the next cursor should walk every user exactly once, in order
+func TestInProcessListPaging(t *testing.T) {
+	api := newTestAPI(t)
+	for _, name := range []string{"zed", "amy", "bob", "carl", "dana"} {
+		api.createUser(name)
+	}
+	admin := api.login("admin", "adminpassword")
+
+	var seen []string
+	path := "/api/user?limit=2&sort=-username"
+	for path != "" {
+		rec := api.do("GET", path, admin, nil)
+		require.Equal(t, 200, rec.Code, rec.Body.String())
+		assert.Equal(t, "6", rec.Header().Get("X-Total-Count"))
+
+		var page user.UserPage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		for _, u := range page.Users {
+			seen = append(seen, u.Username)
+		}
+
+		path = ""
+		if page.NextCursor != "" {
+			path = "/api/user?limit=2&sort=-username&cursor=" + page.NextCursor
+		}
+	}
+	assert.Equal(t, []string{"zed", "dana", "carl", "bob", "amy", "admin"}, seen)
+
+	rec := api.do("GET", "/api/user?name_contains=mctest&offset=4", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	var page user.UserPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	assert.Equal(t, int64(5), page.Total)
+	assert.Len(t, page.Users, 1)
+}
+
+// TestInProcessRefreshRotation - refresh tokens can only be used once
+func TestInProcessRefreshRotation(t *testing.T) {
+	api := newTestAPI(t)
+	rec := api.do("POST", "/api/auth/token", "", `{"Username": "admin", "Password": "adminpassword"}`)
+	require.Equal(t, 200, rec.Code)
+	var tokens auth.TokenPair
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tokens))
+
+	body := map[string]string{"refresh_token": tokens.RefreshToken}
+	assert.Equal(t, 200, api.do("POST", "/api/auth/refresh", "", body).Code)
+	assert.Equal(t, 401, api.do("POST", "/api/auth/refresh", "", body).Code)
+}
+
+// TestInProcessValidationErrors - every invalid field is reported at once, with a code per rule
+func TestInProcessValidationErrors(t *testing.T) {
+	api := newTestAPI(t)
+	rec := api.do("POST", "/api/user", "", map[string]string{
+		"Username":  "testyguy",
+		"Password":  "short",
+		"LastName":  "McTest",
+		"Email":     "testyguy@",
+		"Telephone": "seven",
+	})
+	require.Equal(t, 422, rec.Code)
+
+	var problem transHTTP.Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	codes := map[string]string{}
+	for _, e := range problem.Errors {
+		codes[e.Field] = e.Code
+		assert.NotEmpty(t, e.Message)
+	}
+	assert.Equal(t, map[string]string{
+		"FirstName": user.CodeRequired,
+		"Password":  user.CodeInvalidLength,
+		"Email":     user.CodeInvalidFormat,
+		"Telephone": user.CodeInvalidFormat,
+	}, codes)
+}
+
+// TestInProcessUpdateValidation - updates are checked against the same rules as new users, and only the fields sent are checked
+func TestInProcessUpdateValidation(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	token := api.login("testyguy", "testyguypassword")
+
+	rec := api.do("PUT", "/api/user/2", token, `{"Email": "not-an-email", "FirstName": "T", "Password": "short"}`)
+	require.Equal(t, 422, rec.Code, rec.Body.String())
+	var problem transHTTP.Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	codes := map[string]string{}
+	for _, e := range problem.Errors {
+		codes[e.Field] = e.Code
+	}
+	assert.Equal(t, map[string]string{
+		"Email":     user.CodeInvalidFormat,
+		"FirstName": user.CodeInvalidLength,
+		"Password":  user.CodeInvalidLength,
+	}, codes)
+
+	// Nothing should have been changed by the rejected update
+	stored, err := api.users.GetUser(2)
+	require.NoError(t, err)
+	assert.Equal(t, "testyguy@example.com", stored.Email)
+	assert.Equal(t, "Testy", stored.FirstName)
+	api.login("testyguy", "testyguypassword")
+
+	assert.Equal(t, 422, api.do("PUT", "/api/user/2", token, `{"Telephone": "seven"}`).Code)
+	assert.Equal(t, 422, api.do("PUT", "/api/user/2", token, `{"Role": "superuser"}`).Code)
+	assert.Equal(t, 200, api.do("PUT", "/api/user/2", token, `{"LastName": "McTesterson"}`).Code)
+}
+
+// TestInProcessProblems - errors are problem documents with the right status for what went wrong,
+// and carry the request ID sent back in the X-Request-ID header
+func TestInProcessProblems(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+
+	decode := func(rec *httptest.ResponseRecorder) transHTTP.Problem {
+		t.Helper()
+		assert.Equal(t, transHTTP.ProblemContentType, rec.Header().Get("Content-Type"))
+		var problem transHTTP.Problem
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+		assert.Equal(t, rec.Code, problem.Status)
+		assert.NotEmpty(t, problem.RequestID)
+		assert.Equal(t, rec.Header().Get(transHTTP.RequestIDHeader), problem.RequestID)
+		return problem
+	}
+
+	problem := decode(api.do("GET", "/api/user/99", admin, nil))
+	assert.Equal(t, 404, problem.Status)
+	assert.Equal(t, "/problems/not-found", problem.Type)
+	assert.Equal(t, "/api/user/99", problem.Instance)
+
+	problem = decode(api.do("GET", "/api/user?username=nobody", admin, nil))
+	assert.Equal(t, 404, problem.Status)
+
+	problem = decode(api.do("POST", "/api/user", "", `{"Username": "testyguy"`))
+	assert.Equal(t, 400, problem.Status)
+
+	problem = decode(api.do("POST", "/api/auth/token", "", `{"Username": "nobody", "Password": "password"}`))
+	assert.Equal(t, 401, problem.Status)
+
+	problem = decode(api.do("PUT", "/api/user/2", admin, `{"Username": "admin"}`))
+	assert.Equal(t, 409, problem.Status)
+	assert.Equal(t, "/problems/conflict", problem.Type)
+
+	problem = decode(api.do("GET", "/api/nothing-here", "", nil))
+	assert.Equal(t, 404, problem.Status)
+
+	// A request ID sent by the client is used instead of a new one
+	rec := api.doWithHeaders("GET", "/api/user/99", admin, nil, map[string]string{transHTTP.RequestIDHeader: "my-request-123"})
+	assert.Equal(t, "my-request-123", decode(rec).RequestID)
+}
+
+// TestInProcessAuditLog - every change to a user is audited with who made it and what changed, and only admins can read it
+func TestInProcessAuditLog(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	token := api.login("testyguy", "testyguypassword")
+	admin := api.login("admin", "adminpassword")
+
+	rec := api.doWithHeaders("PUT", "/api/user/2", token, `{"FirstName": "Changed", "Password": "newpassword"}`,
+		map[string]string{transHTTP.RequestIDHeader: "update-request"})
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	require.Equal(t, 200, api.do("DELETE", "/api/user/2", admin, nil).Code)
+	require.Equal(t, 200, api.do("POST", "/api/user/2/restore", admin, nil).Code)
+	require.Equal(t, 200, api.do("DELETE", "/api/user/2", admin, nil).Code)
+	require.Equal(t, 200, api.do("DELETE", "/api/user/2/purge", admin, nil).Code)
+
+	// A failed change isn't audited
+	assert.Equal(t, 422, api.do("PUT", "/api/user/1", admin, `{"Email": "bad"}`).Code)
+
+	rec = api.do("GET", "/api/user/2/audit", admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, "6", rec.Header().Get("X-Total-Count"))
+	assertNoHash(t, rec.Body.String())
+	var page user.AuditPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Entries, 6)
+
+	actions := []user.AuditAction{}
+	for _, entry := range page.Entries {
+		actions = append(actions, entry.Action)
+		assert.Equal(t, uint(2), entry.TargetID)
+		assert.Equal(t, "192.0.2.1", entry.IP)
+		assert.NotEmpty(t, entry.RequestID)
+	}
+	assert.Equal(t, []user.AuditAction{user.AuditCreate, user.AuditUpdate, user.AuditDelete, user.AuditRestore, user.AuditDelete, user.AuditPurge}, actions)
+
+	// Signing up is anonymous, everything else was done by someone
+	created, updated, deleted := page.Entries[0], page.Entries[1], page.Entries[2]
+	assert.Nil(t, created.ActorID)
+	assert.Contains(t, created.Changes, user.FieldChange{Field: "Username", Before: nil, After: "testyguy"})
+	assert.Contains(t, created.Changes, user.FieldChange{Field: "Password", Before: nil, After: user.Redacted})
+	require.NotNil(t, updated.ActorID)
+	assert.Equal(t, uint(2), *updated.ActorID)
+	assert.Equal(t, "update-request", updated.RequestID)
+	assert.Equal(t, user.FieldChanges{
+		{Field: "Password", Before: user.Redacted, After: user.Redacted},
+		{Field: "FirstName", Before: "Testy", After: "Changed"},
+		{Field: "Version", Before: float64(1), After: float64(2)},
+	}, updated.Changes)
+	require.NotNil(t, deleted.ActorID)
+	assert.Equal(t, uint(1), *deleted.ActorID)
+	require.Len(t, deleted.Changes, 2)
+	assert.Equal(t, user.FieldChange{Field: "Version", Before: float64(2), After: float64(3)}, deleted.Changes[0])
+	assert.Equal(t, "DeletedAt", deleted.Changes[1].Field)
+	assert.Nil(t, deleted.Changes[1].Before)
+
+	// Paging works like the user list
+	rec = api.do("GET", "/api/user/2/audit?limit=2", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Entries, 2)
+	assert.Contains(t, rec.Header().Get("Link"), `rel="next"`)
+	rec = api.do("GET", "/api/user/2/audit?limit=2&cursor="+page.NextCursor, admin, nil)
+	require.Equal(t, 200, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, user.AuditDelete, page.Entries[0].Action)
+	assert.Equal(t, 400, api.do("GET", "/api/user/2/audit?cursor=nonsense", admin, nil).Code)
+	assert.Equal(t, 400, api.do("GET", "/api/user/2/audit?limit=1000", admin, nil).Code)
+
+	// Only admins can read the audit log, even their own
+	other := api.createUser("otherguy")
+	otherToken := api.login("otherguy", "otherguypassword")
+	assert.Equal(t, 403, api.do("GET", fmt.Sprintf("/api/user/%d/audit", other.ID), otherToken, nil).Code)
+	assert.Equal(t, 401, api.do("GET", "/api/user/2/audit", "", nil).Code)
+}
+
+// TestInProcessRevisions - every change makes a revision, which support can browse (or read the user as of some time)
+// and admins can revert to
+func TestInProcessRevisions(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+	token := api.login("testyguy", "testyguypassword")
+	require.Equal(t, 200, api.do("PUT", "/api/user/2", token, `{"FirstName": "Second"}`).Code)
+	require.Equal(t, 200, api.do("PUT", "/api/user/2", token, `{"LastName": "Third", "Password": "newpassword"}`).Code)
+
+	supportUser := api.createUser("supportguy")
+	_, err := api.users.UpdateUser(context.Background(), supportUser.ID, user.User{Role: user.RoleSupport}, user.AnyVersion)
+	require.NoError(t, err)
+	support := api.login("supportguy", "supportguypassword")
+
+	rec := api.do("GET", "/api/user/2/revisions", support, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, "3", rec.Header().Get("X-Total-Count"))
+	assertNoHash(t, rec.Body.String())
+	var page user.RevisionPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Revisions, 3)
+	for i, revision := range page.Revisions {
+		assert.Equal(t, uint(i+1), revision.Number)
+		assert.Equal(t, uint(i+1), revision.Snapshot.Version)
+		assert.Equal(t, uint(2), revision.UserID)
+	}
+	assert.Equal(t, "Testy", page.Revisions[0].Snapshot.FirstName)
+	assert.Equal(t, "Second", page.Revisions[1].Snapshot.FirstName)
+	assert.Equal(t, "Third", page.Revisions[2].Snapshot.LastName)
+
+	// Reading the user as of a revision gives the user as it was then, with the ETag it had then
+	asOf := page.Revisions[1].CreatedAt.Format(time.RFC3339Nano)
+	rec = api.do("GET", "/api/user/2?as_of="+asOf, support, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, `"2-2"`, rec.Header().Get("ETag"))
+	var old user.UserResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &old))
+	assert.Equal(t, "Second", old.FirstName)
+	assert.Equal(t, "McTest", old.LastName)
+	assert.Equal(t, 404, api.do("GET", "/api/user/2?as_of=2001-01-01T00:00:00Z", support, nil).Code)
+	assert.Equal(t, 400, api.do("GET", "/api/user/2?as_of=yesterday", support, nil).Code)
+
+	// Regular users can't see revisions, even their own, and only admins can revert
+	assert.Equal(t, 403, api.do("GET", "/api/user/2/revisions", token, nil).Code)
+	assert.Equal(t, 403, api.do("GET", "/api/user/2?as_of="+asOf, token, nil).Code)
+	assert.Equal(t, 403, api.do("POST", "/api/user/2/revisions/1/revert", support, nil).Code)
+
+	// A revert is an update - it honours If-Match, and makes a new revision
+	rec = api.doWithHeaders("POST", "/api/user/2/revisions/1/revert", admin, nil, map[string]string{"If-Match": `"2-2"`})
+	assert.Equal(t, 412, rec.Code)
+	rec = api.doWithHeaders("POST", "/api/user/2/revisions/1/revert", admin, nil, map[string]string{"If-Match": `"2-3"`})
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	var reverted user.UserResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reverted))
+	assert.Equal(t, "Testy", reverted.FirstName)
+	assert.Equal(t, "McTest", reverted.LastName)
+	assert.Equal(t, uint(4), reverted.Version)
+	api.login("testyguy", "newpassword")
+
+	revisions, err := api.users.ListRevisions(2, user.HistoryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), revisions.Total)
+	audit, err := api.users.GetAuditLog(2, user.HistoryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, user.AuditRevert, audit.Entries[len(audit.Entries)-1].Action)
+
+	assert.Equal(t, 404, api.do("POST", "/api/user/2/revisions/99/revert", admin, nil).Code)
+	assert.Equal(t, 400, api.do("POST", "/api/user/2/revisions/first/revert", admin, nil).Code)
+
+	// Reverting goes through the same checks as any update, so an old username somebody has taken since is a conflict
+	require.Equal(t, 200, api.do("PUT", "/api/user/2", admin, `{"Username": "renamedguy", "Email": "renamedguy@example.com"}`).Code)
+	api.createUser("testyguy")
+	assert.Equal(t, 409, api.do("POST", "/api/user/2/revisions/1/revert", admin, nil).Code)
+}
+
+// TestInProcessRevisionsDeleted - deleting a user makes a revision too, so reading the user as of a time it was
+// deleted finds it gone, and as of a time after it was restored finds it back
+func TestInProcessRevisionsDeleted(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+	require.Equal(t, 200, api.do("DELETE", "/api/user/2", admin, nil).Code)
+
+	rec := api.do("GET", "/api/user/2/revisions", admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	var page user.RevisionPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Revisions, 2)
+	assert.Equal(t, uint(2), page.Revisions[1].Number)
+	assert.NotNil(t, page.Revisions[1].Snapshot.DeletedAt)
+
+	deletedAt := page.Revisions[1].CreatedAt.Format(time.RFC3339Nano)
+	assert.Equal(t, 404, api.do("GET", "/api/user/2?as_of="+deletedAt, admin, nil).Code)
+	created := page.Revisions[0].CreatedAt.Format(time.RFC3339Nano)
+	assert.Equal(t, 200, api.do("GET", "/api/user/2?as_of="+created, admin, nil).Code)
+
+	require.Equal(t, 200, api.do("POST", "/api/user/2/restore", admin, nil).Code)
+	rec = api.do("GET", "/api/user/2?as_of="+time.Now().Format(time.RFC3339Nano), admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, `"2-3"`, rec.Header().Get("ETag"))
+	assert.Equal(t, 404, api.do("GET", "/api/user/2?as_of="+deletedAt, admin, nil).Code)
+}
+
+// brokenStore - a user store whose lookups fail the way they would if the database went away
+type brokenStore struct {
+	*user.MemoryStore
+}
+
+// GetByID - always fails
+func (s brokenStore) GetByID(ID uint) (user.User, error) {
+	return user.User{}, errors.New("dial tcp 10.0.0.5:5432: connection refused")
+}
+
+// WithContext - the broken store itself, so requests see it too
+func (s brokenStore) WithContext(ctx context.Context) user.Store {
+	return s
+}
+
+// TestInProcessInternalError - unexpected errors are a 500, and never leak their details to the client
+func TestInProcessInternalError(t *testing.T) {
+	api := newTestAPI(t)
+	admin := api.login("admin", "adminpassword")
+
+	users := user.NewService(brokenStore{user.NewMemoryStore()})
+	handler := transHTTP.NewHandler(users, api.authSvc)
+	handler.InitRoutes()
+	api.server = handler.Router
+
+	rec := api.do("GET", "/api/user/1", admin, nil)
+	assert.Equal(t, 500, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "10.0.0.5")
+
+	var problem transHTTP.Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal(t, "/problems/internal", problem.Type)
+}
+
+// TestInProcessConcurrency - ETags change with every update, stale If-Match headers are rejected and
+// If-None-Match saves re-sending a user the client already has
+func TestInProcessConcurrency(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+
+	rec := api.do("GET", "/api/user/2", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.Equal(t, `"2-1"`, etag)
+
+	rec = api.doWithHeaders("GET", "/api/user/2", admin, nil, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 304, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	// The first admin to update wins, the second has an old ETag and has to read the user again
+	rec = api.doWithHeaders("PUT", "/api/user/2", admin, `{"FirstName": "First"}`, map[string]string{"If-Match": etag})
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	newETag := rec.Header().Get("ETag")
+	assert.Equal(t, `"2-2"`, newETag)
+
+	rec = api.doWithHeaders("PUT", "/api/user/2", admin, `{"FirstName": "Second"}`, map[string]string{"If-Match": etag})
+	assert.Equal(t, 412, rec.Code)
+	assert.Equal(t, newETag, rec.Header().Get("ETag"))
+	rec = api.doWithHeaders("DELETE", "/api/user/2", admin, nil, map[string]string{"If-Match": etag})
+	assert.Equal(t, 412, rec.Code)
+
+	stored, err := api.users.GetUser(2)
+	require.NoError(t, err)
+	assert.Equal(t, "First", stored.FirstName)
+
+	rec = api.doWithHeaders("GET", "/api/user/2", admin, nil, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 200, rec.Code)
+
+	// Weak tags never match If-Match, but * matches any version
+	rec = api.doWithHeaders("PUT", "/api/user/2", admin, `{"FirstName": "Third"}`, map[string]string{"If-Match": "W/" + newETag})
+	assert.Equal(t, 412, rec.Code)
+	rec = api.doWithHeaders("PUT", "/api/user/2", admin, `{"FirstName": "Third"}`, map[string]string{"If-Match": "*"})
+	assert.Equal(t, 200, rec.Code)
+
+	// The service checks versions too, for updates that raced past the handler
+	_, err = api.users.UpdateUser(context.Background(), 2, user.User{FirstName: "Fourth"}, 1)
+	assert.ErrorIs(t, err, user.ErrVersionMismatch)
+}
+
+// TestInProcessIfMatchRequired - with RequireIfMatch on, changes without an If-Match are refused
+func TestInProcessIfMatchRequired(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+
+	handler := transHTTP.NewHandler(api.users, api.authSvc)
+	handler.RequireIfMatch = true
+	handler.InitRoutes()
+	api.server = handler.Router
+
+	assert.Equal(t, 428, api.do("PUT", "/api/user/2", admin, `{"FirstName": "Changed"}`).Code)
+	assert.Equal(t, 428, api.do("DELETE", "/api/user/2", admin, nil).Code)
+
+	rec := api.doWithHeaders("PUT", "/api/user/2", admin, `{"FirstName": "Changed"}`, map[string]string{"If-Match": `"2-1"`})
+	assert.Equal(t, 200, rec.Code)
+	rec = api.doWithHeaders("DELETE", "/api/user/2", admin, nil, map[string]string{"If-Match": rec.Header().Get("ETag")})
+	assert.Equal(t, 200, rec.Code)
+}
+
+// TestInProcessPatch - merge patches and JSON patches are applied to the user as GET returns it, and the result
+// is validated, so unlike PUT a patch can clear a field (and be told it is required)
+func TestInProcessPatch(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	token := api.login("testyguy", "testyguypassword")
+
+	merge := map[string]string{"Content-Type": string(user.MergePatch)}
+	jsonPatch := map[string]string{"Content-Type": string(user.JSONPatch)}
+	patch := func(body string, headers map[string]string) *httptest.ResponseRecorder {
+		return api.doWithHeaders("PATCH", "/api/user/2", token, body, headers)
+	}
+	fieldCodes := func(rec *httptest.ResponseRecorder) map[string]string {
+		var problem transHTTP.Problem
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+		codes := map[string]string{}
+		for _, e := range problem.Errors {
+			codes[e.Field] = e.Code
+		}
+		return codes
+	}
+
+	rec := patch(`{"FirstName": "Patched"}`, merge)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	var patched user.UserResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &patched))
+	assert.Equal(t, "Patched", patched.FirstName)
+	assert.Equal(t, "McTest", patched.LastName)
+	assert.Equal(t, uint(2), patched.Version)
+
+	// null clears a field, which a user can't be without
+	rec = patch(`{"Telephone": null}`, merge)
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, map[string]string{"Telephone": user.CodeRequired}, fieldCodes(rec))
+
+	rec = patch(`{"ID": 7, "Nickname": "testy", "Email": 5}`, merge)
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, map[string]string{"ID": user.CodeReadOnly, "Nickname": user.CodeUnknownField, "Email": user.CodeInvalidFormat}, fieldCodes(rec))
+
+	// test operations guard the rest of the patch
+	rec = patch(`[{"op": "test", "path": "/Version", "value": 2}, {"op": "replace", "path": "/LastName", "value": "Patchy"}]`, jsonPatch)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	rec = patch(`[{"op": "test", "path": "/Version", "value": 2}, {"op": "replace", "path": "/LastName", "value": "Stale"}]`, jsonPatch)
+	assert.Equal(t, 409, rec.Code)
+	rec = patch(`[{"op": "remove", "path": "/FirstName"}]`, jsonPatch)
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, map[string]string{"FirstName": user.CodeRequired}, fieldCodes(rec))
+
+	// Passwords are never shown, so they can only be added
+	assert.Equal(t, 422, patch(`[{"op": "replace", "path": "/Password", "value": "newpassword"}]`, jsonPatch).Code)
+	rec = patch(`[{"op": "add", "path": "/Password", "value": "newpassword"}]`, jsonPatch)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assertNoHash(t, rec.Body.String())
+	api.login("testyguy", "newpassword")
+
+	stored, err := api.users.GetUser(2)
+	require.NoError(t, err)
+	assert.Equal(t, "Patched", stored.FirstName)
+	assert.Equal(t, "Patchy", stored.LastName)
+	assert.Equal(t, "5555555555", stored.Telephone)
+
+	// Roles still need an admin, and only the patch formats are accepted
+	assert.Equal(t, 403, patch(`{"Role": "admin"}`, merge).Code)
+	assert.Equal(t, 400, patch(`[{"op": "replace"`, jsonPatch).Code)
+	rec = patch(`{"FirstName": "Plain"}`, map[string]string{"Content-Type": "application/json"})
+	assert.Equal(t, 415, rec.Code)
+	assert.Contains(t, rec.Header().Get("Accept-Patch"), string(user.MergePatch))
+}
+
+// assertNoHash - fails if a response body contains a bcrypt hash
+func assertNoHash(t *testing.T, body string) {
+	t.Helper()
+	assert.NotRegexp(t, `\$2[aby]\$\d{2}\$`, body)
+}
@@ -0,0 +1,266 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	transHTTP "github.com/aebranton/rest-api/internal/transport/http"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bulk - sends a batch and decodes the response
+func (a *testAPI) bulk(token string, body interface{}) (int, transHTTP.BulkResponse) {
+	a.t.Helper()
+	rec := a.do("POST", "/api/user/bulk", token, body)
+	var resp transHTTP.BulkResponse
+	require.NoError(a.t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	return rec.Code, resp
+}
+
+// bulkCreate - a create operation for the given user
+func bulkCreate(username string) map[string]interface{} {
+	return map[string]interface{}{"Op": "create", "User": signupBody(username)}
+}
+
+// TestInProcessBulkAtomic - a batch either makes every change or none of them
+func TestInProcessBulkAtomic(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	api.createUser("otherguy")
+	admin := api.login("admin", "adminpassword")
+
+	status, resp := api.bulk(admin, map[string]interface{}{
+		"Operations": []interface{}{
+			bulkCreate("newguy"),
+			map[string]interface{}{"Op": "update", "ID": 2, "Version": 1, "User": map[string]string{"Telephone": "6666666666"}},
+			map[string]interface{}{"Op": "delete", "ID": 3},
+		},
+	})
+	require.Equal(t, 200, status)
+	assert.Equal(t, user.BulkAtomic, resp.Mode)
+	assert.Equal(t, 3, resp.Succeeded)
+	require.Len(t, resp.Results, 3)
+	assert.Equal(t, "newguy", resp.Results[0].User.Username)
+	assert.Equal(t, "6666666666", resp.Results[1].User.Telephone)
+	assert.NotNil(t, resp.Results[2].User.DeletedAt)
+	for i, result := range resp.Results {
+		assert.Equal(t, i, result.Index)
+		assert.Equal(t, 200, result.Status)
+	}
+	created, err := api.users.GetUserByUsername("newguy")
+	require.NoError(t, err)
+	assert.True(t, user.ComparePassword("newguypassword", created.Password))
+	rec := api.do("GET", "/api/user/3", admin, nil)
+	assert.Equal(t, 404, rec.Code)
+
+	// An invalid user fails the whole batch before anything is changed
+	invalid := bulkCreate("badguy")
+	invalid["User"].(map[string]string)["Email"] = "not-an-email"
+	status, resp = api.bulk(admin, map[string]interface{}{
+		"Mode": "atomic",
+		"Operations": []interface{}{
+			bulkCreate("fourthguy"),
+			invalid,
+			map[string]interface{}{"Op": "update", "ID": 2, "User": map[string]string{"Telephone": "7777777777"}},
+		},
+	})
+	require.Equal(t, 207, status)
+	assert.Equal(t, 0, resp.Succeeded)
+	assert.Equal(t, 3, resp.Failed)
+	assert.Equal(t, 424, resp.Results[0].Status)
+	assert.Equal(t, "failed-dependency", resp.Results[0].Code)
+	assert.Equal(t, 422, resp.Results[1].Status)
+	assert.Equal(t, "validation", resp.Results[1].Code)
+	require.NotNil(t, resp.Results[1].Error)
+	assert.Equal(t, "Email", resp.Results[1].Error.Errors[0].Field)
+	assert.Equal(t, 424, resp.Results[2].Status)
+
+	// So does one that only fails once it's made - the earlier create is rolled back
+	status, resp = api.bulk(admin, map[string]interface{}{
+		"Operations": []interface{}{bulkCreate("fourthguy"), bulkCreate("newguy")},
+	})
+	require.Equal(t, 207, status)
+	assert.Equal(t, 424, resp.Results[0].Status)
+	assert.Equal(t, 409, resp.Results[1].Status)
+	assert.Equal(t, "conflict", resp.Results[1].Code)
+
+	_, err = api.users.GetUserByUsername("fourthguy")
+	assert.ErrorIs(t, err, user.ErrNotFound)
+	unchanged, err := api.users.GetUser(2)
+	require.NoError(t, err)
+	assert.Equal(t, "6666666666", unchanged.Telephone)
+}
+
+// TestInProcessBulkBestEffort - a best effort batch makes every change it can, and reports the rest
+func TestInProcessBulkBestEffort(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+
+	status, resp := api.bulk(admin, map[string]interface{}{
+		"Mode": "best_effort",
+		"Operations": []interface{}{
+			bulkCreate("newguy"),
+			bulkCreate("testyguy"),
+			map[string]interface{}{"Op": "update", "ID": 2, "Version": 7, "User": map[string]string{"Telephone": "6666666666"}},
+			map[string]interface{}{"Op": "delete", "ID": 42},
+			map[string]interface{}{"Op": "frobnicate", "ID": 2},
+			bulkCreate("thirdguy"),
+		},
+	})
+	require.Equal(t, 207, status)
+	assert.Equal(t, 2, resp.Succeeded)
+	assert.Equal(t, 4, resp.Failed)
+	codes := []string{}
+	for _, result := range resp.Results {
+		codes = append(codes, result.Code)
+	}
+	assert.Equal(t, []string{"", "conflict", "precondition-failed", "not-found", "bad-request", ""}, codes)
+
+	_, err := api.users.GetUserByUsername("newguy")
+	assert.NoError(t, err)
+	_, err = api.users.GetUserByUsername("thirdguy")
+	assert.NoError(t, err)
+
+	// Every change made in a batch is audited like any other
+	rec := api.do("GET", "/api/user/3/audit", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"create"`)
+}
+
+// TestInProcessBulkPolicy - only admins and support can send batches, and each operation is held to the same
+// policy as its own request
+func TestInProcessBulkPolicy(t *testing.T) {
+	api := newTestAPI(t)
+	supportUser := api.createUser("supportguy")
+	api.createUser("otherguy")
+	_, err := api.users.UpdateUser(context.Background(), supportUser.ID, user.User{Role: user.RoleSupport}, user.AnyVersion)
+	require.NoError(t, err)
+	token := api.login("supportguy", "supportguypassword")
+
+	// Regular users can't send a batch at all, so nothing in it is hashed or created
+	regular := api.login("otherguy", "otherguypassword")
+	rec := api.do("POST", "/api/user/bulk", regular, map[string]interface{}{
+		"Operations": []interface{}{
+			bulkCreate("spamguy"),
+			map[string]interface{}{"Op": "update", "ID": 3, "User": map[string]string{"Telephone": "6666666666"}},
+		},
+	})
+	assert.Equal(t, 403, rec.Code)
+	_, err = api.users.GetUserByUsername("spamguy")
+	assert.Error(t, err)
+
+	promoted := bulkCreate("bossguy")
+	promoted["User"].(map[string]string)["Role"] = "admin"
+	status, resp := api.bulk(token, map[string]interface{}{
+		"Mode": "best_effort",
+		"Operations": []interface{}{
+			map[string]interface{}{"Op": "update", "ID": 3, "User": map[string]string{"Telephone": "6666666666"}},
+			map[string]interface{}{"Op": "update", "ID": 1, "User": map[string]string{"Telephone": "6666666666"}},
+			map[string]interface{}{"Op": "delete", "ID": 2},
+			promoted,
+			bulkCreate("newguy"),
+		},
+	})
+	require.Equal(t, 207, status)
+	assert.Equal(t, 200, resp.Results[0].Status)
+	assert.Equal(t, 403, resp.Results[1].Status)
+	assert.Equal(t, 403, resp.Results[2].Status)
+	assert.Equal(t, "forbidden", resp.Results[2].Code)
+	assert.Equal(t, 403, resp.Results[3].Status)
+	assert.Equal(t, 200, resp.Results[4].Status)
+
+	rec = api.do("POST", "/api/user/bulk", "", map[string]interface{}{"Operations": []interface{}{bulkCreate("anonguy")}})
+	assert.Equal(t, 401, rec.Code)
+
+	// Versions are required along with If-Match
+	api.handler.RequireIfMatch = true
+	status, resp = api.bulk(token, map[string]interface{}{
+		"Operations": []interface{}{
+			map[string]interface{}{"Op": "update", "ID": 2, "User": map[string]string{"Telephone": "7777777777"}},
+		},
+	})
+	require.Equal(t, 207, status)
+	assert.Equal(t, 422, resp.Results[0].Status)
+	assert.Equal(t, "Version", resp.Results[0].Error.Errors[0].Field)
+}
+
+// TestInProcessBulkProblems - batches that can't be run at all are rejected as a whole
+func TestInProcessBulkProblems(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+	update := map[string]interface{}{"Op": "update", "ID": 2, "User": map[string]string{"Telephone": "6666666666"}}
+
+	for name, body := range map[string]interface{}{
+		"not json":     `{"Operations": [`,
+		"empty":        map[string]interface{}{"Operations": []interface{}{}},
+		"unknown mode": map[string]interface{}{"Mode": "yolo", "Operations": []interface{}{update}},
+		"same user twice": map[string]interface{}{
+			"Operations": []interface{}{update, map[string]interface{}{"Op": "delete", "ID": 2}},
+		},
+	} {
+		rec := api.do("POST", "/api/user/bulk", admin, body)
+		assert.Equal(t, 400, rec.Code, name)
+		assert.Equal(t, transHTTP.ProblemContentType, rec.Header().Get("Content-Type"), name)
+	}
+
+	tooMany := make([]interface{}, transHTTP.MaxBulkOperations+1)
+	for i := range tooMany {
+		tooMany[i] = update
+	}
+	rec := api.do("POST", "/api/user/bulk", admin, map[string]interface{}{"Operations": tooMany})
+	assert.Equal(t, 400, rec.Code)
+
+	huge := bulkCreate("hugeguy")
+	huge["User"].(map[string]string)["FirstName"] = strings.Repeat("a", transHTTP.MaxBulkSize)
+	rec = api.do("POST", "/api/user/bulk", admin, map[string]interface{}{"Operations": []interface{}{huge}})
+	assert.Equal(t, 400, rec.Code)
+}
+
+// TestInProcessBulkHashing - passwords are only hashed for operations that are about to be made, so a failed
+// atomic batch doesn't hash every password in it
+func TestInProcessBulkHashing(t *testing.T) {
+	recorder := recordSpans(t)
+	api := newTestAPI(t)
+	admin := api.login("admin", "adminpassword")
+
+	// An operation that fails its checks fails the batch before anything is hashed
+	invalid := bulkCreate("badguy")
+	invalid["User"].(map[string]string)["Email"] = "not-an-email"
+	status, resp := api.bulk(admin, map[string]interface{}{
+		"Operations": []interface{}{bulkCreate("oneguy"), bulkCreate("twoguy"), invalid},
+	})
+	require.Equal(t, 207, status)
+	assert.Equal(t, 422, resp.Results[2].Status)
+	assert.Empty(t, spansNamed(recorder, "user.HashPassword"))
+
+	// The batch stops at the first operation that fails, and nothing after it is hashed
+	status, resp = api.bulk(admin, map[string]interface{}{
+		"Operations": []interface{}{
+			bulkCreate("oneguy"),
+			map[string]interface{}{"Op": "update", "ID": 1, "Version": 42, "User": map[string]string{"Telephone": "6666666666"}},
+			bulkCreate("twoguy"),
+			bulkCreate("threeguy"),
+		},
+	})
+	require.Equal(t, 207, status)
+	assert.Equal(t, 412, resp.Results[1].Status)
+	for _, i := range []int{0, 2, 3} {
+		assert.Equal(t, 424, resp.Results[i].Status)
+	}
+	assert.Len(t, spansNamed(recorder, "user.HashPassword"), 1)
+
+	// Best effort batches hash the passwords of the operations that are made
+	status, resp = api.bulk(admin, map[string]interface{}{
+		"Mode":       "best_effort",
+		"Operations": []interface{}{bulkCreate("oneguy"), invalid, bulkCreate("twoguy")},
+	})
+	require.Equal(t, 207, status)
+	assert.Equal(t, 2, resp.Succeeded)
+	assert.Len(t, spansNamed(recorder, "user.HashPassword"), 3)
+}
@@ -2,6 +2,71 @@
 
 package test
 
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
 const (
 	ROOT_URL = "http://localhost:8081/"
 )
+
+// TokenResponse - the token pair returned by the auth token and refresh endpoints
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// getTokens - logs in with the given username and password and returns the token pair.
+// Fails the test right away if the login doesn't work, since nothing after it will either
+func getTokens(t *testing.T, username, password string) TokenResponse {
+	t.Helper()
+	client := resty.New()
+	resp, err := client.R().
+		SetBody(map[string]string{"Username": username, "Password": password}).
+		Post(ROOT_URL + "api/auth/token")
+	if err != nil || resp.StatusCode() != 200 {
+		t.Fatalf("unable to log in as %s: %v %s", username, err, resp.String())
+	}
+
+	var tokens TokenResponse
+	if err := json.Unmarshal(resp.Body(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+// getAccessToken - logs in as the default test user and returns an access token
+func getAccessToken(t *testing.T) string {
+	t.Helper()
+	return getTokens(t, "testyguy", "testyguy").AccessToken
+}
+
+// getAdminToken - logs in as the admin account from docker-compose.test.yml and returns an access token.
+// The admin is created when the api starts, so it will always be user 1
+func getAdminToken(t *testing.T) string {
+	t.Helper()
+	return getTokens(t, "admin", "adminpassword").AccessToken
+}
+
+// bcryptHashRegex - matches anything that looks like a bcrypt hash ($2a$10$...)
+var bcryptHashRegex = regexp.MustCompile(`\$2[abxy]?\$\d{2}\$`)
+
+// assertNoPasswordMaterial - makes sure a response body doesn't contain a password field,
+// anything that looks like a bcrypt hash, or the plain text password we sent
+func assertNoPasswordMaterial(t *testing.T, resp *resty.Response, password string) {
+	t.Helper()
+	body := resp.String()
+	assert.NotContains(t, strings.ToLower(body), `"password"`)
+	assert.False(t, bcryptHashRegex.MatchString(body), "response contains a bcrypt hash: %s", body)
+	if password != "" {
+		assert.NotContains(t, body, password)
+	}
+}
@@ -0,0 +1,163 @@
+package test
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// env - a fake environment for config.Load
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+// writeConfigFile - writes a config file with the given name to a temporary directory, and returns its path
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+// TestConfigDefaults - with nothing set, everything but the JWT secret has a default
+func TestConfigDefaults(t *testing.T) {
+	cfg, args, err := config.Load(nil, env(nil))
+	require.NoError(t, err)
+	assert.Empty(t, args)
+	assert.Equal(t, config.Default(), cfg)
+	assert.Equal(t, ":8080", cfg.HTTP.Addr)
+	assert.Equal(t, time.Second, cfg.HTTP.WriteTimeout)
+	assert.Equal(t, 3, cfg.Database.ConnectRetries)
+	assert.Equal(t, config.List{"webhook"}, cfg.Events.Sinks)
+
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "auth.jwt_secret must be set (set with JWT_SECRET or -auth-jwt-secret)")
+	assert.NoError(t, cfg.ValidateDatabase())
+}
+
+// TestConfigPrecedence - a config file overrides the defaults, the environment overrides the file,
+// and flags override everything
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+http:
+  addr: ":9000"
+  write_timeout: 5s
+  require_if_match: true
+database:
+  host: db.example.com
+  port: 6543
+auth:
+  jwt_secret: from-the-file
+events:
+  sinks: [stdout, file]
+  file: /tmp/events.log
+`)
+
+	cfg, args, err := config.Load(
+		[]string{"-config", path, "-database-port", "7654", "-http-write-timeout=10s", "migrate", "up"},
+		env(map[string]string{
+			"DB_HOST":     "env.example.com",
+			"DB_PORT":     "1111",
+			"BCRYPT_COST": "12",
+			"EVENT_SINKS": "webhook, stdout",
+		}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"migrate", "up"}, args)
+	assert.Equal(t, ":9000", cfg.HTTP.Addr)
+	assert.True(t, cfg.HTTP.RequireIfMatch)
+	assert.Equal(t, 10*time.Second, cfg.HTTP.WriteTimeout)
+	assert.Equal(t, time.Second, cfg.HTTP.ReadTimeout)
+	assert.Equal(t, "env.example.com", cfg.Database.Host)
+	assert.Equal(t, 7654, cfg.Database.Port)
+	assert.Equal(t, "from-the-file", cfg.Auth.JWTSecret.Reveal())
+	assert.Equal(t, 12, cfg.Users.BcryptCost)
+	assert.Equal(t, config.List{"webhook", "stdout"}, cfg.Events.Sinks)
+	assert.NoError(t, cfg.Validate())
+
+	// The file can be named by CONFIG_FILE instead, and can be TOML
+	path = writeConfigFile(t, "config.toml", `
+[http]
+addr = ":9001"
+idle_timeout = "5m"
+
+[users]
+deleted_user_retention = "720h"
+`)
+	cfg, _, err = config.Load(nil, env(map[string]string{config.FileEnv: path}))
+	require.NoError(t, err)
+	assert.Equal(t, ":9001", cfg.HTTP.Addr)
+	assert.Equal(t, 5*time.Minute, cfg.HTTP.IdleTimeout)
+	assert.Equal(t, 720*time.Hour, cfg.Users.DeletedUserRetention)
+}
+
+// TestConfigErrors - anything that can't be loaded, and every problem with what was loaded, is reported clearly
+func TestConfigErrors(t *testing.T) {
+	for name, path := range map[string]string{
+		"unknown yaml key": writeConfigFile(t, "typo.yaml", "http:\n  adress: \":9000\"\n"),
+		"unknown toml key": writeConfigFile(t, "typo.toml", "[http]\nadress = \":9000\"\n"),
+		"bad duration":     writeConfigFile(t, "bad.yaml", "http:\n  read_timeout: soon\n"),
+		"unknown format":   writeConfigFile(t, "config.ini", "addr = :9000\n"),
+		"missing":          filepath.Join(t.TempDir(), "missing.yaml"),
+	} {
+		_, _, err := config.Load([]string{"-config", path}, env(nil))
+		assert.Error(t, err, name)
+	}
+
+	_, _, err := config.Load(nil, env(map[string]string{"DB_PORT": "five"}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid DB_PORT "five"`)
+	_, _, err = config.Load([]string{"-no-such-flag"}, env(nil))
+	assert.Error(t, err)
+	_, _, err = config.Load([]string{"-http-require-if-match=maybe"}, env(nil))
+	assert.Error(t, err)
+	_, _, err = config.Load([]string{"-help"}, env(nil))
+	assert.True(t, errors.Is(err, flag.ErrHelp))
+
+	cfg, _, err := config.Load(nil, env(map[string]string{
+		"JWT_SECRET":     "shh",
+		"ADMIN_USERNAME": "admin",
+		"BCRYPT_COST":    "99",
+		"EVENT_SINKS":    "webhook,kafka",
+		"READ_TIMEOUT":   "0s",
+
+		// Longer than http.write_timeout, but not the bulk routes write timeout
+		"IDEMPOTENCY_LEASE": "1m",
+	}))
+	require.NoError(t, err)
+	err = cfg.Validate()
+	var problems config.ValidationError
+	require.True(t, errors.As(err, &problems))
+	keys := []string{}
+	for _, p := range problems {
+		keys = append(keys, p.Key)
+	}
+	assert.Equal(t, []string{"http.read_timeout", "admin.password", "admin.email", "users.bcrypt_cost", "events.sinks", "idempotency.lease"}, keys)
+}
+
+// TestConfigRedacted - secrets never show up when the config is printed
+func TestConfigRedacted(t *testing.T) {
+	cfg, _, err := config.Load([]string{"-admin-password", "hunter22"}, env(map[string]string{
+		"JWT_SECRET":  "super-secret-jwt",
+		"DB_PASSWORD": "super-secret-db",
+	}))
+	require.NoError(t, err)
+
+	printed := cfg.String()
+	assert.Contains(t, printed, "jwt_secret: '[REDACTED]'")
+	for _, secret := range []string{"super-secret-jwt", "super-secret-db", "hunter22"} {
+		assert.NotContains(t, printed, secret)
+	}
+	assert.Equal(t, "[REDACTED]", cfg.Auth.JWTSecret.String())
+	assert.Equal(t, "super-secret-jwt", cfg.Auth.JWTSecret.Reveal())
+}
@@ -0,0 +1,192 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/outbox"
+	transHTTP "github.com/aebranton/rest-api/internal/transport/http"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sseMessage - a single message read off an event stream. Heartbeats are comments, with nothing else set
+type sseMessage struct {
+	ID      string
+	Event   string
+	Data    string
+	Comment string
+}
+
+// openStream - opens an event stream on the server, and returns the messages read off it until it is closed
+func openStream(t *testing.T, ctx context.Context, url, token, lastEventID string) <-chan sseMessage {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	messages := make(chan sseMessage, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(messages)
+		var msg sseMessage
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				messages <- msg
+				msg = sseMessage{}
+			case strings.HasPrefix(line, ":"):
+				msg.Comment = strings.TrimSpace(line[1:])
+			case strings.HasPrefix(line, "id: "):
+				msg.ID = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				msg.Event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				msg.Data = line[6:]
+			}
+		}
+	}()
+	return messages
+}
+
+// nextEvent - waits for the next event on the stream, skipping heartbeats
+func nextEvent(t *testing.T, messages <-chan sseMessage) sseMessage {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-messages:
+			require.True(t, ok, "the stream closed")
+			if msg.Comment == "" {
+				return msg
+			}
+		case <-timeout:
+			require.FailNow(t, "timed out waiting for an event")
+		}
+	}
+}
+
+// TestInProcessEventStream - user events are streamed as they're relayed, filtered by user, kept open
+// by heartbeats well past the write timeout, and replayed after Last-Event-ID
+func TestInProcessEventStream(t *testing.T) {
+	api := newTestAPI(t)
+	api.handler.Heartbeat = 20 * time.Millisecond
+	server := httptest.NewUnstartedServer(transHTTP.WriteDeadline(api.server, 100*time.Millisecond))
+	server.Config.ConnContext = transHTTP.ConnContext
+	server.Start()
+	defer server.Close()
+
+	admin := api.login("admin", "adminpassword")
+	api.deliver()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages := openStream(t, ctx, server.URL+"/api/user/events?user_id=2", admin, "")
+
+	api.createUser("streamer")
+	api.createUser("bystander")
+	api.deliver()
+	created := nextEvent(t, messages)
+	assert.Equal(t, "user.created", created.Event)
+	var event user.Event
+	require.NoError(t, json.Unmarshal([]byte(created.Data), &event))
+	assert.Equal(t, created.ID, event.ID)
+	assert.Equal(t, uint(2), event.UserID)
+	assert.Equal(t, "streamer", event.User.Username)
+	assertNoHash(t, created.Data)
+
+	// Outlive the write timeout a few times over - heartbeats keep the stream going
+	time.Sleep(300 * time.Millisecond)
+	rec := api.do("PUT", "/api/user/2", admin, `{"Telephone": "6666666666"}`)
+	require.Equal(t, 200, rec.Code)
+	rec = api.do("DELETE", "/api/user/2", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	api.deliver()
+
+	heartbeats := 0
+	var updated sseMessage
+	for updated.Event == "" {
+		msg := <-messages
+		if msg.Comment == "heartbeat" {
+			heartbeats++
+			continue
+		}
+		updated = msg
+	}
+	assert.Greater(t, heartbeats, 0)
+	assert.Equal(t, "user.updated", updated.Event)
+	deleted := nextEvent(t, messages)
+	assert.Equal(t, "user.deleted", deleted.Event)
+	cancel()
+
+	// Reconnecting with the last event seen replays everything since
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	messages = openStream(t, ctx, server.URL+"/api/user/events?user_id=2", admin, created.ID)
+	assert.Equal(t, updated.ID, nextEvent(t, messages).ID)
+	assert.Equal(t, deleted.ID, nextEvent(t, messages).ID)
+}
+
+// TestInProcessEventStreamProblems - the stream is only for callers who can list users, and user_id must be IDs
+func TestInProcessEventStreamProblems(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	token := api.login("testyguy", "testyguypassword")
+	admin := api.login("admin", "adminpassword")
+
+	rec := api.do("GET", "/api/user/events", token, nil)
+	assert.Equal(t, 403, rec.Code)
+	rec = api.do("GET", "/api/user/events", "", nil)
+	assert.Equal(t, 401, rec.Code)
+	rec = api.do("GET", "/api/user/events?user_id=1,bob", admin, nil)
+	assert.Equal(t, 400, rec.Code)
+	assert.Equal(t, transHTTP.ProblemContentType, rec.Header().Get("Content-Type"))
+}
+
+// TestBroadcasterReplay - the replay buffer only keeps the latest events, a forgotten Last-Event-ID replays
+// all of them, and a listener that falls too far behind is dropped
+func TestBroadcasterReplay(t *testing.T) {
+	b := outbox.NewBroadcaster(3)
+	ctx := context.Background()
+	var events []user.Event
+	for i := 1; i <= 5; i++ {
+		u := user.User{Username: fmt.Sprintf("user%d", i)}
+		u.ID = uint(i)
+		events = append(events, user.NewEvent(user.EventUserCreated, u))
+		require.NoError(t, b.Publish(ctx, events[i-1]))
+	}
+
+	replay, l := b.Listen(events[2].ID, nil)
+	assert.Equal(t, events[3:], replay)
+	b.Stop(l)
+	replay, l = b.Listen(events[0].ID, func(e user.Event) bool { return e.UserID != 4 })
+	assert.Equal(t, []user.Event{events[2], events[4]}, replay)
+	b.Stop(l)
+	replay, l = b.Listen("", nil)
+	assert.Empty(t, replay)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, b.Publish(ctx, events[0]))
+	}
+	received := 0
+	for range l.C {
+		received++
+	}
+	assert.Less(t, received, 100)
+}
@@ -22,3 +22,17 @@ func TestStatusEndpoint(t *testing.T) {
 
 	assert.Equal(t, 200, resp.StatusCode())
 }
+
+// TestHealthEndpoints - the api is alive, and ready since its database is up and migrated
+func TestHealthEndpoints(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().Get(ROOT_URL + "healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+
+	resp, err = client.R().Get(ROOT_URL + "readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode(), resp.String())
+	assert.Contains(t, resp.String(), `"Name":"database","Status":"ok"`)
+	assert.Contains(t, resp.String(), `"Name":"migrations","Status":"ok"`)
+}
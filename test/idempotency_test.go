@@ -0,0 +1,181 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/idempotency"
+	transHTTP "github.com/aebranton/rest-api/internal/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signupBody - the body for signing up the given user
+func signupBody(username string) map[string]string {
+	return map[string]string{
+		"Username":  username,
+		"Password":  username + "password",
+		"FirstName": "Testy",
+		"LastName":  "McTest",
+		"Email":     username + "@example.com",
+		"Telephone": "5555555555",
+	}
+}
+
+// TestInProcessIdempotentCreate - retrying a sign up with the same key replays the first response instead of
+// making a second user, and reusing the key for a different sign up is rejected
+func TestInProcessIdempotentCreate(t *testing.T) {
+	api := newTestAPI(t)
+	key := map[string]string{transHTTP.IdempotencyKeyHeader: "signup-1"}
+
+	first := api.doWithHeaders("POST", "/api/user", "", signupBody("testyguy"), key)
+	require.Equal(t, 200, first.Code, first.Body.String())
+	assert.Empty(t, first.Header().Get(transHTTP.IdempotentReplayedHeader))
+
+	retry := api.doWithHeaders("POST", "/api/user", "", signupBody("testyguy"), key)
+	assert.Equal(t, 200, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get(transHTTP.IdempotentReplayedHeader))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, first.Header().Get("ETag"), retry.Header().Get("ETag"))
+	assert.NotEqual(t, first.Header().Get(transHTTP.RequestIDHeader), retry.Header().Get(transHTTP.RequestIDHeader))
+
+	admin := api.login("admin", "adminpassword")
+	rec := api.do("GET", "/api/user?username=testyguy", admin, nil)
+	assert.Equal(t, 200, rec.Code)
+	rec = api.do("GET", "/api/user/3", admin, nil)
+	assert.Equal(t, 404, rec.Code)
+
+	rec = api.doWithHeaders("POST", "/api/user", "", signupBody("otherguy"), key)
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, transHTTP.ProblemContentType, rec.Header().Get("Content-Type"))
+
+	// Without a key, or with a new one, the request runs again
+	rec = api.do("POST", "/api/user", "", signupBody("testyguy"))
+	assert.Equal(t, 409, rec.Code)
+	rec = api.doWithHeaders("POST", "/api/user", "", signupBody("testyguy"),
+		map[string]string{transHTTP.IdempotencyKeyHeader: "signup-2"})
+	assert.Equal(t, 409, rec.Code)
+}
+
+// TestInProcessIdempotentChanges - keys belong to the caller, deletes replay rather than 404ing,
+// reads ignore the key, and keys that are too long are rejected
+func TestInProcessIdempotentChanges(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	api.createUser("otherguy")
+	token := api.login("testyguy", "testyguypassword")
+	admin := api.login("admin", "adminpassword")
+	key := map[string]string{transHTTP.IdempotencyKeyHeader: "change-1"}
+
+	rec := api.doWithHeaders("PUT", "/api/user/2", token, `{"Telephone": "6666666666"}`, key)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+
+	// The same key from someone else is theirs to use
+	rec = api.doWithHeaders("DELETE", "/api/user/3", admin, nil, key)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	rec = api.doWithHeaders("DELETE", "/api/user/3", admin, nil, key)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get(transHTTP.IdempotentReplayedHeader))
+	rec = api.do("DELETE", "/api/user/3", admin, nil)
+	assert.Equal(t, 404, rec.Code)
+
+	rec = api.doWithHeaders("GET", "/api/user/2", token, nil, key)
+	assert.Equal(t, 200, rec.Code)
+	assert.Empty(t, rec.Header().Get(transHTTP.IdempotentReplayedHeader))
+
+	long := make([]byte, idempotency.MaxKeyLength+1)
+	for i := range long {
+		long[i] = 'k'
+	}
+	rec = api.doWithHeaders("PUT", "/api/user/2", token, `{"Telephone": "7777777777"}`,
+		map[string]string{transHTTP.IdempotencyKeyHeader: string(long)})
+	assert.Equal(t, 400, rec.Code)
+}
+
+// TestIdempotencyKeys - a key can't be replayed while its first request is running, abandoned keys can be
+// used again, and keys are forgotten once they expire
+func TestIdempotencyKeys(t *testing.T) {
+	svc := idempotency.NewService(idempotency.NewMemoryStore(), 50*time.Millisecond)
+
+	record, fresh, err := svc.Begin("user:1", "key", "fingerprint")
+	require.NoError(t, err)
+	assert.True(t, fresh)
+	_, _, err = svc.Begin("user:1", "key", "fingerprint")
+	assert.ErrorIs(t, err, idempotency.ErrInProgress)
+	_, _, err = svc.Begin("user:1", "key", "other")
+	assert.ErrorIs(t, err, idempotency.ErrKeyReused)
+
+	require.NoError(t, svc.Abandon(record))
+	record, fresh, err = svc.Begin("user:1", "key", "fingerprint")
+	require.NoError(t, err)
+	assert.True(t, fresh)
+	require.NoError(t, svc.Complete(&record, 201, nil, []byte("created")))
+
+	replay, fresh, err := svc.Begin("user:1", "key", "fingerprint")
+	require.NoError(t, err)
+	assert.False(t, fresh)
+	assert.Equal(t, 201, replay.Status)
+	assert.Equal(t, []byte("created"), replay.Body)
+
+	time.Sleep(60 * time.Millisecond)
+	_, fresh, err = svc.Begin("user:1", "key", "other")
+	require.NoError(t, err)
+	assert.True(t, fresh)
+
+	time.Sleep(60 * time.Millisecond)
+	purged, err := svc.PurgeExpired()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+}
+
+// TestIdempotencyLease - a request that never finished holds its key until its lease runs out, then a retry takes
+// the key over. The abandoned request can't store its response over the retry's, and a finished request's key
+// is kept for its whole TTL
+func TestIdempotencyLease(t *testing.T) {
+	svc := idempotency.NewService(idempotency.NewMemoryStore(), time.Hour)
+	svc.Lease = 20 * time.Millisecond
+
+	crashed, fresh, err := svc.Begin("user:1", "key", "fingerprint")
+	require.NoError(t, err)
+	assert.True(t, fresh)
+	_, _, err = svc.Begin("user:1", "key", "fingerprint")
+	assert.ErrorIs(t, err, idempotency.ErrInProgress)
+
+	time.Sleep(30 * time.Millisecond)
+	retry, fresh, err := svc.Begin("user:1", "key", "fingerprint")
+	require.NoError(t, err)
+	assert.True(t, fresh, "the key should be taken over once the lease runs out")
+	assert.NotEqual(t, crashed.ID, retry.ID)
+
+	require.NoError(t, svc.Complete(&crashed, 200, nil, []byte("late")))
+	_, _, err = svc.Begin("user:1", "key", "fingerprint")
+	assert.ErrorIs(t, err, idempotency.ErrInProgress)
+
+	require.NoError(t, svc.Complete(&retry, 201, nil, []byte("created")))
+	time.Sleep(30 * time.Millisecond)
+	replay, fresh, err := svc.Begin("user:1", "key", "fingerprint")
+	require.NoError(t, err)
+	assert.False(t, fresh)
+	assert.Equal(t, []byte("created"), replay.Body)
+}
+
+// TestIdempotencyNotOnImports - imports stream in files far bigger than an idempotent request can be, so an
+// Idempotency-Key on one is ignored rather than refusing it
+func TestIdempotencyNotOnImports(t *testing.T) {
+	api := newTestAPI(t)
+	admin := api.login("admin", "adminpassword")
+
+	body := "Username,Password,FirstName,LastName,Email,Telephone\n" +
+		"importguy,importguypassword,Import,Guy,importguy@example.com,5555555555\n" +
+		strings.Repeat("\n", transHTTP.MaxIdempotentBodySize)
+	headers := map[string]string{"Content-Type": "text/csv", transHTTP.IdempotencyKeyHeader: "import-key"}
+	rec := api.doWithHeaders("POST", "/api/user/import", admin, body, headers)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Empty(t, rec.Header().Get(transHTTP.IdempotentReplayedHeader))
+
+	rec = api.doWithHeaders("POST", "/api/user/import", admin, body, headers)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Empty(t, rec.Header().Get(transHTTP.IdempotentReplayedHeader))
+	assert.Contains(t, rec.Body.String(), `"Unchanged":1`)
+}
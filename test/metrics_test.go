@@ -0,0 +1,55 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/metrics"
+	transHTTP "github.com/aebranton/rest-api/internal/transport/http"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestInProcessMetrics - requests, logins, password hashing and users all show up on /metrics
+func TestInProcessMetrics(t *testing.T) {
+	api := newTestAPI(t)
+	m := metrics.New()
+	require.NoError(t, m.RegisterUserCounts(api.users.CountUsers))
+	user.PasswordHashed = m.ObservePasswordHash
+	defer func() { user.PasswordHashed = func(d time.Duration) {} }()
+	api.handler.Metrics = m
+	api.handler.InitRoutes()
+	api.server = transHTTP.Instrument(api.handler.Router, m)
+
+	created := api.createUser("testyguy")
+	api.createUser("otherguy")
+	token := api.login("testyguy", "testyguypassword")
+	rec := api.do("POST", "/api/auth/token", "", map[string]string{"Username": "testyguy", "Password": "wrong"})
+	require.Equal(t, 401, rec.Code)
+	rec = api.do("GET", "/api/user/2", token, nil)
+	require.Equal(t, 200, rec.Code)
+	rec = api.do("GET", "/api/user/42", token, nil)
+	require.Equal(t, 404, rec.Code)
+	rec = api.do("DELETE", "/api/user/3", api.login("admin", "adminpassword"), nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	api.do("GET", "/no/such/route", "", nil)
+
+	rec = api.do("GET", "/metrics", "", nil)
+	require.Equal(t, 200, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/api/user/{id}",status="200"} 1`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/api/user/{id}",status="404"} 1`)
+	assert.Contains(t, body, `http_requests_total{method="POST",route="/api/user",status="200"} 2`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/api/user/{id}",status="200"} 1`)
+	// The scrape itself is in flight while it's written
+	assert.Contains(t, body, "http_requests_in_flight 1")
+	assert.Contains(t, body, `auth_attempts_total{method="password",result="success"} 2`)
+	assert.Contains(t, body, `auth_attempts_total{method="password",result="failure"} 1`)
+	assert.Contains(t, body, "user_password_hash_duration_seconds_count 2")
+	assert.Contains(t, body, `users{state="active"} 2`)
+	assert.Contains(t, body, `users{state="deleted"} 1`)
+	assert.Contains(t, body, "go_goroutines")
+	assert.NotContains(t, body, created.Email)
+}
@@ -0,0 +1,48 @@
+// +build e2e
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/database"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMigrationsCheckerReadOnly - the readiness check only reads. Against a database that has never been
+// migrated it reports every migration pending, without making the schema_migrations table itself
+func TestMigrationsCheckerReadOnly(t *testing.T) {
+	db, err := gorm.Open("postgres", DB_URL)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// An empty schema of our own stands in for a fresh database
+	schema := fmt.Sprintf("fresh%d", time.Now().UnixNano())
+	require.NoError(t, db.Exec("CREATE SCHEMA "+schema).Error)
+	defer db.Exec("DROP SCHEMA " + schema + " CASCADE")
+	fresh, err := gorm.Open("postgres", DB_URL+" search_path="+schema)
+	require.NoError(t, err)
+	defer fresh.Close()
+
+	checker, err := database.MigrationsChecker(fresh)
+	require.NoError(t, err)
+	err = checker.Check(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pending")
+
+	var tables int
+	require.NoError(t, db.Raw("SELECT count(*) FROM information_schema.tables WHERE table_schema = ?", schema).Row().Scan(&tables))
+	assert.Zero(t, tables)
+
+	migrator, err := database.NewMigrator(fresh)
+	require.NoError(t, err)
+	pending, err := migrator.Pending()
+	require.NoError(t, err)
+	assert.Len(t, pending, len(migrator.Migrations))
+}
@@ -0,0 +1,49 @@
+package test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/aebranton/rest-api/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEmbeddedMigrations - every migration built into the binary should load, with versions counting up from 1
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := database.EmbeddedMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, uint(i+1), m.Version, "migration %s is out of sequence", m.Name)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+// TestLoadMigrations - migrations are ordered by version, and the no-transaction marker is picked up
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0002_add_index.up.sql":      {Data: []byte("-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY a ON b (c);")},
+		"migrations/0002_add_index.down.sql":    {Data: []byte("-- migrate:no-transaction\nDROP INDEX CONCURRENTLY a;")},
+		"migrations/0001_create_table.up.sql":   {Data: []byte("CREATE TABLE b (c int);")},
+		"migrations/0001_create_table.down.sql": {Data: []byte("DROP TABLE b;")},
+	}
+	migrations, err := database.LoadMigrations(fsys)
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, "create_table", migrations[0].Name)
+	assert.False(t, migrations[0].NoTransaction)
+	assert.Equal(t, "add_index", migrations[1].Name)
+	assert.True(t, migrations[1].NoTransaction)
+}
+
+// TestLoadMigrationsRequiresDown - a migration without a way back is rejected
+func TestLoadMigrationsRequiresDown(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0001_create_table.up.sql": {Data: []byte("CREATE TABLE b (c int);")},
+	}
+	_, err := database.LoadMigrations(fsys)
+	assert.Error(t, err)
+}
@@ -0,0 +1,272 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/outbox"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink - a sink that remembers every event it publishes, and fails every event for the users in failFor
+type recordingSink struct {
+	mu      sync.Mutex
+	events  []user.Event
+	failFor map[uint]bool
+}
+
+// Publish - records the event, unless its user is failing
+func (s *recordingSink) Publish(ctx context.Context, event user.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failFor[event.UserID] {
+		return errors.New("sink is down for this user")
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+// recordingBroker - a broker that remembers the topic and key of everything published to it
+type recordingBroker struct {
+	topics, keys []string
+}
+
+// Publish - records the message
+func (b *recordingBroker) Publish(ctx context.Context, topic string, key string, payload []byte) error {
+	b.topics = append(b.topics, topic)
+	b.keys = append(b.keys, key)
+	return nil
+}
+
+// newOutboxUser - a valid user to create in outbox tests
+func newOutboxUser(username string) user.User {
+	return user.User{
+		Username: username, Password: "password", FirstName: "Outbox", LastName: "User",
+		Email: username + "@example.com", Telephone: "5555555555", Role: user.RoleUser,
+	}
+}
+
+// TestOutboxWrittenWithChanges - every change writes its event to the outbox, and a change that fails writes nothing
+func TestOutboxWrittenWithChanges(t *testing.T) {
+	store := user.NewMemoryStore()
+	users := user.NewService(store)
+	ctx := context.Background()
+
+	created, err := users.CreateUser(ctx, newOutboxUser("outboxer"))
+	require.NoError(t, err)
+	_, err = users.UpdateUser(ctx, created.ID, user.User{FirstName: "Changed"}, user.AnyVersion)
+	require.NoError(t, err)
+	require.NoError(t, users.DeleteUser(ctx, created.ID, user.AnyVersion))
+
+	// Failed changes are rolled back along with their events
+	_, err = users.CreateUser(ctx, newOutboxUser("outboxer2"))
+	require.NoError(t, err)
+	dupe := newOutboxUser("outboxer2")
+	_, err = users.CreateUser(ctx, dupe)
+	assert.ErrorIs(t, err, user.ErrDuplicate)
+	_, err = users.UpdateUser(ctx, created.ID+1, user.User{FirstName: "Stale"}, 99)
+	assert.ErrorIs(t, err, user.ErrVersionMismatch)
+
+	pending, err := store.PendingOutbox(100)
+	require.NoError(t, err)
+	types := []user.EventType{}
+	for _, message := range pending {
+		types = append(types, message.EventType)
+	}
+	assert.Equal(t, []user.EventType{user.EventUserCreated, user.EventUserUpdated, user.EventUserDeleted, user.EventUserCreated}, types)
+
+	event, err := pending[1].Event()
+	require.NoError(t, err)
+	assert.Equal(t, pending[1].EventID, event.ID)
+	assert.Equal(t, created.ID, event.UserID)
+	assert.Equal(t, "Changed", event.User.FirstName)
+}
+
+// TestOutboxRelayOrdering - a user whose event can't be published holds up only their own later events,
+// which are then published in order once the sink recovers
+func TestOutboxRelayOrdering(t *testing.T) {
+	store := user.NewMemoryStore()
+	users := user.NewService(store)
+	ctx := context.Background()
+
+	first, err := users.CreateUser(ctx, newOutboxUser("first"))
+	require.NoError(t, err)
+	second, err := users.CreateUser(ctx, newOutboxUser("second"))
+	require.NoError(t, err)
+	for _, name := range []string{"One", "Two"} {
+		_, err = users.UpdateUser(ctx, first.ID, user.User{FirstName: name}, user.AnyVersion)
+		require.NoError(t, err)
+	}
+
+	sink := &recordingSink{failFor: map[uint]bool{first.ID: true}}
+	relay := outbox.NewRelay(store, sink)
+	relay.BaseBackoff = 0
+
+	published, err := relay.RelayPending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, published)
+	require.Len(t, sink.events, 1)
+	assert.Equal(t, second.ID, sink.events[0].UserID)
+
+	pending, err := store.PendingOutbox(100)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.NotEmpty(t, pending[0].LastError)
+	assert.Equal(t, 0, pending[1].Attempts, "later events wait for the failed one")
+
+	sink.failFor = nil
+	published, err = relay.RelayPending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, published)
+	require.Len(t, sink.events, 4)
+	assert.Equal(t, user.EventUserCreated, sink.events[1].Type)
+	assert.Equal(t, "One", sink.events[2].User.FirstName)
+	assert.Equal(t, "Two", sink.events[3].User.FirstName)
+
+	// Published messages aren't published again, and are pruned once they're past retention
+	published, err = relay.RelayPending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, published)
+	pruned, err := store.PruneOutbox(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), pruned)
+}
+
+// TestOutboxRelayBackoff - a failed message isn't tried again until its backoff has passed
+func TestOutboxRelayBackoff(t *testing.T) {
+	store := user.NewMemoryStore()
+	users := user.NewService(store)
+	created, err := users.CreateUser(context.Background(), newOutboxUser("backoffer"))
+	require.NoError(t, err)
+
+	sink := &recordingSink{failFor: map[uint]bool{created.ID: true}}
+	relay := outbox.NewRelay(store, sink)
+	_, err = relay.RelayPending(context.Background())
+	require.NoError(t, err)
+
+	sink.failFor = nil
+	published, err := relay.RelayPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, published)
+
+	pending, err := store.PendingOutbox(100)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.NotNil(t, pending[0].NextAttemptAt)
+	assert.True(t, pending[0].NextAttemptAt.After(time.Now()))
+}
+
+// lockedOutStore - a user store on an instance whose relay never gets the outbox lock, because another
+// instance's relay always has it
+type lockedOutStore struct {
+	*user.MemoryStore
+}
+
+// Transaction - runs fn in a transaction that can't take the lock either
+func (s lockedOutStore) Transaction(fn func(tx user.Store) error) error {
+	return s.MemoryStore.Transaction(func(tx user.Store) error {
+		return fn(lockedOutStore{tx.(*user.MemoryStore)})
+	})
+}
+
+// LockOutbox - never gets the lock
+func (s lockedOutStore) LockOutbox() (bool, error) {
+	return false, nil
+}
+
+// TestOutboxTailEveryInstance - with two instances, only the one holding the lock relays, but both instances'
+// event streams get every event, in order and only once
+func TestOutboxTailEveryInstance(t *testing.T) {
+	store := user.NewMemoryStore()
+	users := user.NewService(store)
+	ctx := context.Background()
+
+	first, err := users.CreateUser(ctx, newOutboxUser("first"))
+	require.NoError(t, err)
+	_, err = users.CreateUser(ctx, newOutboxUser("second"))
+	require.NoError(t, err)
+	_, err = users.UpdateUser(ctx, first.ID, user.User{FirstName: "Updated"}, user.AnyVersion)
+	require.NoError(t, err)
+
+	relaying := outbox.NewRelay(store, &recordingSink{})
+	lockedOut := outbox.NewRelay(lockedOutStore{store}, &recordingSink{})
+	broadcasters := []*outbox.Broadcaster{outbox.NewBroadcaster(outbox.DefaultReplaySize), outbox.NewBroadcaster(outbox.DefaultReplaySize)}
+	tails := []*outbox.Tail{outbox.NewTail(store, broadcasters[0]), outbox.NewTail(lockedOutStore{store}, broadcasters[1])}
+	var listeners []*outbox.Listener
+	for _, b := range broadcasters {
+		_, l := b.Listen("", nil)
+		defer b.Stop(l)
+		listeners = append(listeners, l)
+	}
+
+	published, err := lockedOut.RelayPending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, published)
+	for _, tail := range tails {
+		handed, err := tail.Poll(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, handed, "nothing is handed on until it's published")
+	}
+
+	published, err = relaying.RelayPending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, published)
+	for i, tail := range tails {
+		handed, err := tail.Poll(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 3, handed)
+		assert.Equal(t, user.EventUserCreated, (<-listeners[i].C).Type)
+		assert.Equal(t, user.EventUserCreated, (<-listeners[i].C).Type)
+		assert.Equal(t, "Updated", (<-listeners[i].C).User.FirstName)
+
+		handed, err = tail.Poll(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, handed, "events are only handed on once")
+	}
+
+	require.NoError(t, users.DeleteUser(ctx, first.ID, user.AnyVersion))
+	_, err = relaying.RelayPending(ctx)
+	require.NoError(t, err)
+	for i, tail := range tails {
+		handed, err := tail.Poll(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, handed)
+		assert.Equal(t, user.EventUserDeleted, (<-listeners[i].C).Type)
+	}
+}
+
+// TestOutboxSinks - the NDJSON and broker sinks, fanned out to with Sinks
+func TestOutboxSinks(t *testing.T) {
+	var buf bytes.Buffer
+	broker := &recordingBroker{}
+	sinks := outbox.Sinks{outbox.NewWriterSink(&buf), outbox.NewBrokerSink(broker, "users")}
+
+	u := newOutboxUser("sinker")
+	u.ID = 42
+	ctx := context.Background()
+	require.NoError(t, sinks.Publish(ctx, user.NewEvent(user.EventUserCreated, u)))
+	require.NoError(t, sinks.Publish(ctx, user.NewEvent(user.EventUserDeleted, u)))
+
+	scanner := bufio.NewScanner(&buf)
+	types := []user.EventType{}
+	for scanner.Scan() {
+		var event user.Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		assert.Equal(t, "sinker", event.User.Username)
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []user.EventType{user.EventUserCreated, user.EventUserDeleted}, types)
+	assertNoHash(t, buf.String())
+
+	assert.Equal(t, []string{"users", "users"}, broker.topics)
+	assert.Equal(t, []string{"42", "42"}, broker.keys)
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getReport - gets a health endpoint and decodes its report
+func (a *testAPI) getReport(path string) (int, health.Report) {
+	a.t.Helper()
+	rec := a.do("GET", path, "", nil)
+	var report health.Report
+	require.NoError(a.t, json.Unmarshal(rec.Body.Bytes(), &report), rec.Body.String())
+	return rec.Code, report
+}
+
+// TestInProcessHealth - liveness always passes, readiness only while every check does and we aren't shutting down
+func TestInProcessHealth(t *testing.T) {
+	api := newTestAPI(t)
+
+	status, report := api.getReport("/healthz")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, health.StatusOK, report.Status)
+
+	database := errors.New("connection refused")
+	api.handler.Health.Timeout = 50 * time.Millisecond
+	api.handler.Health.Add(health.CheckerFunc("database", func(ctx context.Context) error { return database }))
+	api.handler.Health.Add(health.CheckerFunc("cache", func(ctx context.Context) error { return nil }))
+
+	status, report = api.getReport("/readyz")
+	assert.Equal(t, 503, status)
+	assert.Equal(t, health.StatusFailing, report.Status)
+	require.Len(t, report.Checks, 3)
+	assert.Equal(t, health.ShutdownCheck, report.Checks[0].Name)
+	assert.Equal(t, health.StatusOK, report.Checks[0].Status)
+	assert.Equal(t, "database", report.Checks[1].Name)
+	assert.Equal(t, health.StatusFailing, report.Checks[1].Status)
+	assert.Equal(t, "connection refused", report.Checks[1].Error)
+	assert.Equal(t, health.StatusOK, report.Checks[2].Status)
+
+	database = nil
+	status, report = api.getReport("/readyz")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, health.StatusOK, report.Status)
+
+	// A check that hangs is failed once its timeout is up, without holding up the others
+	api.handler.Health.Add(health.CheckerFunc("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(time.Second)
+		return ctx.Err()
+	}))
+	start := time.Now()
+	status, report = api.getReport("/readyz")
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+	assert.Equal(t, 503, status)
+	assert.Equal(t, "timed out after 50ms", report.Checks[3].Error)
+	assert.GreaterOrEqual(t, report.Checks[3].LatencyMS, 50.0)
+
+	// Once shutdown starts readiness fails, but we're still alive
+	api.handler.Health = health.NewService(health.DefaultTimeout)
+	api.handler.Health.ShuttingDown()
+	status, report = api.getReport("/readyz")
+	assert.Equal(t, 503, status)
+	assert.Equal(t, health.ErrShuttingDown.Error(), report.Checks[0].Error)
+	status, _ = api.getReport("/healthz")
+	assert.Equal(t, 200, status)
+}
@@ -0,0 +1,102 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aebranton/rest-api/internal/tracing"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans - records every span ended from now on until the test is done
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.Install(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+	return recorder
+}
+
+// spansNamed - the spans recorded with the given name
+func spansNamed(recorder *tracetest.SpanRecorder, name string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// spanAttribute - the value of the attribute with the given key on span
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// TestInProcessTracing - requests are traced by route template, carry on a trace sent in traceparent,
+// and password hashing and comparing show up as children of the request they were for
+func TestInProcessTracing(t *testing.T) {
+	recorder := recordSpans(t)
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	signup := spansNamed(recorder, "/api/user")
+	require.Len(t, signup, 1)
+	hashes := spansNamed(recorder, "user.HashPassword")
+	require.Len(t, hashes, 1)
+	assert.Equal(t, signup[0].SpanContext().SpanID(), hashes[0].Parent().SpanID())
+
+	token := api.login("testyguy", "testyguypassword")
+	logins := spansNamed(recorder, "/api/auth/token")
+	require.Len(t, logins, 1)
+	compares := spansNamed(recorder, "user.ComparePassword")
+	require.Len(t, compares, 1)
+	assert.Equal(t, logins[0].SpanContext().SpanID(), compares[0].Parent().SpanID())
+	matched, _ := spanAttribute(compares[0], "user.password_matched")
+	assert.True(t, matched.AsBool())
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	rec := api.doWithHeaders("GET", "/api/user/2", token, nil, map[string]string{"traceparent": traceparent})
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	gets := spansNamed(recorder, "/api/user/{id}")
+	require.Len(t, gets, 1)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", gets[0].Parent().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", gets[0].Parent().SpanID().String())
+	assert.True(t, gets[0].Parent().IsRemote())
+	assert.Equal(t, trace.SpanKindServer, gets[0].SpanKind())
+	status, _ := spanAttribute(gets[0], "http.status_code")
+	assert.Equal(t, int64(200), status.AsInt64())
+	route, _ := spanAttribute(gets[0], "http.route")
+	assert.Equal(t, "/api/user/{id}", route.AsString())
+	assert.NotEqual(t, gets[0].SpanContext().TraceID(), signup[0].SpanContext().TraceID())
+
+	rec = api.do("GET", "/api/user/42", token, nil)
+	require.Equal(t, 404, rec.Code)
+	gets = spansNamed(recorder, "/api/user/{id}")
+	require.Len(t, gets, 2)
+	status, _ = spanAttribute(gets[1], "http.status_code")
+	assert.Equal(t, int64(404), status.AsInt64())
+}
+
+// TestTracingWithoutARequest - nothing is recorded for work that isn't part of a request, ie making sure
+// the admin account exists at startup
+func TestTracingWithoutARequest(t *testing.T) {
+	recorder := recordSpans(t)
+	api := newTestAPI(t)
+
+	_, err := api.users.EnsureAdmin(context.Background(), "otheradmin", "otheradminpassword", "otheradmin@example.com")
+	require.NoError(t, err)
+	_, err = api.users.AuthenticateUser(user.UserAuth{Username: "otheradmin", Password: "otheradminpassword"})
+	require.NoError(t, err)
+	assert.Empty(t, recorder.Ended())
+}
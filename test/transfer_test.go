@@ -0,0 +1,203 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	transHTTP "github.com/aebranton/rest-api/internal/transport/http"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// importUsers - sends an import with the given content type and decodes the report
+func (a *testAPI) importUsers(token, query, contentType, body string) (int, transHTTP.ImportResponse) {
+	a.t.Helper()
+	req := httptest.NewRequest("POST", "/api/user/import"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	a.server.ServeHTTP(rec, req)
+
+	var resp transHTTP.ImportResponse
+	require.NoError(a.t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	return rec.Code, resp
+}
+
+// TestInProcessExport - users are exported as CSV or NDJSON, with the columns and filters asked for
+func TestInProcessExport(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	api.createUser("otherguy")
+	admin := api.login("admin", "adminpassword")
+
+	rec := api.do("GET", "/api/user/export", admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "users.csv")
+	rows, err := csv.NewReader(bytes.NewReader(rec.Body.Bytes())).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, []string{"ID", "CreatedAt", "UpdatedAt", "Username", "FirstName", "LastName",
+		"Email", "Telephone", "Role", "Version"}, rows[0])
+	assert.Equal(t, "admin", rows[1][3])
+	assert.NotContains(t, rec.Body.String(), "Password")
+
+	rec = api.do("GET", "/api/user/export?format=ndjson&columns=username,Email&username_contains=guy&sort=-username", admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	assert.Equal(t, transHTTP.NDJSONContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, `{"Username":"testyguy","Email":"testyguy@example.com"}`+"\n"+
+		`{"Username":"otherguy","Email":"otherguy@example.com"}`+"\n", rec.Body.String())
+
+	// An export with no users is just the header
+	rec = api.do("GET", "/api/user/export?columns=ID&username_contains=nobody", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	assert.Equal(t, "ID\n", rec.Body.String())
+
+	for _, query := range []string{"format=xml", "columns=Password", "limit=10", "sort=password"} {
+		rec = api.do("GET", "/api/user/export?"+query, admin, nil)
+		assert.Equal(t, 400, rec.Code, query)
+	}
+	rec = api.do("GET", "/api/user/export", "", nil)
+	assert.Equal(t, 401, rec.Code)
+}
+
+// TestInProcessExportFormulas - CSV cells a spreadsheet would run as formulas are escaped, and imported back as they were
+func TestInProcessExportFormulas(t *testing.T) {
+	api := newTestAPI(t)
+	u := api.createUser("testyguy")
+	_, err := api.users.UpdateUser(context.Background(), u.ID,
+		user.User{FirstName: `=HYPERLINK("http://evil.example.com","hi")`, LastName: "@SUM(A1)"}, user.AnyVersion)
+	require.NoError(t, err)
+	admin := api.login("admin", "adminpassword")
+
+	rec := api.do("GET", "/api/user/export?columns=Username,FirstName,LastName&username_contains=testy", admin, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	rows, err := csv.NewReader(bytes.NewReader(rec.Body.Bytes())).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, []string{"testyguy", `'=HYPERLINK("http://evil.example.com","hi")`, "'@SUM(A1)"}, rows[1])
+
+	status, resp := api.importUsers(admin, "", "text/csv", rec.Body.String())
+	require.Equal(t, 200, status, resp)
+	assert.Equal(t, 1, resp.Unchanged)
+	imported, err := api.users.GetUser(u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "@SUM(A1)", imported.LastName)
+}
+
+// TestInProcessImport - imports create new users and update the ones matching by username or email
+func TestInProcessImport(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+
+	body := "Username,Password,FirstName,LastName,Email,Telephone,ID\n" +
+		"newguy,newguypassword,New,Guy,newguy@example.com,5555555555,\n" +
+		",,Testy,Updated,testyguy@example.com,,2\n" +
+		"badguy,badguypassword,Bad,Guy,not-an-email,5555555555,\n" +
+		"testyguy,,Testy,McTest,,,\n"
+
+	// A dry run reports what would happen, without changing anything
+	status, resp := api.importUsers(admin, "?dry_run=true", "text/csv", body)
+	require.Equal(t, 207, status)
+	assert.True(t, resp.DryRun)
+	assert.Equal(t, 1, resp.Created)
+	assert.Equal(t, 1, resp.Updated)
+	assert.Equal(t, 1, resp.Unchanged)
+	assert.Equal(t, 1, resp.Failed)
+	_, err := api.users.GetUserByUsername("newguy")
+	assert.ErrorIs(t, err, user.ErrNotFound)
+
+	status, resp = api.importUsers(admin, "", "text/csv", body)
+	require.Equal(t, 207, status)
+	require.Len(t, resp.Rows, 4)
+	assert.Equal(t, user.ImportCreated, resp.Rows[0].Action)
+	assert.Equal(t, user.ImportUpdated, resp.Rows[1].Action)
+	assert.Equal(t, uint(2), resp.Rows[1].ID)
+	assert.Equal(t, 422, resp.Rows[2].Status)
+	assert.Equal(t, "validation", resp.Rows[2].Code)
+	require.NotNil(t, resp.Rows[2].Error)
+	assert.Equal(t, "Email", resp.Rows[2].Error.Errors[0].Field)
+	assert.Equal(t, 3, resp.Rows[2].Row)
+	assert.Equal(t, user.ImportUpdated, resp.Rows[3].Action)
+
+	created, err := api.users.GetUserByUsername("newguy")
+	require.NoError(t, err)
+	assert.True(t, user.ComparePassword("newguypassword", created.Password))
+	updated, err := api.users.GetUser(2)
+	require.NoError(t, err)
+	assert.Equal(t, "McTest", updated.LastName)
+	api.login("newguy", "newguypassword")
+
+	// Importing the same users again changes nothing
+	status, resp = api.importUsers(admin, "", "text/csv",
+		"Username,Password,Email\nnewguy,newguypassword,newguy@example.com\n")
+	require.Equal(t, 200, status)
+	assert.Equal(t, 1, resp.Unchanged)
+}
+
+// TestInProcessImportNDJSON - NDJSON imports, including pre-hashed passwords and an export imported back in
+func TestInProcessImportNDJSON(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	api.createUser("otherguy")
+	admin := api.login("admin", "adminpassword")
+
+	hashed, err := user.HashPassword("hashedguypassword")
+	require.NoError(t, err)
+	line, err := json.Marshal(map[string]string{
+		"Username": "hashedguy", "Password": hashed, "FirstName": "Hashed", "LastName": "Guy",
+		"Email": "hashedguy@example.com", "Telephone": "5555555555",
+	})
+	require.NoError(t, err)
+	body := string(line) + "\n\n" +
+		`{"Username": "plainguy", "Password": "plainguypassword", "FirstName": "Plain", "LastName": "Guy", ` +
+		`"Email": "plainguy@example.com", "Telephone": "5555555555"}` + "\n" +
+		`{"Username": "typoguy", "Pasword": "oops"}` + "\n" +
+		`{"Username": "testyguy", "Email": "otherguy@example.com"}` + "\n"
+
+	status, resp := api.importUsers(admin, "?hashed_passwords=true", "application/x-ndjson", body)
+	require.Equal(t, 207, status)
+	require.Len(t, resp.Rows, 4)
+	assert.Equal(t, user.ImportCreated, resp.Rows[0].Action)
+	assert.Equal(t, 422, resp.Rows[1].Status)
+	assert.Equal(t, "Password", resp.Rows[1].Error.Errors[0].Field)
+	assert.Equal(t, 400, resp.Rows[2].Status)
+	assert.Equal(t, 409, resp.Rows[3].Status)
+	// Rows are line numbers, so the blank line is counted
+	assert.Equal(t, 1, resp.Rows[0].Row)
+	assert.Equal(t, 3, resp.Rows[1].Row)
+	assert.Equal(t, 5, resp.Rows[3].Row)
+	api.login("hashedguy", "hashedguypassword")
+
+	// An export can be imported back in as it is
+	rec := api.do("GET", "/api/user/export?format=ndjson", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	status, resp = api.importUsers(admin, "?format=ndjson", "text/plain", rec.Body.String())
+	require.Equal(t, 200, status, resp)
+	assert.Equal(t, 4, resp.Unchanged)
+}
+
+// TestInProcessImportProblems - imports that can't be read at all are rejected as a whole
+func TestInProcessImportProblems(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	admin := api.login("admin", "adminpassword")
+	token := api.login("testyguy", "testyguypassword")
+
+	rec := api.do("POST", "/api/user/import", admin, "Username\n")
+	assert.Equal(t, 415, rec.Code)
+	rec = api.doWithHeaders("POST", "/api/user/import", admin, "Username,Shoesize\n", map[string]string{"Content-Type": "text/csv"})
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Shoesize")
+	rec = api.doWithHeaders("POST", "/api/user/import?dry_run=maybe", admin, "Username\n", map[string]string{"Content-Type": "text/csv"})
+	assert.Equal(t, 400, rec.Code)
+	rec = api.doWithHeaders("POST", "/api/user/import", token, "Username\n", map[string]string{"Content-Type": "text/csv"})
+	assert.Equal(t, 403, rec.Code)
+}
@@ -9,14 +9,12 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// TestGetUsers - tests the get all users endpoint
-func TestGetUsers(t *testing.T) {
+// TestGetUsersRequiresToken - the user routes should all be rejected without an access token
+func TestGetUsersRequiresToken(t *testing.T) {
 	client := resty.New()
 	resp, err := client.R().Get(ROOT_URL + "api/user")
-	if err != nil {
-		t.Fail()
-	}
-	assert.Equal(t, 200, resp.StatusCode())
+	assert.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode())
 }
 
 // TestCreateUser - tests creating a user, this should succeed, assuming we have started the test
@@ -33,6 +31,97 @@ func TestCreateUser(t *testing.T) {
 		Post(ROOT_URL + "api/user")
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode())
+	assertNoPasswordMaterial(t, resp, "")
+}
+
+// TestGetUsers - tests the get all users endpoint
+func TestGetUsers(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAdminToken(t)).
+		Get(ROOT_URL + "api/user")
+	if err != nil {
+		t.Fail()
+	}
+	assert.Equal(t, 200, resp.StatusCode())
+	assertNoPasswordMaterial(t, resp, "")
+}
+
+// TestGetUsersPaginated - the user list should page, and tell us how to get the next page.
+// There are at least two users by now (the admin and testyguy)
+func TestGetUsersPaginated(t *testing.T) {
+	var page struct {
+		Users      []map[string]interface{}
+		Total      int64
+		NextCursor string
+	}
+
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAdminToken(t)).
+		SetResult(&page).
+		Get(ROOT_URL + "api/user?limit=1&sort=-created_at")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.Len(t, page.Users, 1)
+	assert.GreaterOrEqual(t, page.Total, int64(2))
+	assert.NotEmpty(t, page.NextCursor)
+	assert.Contains(t, resp.Header().Get("Link"), `rel="next"`)
+	assert.NotEmpty(t, resp.Header().Get("X-Total-Count"))
+
+	resp, err = client.R().
+		SetAuthToken(getAdminToken(t)).
+		Get(ROOT_URL + "api/user?limit=1&offset=1&cursor=" + page.NextCursor)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, resp.StatusCode())
+}
+
+// TestGetUsersFiltered - filtering by username should only bring back matching users
+func TestGetUsersFiltered(t *testing.T) {
+	var page struct {
+		Users []map[string]interface{}
+		Total int64
+	}
+
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAdminToken(t)).
+		SetResult(&page).
+		Get(ROOT_URL + "api/user?username_contains=TESTY")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.Equal(t, int64(1), page.Total)
+}
+
+// TestGetUsersForbiddenForUser - regular users can't list everybody
+func TestGetUsersForbiddenForUser(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAccessToken(t)).
+		Get(ROOT_URL + "api/user")
+	assert.NoError(t, err)
+	assert.Equal(t, 403, resp.StatusCode())
+}
+
+// TestCreateUserRejectRoleWithoutAdmin - signing up can't be used to make yourself an admin
+func TestCreateUserRejectRoleWithoutAdmin(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetBody(`{"FirstName": "Sneaky", "LastName": "Admin", "Username": "sneakyadmin",
+				 "Password": "sneakyadmin", "Email": "sneakyadmin@example.com",
+				 "Telephone": "5555555555", "Role": "admin"}`).
+		Post(ROOT_URL + "api/user")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode())
+
+	resp, err = client.R().
+		SetAuthToken(getAccessToken(t)).
+		SetBody(`{"FirstName": "Sneaky", "LastName": "Admin", "Username": "sneakyadmin",
+				 "Password": "sneakyadmin", "Email": "sneakyadmin@example.com",
+				 "Telephone": "5555555555", "Role": "admin"}`).
+		Post(ROOT_URL + "api/user")
+	assert.NoError(t, err)
+	assert.Equal(t, 403, resp.StatusCode())
 }
 
 // TestCreateUserRejectBadEmail - Make sure that creating a user has email validation.
@@ -45,7 +134,7 @@ func TestCreateUserRejectBadEmail(t *testing.T) {
 				 "Telephone": "5555555555"}`).
 		Post(ROOT_URL + "api/user")
 	assert.NoError(t, err)
-	assert.Equal(t, 400, resp.StatusCode())
+	assert.Equal(t, 422, resp.StatusCode())
 }
 
 // TestCreateUserRejectBadPhone - Make sure that creating a user has phone validation.
@@ -58,7 +147,7 @@ func TestCreateUserRejectBadPhone(t *testing.T) {
 				 "Telephone": "seven"}`).
 		Post(ROOT_URL + "api/user")
 	assert.NoError(t, err)
-	assert.Equal(t, 400, resp.StatusCode())
+	assert.Equal(t, 422, resp.StatusCode())
 }
 
 // TestCreateUserRejectEmptyField - Make sure that creating a user has required field validation.
@@ -71,41 +160,179 @@ func TestCreateUserRejectEmptyField(t *testing.T) {
 				 "Telephone": "seven"}`).
 		Post(ROOT_URL + "api/user")
 	assert.NoError(t, err)
-	assert.Equal(t, 400, resp.StatusCode())
+	assert.Equal(t, 422, resp.StatusCode())
+
+	// Both problems should be reported, not just the first
+	assert.Contains(t, resp.String(), `{"Field":"FirstName","Code":"required"`)
+	assert.Contains(t, resp.String(), `{"Field":"Telephone","Code":"invalid_format"`)
 }
 
 // TestUpdateUser - make sure we can do a Put request on the user we created earlier
+// (user 2, since the admin account is always user 1)
 func TestUpdateUser(t *testing.T) {
 	client := resty.New()
 	resp, err := client.R().
-		SetBody(`{"Telephone": "6666666666"}`).Put(ROOT_URL + "api/user/1")
+		SetAuthToken(getAccessToken(t)).
+		SetBody(`{"Telephone": "6666666666"}`).Put(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assertNoPasswordMaterial(t, resp, "")
+}
+
+// TestUpdateUserPasswordNotReturned - changing a password shouldn't send it (or its hash) back.
+// Puts the original password back afterwards so the rest of the tests can still log in
+func TestUpdateUserPasswordNotReturned(t *testing.T) {
+	token := getAccessToken(t)
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(token).
+		SetBody(`{"Password": "s3cretPassw0rd"}`).Put(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assertNoPasswordMaterial(t, resp, "s3cretPassw0rd")
+
+	resp, err = client.R().
+		SetAuthToken(token).
+		SetBody(`{"Password": "testyguy"}`).Put(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+}
+
+// TestUpdateUserRejectRoleChange - regular users can't promote themselves
+func TestUpdateUserRejectRoleChange(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAccessToken(t)).
+		SetBody(`{"Role": "admin"}`).Put(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 403, resp.StatusCode())
+}
+
+// TestUpdateUserRejectStaleETag - an update made against an old version of the user is refused with a 412,
+// and the current ETag still works
+func TestUpdateUserRejectStaleETag(t *testing.T) {
+	token := getAccessToken(t)
+	client := resty.New()
+	resp, err := client.R().SetAuthToken(token).Get(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	etag := resp.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	resp, err = client.R().SetAuthToken(token).SetHeader("If-None-Match", etag).Get(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 304, resp.StatusCode())
+
+	resp, err = client.R().
+		SetAuthToken(token).
+		SetHeader("If-Match", `"2-0"`).
+		SetBody(`{"Telephone": "7777777777"}`).Put(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 412, resp.StatusCode())
+
+	resp, err = client.R().
+		SetAuthToken(token).
+		SetHeader("If-Match", etag).
+		SetBody(`{"Telephone": "7777777777"}`).Put(ROOT_URL + "api/user/2")
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode())
+	assert.NotEqual(t, etag, resp.Header().Get("ETag"))
+}
+
+// TestPatchUser - merge patches change just the fields given, and JSON patches can test before they change anything
+func TestPatchUser(t *testing.T) {
+	token := getAccessToken(t)
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(token).
+		SetHeader("Content-Type", "application/merge-patch+json").
+		SetBody(`{"Telephone": "8888888888"}`).Patch(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.Contains(t, resp.String(), `"Telephone":"8888888888"`)
+	assertNoPasswordMaterial(t, resp, "")
+
+	resp, err = client.R().
+		SetAuthToken(token).
+		SetHeader("Content-Type", "application/json-patch+json").
+		SetBody(`[{"op": "test", "path": "/Telephone", "value": "0000000000"}, {"op": "remove", "path": "/Telephone"}]`).
+		Patch(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 409, resp.StatusCode())
+}
+
+// TestUpdateUserRejectInvalid - an update that would leave the user invalid is rejected with a 422
+func TestUpdateUserRejectInvalid(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAccessToken(t)).
+		SetBody(`{"Email": "not-an-email"}`).Put(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 422, resp.StatusCode())
+	assert.Contains(t, resp.String(), `{"Field":"Email","Code":"invalid_format"`)
 }
 
 // TestGetUser - tests getting a single user by ID
 func TestGetUser(t *testing.T) {
 	client := resty.New()
 	resp, err := client.R().
-		Get(ROOT_URL + "api/user/1")
+		SetAuthToken(getAccessToken(t)).
+		Get(ROOT_URL + "api/user/2")
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode())
+	assertNoPasswordMaterial(t, resp, "")
+}
+
+// TestGetUserNotFound - a missing user is a 404 problem document, tagged with the request ID
+func TestGetUserNotFound(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAdminToken(t)).
+		Get(ROOT_URL + "api/user/99999")
+	assert.NoError(t, err)
+	assert.Equal(t, 404, resp.StatusCode())
+	assert.Equal(t, "application/problem+json", resp.Header().Get("Content-Type"))
+	assert.NotEmpty(t, resp.Header().Get("X-Request-ID"))
+	assert.Contains(t, resp.String(), `"type":"/problems/not-found"`)
+}
+
+// TestGetUserForbiddenForOtherUser - regular users can only look at themselves
+func TestGetUserForbiddenForOtherUser(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAccessToken(t)).
+		Get(ROOT_URL + "api/user/1")
+	assert.NoError(t, err)
+	assert.Equal(t, 403, resp.StatusCode())
 }
 
 // TestGetUserByUsername - Tests the get user by username endpoint
 func TestGetUserByUsername(t *testing.T) {
 	client := resty.New()
 	resp, err := client.R().
+		SetAuthToken(getAccessToken(t)).
 		Get(ROOT_URL + "api/user?username=testyguy")
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode())
+	assertNoPasswordMaterial(t, resp, "")
+}
+
+// TestDeleteUserForbiddenForUser - only admins can delete users, even themselves
+func TestDeleteUserForbiddenForUser(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken(getAccessToken(t)).
+		Delete(ROOT_URL + "api/user/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 403, resp.StatusCode())
 }
 
 // TestDeleteUser - Tests deleting a user
 func TestDeleteUser(t *testing.T) {
 	client := resty.New()
 	resp, err := client.R().
-		Delete(ROOT_URL + "api/user/1")
+		SetAuthToken(getAdminToken(t)).
+		Delete(ROOT_URL + "api/user/2")
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode())
 }
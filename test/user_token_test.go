@@ -0,0 +1,91 @@
+// +build e2e
+
+package test
+
+import (
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTokenCreateUser - creates the user the rest of the token tests log in as
+func TestTokenCreateUser(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetBody(`{"FirstName": "Token", "LastName": "Guy", "Username": "tokenguy",
+				 "Password": "tokenguy", "Email": "tokenguy@example.com",
+				 "Telephone": "5555555555"}`).
+		Post(ROOT_URL + "api/user")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assertNoPasswordMaterial(t, resp, "")
+}
+
+// TestTokenRejectBadPassword - a wrong password should never get a token
+func TestTokenRejectBadPassword(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetBody(`{"Username": "tokenguy", "Password": "notmypassword"}`).
+		Post(ROOT_URL + "api/auth/token")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode())
+}
+
+// TestTokenRejectBadToken - a garbage bearer token should be rejected by the middleware
+func TestTokenRejectBadToken(t *testing.T) {
+	client := resty.New()
+	resp, err := client.R().
+		SetAuthToken("not.a.token").
+		Get(ROOT_URL + "api/user")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode())
+}
+
+// TestTokenRefreshRotates - a refresh token can be exchanged once, and reusing it is rejected
+func TestTokenRefreshRotates(t *testing.T) {
+	tokens := getTokens(t, "tokenguy", "tokenguy")
+
+	client := resty.New()
+	resp, err := client.R().
+		SetBody(map[string]string{"refresh_token": tokens.RefreshToken}).
+		SetResult(&TokenResponse{}).
+		Post(ROOT_URL + "api/auth/refresh")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+
+	refreshed := resp.Result().(*TokenResponse)
+	assert.NotEmpty(t, refreshed.AccessToken)
+	assert.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+
+	// Using the old refresh token again should fail, and take the new one down with it
+	resp, err = client.R().
+		SetBody(map[string]string{"refresh_token": tokens.RefreshToken}).
+		Post(ROOT_URL + "api/auth/refresh")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode())
+
+	resp, err = client.R().
+		SetBody(map[string]string{"refresh_token": refreshed.RefreshToken}).
+		Post(ROOT_URL + "api/auth/refresh")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode())
+}
+
+// TestTokenLogout - once logged out, the refresh token can't be used anymore
+func TestTokenLogout(t *testing.T) {
+	tokens := getTokens(t, "tokenguy", "tokenguy")
+
+	client := resty.New()
+	resp, err := client.R().
+		SetBody(map[string]string{"refresh_token": tokens.RefreshToken}).
+		Post(ROOT_URL + "api/auth/logout")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+
+	resp, err = client.R().
+		SetBody(map[string]string{"refresh_token": tokens.RefreshToken}).
+		Post(ROOT_URL + "api/auth/refresh")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode())
+}
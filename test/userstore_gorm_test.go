@@ -0,0 +1,108 @@
+// +build e2e
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/tracing"
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// DB_URL - the e2e database from docker-compose.test.yml, already migrated by the api container
+const DB_URL = "host=localhost port=5433 user=postgres dbname=postgres password=dummypass sslmode=disable"
+
+// TestGormStoreLookups - username and email lookups against postgres, through the same checks as the
+// in-memory store. The users are prefixed so they don't clash with anything the api tests created
+func TestGormStoreLookups(t *testing.T) {
+	db, err := gorm.Open("postgres", DB_URL)
+	require.NoError(t, err)
+	defer db.Close()
+
+	testStoreLookups(t, user.NewGormStore(db), fmt.Sprintf("store%d", time.Now().UnixNano()))
+}
+
+// TestGormStoreVersions - optimistic concurrency against postgres
+func TestGormStoreVersions(t *testing.T) {
+	db, err := gorm.Open("postgres", DB_URL)
+	require.NoError(t, err)
+	defer db.Close()
+
+	testStoreVersions(t, user.NewGormStore(db), fmt.Sprintf("store%d", time.Now().UnixNano()))
+}
+
+// TestGormStoreSoftDelete - restoring and purging deleted users against postgres, and the partial unique indexes
+func TestGormStoreSoftDelete(t *testing.T) {
+	db, err := gorm.Open("postgres", DB_URL)
+	require.NoError(t, err)
+	defer db.Close()
+
+	testStoreSoftDelete(t, user.NewGormStore(db), fmt.Sprintf("store%d", time.Now().UnixNano()))
+}
+
+// TestGormStoreAudit - transactions and the audit log against postgres
+func TestGormStoreAudit(t *testing.T) {
+	db, err := gorm.Open("postgres", DB_URL)
+	require.NoError(t, err)
+	defer db.Close()
+
+	testStoreAudit(t, user.NewGormStore(db), fmt.Sprintf("store%d", time.Now().UnixNano()))
+}
+
+// TestGormStoreRevisions - revisions against postgres
+func TestGormStoreRevisions(t *testing.T) {
+	db, err := gorm.Open("postgres", DB_URL)
+	require.NoError(t, err)
+	defer db.Close()
+
+	testStoreRevisions(t, user.NewGormStore(db), fmt.Sprintf("store%d", time.Now().UnixNano()))
+}
+
+// TestGormStoreTracing - queries made through a store with a request's context are traced as children of
+// the request, with their sql, and lookups that find nothing aren't errors
+func TestGormStoreTracing(t *testing.T) {
+	db, err := gorm.Open("postgres", DB_URL)
+	require.NoError(t, err)
+	defer db.Close()
+	tracing.RegisterCallbacks(db)
+	recorder := recordSpans(t)
+
+	ctx, request := otel.Tracer("test").Start(context.Background(), "request")
+	store := user.NewGormStore(db).WithContext(ctx)
+	prefix := fmt.Sprintf("store%d", time.Now().UnixNano())
+	created := user.User{
+		Username: prefix + "traced", Password: "password", FirstName: "Tracey", LastName: "Traced",
+		Email: prefix + "traced@example.com", Telephone: "5555555555",
+	}
+	require.NoError(t, store.Create(&created))
+	_, err = store.GetByID(created.ID)
+	require.NoError(t, err)
+	_, err = store.GetByUsername(prefix + "nobody")
+	require.ErrorIs(t, err, user.ErrNotFound)
+	request.End()
+
+	creates := spansNamed(recorder, "gorm.create")
+	require.NotEmpty(t, creates)
+	queries := spansNamed(recorder, "gorm.query")
+	require.Len(t, queries, 2)
+	for _, span := range append(creates, queries...) {
+		assert.Equal(t, request.SpanContext().SpanID(), span.Parent().SpanID())
+		assert.NotEqual(t, codes.Error, span.Status().Code)
+		statement, _ := spanAttribute(span, "db.statement")
+		assert.Contains(t, statement.AsString(), `"users"`)
+	}
+
+	// The same store without a context isn't traced
+	_, err = user.NewGormStore(db).GetByID(created.ID)
+	require.NoError(t, err)
+	assert.Len(t, spansNamed(recorder, "gorm.query"), 2)
+}
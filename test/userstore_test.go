@@ -0,0 +1,310 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStoreLookups - checks a user store's username and email lookups: exact, case-insensitive matches,
+// ErrNotFound for anything else, and uniqueness that ignores case. Run against every Store implementation.
+// prefix keeps the users unique, for stores that outlive the test
+func testStoreLookups(t *testing.T, store user.Store, prefix string) {
+	created := user.User{
+		Username: prefix + "CaseyJones", Password: "password", FirstName: "Casey", LastName: "Jones",
+		Email: prefix + "Casey@Example.com", Telephone: "5555555555",
+	}
+	require.NoError(t, store.Create(&created))
+
+	for _, username := range []string{prefix + "CaseyJones", prefix + "caseyjones", prefix + "CASEYJONES"} {
+		found, err := store.GetByUsername(username)
+		require.NoError(t, err, username)
+		assert.Equal(t, created.ID, found.ID)
+		assert.Equal(t, prefix+"CaseyJones", found.Username, "the username should be kept as it was given")
+	}
+	for _, email := range []string{prefix + "Casey@Example.com", prefix + "casey@example.com", prefix + "CASEY@EXAMPLE.COM"} {
+		found, err := store.GetByEmail(email)
+		require.NoError(t, err, email)
+		assert.Equal(t, created.ID, found.ID)
+	}
+
+	// Lookups are exact - no prefixes, suffixes or wildcards
+	for _, username := range []string{prefix + "Casey", prefix + "CaseyJones2", prefix + "Casey%", ""} {
+		_, err := store.GetByUsername(username)
+		assert.ErrorIs(t, err, user.ErrNotFound, username)
+	}
+	_, err := store.GetByEmail(prefix + "casey@example")
+	assert.ErrorIs(t, err, user.ErrNotFound)
+
+	// Usernames and emails that only differ by case are taken
+	dupe := created
+	dupe.ID, dupe.Username, dupe.Email = 0, prefix+"CASEYJONES", prefix+"other@example.com"
+	assert.ErrorIs(t, store.Create(&dupe), user.ErrDuplicate)
+	dupe = created
+	dupe.ID, dupe.Username, dupe.Email = 0, prefix+"otherguy", prefix+"CASEY@example.com"
+	assert.ErrorIs(t, store.Create(&dupe), user.ErrDuplicate)
+
+	require.NoError(t, store.Delete(created.ID, user.AnyVersion))
+	_, err = store.GetByUsername(prefix + "caseyjones")
+	assert.ErrorIs(t, err, user.ErrNotFound)
+	_, err = store.GetByEmail(prefix + "casey@example.com")
+	assert.ErrorIs(t, err, user.ErrNotFound)
+}
+
+// testStoreVersions - checks a user store bumps versions on update, and refuses updates and deletes
+// made against an old version
+func testStoreVersions(t *testing.T, store user.Store, prefix string) {
+	created := user.User{
+		Username: prefix + "versioned", Password: "password", FirstName: "Version", LastName: "Guy",
+		Email: prefix + "versioned@example.com", Telephone: "5555555555",
+	}
+	require.NoError(t, store.Create(&created))
+	assert.Equal(t, uint(1), created.Version)
+
+	first, err := store.GetByID(created.ID)
+	require.NoError(t, err)
+	second := first
+
+	require.NoError(t, store.Update(&first, user.User{FirstName: "Updated"}))
+	assert.Equal(t, uint(2), first.Version)
+	assert.Equal(t, "Updated", first.FirstName)
+
+	// second was read before the update, so it can't be used to change the user anymore
+	assert.ErrorIs(t, store.Update(&second, user.User{LastName: "Stale"}), user.ErrVersionMismatch)
+	assert.ErrorIs(t, store.Delete(created.ID, 1), user.ErrVersionMismatch)
+
+	stored, err := store.GetByID(created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), stored.Version)
+	assert.Equal(t, "Guy", stored.LastName)
+
+	require.NoError(t, store.Delete(created.ID, 2))
+	assert.ErrorIs(t, store.Update(&stored, user.User{LastName: "Gone"}), user.ErrNotFound)
+	assert.ErrorIs(t, store.Delete(created.ID, user.AnyVersion), user.ErrNotFound)
+}
+
+// testStoreSoftDelete - checks a user store only keeps usernames and emails unique among live users,
+// and can restore and purge deleted users
+func testStoreSoftDelete(t *testing.T, store user.Store, prefix string) {
+	first := user.User{
+		Username: prefix + "deleteme", Password: "password", FirstName: "Delete", LastName: "Me",
+		Email: prefix + "deleteme@example.com", Telephone: "5555555555",
+	}
+	require.NoError(t, store.Create(&first))
+	require.NoError(t, store.Delete(first.ID, user.AnyVersion))
+
+	deleted, err := store.GetDeletedByID(first.ID)
+	require.NoError(t, err)
+	assert.NotNil(t, deleted.DeletedAt)
+
+	// The deleted users username and email are free to be used again, so now it can't be restored
+	second := first
+	second.ID, second.Username = 0, prefix+"DeleteMe"
+	require.NoError(t, store.Create(&second))
+	assert.ErrorIs(t, store.Restore(first.ID), user.ErrDuplicate)
+	_, err = store.GetDeletedByID(second.ID)
+	assert.ErrorIs(t, err, user.ErrNotFound, "live users aren't deleted")
+	assert.ErrorIs(t, store.Restore(second.ID), user.ErrNotFound)
+	assert.ErrorIs(t, store.Purge(second.ID), user.ErrNotFound)
+
+	require.NoError(t, store.Delete(second.ID, user.AnyVersion))
+	require.NoError(t, store.Restore(first.ID))
+	restored, err := store.GetByID(first.ID)
+	require.NoError(t, err)
+	assert.Nil(t, restored.DeletedAt)
+	assert.Equal(t, uint(3), restored.Version, "deleting and restoring both bump the version")
+
+	require.NoError(t, store.Purge(second.ID))
+	_, err = store.GetDeletedByID(second.ID)
+	assert.ErrorIs(t, err, user.ErrNotFound)
+
+	// Only users deleted before the cutoff are purged
+	require.NoError(t, store.Delete(first.ID, user.AnyVersion))
+	purged, err := store.PurgeDeletedBefore(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, purged)
+	_, err = store.GetDeletedByID(first.ID)
+	require.NoError(t, err)
+
+	// A user that has been restored since it was deleted is never purged, however long ago the delete was
+	third := user.User{
+		Username: prefix + "restoreme", Password: "password", FirstName: "Restore", LastName: "Me",
+		Email: prefix + "restoreme@example.com", Telephone: "5555555555",
+	}
+	require.NoError(t, store.Create(&third))
+	require.NoError(t, store.Delete(third.ID, user.AnyVersion))
+	require.NoError(t, store.Restore(third.ID))
+	purged, err = store.PurgeDeletedBefore(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	purgedIDs := map[uint]bool{}
+	for _, u := range purged {
+		purgedIDs[u.ID] = true
+	}
+	assert.True(t, purgedIDs[first.ID])
+	assert.False(t, purgedIDs[third.ID])
+	_, err = store.GetDeletedByID(first.ID)
+	assert.ErrorIs(t, err, user.ErrNotFound)
+	_, err = store.GetByID(third.ID)
+	assert.NoError(t, err)
+}
+
+// testStoreAudit - checks a user store only keeps changes (and their audit entries) made in a
+// Transaction if it succeeds, and pages through a users audit log oldest first
+func testStoreAudit(t *testing.T, store user.Store, prefix string) {
+	failed := errors.New("something went wrong")
+	err := store.Transaction(func(tx user.Store) error {
+		rolledBack := user.User{
+			Username: prefix + "rolledback", Password: "password", FirstName: "Rolled", LastName: "Back",
+			Email: prefix + "rolledback@example.com", Telephone: "5555555555",
+		}
+		require.NoError(t, tx.Create(&rolledBack))
+		require.NoError(t, tx.AddAudit(&user.AuditEntry{Action: user.AuditCreate, TargetID: rolledBack.ID}))
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+	_, err = store.GetByUsername(prefix + "rolledback")
+	assert.ErrorIs(t, err, user.ErrNotFound, "a failed transaction shouldn't keep anything")
+
+	var created user.User
+	err = store.Transaction(func(tx user.Store) error {
+		created = user.User{
+			Username: prefix + "audited", Password: "password", FirstName: "Audited", LastName: "Guy",
+			Email: prefix + "audited@example.com", Telephone: "5555555555",
+		}
+		if err := tx.Create(&created); err != nil {
+			return err
+		}
+		for i := 0; i < 3; i++ {
+			entry := user.AuditEntry{
+				Action: user.AuditUpdate, TargetID: created.ID, RequestID: fmt.Sprintf("request-%d", i),
+				Changes: user.FieldChanges{{Field: "FirstName", Before: "Audited", After: "Changed"}},
+			}
+			if err := tx.AddAudit(&entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	_, err = store.GetByID(created.ID)
+	require.NoError(t, err)
+
+	opts := user.HistoryOptions{Limit: 2}
+	require.NoError(t, opts.Validate())
+	page, err := store.ListAudit(created.ID, opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), page.Total)
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, "request-0", page.Entries[0].RequestID)
+	assert.Equal(t, user.FieldChanges{{Field: "FirstName", Before: "Audited", After: "Changed"}}, page.Entries[0].Changes)
+	assert.Nil(t, page.Entries[0].ActorID)
+	require.NotEmpty(t, page.NextCursor)
+
+	opts = user.HistoryOptions{Limit: 2, Cursor: page.NextCursor}
+	require.NoError(t, opts.Validate())
+	page, err = store.ListAudit(created.ID, opts)
+	require.NoError(t, err)
+	require.Len(t, page.Entries, 1)
+	assert.Equal(t, "request-2", page.Entries[0].RequestID)
+	assert.Empty(t, page.NextCursor)
+}
+
+// testStoreRevisions - checks a user store keeps revisions, finds them by number or time, pages through them
+// oldest first and removes them when their user is purged
+func testStoreRevisions(t *testing.T, store user.Store, prefix string) {
+	created := user.User{
+		Username: prefix + "revised", Password: "password", FirstName: "Revised", LastName: "Guy",
+		Email: prefix + "revised@example.com", Telephone: "5555555555",
+	}
+	require.NoError(t, store.Create(&created))
+
+	var times []time.Time
+	for number := uint(1); number <= 3; number++ {
+		revision := user.Revision{UserID: created.ID, Number: number, Snapshot: user.Snapshot(created.ToResponse())}
+		revision.Snapshot.Version = number
+		require.NoError(t, store.AddRevision(&revision))
+		times = append(times, revision.CreatedAt)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	revision, err := store.GetRevision(created.ID, 2)
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), revision.Snapshot.Version)
+	assert.Equal(t, prefix+"revised", revision.User().Username)
+	_, err = store.GetRevision(created.ID, 4)
+	assert.ErrorIs(t, err, user.ErrNotFound)
+
+	revision, err = store.GetRevisionAt(created.ID, times[1].Add(5*time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), revision.Number)
+	revision, err = store.GetRevisionAt(created.ID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, uint(3), revision.Number)
+	_, err = store.GetRevisionAt(created.ID, times[0].Add(-time.Second))
+	assert.ErrorIs(t, err, user.ErrNotFound)
+
+	opts := user.HistoryOptions{Limit: 2}
+	require.NoError(t, opts.Validate())
+	page, err := store.ListRevisions(created.ID, opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), page.Total)
+	require.Len(t, page.Revisions, 2)
+	assert.Equal(t, uint(1), page.Revisions[0].Number)
+	opts = user.HistoryOptions{Limit: 2, Cursor: page.NextCursor}
+	require.NoError(t, opts.Validate())
+	page, err = store.ListRevisions(created.ID, opts)
+	require.NoError(t, err)
+	require.Len(t, page.Revisions, 1)
+	assert.Equal(t, uint(3), page.Revisions[0].Number)
+
+	require.NoError(t, store.Delete(created.ID, user.AnyVersion))
+	require.NoError(t, store.Purge(created.ID))
+	page, err = store.ListRevisions(created.ID, user.HistoryOptions{Limit: 10})
+	require.NoError(t, err)
+	assert.Empty(t, page.Revisions)
+}
+
+// TestMemoryStoreLookups - username and email lookups against the in-memory store
+func TestMemoryStoreLookups(t *testing.T) {
+	testStoreLookups(t, user.NewMemoryStore(), "")
+}
+
+// TestMemoryStoreVersions - optimistic concurrency against the in-memory store
+func TestMemoryStoreVersions(t *testing.T) {
+	testStoreVersions(t, user.NewMemoryStore(), "")
+}
+
+// TestMemoryStoreSoftDelete - restoring and purging deleted users in the in-memory store
+func TestMemoryStoreSoftDelete(t *testing.T) {
+	testStoreSoftDelete(t, user.NewMemoryStore(), "")
+}
+
+// TestMemoryStoreAudit - transactions and the audit log in the in-memory store
+func TestMemoryStoreAudit(t *testing.T) {
+	testStoreAudit(t, user.NewMemoryStore(), "")
+}
+
+// TestMemoryStoreRevisions - revisions in the in-memory store
+func TestMemoryStoreRevisions(t *testing.T) {
+	testStoreRevisions(t, user.NewMemoryStore(), "")
+}
+
+// TestInProcessLoginIgnoresCase - users can log in and be looked up with their username in any case
+func TestInProcessLoginIgnoresCase(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	token := api.login("TestyGuy", "testyguypassword")
+
+	rec := api.do("GET", "/api/user?username=TESTYGUY", token, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	rec = api.do("GET", "/api/user?email=TestyGuy@Example.com", token, nil)
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+
+	assert.Equal(t, 404, api.do("GET", "/api/user?username=testy", token, nil).Code)
+	assert.Equal(t, 401, api.do("POST", "/api/auth/token", "", `{"Username": "TestyGuy", "Password": "TESTYGUYPASSWORD"}`).Code)
+}
@@ -0,0 +1,306 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aebranton/rest-api/internal/user"
+	"github.com/aebranton/rest-api/internal/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver - a subscriber running on a local test server, that records every delivery
+// and answers with whatever status it is told to
+type webhookReceiver struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []receivedWebhook
+}
+
+// receivedWebhook - a single delivery the receiver got
+type receivedWebhook struct {
+	Header http.Header
+	Body   []byte
+}
+
+// newWebhookReceiver - starts a receiver that answers 200 until told otherwise
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+	rcv := &webhookReceiver{status: http.StatusOK}
+	rcv.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.requests = append(rcv.requests, receivedWebhook{Header: r.Header.Clone(), Body: body})
+		w.WriteHeader(rcv.status)
+	}))
+	t.Cleanup(rcv.server.Close)
+	return rcv
+}
+
+// answerWith - sets the status the receiver answers with from now on
+func (rcv *webhookReceiver) answerWith(status int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.status = status
+}
+
+// received - every delivery the receiver has got so far
+func (rcv *webhookReceiver) received() []receivedWebhook {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]receivedWebhook{}, rcv.requests...)
+}
+
+// deliver - relays the outbox to the webhook service and tails it to the event stream, then sends every
+// webhook delivery that is due, and returns how many were sent
+func (a *testAPI) deliver() int {
+	a.t.Helper()
+	_, err := a.relay.RelayPending(context.Background())
+	require.NoError(a.t, err)
+	_, err = a.tail.Poll(context.Background())
+	require.NoError(a.t, err)
+	sent, err := a.webhooks.DeliverDue(context.Background())
+	require.NoError(a.t, err)
+	return sent
+}
+
+// TestInProcessWebhooks - user events are delivered signed, retried until they're dead-lettered,
+// and can be redelivered once the subscriber is fixed
+func TestInProcessWebhooks(t *testing.T) {
+	api := newTestAPI(t)
+	api.webhooks.BaseBackoff = 0
+	api.webhooks.MaxAttempts = 3
+	rcv := newWebhookReceiver(t)
+	admin := api.login("admin", "adminpassword")
+	const secret = "a-very-secret-secret"
+
+	// Nothing is subscribed yet, so the admin logging in isn't delivered anywhere
+	assert.Equal(t, 0, api.deliver())
+
+	rec := api.do("POST", "/api/webhooks", admin, map[string]interface{}{
+		"URL":    rcv.server.URL,
+		"Secret": secret,
+		"Events": []string{"user.created", "user.deleted", "user.authenticated"},
+	})
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	var created struct {
+		ID     uint
+		Secret string
+		Events []user.EventType
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.Equal(t, secret, created.Secret)
+	assert.Len(t, created.Events, 3)
+
+	// The secret is only shown when the webhook is created
+	rec = api.do("GET", "/api/webhooks", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	assert.NotContains(t, rec.Body.String(), secret)
+
+	// Signing up is delivered as a signed user.created event, without the password
+	api.createUser("hooky")
+	assert.Equal(t, 1, api.deliver())
+	got := rcv.received()
+	require.Len(t, got, 1)
+	header := got[0].Header
+	assert.Equal(t, "user.created", header.Get(webhook.HeaderEvent))
+	assert.True(t, webhook.Verify(secret, header.Get(webhook.HeaderTimestamp), header.Get(webhook.HeaderSignature), got[0].Body))
+	assert.False(t, webhook.Verify("some-other-secret", header.Get(webhook.HeaderTimestamp), header.Get(webhook.HeaderSignature), got[0].Body))
+	assertNoHash(t, string(got[0].Body))
+
+	var event user.Event
+	require.NoError(t, json.Unmarshal(got[0].Body, &event))
+	assert.Equal(t, header.Get(webhook.HeaderID), event.ID)
+	assert.Equal(t, user.EventUserCreated, event.Type)
+	assert.Equal(t, uint(2), event.UserID)
+	assert.Equal(t, "hooky", event.User.Username)
+
+	// Logging in is a user.authenticated event, and updates aren't subscribed to
+	token := api.login("hooky", "hookypassword")
+	rec = api.do("PUT", "/api/user/2", token, `{"Telephone": "6666666666"}`)
+	require.Equal(t, 200, rec.Code)
+	assert.Equal(t, 1, api.deliver())
+	got = rcv.received()
+	require.Len(t, got, 2)
+	assert.Equal(t, "user.authenticated", got[1].Header.Get(webhook.HeaderEvent))
+
+	// A subscriber that keeps failing gets every attempt, and then the delivery is dead-lettered
+	rcv.answerWith(http.StatusInternalServerError)
+	rec = api.do("DELETE", "/api/user/2", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 1, api.deliver())
+	}
+	assert.Equal(t, 0, api.deliver())
+	got = rcv.received()
+	require.Len(t, got, 5)
+	assert.Equal(t, got[2].Header.Get(webhook.HeaderID), got[4].Header.Get(webhook.HeaderID), "retries send the same event")
+
+	rec = api.do("GET", "/api/webhooks/dead-letters", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	var dead []webhook.DeliveryResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &dead))
+	require.Len(t, dead, 1)
+	assert.Equal(t, user.EventUserDeleted, dead[0].EventType)
+	assert.Equal(t, webhook.StatusDead, dead[0].Status)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, 500, dead[0].LastStatus)
+
+	// Once the subscriber is fixed the dead letter can be sent again
+	rcv.answerWith(http.StatusNoContent)
+	rec = api.do("POST", fmt.Sprintf("/api/webhooks/deliveries/%d/redeliver", dead[0].ID), admin, nil)
+	require.Equal(t, 202, rec.Code, rec.Body.String())
+	assert.Equal(t, 1, api.deliver())
+	require.Len(t, rcv.received(), 6)
+
+	rec = api.do("GET", "/api/webhooks/dead-letters", admin, nil)
+	require.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, "[]", rec.Body.String())
+
+	rec = api.do("POST", "/api/webhooks/deliveries/99/redeliver", admin, nil)
+	assert.Equal(t, 404, rec.Code)
+
+	// Unsubscribed webhooks don't get any more events
+	rec = api.do("DELETE", fmt.Sprintf("/api/webhooks/%d", created.ID), admin, nil)
+	require.Equal(t, 200, rec.Code)
+	api.createUser("unhooked")
+	assert.Equal(t, 0, api.deliver())
+	rec = api.do("DELETE", fmt.Sprintf("/api/webhooks/%d", created.ID), admin, nil)
+	assert.Equal(t, 404, rec.Code)
+}
+
+// TestInProcessWebhookPolicy - only admins can manage webhooks, and subscriptions are validated
+func TestInProcessWebhookPolicy(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser("testyguy")
+	token := api.login("testyguy", "testyguypassword")
+	admin := api.login("admin", "adminpassword")
+
+	rec := api.do("GET", "/api/webhooks", token, nil)
+	assert.Equal(t, 403, rec.Code)
+	rec = api.do("POST", "/api/webhooks", token, map[string]string{"URL": "http://example.com/hook"})
+	assert.Equal(t, 403, rec.Code)
+	rec = api.do("GET", "/api/webhooks", "", nil)
+	assert.Equal(t, 401, rec.Code)
+
+	rec = api.do("POST", "/api/webhooks", admin, map[string]interface{}{
+		"URL":    "ftp://example.com/hook",
+		"Secret": "short",
+		"Events": []string{"user.exploded"},
+	})
+	require.Equal(t, 422, rec.Code, rec.Body.String())
+	var problem struct {
+		Errors user.ValidationErrors `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	fields := []string{}
+	for _, e := range problem.Errors {
+		fields = append(fields, e.Field)
+	}
+	assert.ElementsMatch(t, []string{"URL", "Secret", "Events"}, fields)
+
+	// Leaving out the secret and events generates a secret and subscribes to everything
+	rec = api.do("POST", "/api/webhooks", admin, map[string]string{"URL": "https://example.com/hook"})
+	require.Equal(t, 200, rec.Code, rec.Body.String())
+	var created struct {
+		Secret string
+		Events []user.EventType
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.GreaterOrEqual(t, len(created.Secret), webhook.MinSecretLength)
+	assert.Equal(t, user.EventTypes, created.Events)
+}
+
+// TestWebhookBackoff - a failed delivery isn't tried again until its backoff has passed
+func TestWebhookBackoff(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	rcv.answerWith(http.StatusServiceUnavailable)
+	svc := webhook.NewService(webhook.NewMemoryStore())
+	_, err := svc.Subscribe(webhook.SubscriptionRequest{URL: rcv.server.URL})
+	require.NoError(t, err)
+
+	u := user.User{Username: "backoff"}
+	u.ID = 7
+	require.NoError(t, svc.Publish(context.Background(), user.NewEvent(user.EventUserUpdated, u)))
+
+	start := time.Now()
+	sent, err := svc.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	// Nothing is due again until the base backoff has passed
+	sent, err = svc.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+
+	d, err := svc.Store.GetDelivery(1)
+	require.NoError(t, err)
+	assert.Equal(t, webhook.StatusPending, d.Status())
+	assert.Equal(t, 1, d.Attempts)
+	assert.Equal(t, 503, d.LastStatus)
+	require.NotNil(t, d.NextAttemptAt)
+	assert.WithinDuration(t, start.Add(webhook.DefaultBaseBackoff), *d.NextAttemptAt, 2*time.Second)
+}
+
+// TestWebhookLeaseOutlasted - a sender that takes longer than its lease doesn't overwrite the attempt of whoever
+// claimed the delivery after it
+func TestWebhookLeaseOutlasted(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+		if call == 1 {
+			close(arrived)
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	slow := webhook.NewService(webhook.NewMemoryStore())
+	slow.Lease = 20 * time.Millisecond
+	_, err := slow.Subscribe(webhook.SubscriptionRequest{URL: server.URL})
+	require.NoError(t, err)
+	u := user.User{Username: "leased"}
+	u.ID = 7
+	require.NoError(t, slow.Publish(context.Background(), user.NewEvent(user.EventUserUpdated, u)))
+
+	done := make(chan error)
+	go func() {
+		_, err := slow.DeliverDue(context.Background())
+		done <- err
+	}()
+	<-arrived
+	time.Sleep(2 * slow.Lease)
+
+	// The lease has run out, so another instance claims the delivery and gets it through
+	other := webhook.NewService(slow.Store)
+	sent, err := other.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	close(release)
+	require.NoError(t, <-done)
+	d, err := slow.Store.GetDelivery(1)
+	require.NoError(t, err)
+	assert.Equal(t, webhook.StatusDelivered, d.Status())
+	assert.Equal(t, 1, d.Attempts)
+	assert.Equal(t, 200, d.LastStatus)
+}